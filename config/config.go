@@ -16,33 +16,93 @@ package config
 
 import (
 	"io/ioutil"
+	"net"
+	"os"
+	"strings"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 
+	"rcproxy/core/codec"
 	"rcproxy/core/pkg/logging"
 )
 
 type Config struct {
-	Port         int         `yaml:"port"`
-	WebPort      int         `yaml:"web_port"`
-	LogPath      string      `yaml:"log_path"`
-	LogLevel     string      `yaml:"log_level"`
-	LogExpireDay int         `yaml:"log_expire_day"`
-	Redis        redisConfig `yaml:"redis"`
+	Port            int         `yaml:"port"`
+	WebPort         int         `yaml:"web_port"`
+	LogPath         string      `yaml:"log_path"`
+	LogLevel        string      `yaml:"log_level"`
+	LogExpireDay    int         `yaml:"log_expire_day"`
+	AuditConns      bool        `yaml:"audit_conns"`
+	DebugEndpoints  bool        `yaml:"debug_endpoints"`
+	ShutdownTimeout int         `yaml:"shutdown_timeout"`
+	ServerName      string      `yaml:"server_name"`
+	Redis           redisConfig `yaml:"redis"`
 }
 
 type redisConfig struct {
-	Servers            string `yaml:"servers"`
-	Password           string `yaml:"password"`
-	DisableSlave       bool   `yaml:"disable_slave"`
-	Preconnect         bool   `yaml:"preconnect"`
-	MsgMaxLengthLimit  int    `yaml:"msg_max_length_limit"`
-	ConnTimeout        int    `yaml:"conn_timeout"`
-	Timeout            int    `yaml:"timeout"`
-	ServerRetryTimeout int    `yaml:"server_retry_timeout"`
-	ServerConnections  int    `yaml:"server_connections"`
-	SlowlogSlowerThan  int64  `yaml:"slowlog_slower_than"`
+	Servers              string `yaml:"servers"`
+	Password             string `yaml:"password"`
+	PasswordFile         string `yaml:"password_file"`
+	PasswordEnv          string `yaml:"password_env"`
+	DisableSlave         bool   `yaml:"disable_slave"`
+	ReadOnlyProxy        bool   `yaml:"read_only_proxy"`
+	PassthroughRedirects bool   `yaml:"passthrough_redirects"`
+	Preconnect           bool   `yaml:"preconnect"`
+	PreconnectQuorum     int    `yaml:"preconnect_quorum"`
+	PreconnectRetries    int    `yaml:"preconnect_retries"`
+	PreconnectBackoff    int    `yaml:"preconnect_backoff"`
+	MsgMaxLengthLimit    int    `yaml:"msg_max_length_limit"`
+	MaxKeysPerCommand    int    `yaml:"max_keys_per_command"`
+	MaxValueSize         int    `yaml:"max_value_size"`
+	MaxReplyElements     int    `yaml:"max_reply_elements"`
+	ConnTimeout          int    `yaml:"conn_timeout"`
+	Timeout              int    `yaml:"timeout"`
+	ServerRetryTimeout   int    `yaml:"server_retry_timeout"`
+	MonitorInterval      int    `yaml:"monitor_interval"`
+	MaxTopologyProbes    int    `yaml:"max_topology_probe_conns"`
+	SlowStartWindow      int    `yaml:"slow_start_window"`
+	SlavePolicy          string `yaml:"slave_policy"`
+	CrossSlotBehavior    string `yaml:"crossslot_behavior"`
+	CommandCase          string `yaml:"command_case"`
+	CommandMetrics       string `yaml:"command_metrics"`
+	DebugSubcommands     string `yaml:"debug_subcommands"`
+	AckOnSend            string `yaml:"ack_on_send"`
+	ReadYourWrites       int    `yaml:"read_your_writes"`
+	MovedCacheWindow     int    `yaml:"moved_cache_window"`
+	ServerConnections    int    `yaml:"server_connections"`
+	ServerConnsMax       int    `yaml:"server_connections_max"`
+	ScaleUpInflight      int    `yaml:"scale_up_inflight"`
+	ServerDrainGrace     int    `yaml:"server_drain_grace"`
+	ServerMaxPending     int    `yaml:"server_max_pending"`
+	ClientReadBuffer     int    `yaml:"client_read_buffer"`
+	ServerReadBuffer     int    `yaml:"server_read_buffer"`
+	SlowClientOutbound   int    `yaml:"slow_client_outbound"`
+	SlowClientSeconds    int    `yaml:"slow_client_seconds"`
+	SlowClientClose      bool   `yaml:"slow_client_disconnect"`
+	HandshakeTimeout     int    `yaml:"client_handshake_timeout"`
+	TLSCert              string `yaml:"tls_cert"`
+	TLSKey               string `yaml:"tls_key"`
+	RedisTLS             bool   `yaml:"redis_tls"`
+	RedisTLSCA           string `yaml:"redis_tls_ca"`
+	RedisTLSInsecure     bool   `yaml:"redis_tls_insecure_skip_verify"`
+	MaxTotalBuffer       int    `yaml:"max_total_buffer_bytes"`
+	MaxConnsPerIP        int    `yaml:"max_client_conns_per_ip"`
+	CompressThreshold    int    `yaml:"client_compress_threshold"`
+	SlotCoverageHook     string `yaml:"slot_coverage_hook"`
+	SlotCoverageGrace    int    `yaml:"slot_coverage_grace"`
+	SlowlogSlowerThan    int64  `yaml:"slowlog_slower_than"`
+	LogRedactKeys        string `yaml:"log_redact_keys"`
+
+	// thresholds of slow query per command family overriding slowlog_slower_than, e.g. sortedsets: 20000
+	SlowlogFamilies map[string]int64 `yaml:"slowlog_slower_than_family"`
+
+	// weights of the slaves picked for reads by addr, the slaves not listed weigh 1, e.g. 10.0.1.12:6379: 4
+	ReadWeights map[string]int `yaml:"read_weights"`
+
+	// tags of the slaves by addr, the reads of the clients which sent PROXY TAG go to the slave of their tag,
+	// e.g. 10.0.1.12:6379: canary
+	NodeTags map[string]string `yaml:"node_tags"`
 }
 
 func LoadConfig(fileName string) (*Config, error) {
@@ -57,15 +117,207 @@ func LoadConfig(fileName string) (*Config, error) {
 	if err = cfg.validate(); err != nil {
 		return nil, errors.Wrapf(err, "config validate failed")
 	}
+	if err = cfg.Redis.resolvePassword(); err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve redis password")
+	}
 	return &cfg, nil
 }
 
+// resolvePassword reads the password from password_file or password_env into Password,
+// so that the secret can be mounted or injected rather than written in the config file
+func (r *redisConfig) resolvePassword() error {
+	switch {
+	case len(r.PasswordFile) > 0:
+		file, err := ioutil.ReadFile(r.PasswordFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read password_file")
+		}
+		// mounted secrets usually end with a line break
+		r.Password = strings.TrimRight(string(file), "\r\n")
+	case len(r.PasswordEnv) > 0:
+		passwd, ok := os.LookupEnv(r.PasswordEnv)
+		if !ok {
+			return errors.Errorf("password_env %s is not set", r.PasswordEnv)
+		}
+		r.Password = passwd
+	}
+	return nil
+}
+
+const (
+	maxPort              = 65535
+	maxServerConnections = 64
+	maxReadBuffer        = 64 * 1024 * 1024
+)
+
 func (c *Config) validate() error {
-	if v, ok := logging.LevelMapperRev[c.LogLevel]; !ok {
-		return errors.Errorf("unknown log level %s", v)
+	if c.Port < 1 || c.Port > maxPort {
+		return errors.Errorf("port %d out of range [1, %d]", c.Port, maxPort)
+	}
+	// web_port 0 disables the web server
+	if c.WebPort < 0 || c.WebPort > maxPort {
+		return errors.Errorf("web_port %d out of range [0, %d]", c.WebPort, maxPort)
+	}
+	if c.WebPort == c.Port {
+		return errors.Errorf("web_port %d must differ from port", c.WebPort)
 	}
-	if len(c.Redis.Servers) < 1 {
+	if _, ok := logging.LevelMapperRev[c.LogLevel]; !ok {
+		return errors.Errorf("unknown log level %s", c.LogLevel)
+	}
+	if c.LogExpireDay < 0 {
+		return errors.Errorf("log_expire_day %d must not be negative", c.LogExpireDay)
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.Errorf("shutdown_timeout %d must not be negative", c.ShutdownTimeout)
+	}
+	// the name is written into the line based PROXY INFO reply
+	if strings.ContainsAny(c.ServerName, "\r\n") {
+		return errors.Errorf("server_name %q must not contain line breaks", c.ServerName)
+	}
+	return c.Redis.validate()
+}
+
+func (r *redisConfig) validate() error {
+	if len(r.Servers) < 1 {
 		return errors.Errorf("unknown redis addrs")
 	}
+	for _, addr := range strings.Split(r.Servers, ",") {
+		// an empty entry would only fail once the proxy dials the redis nodes
+		if addr = strings.TrimSpace(addr); len(addr) < 1 {
+			return errors.Errorf("empty redis addr in servers %q", r.Servers)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return errors.Wrapf(err, "invalid redis addr %q in servers", addr)
+		}
+	}
+	var sources int
+	for _, v := range []string{r.Password, r.PasswordFile, r.PasswordEnv} {
+		if len(v) > 0 {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.Errorf("only one of password, password_file and password_env can be specified")
+	}
+	if (len(r.TLSCert) > 0) != (len(r.TLSKey) > 0) {
+		return errors.Errorf("tls_cert and tls_key must be specified together")
+	}
+	if !r.RedisTLS && (len(r.RedisTLSCA) > 0 || r.RedisTLSInsecure) {
+		return errors.Errorf("redis_tls_ca and redis_tls_insecure_skip_verify require redis_tls")
+	}
+	switch r.SlavePolicy {
+	case "", "random", "slave_affinity":
+	default:
+		return errors.Errorf("unknown slave policy %s", r.SlavePolicy)
+	}
+	switch r.CrossSlotBehavior {
+	case "", "error", "serial":
+	default:
+		return errors.Errorf("unknown crossslot behavior %s", r.CrossSlotBehavior)
+	}
+	switch r.CommandCase {
+	case "", "lower", "upper":
+	default:
+		return errors.Errorf("unknown command case %s", r.CommandCase)
+	}
+	switch r.CommandMetrics {
+	case "", "family", "exact", "off":
+	default:
+		return errors.Errorf("unknown command metrics %s", r.CommandMetrics)
+	}
+
+	if r.ConnTimeout < 1 {
+		return errors.Errorf("conn_timeout %d must be positive", r.ConnTimeout)
+	}
+	if r.ServerConnections < 0 || r.ServerConnections > maxServerConnections {
+		return errors.Errorf("server_connections %d out of range [0, %d]", r.ServerConnections, maxServerConnections)
+	}
+	if r.ServerConnsMax < 0 || r.ServerConnsMax > maxServerConnections {
+		return errors.Errorf("server_connections_max %d out of range [0, %d]", r.ServerConnsMax, maxServerConnections)
+	}
+	if r.ClientReadBuffer < 0 || r.ClientReadBuffer > maxReadBuffer {
+		return errors.Errorf("client_read_buffer %d out of range [0, %d]", r.ClientReadBuffer, maxReadBuffer)
+	}
+	if r.ServerReadBuffer < 0 || r.ServerReadBuffer > maxReadBuffer {
+		return errors.Errorf("server_read_buffer %d out of range [0, %d]", r.ServerReadBuffer, maxReadBuffer)
+	}
+
+	for _, cmd := range strings.Split(r.AckOnSend, ",") {
+		cmd = strings.ToLower(strings.TrimSpace(cmd))
+		if len(cmd) > 0 && !codec.OkReplyCommands[codec.CommandStr2Type[cmd]] {
+			return errors.Errorf("command %s in ack_on_send is not a write command answered +OK", cmd)
+		}
+	}
+
+	for family, v := range r.SlowlogFamilies {
+		if !knownFamily(family) {
+			return errors.Errorf("unknown command family %s in slowlog_slower_than_family", family)
+		}
+		if v < 0 {
+			return errors.Errorf("slowlog_slower_than_family %s %d must not be negative", family, v)
+		}
+	}
+
+	for addr, tag := range r.NodeTags {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return errors.Wrapf(err, "invalid redis addr %q in node_tags", addr)
+		}
+		if len(strings.TrimSpace(tag)) < 1 || strings.EqualFold(tag, "none") {
+			return errors.Errorf("invalid tag %q of %s in node_tags", tag, addr)
+		}
+	}
+
+	for addr, w := range r.ReadWeights {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return errors.Wrapf(err, "invalid redis addr %q in read_weights", addr)
+		}
+		if w < 1 {
+			return errors.Errorf("read_weights %s %d must be positive", addr, w)
+		}
+	}
+
+	// 0 means the default or disabled, but a negative value is always a mistake
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"timeout", r.Timeout},
+		{"server_retry_timeout", r.ServerRetryTimeout},
+		{"monitor_interval", r.MonitorInterval},
+		{"slow_start_window", r.SlowStartWindow},
+		{"read_your_writes", r.ReadYourWrites},
+		{"moved_cache_window", r.MovedCacheWindow},
+		{"msg_max_length_limit", r.MsgMaxLengthLimit},
+		{"max_keys_per_command", r.MaxKeysPerCommand},
+		{"max_value_size", r.MaxValueSize},
+		{"max_reply_elements", r.MaxReplyElements},
+		{"preconnect_quorum", r.PreconnectQuorum},
+		{"preconnect_retries", r.PreconnectRetries},
+		{"preconnect_backoff", r.PreconnectBackoff},
+		{"max_topology_probe_conns", r.MaxTopologyProbes},
+		{"scale_up_inflight", r.ScaleUpInflight},
+		{"server_drain_grace", r.ServerDrainGrace},
+		{"server_max_pending", r.ServerMaxPending},
+		{"slow_client_outbound", r.SlowClientOutbound},
+		{"slow_client_seconds", r.SlowClientSeconds},
+		{"client_handshake_timeout", r.HandshakeTimeout},
+		{"max_total_buffer_bytes", r.MaxTotalBuffer},
+		{"max_client_conns_per_ip", r.MaxConnsPerIP},
+		{"client_compress_threshold", r.CompressThreshold},
+		{"slot_coverage_grace", r.SlotCoverageGrace},
+	} {
+		if v.value < 0 {
+			return errors.Errorf("%s %d must not be negative", v.name, v.value)
+		}
+	}
 	return nil
 }
+
+func knownFamily(family string) bool {
+	for _, v := range codec.Families {
+		if v == family {
+			return true
+		}
+	}
+	return false
+}
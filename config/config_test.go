@@ -0,0 +1,140 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig("../conf/rc.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, 9736, cfg.Port)
+}
+
+func validConfig() *Config {
+	return &Config{
+		Port:     9736,
+		WebPort:  9737,
+		LogLevel: "INFO",
+		Redis: redisConfig{
+			Servers:     "127.0.0.1:8300,127.0.0.2:8300",
+			ConnTimeout: 500,
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.Nil(t, validConfig().validate())
+
+	c := validConfig()
+	c.Redis.Servers = " 127.0.0.1:8300, 127.0.0.2:8300 "
+	assert.Nil(t, c.validate())
+
+	var cases = []struct {
+		modify func(c *Config)
+		expect string
+	}{
+		{func(c *Config) { c.Port = 0 }, "port 0 out of range [1, 65535]"},
+		{func(c *Config) { c.Port = 70000 }, "port 70000 out of range [1, 65535]"},
+		{func(c *Config) { c.WebPort = -1 }, "web_port -1 out of range [0, 65535]"},
+		{func(c *Config) { c.WebPort = c.Port }, "web_port 9736 must differ from port"},
+		{func(c *Config) { c.LogLevel = "TRACE" }, "unknown log level TRACE"},
+		{func(c *Config) { c.LogExpireDay = -1 }, "log_expire_day -1 must not be negative"},
+		{func(c *Config) { c.ShutdownTimeout = -1 }, "shutdown_timeout -1 must not be negative"},
+		{func(c *Config) { c.ServerName = "rcproxy\r\n" }, `server_name "rcproxy\r\n" must not contain line breaks`},
+		{func(c *Config) { c.Redis.Servers = "" }, "unknown redis addrs"},
+		{func(c *Config) { c.Redis.Password, c.Redis.PasswordEnv = "secret", "REDIS_PASSWORD" }, "only one of password, password_file and password_env can be specified"},
+		{func(c *Config) { c.Redis.PasswordFile, c.Redis.PasswordEnv = "/run/secrets/redis", "REDIS_PASSWORD" }, "only one of password, password_file and password_env can be specified"},
+		{func(c *Config) { c.Redis.Servers = "127.0.0.1:8300,127.0.0.2" }, `invalid redis addr "127.0.0.2" in servers`},
+		{func(c *Config) { c.Redis.Servers = "127.0.0.1:8300, ,127.0.0.2:8300" }, `empty redis addr in servers "127.0.0.1:8300, ,127.0.0.2:8300"`},
+		{func(c *Config) { c.Redis.Servers = "127.0.0.1:8300," }, `empty redis addr in servers "127.0.0.1:8300,"`},
+		{func(c *Config) { c.Redis.Servers = " " }, `empty redis addr in servers " "`},
+		{func(c *Config) { c.Redis.SlavePolicy = "nearest" }, "unknown slave policy nearest"},
+		{func(c *Config) { c.Redis.CrossSlotBehavior = "split" }, "unknown crossslot behavior split"},
+		{func(c *Config) { c.Redis.CommandCase = "keep" }, "unknown command case keep"},
+		{func(c *Config) { c.Redis.CommandMetrics = "all" }, "unknown command metrics all"},
+		{func(c *Config) { c.Redis.ConnTimeout = 0 }, "conn_timeout 0 must be positive"},
+		{func(c *Config) { c.Redis.ServerConnections = 10000 }, "server_connections 10000 out of range [0, 64]"},
+		{func(c *Config) { c.Redis.ServerConnsMax = 65 }, "server_connections_max 65 out of range [0, 64]"},
+		{func(c *Config) { c.Redis.ClientReadBuffer = -1 }, "client_read_buffer -1 out of range [0, 67108864]"},
+		{func(c *Config) { c.Redis.ServerReadBuffer = 1 << 30 }, "server_read_buffer 1073741824 out of range [0, 67108864]"},
+		{func(c *Config) { c.Redis.Timeout = -1 }, "timeout -1 must not be negative"},
+		{func(c *Config) { c.Redis.ServerRetryTimeout = -1 }, "server_retry_timeout -1 must not be negative"},
+		{func(c *Config) { c.Redis.MonitorInterval = -1 }, "monitor_interval -1 must not be negative"},
+		{func(c *Config) { c.Redis.SlowStartWindow = -1 }, "slow_start_window -1 must not be negative"},
+		{func(c *Config) { c.Redis.ReadYourWrites = -1 }, "read_your_writes -1 must not be negative"},
+		{func(c *Config) { c.Redis.MovedCacheWindow = -1 }, "moved_cache_window -1 must not be negative"},
+		{func(c *Config) { c.Redis.TLSCert = "rcproxy.crt" }, "tls_cert and tls_key must be specified together"},
+		{func(c *Config) { c.Redis.RedisTLSCA = "ca.crt" }, "redis_tls_ca and redis_tls_insecure_skip_verify require redis_tls"},
+		{func(c *Config) { c.Redis.MsgMaxLengthLimit = -1 }, "msg_max_length_limit -1 must not be negative"},
+		{func(c *Config) { c.Redis.MaxKeysPerCommand = -1 }, "max_keys_per_command -1 must not be negative"},
+		{func(c *Config) { c.Redis.MaxValueSize = -1 }, "max_value_size -1 must not be negative"},
+		{func(c *Config) { c.Redis.MaxReplyElements = -1 }, "max_reply_elements -1 must not be negative"},
+		{func(c *Config) { c.Redis.PreconnectQuorum = -1 }, "preconnect_quorum -1 must not be negative"},
+		{func(c *Config) { c.Redis.PreconnectRetries = -1 }, "preconnect_retries -1 must not be negative"},
+		{func(c *Config) { c.Redis.MaxTopologyProbes = -1 }, "max_topology_probe_conns -1 must not be negative"},
+		{func(c *Config) { c.Redis.AckOnSend = "set, incr" }, "command incr in ack_on_send is not a write command answered +OK"},
+		{func(c *Config) { c.Redis.SlowlogFamilies = map[string]int64{"geo": 50} }, "unknown command family geo in slowlog_slower_than_family"},
+		{func(c *Config) { c.Redis.SlowlogFamilies = map[string]int64{"sortedsets": -1} }, "slowlog_slower_than_family sortedsets -1 must not be negative"},
+		{func(c *Config) { c.Redis.ReadWeights = map[string]int{"127.0.0.1:7001": 0} }, "read_weights 127.0.0.1:7001 0 must be positive"},
+		{func(c *Config) { c.Redis.NodeTags = map[string]string{"127.0.0.1:7001": " "} }, `invalid tag " " of 127.0.0.1:7001 in node_tags`},
+		{func(c *Config) { c.Redis.ScaleUpInflight = -1 }, "scale_up_inflight -1 must not be negative"},
+		{func(c *Config) { c.Redis.ServerDrainGrace = -1 }, "server_drain_grace -1 must not be negative"},
+		{func(c *Config) { c.Redis.ServerMaxPending = -1 }, "server_max_pending -1 must not be negative"},
+		{func(c *Config) { c.Redis.SlowClientOutbound = -1 }, "slow_client_outbound -1 must not be negative"},
+		{func(c *Config) { c.Redis.SlowClientSeconds = -1 }, "slow_client_seconds -1 must not be negative"},
+		{func(c *Config) { c.Redis.HandshakeTimeout = -1 }, "client_handshake_timeout -1 must not be negative"},
+		{func(c *Config) { c.Redis.MaxTotalBuffer = -1 }, "max_total_buffer_bytes -1 must not be negative"},
+		{func(c *Config) { c.Redis.MaxConnsPerIP = -1 }, "max_client_conns_per_ip -1 must not be negative"},
+		{func(c *Config) { c.Redis.CompressThreshold = -1 }, "client_compress_threshold -1 must not be negative"},
+		{func(c *Config) { c.Redis.SlotCoverageGrace = -1 }, "slot_coverage_grace -1 must not be negative"},
+	}
+	for _, v := range cases {
+		c := validConfig()
+		v.modify(c)
+		err := c.validate()
+		if assert.NotNil(t, err, "expect: %s", v.expect) {
+			assert.Contains(t, err.Error(), v.expect)
+		}
+	}
+}
+
+func TestResolvePassword(t *testing.T) {
+	r := &redisConfig{Password: "inline"}
+	assert.Nil(t, r.resolvePassword())
+	assert.Equal(t, "inline", r.Password)
+
+	file := filepath.Join(t.TempDir(), "redis")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("from file\n"), 0600))
+	r = &redisConfig{PasswordFile: file}
+	assert.Nil(t, r.resolvePassword())
+	assert.Equal(t, "from file", r.Password)
+
+	r = &redisConfig{PasswordFile: filepath.Join(t.TempDir(), "missing")}
+	assert.Error(t, r.resolvePassword())
+
+	t.Setenv("RCPROXY_TEST_PASSWORD", "from env")
+	r = &redisConfig{PasswordEnv: "RCPROXY_TEST_PASSWORD"}
+	assert.Nil(t, r.resolvePassword())
+	assert.Equal(t, "from env", r.Password)
+
+	r = &redisConfig{PasswordEnv: "RCPROXY_TEST_PASSWORD_UNSET"}
+	assert.EqualError(t, r.resolvePassword(), "password_env RCPROXY_TEST_PASSWORD_UNSET is not set")
+}
@@ -19,7 +19,9 @@
 package core
 
 import (
+	"net"
 	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -29,10 +31,25 @@ import (
 	"rcproxy/core/pkg/logging"
 )
 
+// acceptFunc accepts a connection on the listener, replaced by the tests simulating the failures
+var acceptFunc = unix.Accept
+
 func (el *eventloop) accept(_ int, _ netpoll.IOEvent) error {
-	nfd, sa, err := unix.Accept(el.ln.fd)
+	nfd, sa, err := acceptFunc(el.ln.fd)
 	if err != nil {
-		if err == unix.EAGAIN {
+		switch err {
+		case unix.EAGAIN:
+			return nil
+		case unix.EMFILE, unix.ENFILE:
+			// out of fds is not fatal, the pending connection is accepted once an fd is released
+			if now := time.Now(); now.Sub(el.exhaustedLog) >= time.Second {
+				el.exhaustedLog = now
+				logging.Errorf("Accept() failed due to fd exhaustion: %v, %d connections open", err, len(el.connections))
+			}
+			GlobalStats.AcceptErrors.WithLabelValues(strings.ToLower(unix.ErrnoName(err.(unix.Errno)))).Inc()
+			if !el.closeIdlestClient() {
+				el.rejectPending()
+			}
 			return nil
 		}
 		logging.Errorf("Accept() failed due to error: %v", err)
@@ -48,10 +65,63 @@ func (el *eventloop) accept(_ int, _ netpoll.IOEvent) error {
 		logging.Error(err)
 	}
 
-	c := newTCPConn(nfd, el, el.ln.addr, remoteAddr, ConnClient, Initialized, false)
-	if err = el.poller.AddRead(c.pollAttachment); err != nil {
+	// the codec reads plaintext only, the TLS clients are opened once terminated
+	if el.engine.tlsConfig != nil {
+		go el.terminateTLS(nfd, remoteAddr, el.engine.tlsConfig)
+		return nil
+	}
+	return el.openClient(nfd, remoteAddr)
+}
+
+// openClient opens the client connection of fd on the event-loop
+func (el *eventloop) openClient(fd int, remoteAddr net.Addr) error {
+	c := newTCPConn(fd, el, el.ln.addr, remoteAddr, ConnClient, Initialized, false)
+	if err := el.poller.AddRead(c.pollAttachment); err != nil {
 		return err
 	}
 	el.connections[c.fd] = c
 	return el.open(c)
 }
+
+// closeIdlestClient closes the client connection idle for the longest time with no request in flight,
+// which releases an fd for the connection pending on the listener. Nothing is closed if every client is busy.
+func (el *eventloop) closeIdlestClient() bool {
+	var idlest *conn
+	for _, c := range el.connections {
+		if c.connType != ConnClient || !c.inMsgQueue.Empty() {
+			continue
+		}
+		if idlest == nil || c.lastActive.Before(idlest.lastActive) {
+			idlest = c
+		}
+	}
+	if idlest == nil {
+		return false
+	}
+	logging.Warnf("[%dc] client %s idle since %s closed to release an fd", idlest.fd, idlest.RemoteAddr(), idlest.lastActive.Format(time.RFC3339))
+	_ = el.closeConn(idlest, nil, ProxyEof)
+	return true
+}
+
+// rejectPending closes the connection pending on the listener with the fd held in reserve, the listener is
+// level-triggered and would fire again at once, spinning the loop while every client is busy
+func (el *eventloop) rejectPending() {
+	if el.spareFd < 0 {
+		return
+	}
+	_ = unix.Close(el.spareFd)
+	if nfd, _, err := acceptFunc(el.ln.fd); err == nil {
+		_ = unix.Close(nfd)
+	}
+	el.spareFd = reserveFd()
+}
+
+// reserveFd opens the fd held in reserve for rejectPending, -1 if none could be opened
+func reserveFd() int {
+	fd, err := unix.Open(os.DevNull, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		logging.Errorf("failed to reserve an fd for the fd exhaustion: %v", err)
+		return -1
+	}
+	return fd
+}
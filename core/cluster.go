@@ -17,11 +17,14 @@ package core
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cornelk/hashmap"
 	"github.com/pkg/errors"
@@ -54,12 +57,15 @@ func (s *redisWrapper) Dial(address, passwd string, options ...redis.DialOption)
 
 type ClusterNodes struct {
 	ServerMap   hashmap.HashMap
-	Replicasets []*replicaset
+	Replicasets []*Replicaset
 
 	redisWrapper    RedisWrapper
+	probeSem        chan struct{} // bounds the probe connections opened at once, unbounded if nil
 	redisAddrs      string
 	passwd          string
+	tlsConfig       *tls.Config // encrypts the probe connections, nil if TLS is not enabled
 	lastServerNames string
+	lastServerHash  uint64
 	serverChanged   bool
 }
 
@@ -94,9 +100,12 @@ type ClusterNode struct {
 	Slots []Slots
 }
 
-type replicaset struct {
+// Replicaset a master and the slaves replicating it
+type Replicaset struct {
 	Master *ClusterNode
 	Slaves []*ClusterNode
+	// Orphaned the master is filtered out of the topology, Master is a placeholder and only the slaves serve
+	Orphaned bool
 }
 
 type Slots struct {
@@ -104,31 +113,103 @@ type Slots struct {
 	End   int32
 }
 
-func (c *ClusterNodes) loopClusterNodes() {
+// topologyMu guards Replicasets and serverChanged, written by the cluster nodes loop and read by the event loop
+var topologyMu sync.Mutex
+
+// updateWaiters channels waiting for the next update of the topology, see RefreshClusterNodes
+var updateWaiters struct {
+	sync.Mutex
+	chans []chan int
+}
+
+// waitUpdate registers for the next update of the topology, the number of nodes is sent on the channel
+func waitUpdate() chan int {
+	ch := make(chan int, 1)
+	updateWaiters.Lock()
+	updateWaiters.chans = append(updateWaiters.chans, ch)
+	updateWaiters.Unlock()
+	return ch
+}
+
+// cancelWait unregisters the channel, if the update didn't come
+func cancelWait(ch chan int) {
+	updateWaiters.Lock()
+	defer updateWaiters.Unlock()
+	for i, v := range updateWaiters.chans {
+		if v == ch {
+			updateWaiters.chans = append(updateWaiters.chans[:i], updateWaiters.chans[i+1:]...)
+			return
+		}
+	}
+}
+
+func notifyUpdate(nodes int) {
+	updateWaiters.Lock()
+	defer updateWaiters.Unlock()
+	for _, ch := range updateWaiters.chans {
+		ch <- nodes
+	}
+	updateWaiters.chans = updateWaiters.chans[:0]
+}
+
+// superviseClusterNodes runs loopClusterNodes until stop is closed, restarting it if it exits or panics,
+// so that a bad cluster info doesn't leave the proxy routing on a stale topology. A nil stop runs it forever
+func (c *ClusterNodes) superviseClusterNodes(stop <-chan struct{}) {
+	for !c.runClusterNodes(stop) {
+		logging.Errorf("[cluster loop] exited unexpectedly, restarted")
+	}
+}
+
+// runClusterNodes runs loopClusterNodes, recovering a panic, and reports whether it exited since stop is closed
+func (c *ClusterNodes) runClusterNodes(stop <-chan struct{}) (stopped bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			logging.Errorf("[cluster loop] panic: %v", err)
+		}
+	}()
+	c.loopClusterNodes(stop)
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *ClusterNodes) loopClusterNodes(stop <-chan struct{}) {
 	for {
 		select {
+		case <-stop:
+			return
 		case msg := <-EngineGlobal.clusterChan:
+			// the reply of a node which is not answering cluster info, skipped until the next one
 			if len(msg) < 3 {
-				return
+				continue
 			}
 			if msg[0] == '+' && msg[1] == 'O' && msg[2] == 'K' {
-				return
+				continue
 			}
 			if msg[0] == '$' && msg[1] == '-' && msg[2] == '1' {
-				return
+				continue
 			}
 
-			length, err := parseLen(msg[1 : bytes.IndexByte(msg, '\n')-1])
+			// the length line and the trailing CRLF of the bulk string
+			i := bytes.IndexByte(msg, '\n')
+			if i < 2 || i+1 > len(msg)-3 {
+				logging.Errorf("[cluster loop] update cluster nodes: nodes info invalid: %q", msg)
+				continue
+			}
+			length, err := parseLen(msg[1 : i-1])
 			if err != nil {
 				logging.Errorf("[cluster loop] update cluster nodes: nodes info invalid: %s", err)
-				return
+				continue
 			}
 			if length > 163840 {
 				logging.Errorf("[cluster loop] update cluster nodes: nodes info too large > 163840")
-				return
+				continue
 			}
 
-			if err := c.updateClusterNodes(string(msg[bytes.IndexByte(msg, '\n')+1 : len(msg)-3])); err != nil {
+			if err := c.updateClusterNodes(string(msg[i+1 : len(msg)-3])); err != nil {
 				logging.Errorf("[cluster loop] update cluster nodes err: %s", err)
 			}
 		}
@@ -142,21 +223,32 @@ func (c *ClusterNodes) updateClusterNodes(msg string) error {
 		return errors.Wrapf(err, "redis do cluster nodes error")
 	}
 
+	topologyMu.Lock()
 	if c.isChanged(allNodes) {
 		c.setServer(allNodes)
 		c.setReplicaset(allNodes)
 		c.serverChanged = true
 	}
+	topologyMu.Unlock()
+	notifyUpdate(len(allNodes))
 
 	return nil
 }
 
+// isChanged compares the hash of the topology with the last one, the names of the servers are
+// joined for the log only when it differs
 func (c *ClusterNodes) isChanged(allNodes []*ClusterNode) (changed bool) {
 	changed = false
 	if len(allNodes) != c.ServerMap.Len() {
 		changed = true
 	}
 
+	hash := topologyHash(allNodes)
+	if hash == c.lastServerHash && !changed {
+		return false
+	}
+	c.lastServerHash = hash
+
 	var serverNames []string
 	for _, n := range allNodes {
 		if n.Role == Master {
@@ -177,6 +269,32 @@ func (c *ClusterNodes) isChanged(allNodes []*ClusterNode) (changed bool) {
 	return changed
 }
 
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// topologyHash sums the FNV-1a hashes of the addr, role and slots of each node,
+// so that it doesn't depend on the order of the nodes in CLUSTER NODES
+func topologyHash(allNodes []*ClusterNode) uint64 {
+	var sum uint64
+	for _, n := range allNodes {
+		h := uint64(fnvOffset64)
+		for i := 0; i < len(n.Addr); i++ {
+			h = (h ^ uint64(n.Addr[i])) * fnvPrime64
+		}
+		h = (h ^ uint64(n.Role)) * fnvPrime64
+		if n.Role == Master {
+			for _, s := range n.Slots {
+				h = (h ^ uint64(uint32(s.Start))) * fnvPrime64
+				h = (h ^ uint64(uint32(s.End))) * fnvPrime64
+			}
+		}
+		sum += h
+	}
+	return sum
+}
+
 func (c *ClusterNodes) setServer(allNodes []*ClusterNode) {
 	for kv := range c.ServerMap.Iter() {
 		c.ServerMap.Del(kv.Key)
@@ -189,33 +307,59 @@ func (c *ClusterNodes) setServer(allNodes []*ClusterNode) {
 }
 
 func (c *ClusterNodes) setReplicaset(allNodes []*ClusterNode) {
-	if c.Replicasets == nil {
-		c.Replicasets = make([]*replicaset, 0)
+	// masters of the last topology, a slave whose master is filtered out is retained under it
+	lastMasters := make(map[string]*ClusterNode, len(c.Replicasets))
+	for _, rs := range c.Replicasets {
+		lastMasters[rs.Master.Name] = rs.Master
 	}
-	c.Replicasets = c.Replicasets[:0]
 
+	var masters, orphans []*Replicaset
 	for _, n := range allNodes {
 		if n.Role == Master {
-			r := new(replicaset)
+			r := new(Replicaset)
 			r.Master = n
-			c.Replicasets = append(c.Replicasets, r)
+			masters = append(masters, r)
 		}
 	}
 	for _, n := range allNodes {
-		if n.Role == Slave {
-			for _, rs := range c.Replicasets {
-				if rs.Master.Name == n.MasterId {
-					rs.Slaves = append(rs.Slaves, n)
-					break
-				}
-			}
+		if n.Role != Slave {
+			continue
 		}
+		if rs := findReplicaset(masters, n.MasterId); rs != nil {
+			rs.Slaves = append(rs.Slaves, n)
+			continue
+		}
+		if rs := findReplicaset(orphans, n.MasterId); rs != nil {
+			rs.Slaves = append(rs.Slaves, n)
+			continue
+		}
+
+		master, ok := lastMasters[n.MasterId]
+		if !ok {
+			// the master is never seen, slots are unknown, keep the slave until the master reappears
+			master = &ClusterNode{Name: n.MasterId, Role: Master}
+		}
+		logging.Warnf("[cluster loop] master %s of slave %s is filtered, retain the slave under a placeholder", n.MasterId, n.Addr)
+		orphans = append(orphans, &Replicaset{Master: master, Slaves: []*ClusterNode{n}, Orphaned: true})
 	}
+
+	// orphans go first, so that a live master owning the same slots overrides them
+	c.Replicasets = append(orphans, masters...)
 	logging.Infof("[cluster loop] set replicaset done")
 	return
 }
 
+func findReplicaset(replicasets []*Replicaset, masterId string) *Replicaset {
+	for _, rs := range replicasets {
+		if rs.Master.Name == masterId {
+			return rs
+		}
+	}
+	return nil
+}
+
 func (c *ClusterNodes) parse(msgs string) (allNodes []*ClusterNode, err error) {
+	var candidates []*ClusterNode
 	lines := strings.Split(msgs, string('\n'))
 	for _, line := range lines {
 		xs := strings.Split(line, " ")
@@ -245,14 +389,32 @@ func (c *ClusterNodes) parse(msgs string) (allNodes []*ClusterNode, err error) {
 			logging.Warnf("[cluster loop] skip redis node because of error occurred, err: %s, line: %+v", err, xs)
 			continue
 		}
+		candidates = append(candidates, node)
+	}
 
-		_, ok := c.ServerMap.Get(node.Addr)
-		if !ok {
-			info, err := c.redisInfo(node.Addr)
-			if err != nil {
-				logging.Warnf("[cluster loop] skip redis node because of info command error occurred, err: %s, line: %+v", err, xs)
-				continue
-			}
+	// the new nodes are probed concurrently, within the bound of probeSem
+	infos := make([]*redis.Info, len(candidates))
+	errs := make([]error, len(candidates))
+	var wg sync.WaitGroup
+	for i, node := range candidates {
+		if _, ok := c.ServerMap.Get(node.Addr); ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			infos[i], errs[i] = c.redisInfo(addr)
+		}(i, node.Addr)
+	}
+	wg.Wait()
+
+	for i, node := range candidates {
+		if errs[i] != nil {
+			logging.Warnf("[cluster loop] skip redis node because of info command error occurred, err: %s, node: %+v", errs[i], node)
+			continue
+		}
+		// only the new nodes have been probed
+		if info := infos[i]; info != nil {
 			if node.Role == Slave && info.Loading {
 				logging.Warnf("[cluster loop] skip redis node because of slave loading, node: %+v, info: %+v", node, info)
 				continue
@@ -379,8 +541,18 @@ func (c *ClusterNode) parseSlot(slotsStr string) (int32, int32, error) {
 	return int32(start), int32(end), nil
 }
 
+// acquireProbe waits for a free probe connection slot, the returned func releases it
+func (c *ClusterNodes) acquireProbe() func() {
+	if c.probeSem == nil {
+		return func() {}
+	}
+	c.probeSem <- struct{}{}
+	return func() { <-c.probeSem }
+}
+
 func (c *ClusterNodes) redisInfo(addr string) (*redis.Info, error) {
-	conn, err := c.redisWrapper.Dial(addr, c.passwd)
+	defer c.acquireProbe()()
+	conn, err := c.redisWrapper.Dial(addr, c.passwd, redis.DialTLS(c.tlsConfig))
 	if err != nil {
 		return nil, err
 	}
@@ -388,6 +560,68 @@ func (c *ClusterNodes) redisInfo(addr string) (*redis.Info, error) {
 	return conn.Info()
 }
 
+// NodeKeys the number of keys of a master reported by DBSIZE, Err is set when the node failed to answer
+type NodeKeys struct {
+	Addr string
+	Keys int64
+	Err  string
+}
+
+// CountKeys issues DBSIZE to every master concurrently, off the event loop, ordered by addr
+func (c *ClusterNodes) CountKeys() []NodeKeys {
+	var masters []string
+	for kv := range c.ServerMap.Iter() {
+		if node := kv.Value.(*ClusterNode); node.Role == Master {
+			masters = append(masters, node.Addr)
+		}
+	}
+	sort.Strings(masters)
+
+	res := make([]NodeKeys, len(masters))
+	var wg sync.WaitGroup
+	for i, addr := range masters {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			res[i].Addr = addr
+			keys, err := c.dbsize(addr)
+			if err != nil {
+				logging.Warnf("failed to count keys of redis %s, err: %s", addr, err)
+				res[i].Err = err.Error()
+				return
+			}
+			res[i].Keys = keys
+		}(i, addr)
+	}
+	wg.Wait()
+	return res
+}
+
+func (c *ClusterNodes) dbsize(addr string) (int64, error) {
+	defer c.acquireProbe()()
+	conn, err := c.redisWrapper.Dial(
+		addr,
+		c.passwd,
+		redis.DialConnectTimeout(1*time.Second),
+		redis.DialReadTimeout(3*time.Second),
+		redis.DialWriteTimeout(3*time.Second),
+		redis.DialTLS(c.tlsConfig),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	res, err := conn.Do("DBSIZE")
+	if err != nil {
+		return 0, err
+	}
+	keys, ok := res.(int64)
+	if !ok {
+		return 0, errors.Errorf("unknown res %v", res)
+	}
+	return keys, nil
+}
+
 func GetClusterNodes() []*ClusterNode {
 	var nodes []*ClusterNode
 	for kv := range EngineGlobal.ClusterNodes.ServerMap.Iter() {
@@ -1,11 +1,19 @@
 package core
 
 import (
+	"fmt"
+	"io"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/sys/unix"
 
+	"rcproxy/core/pkg/constant"
+	gerrors "rcproxy/core/pkg/errors"
+	"rcproxy/core/pkg/logging"
 	"rcproxy/core/pkg/redis"
 )
 
@@ -86,3 +94,313 @@ func TestClusterNodesDown(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 3, len(allNodes))
 }
+
+func TestSetReplicasetOrphanedSlaves(t *testing.T) {
+	master := &ClusterNode{Name: "m1", Addr: "127.0.0.1:8300", Role: Master, Slots: []Slots{{0, 8191}}}
+	slave1 := &ClusterNode{Name: "s1", Addr: "127.0.0.1:8306", Role: Slave, MasterId: "m1"}
+	slave2 := &ClusterNode{Name: "s2", Addr: "127.0.0.1:8308", Role: Slave, MasterId: "m1"}
+	master2 := &ClusterNode{Name: "m2", Addr: "127.0.0.1:8302", Role: Master, Slots: []Slots{{8192, 16383}}}
+
+	c := ClusterNodes{}
+	c.setReplicaset([]*ClusterNode{master, slave1, slave2, master2})
+	assert.Equal(t, 2, len(c.Replicasets))
+	for _, rs := range c.Replicasets {
+		assert.False(t, rs.Orphaned)
+	}
+
+	// the master is filtered as fail, its healthy slaves are retained with the slots it owned
+	c.setReplicaset([]*ClusterNode{slave1, slave2, master2})
+	assert.Equal(t, 2, len(c.Replicasets))
+	orphaned := c.Replicasets[0]
+	assert.True(t, orphaned.Orphaned)
+	assert.Same(t, master, orphaned.Master)
+	assert.Equal(t, []*ClusterNode{slave1, slave2}, orphaned.Slaves)
+	assert.Same(t, master2, c.Replicasets[1].Master)
+
+	// still filtered on the next update
+	c.setReplicaset([]*ClusterNode{slave1, slave2, master2})
+	assert.True(t, c.Replicasets[0].Orphaned)
+	assert.Same(t, master, c.Replicasets[0].Master)
+
+	// the master reappears
+	c.setReplicaset([]*ClusterNode{master, slave1, slave2, master2})
+	assert.Equal(t, 2, len(c.Replicasets))
+	assert.False(t, c.Replicasets[0].Orphaned)
+	assert.Equal(t, []*ClusterNode{slave1, slave2}, c.Replicasets[0].Slaves)
+
+	// a master never seen, the slave is retained under a placeholder without slots
+	c = ClusterNodes{}
+	c.setReplicaset([]*ClusterNode{slave1, master2})
+	assert.Equal(t, 2, len(c.Replicasets))
+	assert.True(t, c.Replicasets[0].Orphaned)
+	assert.Equal(t, "m1", c.Replicasets[0].Master.Name)
+	assert.Equal(t, 0, len(c.Replicasets[0].Master.Slots))
+	assert.Equal(t, []*ClusterNode{slave1}, c.Replicasets[0].Slaves)
+}
+
+func TestRefreshClusterNodes(t *testing.T) {
+	el, s, peer := newTestLoop(t, ConnServer)
+	el.engine.el = el
+	el.engine.opts.RedisMonitorInterval = 60000
+
+	mRedis := new(mockedRedis)
+	mRedis.On("Info").Return(&redis.Info{Loading: false, MasterLinkStatus: "up", Version: "6.2.6"}, nil)
+	wrapper := new(mockedRedisWrapper)
+	wrapper.On("Dial", mock.Anything, mock.Anything).Return(mRedis, nil)
+
+	seed := "127.0.0.1:8300"
+	pool := &Pool{Addr: seed, maxActive: 1, Dial: func(string, bool) (SConn, error) { return s, nil }}
+	EngineGlobal = &Engine{
+		eng:         el.engine,
+		sCodec:      SRespCodec{MsgMaxLength: 10000},
+		ProxyPool:   map[string]*Pool{seed: pool},
+		ProxyAddrs:  []string{seed},
+		clusterChan: make(chan []byte, 3),
+		ClusterNodes: ClusterNodes{
+			redisWrapper: wrapper,
+		},
+	}
+	t.Cleanup(func() {
+		for addr, p := range EngineGlobal.ProxyPool {
+			if addr != seed {
+				p.Close()
+			}
+		}
+	})
+	stop, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		EngineGlobal.ClusterNodes.superviseClusterNodes(stop)
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-exited
+	})
+	go func() { _ = el.poller.Polling(el.callback, func() {}, func() {}) }()
+	t.Cleanup(func() {
+		_ = el.poller.UrgentTrigger(func(_ interface{}) error { return gerrors.ErrEngineShutdown }, nil)
+	})
+
+	// plays the redis node, answering the cluster nodes command with the topology after a failover
+	nodes := "m1 127.0.0.1:8300 myself,slave m2 0 0 1 connected\n" +
+		"m2 127.0.0.1:8302 master - 0 0 2 connected 0-8191\n" +
+		"m3 127.0.0.1:8304 master - 0 0 3 connected 8192-16383\n"
+	go func() {
+		buf := make([]byte, 1024)
+		n, err := unix.Read(peer, buf)
+		if !assert.Nil(t, err) || !assert.Equal(t, constant.ReqClusterNodes, string(buf[:n])) {
+			return
+		}
+		_, _ = unix.Write(peer, []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(nodes), nodes)))
+	}()
+
+	refreshed, err := EngineGlobal.RefreshClusterNodes("", 3*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, refreshed)
+
+	// the topology is applied once RefreshClusterNodes returns
+	done := make(chan struct{})
+	_ = el.poller.Trigger(func(_ interface{}) error {
+		defer close(done)
+		assert.Equal(t, 3, len(EngineGlobal.ProxyPool))
+		assert.Equal(t, "127.0.0.1:8302", EngineGlobal.Slots2Node.Get(0).Master.Addr)
+		assert.Equal(t, "127.0.0.1:8304", EngineGlobal.Slots2Node.Get(16383).Master.Addr)
+		assert.Equal(t, seed, EngineGlobal.Slots2Node.Get(0).Slaves[0].Addr)
+		return nil
+	}, nil)
+	<-done
+
+	_, err = EngineGlobal.RefreshClusterNodes("127.0.0.1:9999", time.Second)
+	assert.EqualError(t, err, "proxy pool[127.0.0.1:9999] not found")
+}
+
+// startClusterLoop runs the cluster info processing on a fresh engine until the test ends
+func startClusterLoop(t *testing.T) {
+	mRedis := new(mockedRedis)
+	mRedis.On("Info").Return(&redis.Info{Loading: false, MasterLinkStatus: "up", Version: "6.2.6"}, nil)
+	wrapper := new(mockedRedisWrapper)
+	wrapper.On("Dial", mock.Anything, mock.Anything).Return(mRedis, nil)
+	EngineGlobal = &Engine{
+		clusterChan:  make(chan []byte, 3),
+		ClusterNodes: ClusterNodes{redisWrapper: wrapper},
+	}
+
+	stop, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		EngineGlobal.ClusterNodes.superviseClusterNodes(stop)
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-exited
+	})
+}
+
+// clusterNodesReply returns the bulk string reply of CLUSTER NODES with the topology of 3 nodes
+func clusterNodesReply() []byte {
+	nodes := "m1 127.0.0.1:8300 master - 0 0 1 connected 0-8191\n" +
+		"m2 127.0.0.1:8302 master - 0 0 2 connected 8192-16383\n" +
+		"s1 127.0.0.1:8304 slave m1 0 0 1 connected\n"
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(nodes), nodes))
+}
+
+func TestClusterLoopInvalid(t *testing.T) {
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+	startClusterLoop(t)
+
+	// the replies without line end or payload are logged and skipped
+	for _, invalid := range []string{"$12", "$0\r\n\r\n"} {
+		updated := waitUpdate()
+		EngineGlobal.clusterChan <- []byte(invalid)
+		EngineGlobal.clusterChan <- clusterNodesReply()
+		select {
+		case n := <-updated:
+			assert.Equal(t, 3, n, "after %q", invalid)
+		case <-time.After(time.Second):
+			cancelWait(updated)
+			t.Fatalf("the cluster info after %q is not processed", invalid)
+		}
+	}
+	assert.True(t, sink.Contains(logging.LevelError, "nodes info invalid"))
+	assert.False(t, sink.Contains(logging.LevelError, "exited unexpectedly"))
+}
+
+func TestClusterLoopSkipped(t *testing.T) {
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+	startClusterLoop(t)
+
+	for _, skipped := range []string{"\r\n", "+OK\r\n", "$-1\r\n"} {
+		updated := waitUpdate()
+		EngineGlobal.clusterChan <- []byte(skipped)
+		EngineGlobal.clusterChan <- clusterNodesReply()
+		select {
+		case n := <-updated:
+			assert.Equal(t, 3, n, "after %q", skipped)
+		case <-time.After(time.Second):
+			cancelWait(updated)
+			t.Fatalf("the cluster info after %q is not processed", skipped)
+		}
+	}
+	// skipped by the loop itself, rather than recovered by restarting it
+	assert.False(t, sink.Contains(logging.LevelError, "exited unexpectedly"))
+}
+
+func TestUpdateClusterNodesUnchanged(t *testing.T) {
+	mRedis := new(mockedRedis)
+	mRedis.On("Info").Return(&redis.Info{Loading: false, MasterLinkStatus: "up", Version: "6.2.6"}, nil)
+	wrapper := new(mockedRedisWrapper)
+	wrapper.On("Dial", mock.Anything, mock.Anything).Return(mRedis, nil)
+	c := &ClusterNodes{redisWrapper: wrapper}
+
+	nodes := "m1 127.0.0.1:8300 master - 0 0 1 connected 0-8191\n" +
+		"m2 127.0.0.1:8302 master - 0 0 2 connected 8192-16383\n" +
+		"s1 127.0.0.1:8304 slave m1 0 0 1 connected"
+	assert.Nil(t, c.updateClusterNodes(nodes))
+	assert.True(t, c.serverChanged)
+	replicasets := c.Replicasets
+
+	// the same topology in another order is not rebuilt
+	c.serverChanged = false
+	reordered := "s1 127.0.0.1:8304 slave m1 0 0 1 connected\n" +
+		"m2 127.0.0.1:8302 master - 0 0 2 connected 8192-16383\n" +
+		"m1 127.0.0.1:8300 myself,master - 0 0 1 connected 0-8191"
+	assert.Nil(t, c.updateClusterNodes(reordered))
+	assert.False(t, c.serverChanged)
+	assert.Equal(t, fmt.Sprintf("%p", replicasets), fmt.Sprintf("%p", c.Replicasets))
+
+	// a slot migrated is detected
+	moved := "m1 127.0.0.1:8300 master - 0 0 1 connected 0-8190\n" +
+		"m2 127.0.0.1:8302 master - 0 0 3 connected 8191-16383\n" +
+		"s1 127.0.0.1:8304 slave m1 0 0 1 connected"
+	assert.Nil(t, c.updateClusterNodes(moved))
+	assert.True(t, c.serverChanged)
+}
+
+func BenchmarkIsChanged(b *testing.B) {
+	logging.InitializeLogger(logging.WithWriter(io.Discard), logging.WithLogLevel("ERROR"))
+	b.Cleanup(logging.Reset)
+
+	// 250 masters with a slave each
+	var allNodes []*ClusterNode
+	step := int32(constant.RedisClusterSlots / 250)
+	for i := 0; i < 250; i++ {
+		name := fmt.Sprintf("m%d", i)
+		slots := []Slots{{Start: int32(i) * step, End: int32(i+1)*step - 1}}
+		allNodes = append(allNodes,
+			&ClusterNode{Name: name, Addr: fmt.Sprintf("10.0.%d.%d:6379", i/250, i%250), Role: Master, Slots: slots},
+			&ClusterNode{Addr: fmt.Sprintf("10.1.%d.%d:6379", i/250, i%250), Role: Slave, MasterId: name})
+	}
+	c := &ClusterNodes{}
+	c.isChanged(allNodes)
+	c.setServer(allNodes)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if c.isChanged(allNodes) {
+			b.Fatal("unchanged topology detected as changed")
+		}
+	}
+}
+
+func TestCountKeys(t *testing.T) {
+	m1, m2 := new(mockedRedis), new(mockedRedis)
+	m1.On("Do", "DBSIZE", mock.Anything).Return(int64(120), nil)
+	m2.On("Do", "DBSIZE", mock.Anything).Return(int64(30), nil)
+
+	wrapper := new(mockedRedisWrapper)
+	wrapper.On("Dial", "127.0.0.1:8300", "").Return(m1, nil)
+	wrapper.On("Dial", "127.0.0.1:8302", "").Return(m2, nil)
+	wrapper.On("Dial", "127.0.0.1:8304", "").Return((*mockedRedis)(nil), fmt.Errorf("connection refused"))
+
+	c := ClusterNodes{redisWrapper: wrapper}
+	c.ServerMap.Insert("127.0.0.1:8304", &ClusterNode{Addr: "127.0.0.1:8304", Role: Master})
+	c.ServerMap.Insert("127.0.0.1:8302", &ClusterNode{Addr: "127.0.0.1:8302", Role: Master})
+	c.ServerMap.Insert("127.0.0.1:8300", &ClusterNode{Addr: "127.0.0.1:8300", Role: Master})
+	c.ServerMap.Insert("127.0.0.1:8306", &ClusterNode{Addr: "127.0.0.1:8306", Role: Slave})
+
+	assert.Equal(t, []NodeKeys{
+		{Addr: "127.0.0.1:8300", Keys: 120},
+		{Addr: "127.0.0.1:8302", Keys: 30},
+		{Addr: "127.0.0.1:8304", Err: "connection refused"},
+	}, c.CountKeys())
+	wrapper.AssertNotCalled(t, "Dial", "127.0.0.1:8306", "")
+}
+
+// countingRedisWrapper records the number of probe connections open at once
+type countingRedisWrapper struct {
+	conn      redis.Conn
+	open, max int32
+}
+
+func (w *countingRedisWrapper) Dial(_, _ string, _ ...redis.DialOption) (redis.Conn, error) {
+	n := atomic.AddInt32(&w.open, 1)
+	for {
+		max := atomic.LoadInt32(&w.max)
+		if n <= max || atomic.CompareAndSwapInt32(&w.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	atomic.AddInt32(&w.open, -1)
+	return w.conn, nil
+}
+
+func TestParseProbeConns(t *testing.T) {
+	mRedis := new(mockedRedis)
+	mRedis.On("Info").Return(&redis.Info{MasterLinkStatus: "up", Version: "6.2.6"}, nil)
+	wrapper := &countingRedisWrapper{conn: mRedis}
+
+	c := ClusterNodes{redisWrapper: wrapper, probeSem: make(chan struct{}, 2)}
+	var msg = "00024e4759fc874a55362b9fe7472859cc4235c0 127.0.0.1:8300 myself,master - 0 0 1 connected 0-5460\n01ae6b52c5bcee240275d7b96ee0c33cb4615f01 127.0.0.1:8308 slave 00024e4759fc874a55362b9fe7472859cc4235c0 0 1646637827924 5 connected\nd5c94de92eff84aeab97eaf66079869b0e130f1e 127.0.0.1:8304 master - 0 1646637824420 3 connected 10923-16383\n731aaa0d9dae20695fe7e7702f14d5ad0e10219a 127.0.0.1:8302 master - 0 1646637824921 2 connected 5461-10922\n80651576a8fe05d3eca0678d3b39dc2b0a5315a0 127.0.0.1:8314 slave d5c94de92eff84aeab97eaf66079869b0e130f1e 0 1646637829927 8 connected\n8cb42cde94bf5c906d1696d337b04bb9da3cb205 127.0.0.1:8310 slave 731aaa0d9dae20695fe7e7702f14d5ad0e10219a 0 1646637828926 6 connected"
+	allNodes, err := c.parse(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(allNodes))
+	assert.Equal(t, "127.0.0.1:8300", allNodes[0].Addr, "the order of cluster nodes is kept")
+	assert.Equal(t, "6.2.6", allNodes[5].Version)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&wrapper.max), "probes must run concurrently within the bound")
+}
@@ -31,20 +31,13 @@ type Buffer struct {
 	r   int // next position to read
 }
 
-// buffer single-threaded service, only one message will be decoded at the same time,
-// so a global variable is maintained here to avoid frequent memory requests
-var buffer Buffer
-
+// NewBuffer every decode owns its Buffer, so that decoders on different goroutines never share one.
+// NewBuffer is inlined and the Buffer doesn't escape the decode, so it's allocated on the stack
 func NewBuffer(bs []byte) *Buffer {
-	buffer.r = 0
-
 	if len(bs) == 0 {
-		buffer.buf = nil
-		return &buffer
+		return &Buffer{}
 	}
-
-	buffer.buf = bs
-	return &buffer
+	return &Buffer{buf: bs}
 }
 
 // Empty whether buffer is empty or not
@@ -118,7 +111,7 @@ func (b *Buffer) ReadLine() ([]byte, error) {
 		return nil, EmptyLine
 	}
 	if buf[idx-1] != CRByte {
-		return nil, ErrInvalidResp
+		return nil, ErrCRNotFound
 	}
 	return buf[:len(buf)-2], nil
 }
@@ -16,6 +16,7 @@ package codec
 
 import (
 	"errors"
+	"strconv"
 
 	"rcproxy/core/pkg/utils"
 )
@@ -31,7 +32,13 @@ var AddrNotFound = errors.New("unknown addr")
 var UnKnownProxyPool = errors.New("unknown pool")
 var UnKnownProxyPoolConn = errors.New("unknown pool conn")
 var ErrInvalidResp = errors.New("invalid resp")
+var ErrResp3 = errors.New("resp3 reply, the redis node is not speaking RESP2")
 var ErrInvalidInitializing = errors.New("invalid initializing")
+var ErrInitializeRefused = errors.New("initialization refused by redis")
+var ErrBackendDesync = errors.New("reply without pending request")
+var ErrReqTooLarge = errors.New("declared bulk length too large")
+var ErrReplyTooManyElements = errors.New("array reply has too many elements")
+var ErrPendingLimit = errors.New("too many requests pending on the connection")
 
 const (
 	OK   Status = "+OK\r\n"
@@ -48,14 +55,58 @@ const (
 	ErrUnKnownMget                Error = "-ERR unknown mget error\r\n"
 	ErrMsgReqTooLarge             Error = "-ERR req msg length too large\r\n"
 	ErrMsgRspTooLarge             Error = "-ERR rsp msg length too large\r\n"
+	ErrMsgRspTooManyElements      Error = "-ERR rsp has too many elements\r\n"
+	ErrMsgPendingLimit            Error = "-TRYAGAIN redis node is slow to drain the requests, retry later\r\n"
 	ErrMsgReqWrongArgumentsNumber Error = "-ERR wrong number of arguments\r\n"
+	ErrMsgReqTooManyKeys          Error = "-ERR too many keys in request\r\n"
+	ErrValueTooLarge              Error = "-ERR value too large\r\n"
+	ErrCrossSlot                  Error = "-CROSSSLOT Keys in request don't hash to the same slot\r\n"
 	ErrMsgRequestTimeout          Error = "-ERR proxy request timeout\r\n"
 	ErrAuthInvalidPassword        Error = "-ERR invalid password\r\n"
 	ErrAuthNeedNtPassword         Error = "-ERR Client sent AUTH, but no password is set\r\n"
+	ErrNoAuth                     Error = "-NOAUTH Authentication required\r\n"
+	ErrUnKnownSubcommand          Error = "-ERR unknown subcommand\r\n"
+	ErrUnknownTag                 Error = "-ERR no node has the tag in node_tags\r\n"
+	ErrNoTarget                   Error = "-ERR command without key, choose the node with PROXY TARGET <addr> first\r\n"
+	ErrSyntax                     Error = "-ERR syntax error\r\n"
+	ErrProtoVersion               Error = "-ERR Protocol version is not an integer or out of range\r\n"
+	ErrNoProto                    Error = "-NOPROTO unsupported protocol version\r\n"
+	ErrReadOnlyProxy              Error = "-ERR proxy is read-only\r\n"
+	ErrReadOnlySlot               Error = "-ERR slot is read-only during migration\r\n"
+	ErrOrphanedSlot               Error = "-CLUSTERDOWN the master of the slot is down, only reads are served\r\n"
+	ErrProxyInitializing          Error = "-ERR proxy initializing, retry\r\n"
+	ErrMaxConnsPerIP              Error = "-ERR max number of clients per ip reached\r\n"
+	ErrCompressDisabled           Error = "-ERR compression is disabled by the proxy\r\n"
+	ErrInvalidSlot                Error = "-ERR Invalid or out of range slot\r\n"
+	ErrNoKeyArguments             Error = "-ERR The command has no key arguments\r\n"
+	ErrUnrecognizedOption         Error = "-ERR Unrecognized option\r\n"
+	ErrClientSetinfo              Error = "-ERR CLIENT SETINFO cannot contain spaces, newlines or special characters.\r\n"
+	ErrClusterFailover            Error = "-ERR CLUSTER FAILOVER must be run directly on the node\r\n"
+	ErrFailover                   Error = "-ERR FAILOVER must be run directly on the node\r\n"
+	ErrWait                       Error = "-ERR WAIT is not supported by the proxy\r\n"
+	ErrClientTracking             Error = "-ERR client tracking not supported by proxy\r\n"
+	ErrDebug                      Error = "-ERR DEBUG subcommand is not allowed by the proxy\r\n"
+	ErrTLSRequired                Error = "-ERR TLS is required by the proxy\r\n"
+	ErrFunction                   Error = "-ERR FUNCTION subcommand is node-local, run it directly on the target node\r\n"
+	ErrSelectCluster              Error = "-ERR SELECT is not allowed in cluster mode\r\n"
+	ErrInvalidDBIndex             Error = "-ERR invalid DB index\r\n"
+	ErrInvalidCursor              Error = "-ERR invalid cursor\r\n"
+	ErrScanTooManyNodes           Error = "-ERR too many redis masters to scan through the proxy\r\n"
+	ErrScanCursorTooLarge         Error = "-ERR cursor of the redis node too large to scan through the proxy\r\n"
 )
 
 type Error string
 
+// ErrRequiresVersion the target node is too old for the command
+func ErrRequiresVersion(version string) Error {
+	return Error("-ERR command requires Redis >= " + version + " on the target node\r\n")
+}
+
+// ErrClusterAdmin the CLUSTER subcommand reconfigures the node it is run on, which the proxy can't tell
+func ErrClusterAdmin(subcommand string) Error {
+	return Error("-ERR run CLUSTER " + subcommand + " directly on the target node\r\n")
+}
+
 func (err Error) Nil() bool           { return len(err) < 1 }
 func (err Error) NotNil() bool        { return len(err) > 0 }
 func (err Error) Error() string       { return string(err) }
@@ -69,3 +120,33 @@ func (s Status) String() string      { return string(s) }
 func (s Status) Bytes() []byte       { return utils.S2B(string(s)) }
 func (s Status) Len() int            { return len(s) }
 func (s Status) ShortString() string { return string(s)[:len(s)-2] }
+
+// AppendArrayLen appends the header of a RESP array with n elements to dst
+func AppendArrayLen(dst []byte, n int) []byte {
+	dst = append(dst, '*')
+	dst = strconv.AppendInt(dst, int64(n), 10)
+	return append(dst, LFCRByte...)
+}
+
+// AppendSimpleString appends s to dst as a RESP simple string, s must contain no CR or LF
+func AppendSimpleString(dst []byte, s string) []byte {
+	dst = append(dst, '+')
+	dst = append(dst, s...)
+	return append(dst, LFCRByte...)
+}
+
+// AppendBulkString appends s to dst as a RESP bulk string
+func AppendBulkString(dst []byte, s string) []byte {
+	dst = append(dst, '$')
+	dst = strconv.AppendInt(dst, int64(len(s)), 10)
+	dst = append(dst, LFCRByte...)
+	dst = append(dst, s...)
+	return append(dst, LFCRByte...)
+}
+
+// AppendInteger appends n to dst as a RESP integer
+func AppendInteger(dst []byte, n int64) []byte {
+	dst = append(dst, ':')
+	dst = strconv.AppendInt(dst, n, 10)
+	return append(dst, LFCRByte...)
+}
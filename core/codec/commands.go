@@ -15,6 +15,11 @@
 
 package codec
 
+import (
+	"strconv"
+	"strings"
+)
+
 type Command uint32
 type NArgs int
 
@@ -23,6 +28,8 @@ const (
 	ReqExists         /* redis commands - keys */
 	ReqTtl
 	ReqPttl
+	ReqExpiretime
+	ReqPexpiretime
 	ReqType
 	ReqDump
 	ReqBitcount /* redis requests - string */
@@ -61,6 +68,10 @@ const (
 	ReqZrevrank
 	ReqZscore
 	ReqZscan
+	ReqPfcount /* redis requests - hyperloglog */
+	ReqTime    /* redis requests - server */
+	ReqScan    /* redis requests - scan, answered one master at a time */
+	ReqFcallRo /* redis requests - functions */
 
 	ReqWriteCmdStart /* redis write commands below */
 	ReqDel           /* redis commands - keys */
@@ -74,6 +85,7 @@ const (
 	ReqDecr
 	ReqDecrby
 	ReqGetset
+	ReqGetdel
 	ReqIncr
 	ReqIncrby
 	ReqIncrbyfloat
@@ -104,7 +116,6 @@ const (
 	ReqRpush
 	ReqRpushx
 	ReqPfadd /* redis requests - hyperloglog */
-	ReqPfcount
 	ReqPfmerge
 	ReqSadd /* redis requests - sets */
 	ReqSdiffstore
@@ -123,11 +134,28 @@ const (
 	ReqZunionstore
 	ReqEval /* redis requests - eval */
 	ReqEvalsha
+	ReqFcall
 	ReqPing /* redis requests - ping/quit */
 	ReqQuit
+	ReqAsking
 	ReqAuth
+	ReqSelect
+	ReqProxy /* rcproxy requests - answered by the proxy itself */
+	ReqHello
+	ReqCluster
+	ReqWait
+	ReqFailover
+	ReqDebug
+	ReqClient
+	ReqCommand
+	ReqObject
+	ReqLatency
+	ReqFunction
 	ReqTooLarge
+	ReqValueTooLarge
 	ReqWrongArgumentsNumber
+	ReqTooManyKeys
+	ReqCrossSlot
 
 	RspTooLarge
 	RspStatus /* redis response */
@@ -153,12 +181,15 @@ const (
 	Nargs3       NArgs = 4  // 1 key, 3 parameter
 	NargsInf     NArgs = -1 // 1 key, unlimited parameter
 	NargsEvenInf NArgs = -2 // 1 key, unlimited even parameter
+	NargsAny     NArgs = -3 // 0 key, unlimited parameter
 )
 
 var CommandType2Str = map[Command]string{
 	ReqExists:           "exists",
 	ReqTtl:              "ttl",
 	ReqPttl:             "pttl",
+	ReqExpiretime:       "expiretime",
+	ReqPexpiretime:      "pexpiretime",
 	ReqType:             "type",
 	ReqDump:             "dump",
 	ReqBitcount:         "bitcount",
@@ -209,6 +240,7 @@ var CommandType2Str = map[Command]string{
 	ReqDecr:             "decr",
 	ReqDecrby:           "decrby",
 	ReqGetset:           "getset",
+	ReqGetdel:           "getdel",
 	ReqIncr:             "incr",
 	ReqIncrby:           "incrby",
 	ReqIncrbyfloat:      "incrbyfloat",
@@ -258,15 +290,34 @@ var CommandType2Str = map[Command]string{
 	ReqZunionstore:      "zunionstore",
 	ReqEval:             "eval",
 	ReqEvalsha:          "evalsha",
+	ReqFcall:            "fcall",
+	ReqFcallRo:          "fcall_ro",
 	ReqPing:             "ping",
 	ReqQuit:             "quit",
+	ReqAsking:           "asking",
 	ReqAuth:             "auth",
+	ReqSelect:           "select",
+	ReqProxy:            "proxy",
+	ReqHello:            "hello",
+	ReqCluster:          "cluster",
+	ReqWait:             "wait",
+	ReqFailover:         "failover",
+	ReqDebug:            "debug",
+	ReqClient:           "client",
+	ReqCommand:          "command",
+	ReqObject:           "object",
+	ReqLatency:          "latency",
+	ReqFunction:         "function",
+	ReqTime:             "time",
+	ReqScan:             "scan",
 }
 
 var CommandStr2Type = map[string]Command{
 	"exists":           ReqExists,
 	"ttl":              ReqTtl,
 	"pttl":             ReqPttl,
+	"expiretime":       ReqExpiretime,
+	"pexpiretime":      ReqPexpiretime,
 	"type":             ReqType,
 	"dump":             ReqDump,
 	"bitcount":         ReqBitcount,
@@ -317,6 +368,7 @@ var CommandStr2Type = map[string]Command{
 	"decr":             ReqDecr,
 	"decrby":           ReqDecrby,
 	"getset":           ReqGetset,
+	"getdel":           ReqGetdel,
 	"incr":             ReqIncr,
 	"incrby":           ReqIncrby,
 	"incrbyfloat":      ReqIncrbyfloat,
@@ -366,38 +418,72 @@ var CommandStr2Type = map[string]Command{
 	"zunionstore":      ReqZunionstore,
 	"eval":             ReqEval,
 	"evalsha":          ReqEvalsha,
+	"fcall":            ReqFcall,
+	"fcall_ro":         ReqFcallRo,
 	"ping":             ReqPing,
 	"quit":             ReqQuit,
+	"asking":           ReqAsking,
 	"auth":             ReqAuth,
+	"select":           ReqSelect,
+	"proxy":            ReqProxy,
+	"hello":            ReqHello,
+	"cluster":          ReqCluster,
+	"wait":             ReqWait,
+	"failover":         ReqFailover,
+	"debug":            ReqDebug,
+	"client":           ReqClient,
+	"command":          ReqCommand,
+	"object":           ReqObject,
+	"latency":          ReqLatency,
+	"function":         ReqFunction,
+	"time":             ReqTime,
+	"scan":             ReqScan,
 }
 
 var CommandType2ArgsNumber = map[Command]NArgs{
-	ReqPing: Nargsz,
-	ReqQuit: Nargsz,
-
-	ReqExists:   Nargs0,
-	ReqTtl:      Nargs0,
-	ReqPttl:     Nargs0,
-	ReqType:     Nargs0,
-	ReqDump:     Nargs0,
-	ReqGet:      Nargs0,
-	ReqStrlen:   Nargs0,
-	ReqHgetall:  Nargs0,
-	ReqHkeys:    Nargs0,
-	ReqHlen:     Nargs0,
-	ReqSmembers: Nargs0,
-	ReqZcard:    Nargs0,
-	ReqLlen:     Nargs0,
-	ReqScard:    Nargs0,
-	ReqHvals:    Nargs0,
-	ReqPfcount:  Nargs0,
-	ReqSpop:     Nargs0,
-	ReqAuth:     Nargs0,
-	ReqRpop:     Nargs0,
-	ReqPersist:  Nargs0,
-	ReqDecr:     Nargs0,
-	ReqIncr:     Nargs0,
-	ReqLpop:     Nargs0,
+	ReqPing:   Nargsz,
+	ReqQuit:   Nargsz,
+	ReqAsking: Nargsz,
+	ReqTime:   Nargsz,
+
+	ReqHello:    NargsAny,
+	ReqWait:     NargsAny,
+	ReqFailover: NargsAny,
+	ReqCluster:  NargsInf,
+	ReqDebug:    NargsInf,
+	ReqClient:   NargsInf,
+	ReqCommand:  NargsInf,
+	ReqObject:   NargsInf,
+	ReqLatency:  NargsInf,
+	ReqFunction: NargsInf,
+	ReqScan:     NargsInf,
+
+	ReqExists:      Nargs0,
+	ReqTtl:         Nargs0,
+	ReqPttl:        Nargs0,
+	ReqExpiretime:  Nargs0,
+	ReqPexpiretime: Nargs0,
+	ReqType:        Nargs0,
+	ReqDump:        Nargs0,
+	ReqGet:         Nargs0,
+	ReqStrlen:      Nargs0,
+	ReqHgetall:     Nargs0,
+	ReqHkeys:       Nargs0,
+	ReqHlen:        Nargs0,
+	ReqSmembers:    Nargs0,
+	ReqZcard:       Nargs0,
+	ReqLlen:        Nargs0,
+	ReqScard:       Nargs0,
+	ReqHvals:       Nargs0,
+	ReqSpop:        Nargs0,
+	ReqAuth:        Nargs0,
+	ReqSelect:      Nargs0,
+	ReqRpop:        Nargs0,
+	ReqPersist:     Nargs0,
+	ReqDecr:        Nargs0,
+	ReqIncr:        Nargs0,
+	ReqLpop:        Nargs0,
+	ReqGetdel:      Nargs0,
 
 	ReqRpoplpush:   Nargs1,
 	ReqRpushx:      Nargs1,
@@ -451,6 +537,7 @@ var CommandType2ArgsNumber = map[Command]NArgs{
 	ReqSunion:           NargsInf,
 	ReqHdel:             NargsInf,
 	ReqPfmerge:          NargsInf,
+	ReqPfcount:          NargsInf,
 	ReqRpush:            NargsInf,
 	ReqPfadd:            NargsInf,
 	ReqSadd:             NargsInf,
@@ -465,6 +552,8 @@ var CommandType2ArgsNumber = map[Command]NArgs{
 	ReqZunionstore:      NargsInf,
 	ReqEval:             NargsInf,
 	ReqEvalsha:          NargsInf,
+	ReqFcall:            NargsInf,
+	ReqFcallRo:          NargsInf,
 	ReqMget:             NargsInf,
 	ReqHmget:            NargsInf,
 	ReqHscan:            NargsInf,
@@ -480,10 +569,207 @@ var CommandType2ArgsNumber = map[Command]NArgs{
 	ReqZscan:            NargsInf,
 	ReqDel:              NargsInf,
 	ReqSort:             NargsInf,
+	ReqProxy:            NargsInf,
 
 	ReqMset: NargsEvenInf,
 }
 
+// CommandMinArgs minimum number of arguments, the key included, of the NargsInf commands needing more than the key,
+// so that an obviously malformed request is rejected by the proxy rather than by redis
+var CommandMinArgs = map[Command]int{
+	ReqSet:              2,
+	ReqHmset:            3,
+	ReqLpush:            2,
+	ReqRpush:            2,
+	ReqHdel:             2,
+	ReqHmget:            2,
+	ReqSadd:             2,
+	ReqSrem:             2,
+	ReqSdiffstore:       2,
+	ReqSinterstore:      2,
+	ReqSunionstore:      2,
+	ReqZadd:             3,
+	ReqZrem:             2,
+	ReqZinterstore:      3,
+	ReqZunionstore:      3,
+	ReqZrange:           3,
+	ReqZrangebylex:      3,
+	ReqZrangebyscore:    3,
+	ReqZrevrange:        3,
+	ReqZrevrangebyscore: 3,
+	ReqHscan:            2,
+	ReqSscan:            2,
+	ReqZscan:            2,
+	ReqEval:             2,
+	ReqEvalsha:          2,
+	ReqFcall:            2,
+	ReqFcallRo:          2,
+}
+
+// WriteCommands the commands changing the dataset, refused by a read-only proxy or on a read-only slot.
+// The commands numbered after ReqWriteCmdStart are not all writes, such as SUNION or the ones answered by
+// the proxy, and FUNCTION writes depending on its subcommand.
+var WriteCommands = map[Command]bool{
+	ReqDel:              true,
+	ReqExpire:           true,
+	ReqExpireat:         true,
+	ReqPexpire:          true,
+	ReqPexpireat:        true,
+	ReqPersist:          true,
+	ReqSort:             true,
+	ReqAppend:           true,
+	ReqDecr:             true,
+	ReqDecrby:           true,
+	ReqGetset:           true,
+	ReqGetdel:           true,
+	ReqIncr:             true,
+	ReqIncrby:           true,
+	ReqIncrbyfloat:      true,
+	ReqMset:             true,
+	ReqPsetex:           true,
+	ReqRestore:          true,
+	ReqSet:              true,
+	ReqSetbit:           true,
+	ReqSetex:            true,
+	ReqSetnx:            true,
+	ReqSetrange:         true,
+	ReqHdel:             true,
+	ReqHincrby:          true,
+	ReqHincrbyfloat:     true,
+	ReqHmset:            true,
+	ReqHset:             true,
+	ReqHsetnx:           true,
+	ReqLinsert:          true,
+	ReqLpop:             true,
+	ReqLpush:            true,
+	ReqLpushx:           true,
+	ReqLrem:             true,
+	ReqLset:             true,
+	ReqLtrim:            true,
+	ReqRpop:             true,
+	ReqRpoplpush:        true,
+	ReqRpush:            true,
+	ReqRpushx:           true,
+	ReqPfadd:            true,
+	ReqPfmerge:          true,
+	ReqSadd:             true,
+	ReqSdiffstore:       true,
+	ReqSinterstore:      true,
+	ReqSmove:            true,
+	ReqSpop:             true,
+	ReqSrem:             true,
+	ReqSunionstore:      true,
+	ReqZadd:             true,
+	ReqZincrby:          true,
+	ReqZinterstore:      true,
+	ReqZrem:             true,
+	ReqZremrangebyrank:  true,
+	ReqZremrangebylex:   true,
+	ReqZremrangebyscore: true,
+	ReqZunionstore:      true,
+	ReqEval:             true,
+	ReqEvalsha:          true,
+	ReqFcall:            true,
+}
+
+// OkReplyCommands the write commands whose success reply is +OK, the only ones which may be acknowledged
+// by the proxy on forwarding, since the client expects nothing else from them
+var OkReplyCommands = map[Command]bool{
+	ReqSet:     true,
+	ReqSetex:   true,
+	ReqPsetex:  true,
+	ReqMset:    true,
+	ReqHmset:   true,
+	ReqLset:    true,
+	ReqLtrim:   true,
+	ReqRestore: true,
+	ReqPfmerge: true,
+}
+
+// CommandMinVersion the redis version required by the commands added lately,
+// they are rejected by the proxy if the target node reports an older one
+var CommandMinVersion = map[Command]string{
+	ReqGetdel:      "6.2.0",
+	ReqExpiretime:  "7.0.0",
+	ReqPexpiretime: "7.0.0",
+	ReqFcall:       "7.0.0",
+	ReqFcallRo:     "7.0.0",
+	ReqFunction:    "7.0.0",
+}
+
+// RequiredVersion returns the version the command requires if the node of the version is too old for it.
+// An unknown version is never too old, the node is left to judge
+func RequiredVersion(command Command, version string) (string, bool) {
+	min, ok := CommandMinVersion[command]
+	if !ok || len(version) < 1 {
+		return "", false
+	}
+	return min, compareVersion(version, min) < 0
+}
+
+// compareVersion compares dotted versions such as 6.2.6 numerically
+func compareVersion(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Families the command families of Family, the labels of rcproxy_req_cmd besides the commands counted on their own
+var Families = []string{"del", "string", "bitmap", "incr_decr", "hashs", "lists", "sets", "sortedsets", "other"}
+
+// Family returns the family of the command, such as sortedsets for ZRANGE
+func Family(command Command) string {
+	switch command {
+	case ReqDel:
+		return "del"
+	case ReqGet, ReqSet, ReqMget, ReqMset, ReqSort:
+		fallthrough
+	case ReqSetex, ReqSetnx, ReqSetrange, ReqGetrange, ReqStrlen, ReqGetdel:
+		return "string"
+	case ReqBitcount, ReqSetbit, ReqGetbit:
+		return "bitmap"
+	case ReqIncr, ReqDecr, ReqDecrby, ReqIncrby, ReqIncrbyfloat:
+		return "incr_decr"
+	case ReqHexists, ReqHget, ReqHgetall, ReqHkeys, ReqHlen, ReqHmget, ReqHmset, ReqHdel:
+		fallthrough
+	case ReqHincrby, ReqHincrbyfloat, ReqHset, ReqHsetnx, ReqHscan, ReqHvals:
+		return "hashs"
+	case ReqLrem, ReqLpush, ReqRpush, ReqRpushx, ReqLpushx, ReqLpop, ReqRpop, ReqRpoplpush:
+		fallthrough
+	case ReqLrange, ReqLset, ReqLtrim, ReqLindex, ReqLlen, ReqLinsert:
+		return "lists"
+	case ReqSadd, ReqSpop, ReqSrem, ReqSscan, ReqSmove:
+		fallthrough
+	case ReqSrandmember, ReqScard, ReqSismember, ReqSmembers:
+		fallthrough
+	case ReqSunion, ReqSdiff, ReqSinter, ReqSinterstore, ReqSdiffstore, ReqSunionstore:
+		return "sets"
+	case ReqZadd, ReqZcount, ReqZincrby, ReqZscan, ReqZcard, ReqZscore:
+		fallthrough
+	case ReqZrange, ReqZrank, ReqZrangebyscore, ReqZrevrange, ReqZrangebylex, ReqZrevrank:
+		fallthrough
+	case ReqZinterstore, ReqZrevrangebyscore, ReqZunionstore, ReqZremrangebyscore:
+		fallthrough
+	case ReqZrem, ReqZremrangebylex, ReqZremrangebyrank:
+		return "sortedsets"
+	}
+	return "other"
+}
+
 func Transform2Type(command []byte, n int) Command {
 	toLower(command)
 	if v, ok := CommandStr2Type[string(command)]; ok {
@@ -511,13 +797,14 @@ func checkArgs(command Command, n int) Command {
 			return ReqWrongArgumentsNumber
 		}
 	case NargsInf:
-		if n < 1 {
+		if n < 1 || n < CommandMinArgs[command] {
 			return ReqWrongArgumentsNumber
 		}
 	case NargsEvenInf:
 		if n < 2 || n%2 == 1 {
 			return ReqWrongArgumentsNumber
 		}
+	case NargsAny:
 	default:
 		return ReqWrongArgumentsNumber
 	}
@@ -532,3 +819,79 @@ func toLower(bs []byte) {
 		}
 	}
 }
+
+// ToUpper uppercases the ascii letters of bs in place
+func ToUpper(bs []byte) {
+	for i := 0; i < len(bs); i++ {
+		if bs[i] >= 'a' && bs[i] <= 'z' {
+			bs[i] = bs[i] ^ 0x20
+		}
+	}
+}
+
+// Keys returns the keys among the arguments following the command name, nil if the command has no key.
+// The requests are routed and split by them, a command such as SMOVE which is not split by the first one only.
+func Keys(command Command, args []string) []string {
+	indexes := KeyIndexes(command, args)
+	if len(indexes) < 1 {
+		return nil
+	}
+	keys := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// KeyIndexes returns the positions of the keys among the arguments following the command name, see Keys
+func KeyIndexes(command Command, args []string) []int {
+	switch {
+	case len(args) < 1, command >= ReqPing, command == ReqTime, command == ReqScan:
+		return nil
+	}
+	switch command {
+	case ReqMget, ReqDel, ReqSunion, ReqSinter, ReqPfcount, ReqPfmerge, ReqSdiffstore, ReqSinterstore, ReqSunionstore:
+		return rangeIndexes(0, len(args), 1)
+	case ReqMset:
+		return rangeIndexes(0, len(args), 2)
+	case ReqRpoplpush, ReqSmove:
+		if len(args) < 2 {
+			return rangeIndexes(0, len(args), 1)
+		}
+		return rangeIndexes(0, 2, 1)
+	case ReqZinterstore, ReqZunionstore:
+		// the destination, then numkeys keys
+		n := numKeys(args[1:])
+		if n < 1 {
+			return []int{0}
+		}
+		return append([]int{0}, rangeIndexes(2, 2+n, 1)...)
+	case ReqEval, ReqEvalsha, ReqFcall, ReqFcallRo:
+		n := numKeys(args[1:])
+		if n < 1 {
+			return nil
+		}
+		return rangeIndexes(2, 2+n, 1)
+	}
+	return []int{0}
+}
+
+// numKeys parses the numkeys argument at the head of args, followed by the keys, 0 if it is invalid
+func numKeys(args []string) int {
+	if len(args) < 1 {
+		return 0
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(args)-1 {
+		return 0
+	}
+	return n
+}
+
+func rangeIndexes(start, end, step int) []int {
+	indexes := make([]int, 0, (end-start+step-1)/step)
+	for i := start; i < end; i += step {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
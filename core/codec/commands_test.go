@@ -27,3 +27,77 @@ func Test_UpperOrLower(t *testing.T) {
 	b := 'B'
 	assert.Equal(t, 'b', b^0x20)
 }
+
+func Test_RequiredVersion(t *testing.T) {
+	var cases = []struct {
+		command Command
+		version string
+		min     string
+		old     bool
+	}{
+		{ReqGetdel, "6.0.16", "6.2.0", true},
+		{ReqGetdel, "6.2.0", "6.2.0", false},
+		{ReqGetdel, "6.2", "6.2.0", false},
+		{ReqGetdel, "7.0.11", "6.2.0", false},
+		{ReqExpiretime, "6.2.14", "7.0.0", true},
+		{ReqExpiretime, "10.0.0", "7.0.0", false},
+		{ReqGetdel, "", "", false},
+		{ReqGet, "3.0.2", "", false},
+	}
+	for _, v := range cases {
+		min, old := RequiredVersion(v.command, v.version)
+		assert.Equal(t, v.min, min, "command: %s, version: %s", Transform2Str(v.command), v.version)
+		assert.Equal(t, v.old, old, "command: %s, version: %s", Transform2Str(v.command), v.version)
+	}
+}
+
+func Test_MinArgs(t *testing.T) {
+	var cases = []struct {
+		command string
+		n       int
+		expect  Command
+	}{
+		{"set", 1, ReqWrongArgumentsNumber},
+		{"set", 2, ReqSet},
+		{"set", 5, ReqSet},
+		{"hset", 2, ReqWrongArgumentsNumber},
+		{"hset", 3, ReqHset},
+		{"zadd", 1, ReqWrongArgumentsNumber},
+		{"zadd", 2, ReqWrongArgumentsNumber},
+		{"zadd", 3, ReqZadd},
+		{"zadd", 7, ReqZadd},
+		{"lpush", 1, ReqWrongArgumentsNumber},
+		{"eval", 1, ReqWrongArgumentsNumber},
+		{"fcall", 1, ReqWrongArgumentsNumber},
+		{"fcall_ro", 3, ReqFcallRo},
+		{"function", 0, ReqWrongArgumentsNumber},
+		{"del", 1, ReqDel},
+	}
+	for _, v := range cases {
+		assert.Equal(t, v.expect, Transform2Type([]byte(v.command), v.n), "command: %s, n: %d", v.command, v.n)
+	}
+}
+
+func Test_Keys(t *testing.T) {
+	var cases = []struct {
+		command Command
+		args    []string
+		expect  []string
+	}{
+		{ReqGet, []string{"foo"}, []string{"foo"}},
+		{ReqSet, []string{"foo", "bar", "EX", "10"}, []string{"foo"}},
+		{ReqMget, []string{"a", "b"}, []string{"a", "b"}},
+		{ReqMset, []string{"a", "1", "b", "2"}, []string{"a", "b"}},
+		{ReqEval, []string{"return 1", "2", "a", "b", "c"}, []string{"a", "b"}},
+		{ReqEval, []string{"return 1", "0"}, nil},
+		{ReqEval, []string{"return 1", "3", "a"}, nil},
+		{ReqFcall, []string{"myfunc", "1", "a", "b"}, []string{"a"}},
+		{ReqFcallRo, []string{"myfunc", "0"}, nil},
+		{ReqPing, nil, nil},
+		{ReqTime, nil, nil},
+		{ReqCluster, []string{"info"}, nil},
+	}
+	for _, v := range cases {
+		assert.Equal(t, v.expect, Keys(v.command, v.args), "command: %s, args: %v", Transform2Str(v.command), v.args)
+	}
+}
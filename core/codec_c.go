@@ -17,6 +17,7 @@ package core
 
 import (
 	"strconv"
+	"strings"
 
 	"rcproxy/core/codec"
 	"rcproxy/core/pkg/errors"
@@ -25,15 +26,44 @@ import (
 	"rcproxy/core/pkg/utils"
 )
 
+const (
+	// CrossSlotError rejects the multi-key requests across slots with CROSSSLOT, as redis cluster does
+	CrossSlotError = "error"
+	// CrossSlotSerial splits SUNION and SINTER across slots into one request per slot and merges the replies,
+	// for legacy clients unable to handle CROSSSLOT
+	CrossSlotSerial = "serial"
+
+	// CommandCaseLower forwards the command names in lowercase, whatever the client sent
+	CommandCaseLower = "lower"
+	// CommandCaseUpper forwards the command names in uppercase, for backend ACLs matching the case
+	CommandCaseUpper = "upper"
+)
+
 type CRespCodec struct {
 	MsgMaxLength int
+	MaxKeys      int    // maximum number of keys of a single MGET/DEL/MSET, 0 means no limit
+	CrossSlot    string // how to answer the multi-key requests across slots, see CrossSlotError
+	CommandCase  string // case of the command names forwarded, see CommandCaseLower
+	MaxValueSize int    // maximum length of a value written, 0 means no limit
+	DryRun       bool   // the request is decoded for PROXY EXPLAIN, it takes no id and isn't counted in the stats
+}
+
+// NewCRespCodec returns the codec of the client requests configured by the options
+func NewCRespCodec(opts *Options) CRespCodec {
+	return CRespCodec{MsgMaxLength: opts.RedisMsgMaxLength, MaxKeys: opts.RedisMaxKeysPerCommand, CrossSlot: opts.RedisCrossSlotBehavior, CommandCase: opts.RedisCommandCase, MaxValueSize: opts.RedisMaxValueSize}
 }
 
 // There are three cases of protocol parsing
 // 1. successful parsing
 // 2. tcp packet incompleteness leads to parsing exceptions, wait for the next event loop
 // 3. illegal packets leads to parsing exceptions, so close the client connection directly.
-func (rc *CRespCodec) Decode(c CConn) (*Msg, error) {
+func (rc *CRespCodec) Decode(c CConn) (_ *Msg, err error) {
+	defer func() {
+		if err != nil && !rc.DryRun {
+			GlobalStats.ParseErrorIncr("client", err)
+		}
+	}()
+
 	bs, _ := c.Peek(0)
 	buf := codec.NewBuffer(bs)
 	if buf.Empty() {
@@ -45,7 +75,11 @@ func (rc *CRespCodec) Decode(c CConn) (*Msg, error) {
 		return nil, errors.ErrIncompletePacket
 	}
 
-	msgId++
+	if rc.DryRun {
+		defer func(id uint64) { fragId = id }(fragId)
+	} else {
+		msgId++
+	}
 
 	var n int
 	switch line[0] {
@@ -70,12 +104,15 @@ func (rc *CRespCodec) Decode(c CConn) (*Msg, error) {
 	n--
 
 	resp := MsgPool.Get()
-	resp.Id = msgId
+	if resp.DryRun = rc.DryRun; !resp.DryRun {
+		resp.Id = msgId
+	}
 	resp.Owner = c
 	resp.Type = codec.Transform2Type(msg, n)
-	resp.Body = make(map[int32]*Frag, n)
-	resp.Fd2Slot = make(map[int]int32, n)
-
+	// the name is lowercased in place by Transform2Type, the frags copying the request as is get it too
+	if rc.CommandCase == CommandCaseUpper {
+		codec.ToUpper(msg)
+	}
 	if rc.sizeTooLarge(buf.TotalSize()) {
 		resp.Type = codec.ReqTooLarge
 	}
@@ -85,35 +122,76 @@ func (rc *CRespCodec) Decode(c CConn) (*Msg, error) {
 		if err = rc.Frag1(c, n, resp, buf); err != nil {
 			return nil, err
 		}
-		EngineGlobal.cCodec.MGet(resp)
-		GlobalStats.Fragments.WithLabelValues(codec.Transform2Str(codec.ReqMget)).Inc()
+		if resp.Type == codec.ReqMget {
+			rc.MGet(resp)
+			rc.fragmentsIncr(codec.ReqMget)
+		}
 	case codec.ReqDel:
 		if err = rc.Frag1(c, n, resp, buf); err != nil {
 			return nil, err
 		}
-		EngineGlobal.cCodec.Del(resp)
-		GlobalStats.Fragments.WithLabelValues(codec.Transform2Str(codec.ReqDel)).Inc()
+		if resp.Type == codec.ReqDel {
+			rc.Del(resp)
+			rc.fragmentsIncr(codec.ReqDel)
+		}
 	case codec.ReqMset:
 		if err = rc.Frag2(c, n, resp, buf); err != nil {
 			return nil, err
 		}
-		EngineGlobal.cCodec.MSet(resp)
-		GlobalStats.Fragments.WithLabelValues(codec.Transform2Str(codec.ReqMset)).Inc()
-	case codec.ReqEval, codec.ReqEvalsha:
+		if resp.Type == codec.ReqMset {
+			rc.MSet(resp)
+			rc.fragmentsIncr(codec.ReqMset)
+		}
+	case codec.ReqEval, codec.ReqEvalsha, codec.ReqFcall, codec.ReqFcallRo:
 		if err = rc.Eval(c, n, resp, buf); err != nil {
 			return nil, err
 		}
+	case codec.ReqSunion, codec.ReqSinter:
+		if rc.CrossSlot != CrossSlotSerial {
+			if err = rc.SameSlot(c, n, resp, buf); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if err = rc.Frag1(c, n, resp, buf); err != nil {
+			return nil, err
+		}
+		if resp.Type != codec.ReqTooManyKeys {
+			rc.Split(resp)
+			rc.fragmentsIncr(resp.Type)
+		}
+	case codec.ReqPfcount, codec.ReqPfmerge:
+		if err = rc.SameSlot(c, n, resp, buf); err != nil {
+			return nil, err
+		}
+	case codec.ReqProxy, codec.ReqHello, codec.ReqCluster, codec.ReqWait, codec.ReqFailover, codec.ReqDebug, codec.ReqTime, codec.ReqClient,
+		codec.ReqCommand, codec.ReqObject, codec.ReqLatency, codec.ReqFunction, codec.ReqSelect, codec.ReqScan:
+		if err = rc.Args(c, n, resp, buf); err != nil {
+			return nil, err
+		}
 	default:
 		if err = rc.Default(c, n, resp, buf); err != nil {
 			return nil, err
 		}
 	}
-	GlobalStats.TotalRequests.WithLabelValues().Inc()
+	if !rc.DryRun {
+		GlobalStats.TotalRequests.WithLabelValues().Inc()
+	}
 	_, _ = c.Discard(buf.ReadSize())
 	return resp, nil
 }
 
+// fragmentsIncr counts the request split by slot, unless it is only explained
+func (rc *CRespCodec) fragmentsIncr(cmd codec.Command) {
+	if !rc.DryRun {
+		GlobalStats.FragmentsIncr(cmd)
+	}
+}
+
 func (rc *CRespCodec) Frag1(c CConn, n int, resp *Msg, buf *codec.Buffer) error {
+	if rc.tooManyKeys(n) {
+		return rc.skip(c, n, resp, buf)
+	}
 	resp.Frags = make(map[int32][]string, n)
 	for i := 0; i < n; i++ {
 		msg, err := rc.parseLine(buf)
@@ -136,6 +214,9 @@ func (rc *CRespCodec) Frag1(c CConn, n int, resp *Msg, buf *codec.Buffer) error
 }
 
 func (rc *CRespCodec) Frag2(c CConn, n int, resp *Msg, buf *codec.Buffer) error {
+	if rc.tooManyKeys(n / 2) {
+		return rc.skip(c, n, resp, buf)
+	}
 	resp.Frags2 = make(map[int32][][2]string, n/2)
 	for i := 0; i < n; i = i + 2 {
 		msg, err := rc.parseLine(buf)
@@ -152,6 +233,10 @@ func (rc *CRespCodec) Frag2(c CConn, n int, resp *Msg, buf *codec.Buffer) error
 			}
 			return err
 		}
+		// the keys of MSET are every other argument, the rest are values
+		if rc.MaxValueSize > 0 && len(val) > rc.MaxValueSize {
+			resp.Type = codec.ReqValueTooLarge
+		}
 
 		seg := string(msg)
 		seg2 := string(val)
@@ -167,6 +252,20 @@ func (rc *CRespCodec) Frag2(c CConn, n int, resp *Msg, buf *codec.Buffer) error
 	return nil
 }
 
+// skip consumes the arguments of a request rejected with too many keys, no frag is created
+func (rc *CRespCodec) skip(c CConn, n int, resp *Msg, buf *codec.Buffer) error {
+	resp.Type = codec.ReqTooManyKeys
+	for i := 0; i < n; i++ {
+		if _, err := rc.parseLine(buf); err != nil {
+			if err == codec.ErrInvalidResp {
+				logging.Warnf("[%dm][%dc] unexpect resp, buf: %s", resp.Id, c.Fd(), utils.FormatRedisRESPMessages(buf.PeekAll()))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
 func (rc *CRespCodec) Eval(c CConn, n int, resp *Msg, buf *codec.Buffer) error {
 	if n < 3 {
 		resp.Type = codec.ReqWrongArgumentsNumber
@@ -190,13 +289,63 @@ func (rc *CRespCodec) Eval(c CConn, n int, resp *Msg, buf *codec.Buffer) error {
 	frag.Key = key
 	frag.Peer = resp
 	frag.Req = append(frag.Req[:0], buf.ReadBuf()...)
-	resp.Body[slot] = frag
+	resp.SetFrag(slot, frag)
+	return nil
+}
+
+// SameSlot routes a request whose arguments are all keys by the first one, the keys must hash to the same slot
+// as redis cluster requires, otherwise the request is rejected with CROSSSLOT and no frag is created
+func (rc *CRespCodec) SameSlot(c CConn, n int, resp *Msg, buf *codec.Buffer) error {
+	var key string
+	var slot int32
+	for i := 0; i < n; i++ {
+		msg, err := rc.parseLine(buf)
+		if err != nil {
+			if err == codec.ErrInvalidResp {
+				logging.Warnf("[%dm][%dc] unexpect resp, buf: %s", resp.Id, c.Fd(), utils.FormatRedisRESPMessages(buf.PeekAll()))
+			}
+			return err
+		}
+		if i == 0 {
+			key = string(msg)
+			slot = hashkit.Hash(key)
+		} else if hashkit.Hash(string(msg)) != slot {
+			resp.Type = codec.ReqCrossSlot
+		}
+	}
+	if resp.Type == codec.ReqCrossSlot {
+		return nil
+	}
+	frag := FragPool.Get()
+	frag.Key = key
+	frag.Peer = resp
+	frag.Req = append(frag.Req[:0], buf.ReadBuf()...)
+	resp.SetFrag(slot, frag)
+	return nil
+}
+
+// Args collects the arguments of a command answered by the proxy itself,
+// no frag is created because nothing is forwarded to redis
+func (rc *CRespCodec) Args(c CConn, n int, resp *Msg, buf *codec.Buffer) error {
+	for i := 0; i < n; i++ {
+		msg, err := rc.parseLine(buf)
+		if err != nil {
+			if err == codec.ErrInvalidResp {
+				logging.Warnf("[%dm][%dc] unexpect resp, buf: %s", resp.Id, c.Fd(), utils.FormatRedisRESPMessages(buf.PeekAll()))
+			}
+			return err
+		}
+		resp.Args = append(resp.Args, string(msg))
+	}
 	return nil
 }
 
 func (rc *CRespCodec) Default(c CConn, n int, resp *Msg, buf *codec.Buffer) error {
 	var key string
 	var slot int32
+	// the arguments are only collected, without copy, if a value may be too large
+	var args []string
+	var large bool
 	for i := 0; i < n; i++ {
 		msg, err := rc.parseLine(buf)
 		if err != nil {
@@ -209,23 +358,32 @@ func (rc *CRespCodec) Default(c CConn, n int, resp *Msg, buf *codec.Buffer) erro
 			key = string(msg)
 			slot = hashkit.Hash(key)
 		}
+		if rc.MaxValueSize > 0 && codec.WriteCommands[resp.Type] {
+			args = append(args, utils.B2S(msg))
+			large = large || len(msg) > rc.MaxValueSize
+		}
+	}
+	if large && rc.valueTooLarge(resp.Type, args) {
+		resp.Type = codec.ReqValueTooLarge
 	}
 	frag := FragPool.Get()
 	frag.Key = key
 	frag.Peer = resp
 	frag.Req = append(frag.Req[:0], buf.ReadBuf()...)
-	resp.Body[slot] = frag
+	resp.SetFrag(slot, frag)
 	return nil
 }
 
 func (rc *CRespCodec) MGet(resp *Msg) {
+	resp.growBody(len(resp.Frags))
 	for slot, keys := range resp.Frags {
 		frag := FragPool.Get()
 		frag.Key = keys[0]
 		frag.Peer = resp
 		frag.Req = append(frag.Req, '*')
 		frag.Req = append(frag.Req, strconv.Itoa(len(keys)+1)...)
-		frag.Req = append(frag.Req, "\r\n$4\r\nmget\r\n"...)
+		frag.Req = append(frag.Req, codec.LFCRByte...)
+		frag.Req = rc.appendCommand(frag.Req, codec.ReqMget)
 		for _, k := range keys {
 			frag.Req = append(frag.Req, '$')
 			frag.Req = append(frag.Req, strconv.Itoa(len(k))...)
@@ -233,18 +391,20 @@ func (rc *CRespCodec) MGet(resp *Msg) {
 			frag.Req = append(frag.Req, k...)
 			frag.Req = append(frag.Req, codec.LFCRByte...)
 		}
-		resp.Body[slot] = frag
+		resp.SetFrag(slot, frag)
 	}
 }
 
 func (rc *CRespCodec) Del(resp *Msg) {
+	resp.growBody(len(resp.Frags))
 	for slot, keys := range resp.Frags {
 		frag := FragPool.Get()
 		frag.Key = keys[0]
 		frag.Peer = resp
 		frag.Req = append(frag.Req, '*')
 		frag.Req = append(frag.Req, strconv.Itoa(len(keys)+1)...)
-		frag.Req = append(frag.Req, "\r\n$3\r\ndel\r\n"...)
+		frag.Req = append(frag.Req, codec.LFCRByte...)
+		frag.Req = rc.appendCommand(frag.Req, codec.ReqDel)
 		for _, k := range keys {
 			frag.Req = append(frag.Req, '$')
 			frag.Req = append(frag.Req, strconv.Itoa(len(k))...)
@@ -252,18 +412,43 @@ func (rc *CRespCodec) Del(resp *Msg) {
 			frag.Req = append(frag.Req, k...)
 			frag.Req = append(frag.Req, codec.LFCRByte...)
 		}
-		resp.Body[slot] = frag
+		resp.SetFrag(slot, frag)
+	}
+}
+
+// Split builds one request of the same command per slot of the keys, it is the generalization of MGet
+// for the commands whose arguments are all keys and whose replies are merged by SRespCodec.Merge
+func (rc *CRespCodec) Split(resp *Msg) {
+	resp.growBody(len(resp.Frags))
+	for slot, keys := range resp.Frags {
+		frag := FragPool.Get()
+		frag.Key = keys[0]
+		frag.Peer = resp
+		frag.Req = append(frag.Req, '*')
+		frag.Req = append(frag.Req, strconv.Itoa(len(keys)+1)...)
+		frag.Req = append(frag.Req, codec.LFCRByte...)
+		frag.Req = rc.appendCommand(frag.Req, resp.Type)
+		for _, k := range keys {
+			frag.Req = append(frag.Req, '$')
+			frag.Req = append(frag.Req, strconv.Itoa(len(k))...)
+			frag.Req = append(frag.Req, codec.LFCRByte...)
+			frag.Req = append(frag.Req, k...)
+			frag.Req = append(frag.Req, codec.LFCRByte...)
+		}
+		resp.SetFrag(slot, frag)
 	}
 }
 
 func (rc *CRespCodec) MSet(resp *Msg) {
+	resp.growBody(len(resp.Frags2))
 	for slot, keys := range resp.Frags2 {
 		frag := FragPool.Get()
 		frag.Key = keys[0][0]
 		frag.Peer = resp
 		frag.Req = append(frag.Req, '*')
 		frag.Req = append(frag.Req, strconv.Itoa(len(keys)*2+1)...)
-		frag.Req = append(frag.Req, "\r\n$4\r\nmset\r\n"...)
+		frag.Req = append(frag.Req, codec.LFCRByte...)
+		frag.Req = rc.appendCommand(frag.Req, codec.ReqMset)
 		for _, ks := range keys {
 			for _, k := range ks {
 				frag.Req = append(frag.Req, '$')
@@ -273,10 +458,23 @@ func (rc *CRespCodec) MSet(resp *Msg) {
 				frag.Req = append(frag.Req, codec.LFCRByte...)
 			}
 		}
-		resp.Body[slot] = frag
+		resp.SetFrag(slot, frag)
 	}
 }
 
+// appendCommand appends the command name as a bulk string, in the case of CommandCase
+func (rc *CRespCodec) appendCommand(req []byte, command codec.Command) []byte {
+	name := codec.Transform2Str(command)
+	if rc.CommandCase == CommandCaseUpper {
+		name = strings.ToUpper(name)
+	}
+	req = append(req, '$')
+	req = append(req, strconv.Itoa(len(name))...)
+	req = append(req, codec.LFCRByte...)
+	req = append(req, name...)
+	return append(req, codec.LFCRByte...)
+}
+
 func (rc *CRespCodec) parseLine(buf *codec.Buffer) ([]byte, error) {
 	line, err := buf.ReadLine()
 	if err != nil {
@@ -288,6 +486,10 @@ func (rc *CRespCodec) parseLine(buf *codec.Buffer) ([]byte, error) {
 		if n < 0 || err != nil {
 			return nil, err
 		}
+		// reject by the declared length, rather than buffering the whole payload first
+		if rc.sizeTooLarge(n) {
+			return nil, codec.ErrReqTooLarge
+		}
 		b, err := buf.ReadN(n)
 		if err != nil {
 			return nil, err
@@ -306,6 +508,29 @@ func (rc *CRespCodec) parseLine(buf *codec.Buffer) ([]byte, error) {
 	}
 }
 
+func (rc *CRespCodec) tooManyKeys(keys int) bool {
+	return rc.MaxKeys > 0 && keys > rc.MaxKeys
+}
+
+// valueTooLarge whether an argument of the write command, other than its keys given by codec.Keys,
+// is a value longer than MaxValueSize. The script of EVAL and the function of FCALL are no value.
+func (rc *CRespCodec) valueTooLarge(command codec.Command, args []string) bool {
+	if command >= codec.ReqEval {
+		return false
+	}
+	keys := codec.KeyIndexes(command, args)
+	for i, arg := range args {
+		if len(keys) > 0 && keys[0] == i {
+			keys = keys[1:]
+			continue
+		}
+		if len(arg) > rc.MaxValueSize {
+			return true
+		}
+	}
+	return false
+}
+
 func (rc *CRespCodec) sizeTooLarge(size int) bool {
 	if size > rc.MsgMaxLength {
 		return true
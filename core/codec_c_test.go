@@ -17,6 +17,7 @@ package core
 import (
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"rcproxy/core/codec"
@@ -68,7 +69,7 @@ func TestSDecode(t *testing.T) {
 		cResp, err := r.Decode(c)
 		assert.Equal(t, nil, err, "assert err, input: %s", v.Input)
 		assert.Equal(t, v.Expect.Type, cResp.Type, "assert type, expect [%s], got [%s], input: %s", codec.Transform2Str(v.Expect.Type), codec.Transform2Str(cResp.Type), v.Input)
-		assert.Equal(t, len(v.Expect.Body), len(cResp.Body), "assert len, input: %s", v.Input)
+		assert.Equal(t, len(v.Expect.Body), cResp.NumFrags(), "assert len, input: %s", v.Input)
 
 		for _, k := range v.Keys {
 			slot := hashkit.Hash(k)
@@ -81,8 +82,8 @@ func TestSDecode(t *testing.T) {
 
 func initGnetService() {
 	s := Engine{
-		cCodec: CRespCodec{10000},
-		sCodec: SRespCodec{10000},
+		cCodec: CRespCodec{MsgMaxLength: 10000},
+		sCodec: SRespCodec{MsgMaxLength: 10000},
 	}
 	EngineGlobal = &s
 }
@@ -121,13 +122,13 @@ func TestSDecodeMget(t *testing.T) {
 		assert.Equal(t, nil, err, "assert err, input: %s", v.Input)
 		assert.Equal(t, v.Expect.Type, cResp.Type, "assert type, expect [%s], got [%s], input: %s", codec.Transform2Str(v.Expect.Type), codec.Transform2Str(cResp.Type), v.Input)
 		assert.Equal(t, len(v.Expect.Keys), len(cResp.Keys), "assert keys, input: %s", v.Input)
-		assert.Equal(t, len(v.Expect.Body), len(cResp.Body), "assert len, input: %s", v.Input)
+		assert.Equal(t, len(v.Expect.Body), cResp.NumFrags(), "assert len, input: %s", v.Input)
 
 		for _, k := range v.Keys {
 			slot := hashkit.Hash(k)
 			_, ok := v.Expect.Body[slot]
 			assert.Equal(t, true, ok, "assert slot, input: %s", v.Input)
-			assert.Equal(t, v.Expect.Body[slot].Req, cResp.Body[slot].Req, "assert body.req, input: %s", v.Input)
+			assert.Equal(t, v.Expect.Body[slot].Req, cResp.SlotFrag(slot).Req, "assert body.req, input: %s", v.Input)
 			assert.Equal(t, v.Expect.Frags[slot], cResp.Frags[slot], "assert frags, slot: %d, input: %s", slot, v.Input)
 		}
 	}
@@ -167,13 +168,13 @@ func TestSDecodeDel(t *testing.T) {
 		assert.Equal(t, nil, err, "assert err, input: %s", v.Input)
 		assert.Equal(t, v.Expect.Type, cResp.Type, "assert type, expect [%s], got [%s], input: %s", codec.Transform2Str(v.Expect.Type), codec.Transform2Str(cResp.Type), v.Input)
 		assert.Equal(t, len(v.Expect.Keys), len(cResp.Keys), "assert keys, input: %s", v.Input)
-		assert.Equal(t, len(v.Expect.Body), len(cResp.Body), "assert len, input: %s", v.Input)
+		assert.Equal(t, len(v.Expect.Body), cResp.NumFrags(), "assert len, input: %s", v.Input)
 
 		for _, k := range v.Keys {
 			slot := hashkit.Hash(k)
 			_, ok := v.Expect.Body[slot]
 			assert.Equal(t, true, ok, "assert slot, input: %s", v.Input)
-			assert.Equal(t, v.Expect.Body[slot].Req, cResp.Body[slot].Req, "assert body.req, input: %s", v.Input)
+			assert.Equal(t, v.Expect.Body[slot].Req, cResp.SlotFrag(slot).Req, "assert body.req, input: %s", v.Input)
 			assert.Equal(t, v.Expect.Frags[slot], cResp.Frags[slot], "assert frags, slot: %d, input: %s", slot, v.Input)
 		}
 	}
@@ -212,14 +213,203 @@ func TestSDecodeMset(t *testing.T) {
 		assert.Equal(t, nil, err, "assert err, input: %s", v.Input)
 		assert.Equal(t, v.Expect.Type, cResp.Type, "assert type, expect [%s], got [%s], input: %s", codec.Transform2Str(v.Expect.Type), codec.Transform2Str(cResp.Type), v.Input)
 		assert.Equal(t, len(v.Expect.Keys), len(cResp.Keys), "assert keys, input: %s", v.Input)
-		assert.Equal(t, len(v.Expect.Body), len(cResp.Body), "assert body len, input: %s", v.Input)
+		assert.Equal(t, len(v.Expect.Body), cResp.NumFrags(), "assert body len, input: %s", v.Input)
 
 		for _, k := range v.Keys {
 			slot := hashkit.Hash(k)
 			_, ok := v.Expect.Body[slot]
 			assert.Equal(t, true, ok, "assert slot, input: %s", v.Input)
-			assert.Equal(t, v.Expect.Body[slot].Req, cResp.Body[slot].Req, "assert body.req, input: %s", v.Input)
+			assert.Equal(t, v.Expect.Body[slot].Req, cResp.SlotFrag(slot).Req, "assert body.req, input: %s", v.Input)
 			assert.Equal(t, v.Expect.Frags[slot], cResp.Frags[slot], "assert frags, slot: %d, input: %s", slot, v.Input)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestCDecodeTooLargeBulk(t *testing.T) {
+	c := new(mockedConn)
+	c.On("Fd").Return(1)
+	c.On("Peek").Return(utils.S2B("*2\r\n$3\r\nget\r\n$2000000000\r\n"))
+
+	r := &CRespCodec{MsgMaxLength: 1024}
+	_, err := r.Decode(c)
+	assert.Equal(t, codec.ErrReqTooLarge, err)
+}
+
+func TestCDecodeCommandCase(t *testing.T) {
+	var cases = []struct {
+		Input string
+		Lower string
+		Upper string
+	}{
+		// copied as is
+		{Input: "*2\r\n$3\r\nGet\r\n$1\r\na\r\n",
+			Lower: "*2\r\n$3\r\nget\r\n$1\r\na\r\n", Upper: "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"},
+		// rewritten per slot
+		{Input: "*3\r\n$4\r\nMget\r\n$4\r\n{a}x\r\n$4\r\n{a}y\r\n",
+			Lower: "*3\r\n$4\r\nmget\r\n$4\r\n{a}x\r\n$4\r\n{a}y\r\n", Upper: "*3\r\n$4\r\nMGET\r\n$4\r\n{a}x\r\n$4\r\n{a}y\r\n"},
+		{Input: "*2\r\n$3\r\ndEl\r\n$1\r\na\r\n",
+			Lower: "*2\r\n$3\r\ndel\r\n$1\r\na\r\n", Upper: "*2\r\n$3\r\nDEL\r\n$1\r\na\r\n"},
+		{Input: "*3\r\n$4\r\nmSet\r\n$1\r\na\r\n$1\r\n1\r\n",
+			Lower: "*3\r\n$4\r\nmset\r\n$1\r\na\r\n$1\r\n1\r\n", Upper: "*3\r\n$4\r\nMSET\r\n$1\r\na\r\n$1\r\n1\r\n"},
+	}
+
+	for _, v := range cases {
+		for commandCase, expect := range map[string]string{"": v.Lower, CommandCaseLower: v.Lower, CommandCaseUpper: v.Upper} {
+			c := new(mockedConn)
+			c.On("Fd").Return(1)
+			c.On("Peek").Return([]byte(v.Input))
+
+			r := &CRespCodec{MsgMaxLength: 1024, CommandCase: commandCase}
+			cResp, err := r.Decode(c)
+			assert.Nil(t, err, "input: %q", v.Input)
+			if assert.Equal(t, 1, cResp.NumFrags(), "input: %q", v.Input) {
+				cResp.RangeFrags(func(_ int32, frag *Frag) bool {
+					assert.Equal(t, expect, string(frag.Req), "input: %q, case: %q", v.Input, commandCase)
+					return true
+				})
+			}
+		}
+	}
+}
+
+func TestCDecodeHello(t *testing.T) {
+	var cases = []struct {
+		Input string
+		Args  []string
+	}{
+		{Input: "*1\r\n$5\r\nhello\r\n", Args: nil},
+		{Input: "*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n", Args: []string{"3"}},
+		{Input: "*5\r\n$5\r\nhello\r\n$1\r\n3\r\n$4\r\nAUTH\r\n$4\r\nuser\r\n$4\r\npass\r\n", Args: []string{"3", "AUTH", "user", "pass"}},
+	}
+
+	for _, v := range cases {
+		c := new(mockedConn)
+		c.On("Peek").Return([]byte(v.Input))
+
+		r := &CRespCodec{MsgMaxLength: 1024}
+		cResp, err := r.Decode(c)
+		assert.Nil(t, err, "input: %s", v.Input)
+		assert.Equal(t, codec.ReqHello, cResp.Type, "input: %s", v.Input)
+		assert.Equal(t, len(v.Args), len(cResp.Args), "input: %s", v.Input)
+		for i := range v.Args {
+			assert.Equal(t, v.Args[i], cResp.Args[i], "input: %s", v.Input)
+		}
+		assert.Equal(t, 0, cResp.NumFrags(), "input: %s", v.Input)
+	}
+}
+
+func TestCDecodeSelect(t *testing.T) {
+	var cases = []struct {
+		Input string
+		Type  codec.Command
+		Args  []string
+	}{
+		{Input: "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n", Type: codec.ReqSelect, Args: []string{"0"}},
+		{Input: "*2\r\n$6\r\nselect\r\n$1\r\n1\r\n", Type: codec.ReqSelect, Args: []string{"1"}},
+		{Input: "*2\r\n$6\r\nselect\r\n$2\r\ndb\r\n", Type: codec.ReqSelect, Args: []string{"db"}},
+		{Input: "*3\r\n$6\r\nselect\r\n$1\r\n0\r\n$1\r\n1\r\n", Type: codec.ReqWrongArgumentsNumber},
+	}
+
+	for _, v := range cases {
+		c := new(mockedConn)
+		c.On("Peek").Return([]byte(v.Input))
+
+		r := &CRespCodec{MsgMaxLength: 1024}
+		cResp, err := r.Decode(c)
+		assert.Nil(t, err, "input: %q", v.Input)
+		assert.Equal(t, v.Type, cResp.Type, "input: %q", v.Input)
+		if v.Type == codec.ReqSelect {
+			assert.Equal(t, v.Args, cResp.Args, "input: %q", v.Input)
+			assert.Equal(t, 0, cResp.NumFrags(), "not routed to any slot, input: %q", v.Input)
+			assert.Nil(t, codec.Keys(cResp.Type, cResp.Args), "input: %q", v.Input)
+		}
+	}
+}
+
+func TestCDecodeParseErrors(t *testing.T) {
+	var cases = []struct {
+		Input string
+		Kind  string
+		Count float64
+	}{
+		{Input: "+OK\r\n", Kind: "invalid_resp", Count: 1},
+		{Input: "*2\r\n$3\r\nget\r\n+foo\r\n", Kind: "invalid_resp", Count: 1},
+		{Input: "*2\r\n$3\r\nget\r\n$1\r\nab\r\n", Kind: "invalid_resp", Count: 1},
+		{Input: "*2\r\n$3\nget\r\n$1\r\na\r\n", Kind: "cr_not_found", Count: 1},
+		// incomplete messages are not malformed
+		{Input: "*2\r\n$3\r\nget\r\n$1", Kind: "invalid_resp", Count: 0},
+		{Input: "*2\r\n$3\r\nget\r\n$1\r\na", Kind: "invalid_resp", Count: 0},
+	}
+
+	for _, v := range cases {
+		c := new(mockedConn)
+		c.On("Fd").Return(1)
+		c.On("Peek").Return(utils.S2B(v.Input))
+
+		counter := GlobalStats.ParseErrors.WithLabelValues("client", v.Kind)
+		before := testutil.ToFloat64(counter)
+		r := &CRespCodec{MsgMaxLength: 1024}
+		_, err := r.Decode(c)
+		assert.NotNil(t, err, "input: %q", v.Input)
+		assert.Equal(t, v.Count, testutil.ToFloat64(counter)-before, "input: %q", v.Input)
+	}
+}
+
+func TestCDecodeSingleFrag(t *testing.T) {
+	var cases = []struct {
+		Input  string
+		Single bool
+		Frags  int
+	}{
+		{Input: "*2\r\n$3\r\nget\r\n$3\r\nfoo\r\n", Single: true, Frags: 1},
+		{Input: "*3\r\n$4\r\nmget\r\n$6\r\n{a}foo\r\n$6\r\n{a}bar\r\n", Single: true, Frags: 1},
+		{Input: "*3\r\n$4\r\nmget\r\n$1\r\na\r\n$1\r\nb\r\n", Single: false, Frags: 2},
+		{Input: "*5\r\n$4\r\nmset\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n", Single: false, Frags: 2},
+		// the keys of a hash tag are co-located whatever the command
+		{Input: "*5\r\n$4\r\nmset\r\n$8\r\n{user}:a\r\n$1\r\n1\r\n$8\r\n{user}:b\r\n$1\r\n2\r\n", Single: true, Frags: 1},
+		{Input: "*3\r\n$3\r\ndel\r\n$8\r\n{user}:a\r\n$8\r\n{user}:b\r\n", Single: true, Frags: 1},
+		{Input: "*5\r\n$4\r\neval\r\n$1\r\ns\r\n$1\r\n2\r\n$8\r\n{user}:a\r\n$8\r\n{user}:b\r\n", Single: true, Frags: 1},
+		{Input: "*3\r\n$4\r\nmget\r\n$5\r\n{}key\r\n$5\r\n{}yek\r\n", Single: false, Frags: 2},
+	}
+
+	for _, v := range cases {
+		c := new(mockedConn)
+		c.On("Peek").Return([]byte(v.Input))
+
+		r := &CRespCodec{MsgMaxLength: 1024}
+		cResp, err := r.Decode(c)
+		assert.Nil(t, err, "input: %q", v.Input)
+		assert.Equal(t, v.Single, cResp.Single, "input: %q", v.Input)
+		assert.Equal(t, v.Frags, cResp.NumFrags(), "input: %q", v.Input)
+		if v.Single {
+			assert.Nil(t, cResp.Body, "input: %q", v.Input)
+			assert.Equal(t, cResp.Frag, cResp.SlotFrag(cResp.FragSlot), "input: %q", v.Input)
+		} else {
+			assert.Equal(t, v.Frags, len(cResp.Body), "input: %q", v.Input)
+		}
+		assert.Nil(t, cResp.Fd2Slot, "allocated on a redirection only, input: %q", v.Input)
+	}
+}
+
+// peekConn returns the same request on every Peek, without the bookkeeping of the mock
+type peekConn struct {
+	mockedConn
+	buf []byte
+}
+
+func (c *peekConn) Peek(_ int) ([]byte, error) { return c.buf, nil }
+
+func BenchmarkCDecodeGet(b *testing.B) {
+	c := &peekConn{buf: []byte("*2\r\n$3\r\nget\r\n$10\r\nuser:10086\r\n")}
+	r := &CRespCodec{MsgMaxLength: 1024}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg, err := r.Decode(c)
+		if err != nil {
+			b.Fatal(err)
+		}
+		MsgPool.Put(msg)
+	}
+}
@@ -16,6 +16,7 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
 	"strconv"
 	"strings"
@@ -34,6 +35,9 @@ var ShortcutOK = map[int8]string{
 
 type SRespCodec struct {
 	MsgMaxLength int
+	// MaxReplyElements caps the elements of an array reply, counted
+	// across nested arrays, 0 means unlimited
+	MaxReplyElements int
 }
 
 // When a connection to redis is established, there may be two initialization steps
@@ -77,7 +81,23 @@ func (rc *SRespCodec) InitializingDecode(s SConn) error {
 		return errors.ErrIncompletePacket
 	}
 
-	return nil
+	// a step was refused, the connection is closed once the refusal is read, see refuseInit
+	if _, ok := initRefusal(buf.PeekAll()); !ok {
+		return errors.ErrIncompletePacket
+	}
+	return codec.ErrInitializeRefused
+}
+
+// initRefusal returns the reply of the first init step redis didn't answer with OK, false if not read yet
+func initRefusal(bs []byte) ([]byte, bool) {
+	for strings.HasPrefix(utils.B2S(bs), codec.OK.String()) {
+		bs = bs[codec.OK.Len():]
+	}
+	i := bytes.IndexByte(bs, '\n')
+	if i < 0 {
+		return nil, false
+	}
+	return bs[:i+1], true
 }
 
 func (rc *SRespCodec) Decode(s SConn) (*Frag, error) {
@@ -87,15 +107,20 @@ func (rc *SRespCodec) Decode(s SConn) (*Frag, error) {
 		return nil, errors.ErrIncompletePacket
 	}
 
-	rType, err := rc.readReply(buf)
+	var elements int
+	rType, err := rc.readReply(buf, &elements)
+	if err == codec.ErrReplyTooManyElements {
+		return rc.tooManyElements(s, elements)
+	}
 	if err != nil {
+		GlobalStats.ParseErrorIncr("server", err)
 		return nil, err
 	}
 
 	f := s.DequeueInFrag()
 	if f == nil {
 		logging.Errorf("[%ds] empty inFragQueue, rsp: %s", s.Fd(), utils.FormatRedisRESPMessages(buf.PeekAll()))
-		return nil, codec.ErrUnKnown
+		return nil, codec.ErrBackendDesync
 	}
 
 	f.Type = rType
@@ -108,7 +133,25 @@ func (rc *SRespCodec) Decode(s SConn) (*Frag, error) {
 	return f, nil
 }
 
-func (rc *SRespCodec) readReply(buf *codec.Buffer) (codec.Command, error) {
+// tooManyElements fails the pending frag of an array reply over MaxReplyElements,
+// the reply is not read to its end so the connection has to be recycled.
+func (rc *SRespCodec) tooManyElements(s SConn, elements int) (*Frag, error) {
+	f := s.DequeueInFrag()
+	if f == nil {
+		logging.Errorf("[%ds] empty inFragQueue, rsp of %d elements", s.Fd(), elements)
+		return nil, codec.ErrBackendDesync
+	}
+	logging.Warnf("[%dm|%df][%dc|%ds] rsp has more than %d elements, req: %s", f.MsgId(), f.Id, f.OwnerFd(), s.Fd(), rc.MaxReplyElements, f.ReqString())
+
+	f.Type = codec.RspError
+	f.Error = codec.ErrMsgRspTooManyElements
+	f.RspBody = append(f.RspBody[:0], f.Error.Bytes()...)
+	return f, codec.ErrReplyTooManyElements
+}
+
+// readReply reads a whole reply, elements counts the array elements read so far
+// and the read aborts as soon as it goes over MaxReplyElements.
+func (rc *SRespCodec) readReply(buf *codec.Buffer, elements *int) (codec.Command, error) {
 	line, err := buf.ReadLine()
 	if err != nil {
 		return codec.UNKNOWN, err
@@ -168,13 +211,20 @@ func (rc *SRespCodec) readReply(buf *codec.Buffer) (codec.Command, error) {
 		if n < 0 || err != nil {
 			return codec.UNKNOWN, err
 		}
+		*elements += n
+		if rc.MaxReplyElements > 0 && *elements > rc.MaxReplyElements {
+			return codec.UNKNOWN, codec.ErrReplyTooManyElements
+		}
 		for i := 0; i < n; i++ {
-			_, err := rc.readReply(buf)
+			_, err := rc.readReply(buf, elements)
 			if err != nil {
 				return codec.UNKNOWN, err
 			}
 		}
 		return codec.RspMultibulk, nil
+	case '%', '~', '>', '_', ',', '#', '(', '=', '!', '|':
+		// map, set, push, null, double, boolean, big number, verbatim string, blob error, attribute
+		return codec.UNKNOWN, codec.ErrResp3
 	}
 	return codec.UNKNOWN, codec.ErrInvalidResp
 }
@@ -188,7 +238,7 @@ func (rc *SRespCodec) MGet(f *Frag, sfd int) error {
 		return nil
 	}
 
-	if f.Peer.FragDoneNumber < len(f.Peer.Body) {
+	if f.Peer.FragDoneNumber < f.Peer.NumFrags() {
 		logging.Debugf("[%dm|%df][%dc|%ds] mget frag done %d, waiting for other frags", f.MsgId(), f.Id, f.OwnerFd(), sfd, f.Peer.FragDoneNumber)
 		return codec.Continue
 	}
@@ -204,7 +254,7 @@ func (rc *SRespCodec) MGet(f *Frag, sfd int) error {
 		slot := hashkit.Hash(k)
 		for i, v := range msg.Frags[slot] {
 			if v == k {
-				msg.RspBody = append(msg.RspBody, msg.Body[slot].Rsp[i]...)
+				msg.RspBody = append(msg.RspBody, msg.SlotFrag(slot).Rsp[i]...)
 				break
 			}
 		}
@@ -226,7 +276,7 @@ func (rc *SRespCodec) MSet(f *Frag, sfd int) error {
 		logging.Warnf("unknown mset error, msg: %+v", f)
 	}
 
-	if f.Peer.FragDoneNumber < len(f.Peer.Body) {
+	if f.Peer.FragDoneNumber < f.Peer.NumFrags() {
 		logging.Debugf("[%dm|%df][%dc|%ds] mset frag done %d, waiting for other frags", f.MsgId(), f.Id, f.OwnerFd(), sfd, f.Peer.FragDoneNumber)
 		return codec.Continue
 	}
@@ -234,12 +284,10 @@ func (rc *SRespCodec) MSet(f *Frag, sfd int) error {
 
 	msg := f.Peer
 	msg.Done = true
-	for _, v := range msg.Body {
-		if !v.Ok {
-			logging.Warnf("unknown mset error, msg: %+v", msg)
-			msg.RspBody = append(msg.RspBody[:0], codec.ErrUnKnown.Bytes()...)
-			return nil
-		}
+	if failed := msg.failedFrag(); failed != nil {
+		logging.Warnf("unknown mset error, msg: %+v", msg)
+		msg.RspBody = append(msg.RspBody[:0], codec.ErrUnKnown.Bytes()...)
+		return nil
 	}
 	msg.RspBody = append(msg.RspBody[:0], codec.OK...)
 	return nil
@@ -251,7 +299,7 @@ func (rc *SRespCodec) Del(f *Frag, sfd int) error {
 	f.Peer.DelNum += n
 	f.Done = true
 
-	if f.Peer.FragDoneNumber < len(f.Peer.Body) {
+	if f.Peer.FragDoneNumber < f.Peer.NumFrags() {
 		logging.Debugf("[%dm|%df][%dc|%ds] del frag done %d, waiting for other frags", f.MsgId(), f.Id, f.OwnerFd(), sfd, f.Peer.FragDoneNumber)
 		return codec.Continue
 	}
@@ -263,6 +311,120 @@ func (rc *SRespCodec) Del(f *Frag, sfd int) error {
 	return nil
 }
 
+// Broadcast merges the replies of a command sent to every master, which answer alike, such as +OK
+// or the library name of FUNCTION LOAD, otherwise the error reply of a node
+func (rc *SRespCodec) Broadcast(f *Frag, sfd int) error {
+	f.Ok = len(f.RspBody) > 0 && f.RspBody[0] != '-'
+	f.Done = true
+
+	if f.Peer.FragDoneNumber < f.Peer.NumFrags() {
+		logging.Debugf("[%dm|%df][%dc|%ds] broadcast frag done %d, waiting for other frags", f.MsgId(), f.Id, f.OwnerFd(), sfd, f.Peer.FragDoneNumber)
+		return codec.Continue
+	}
+	logging.Debugf("[%dm|%df][%dc|%ds] all broadcast frag done %d, prepare to reply client", f.MsgId(), f.Id, f.OwnerFd(), sfd, f.Peer.FragDoneNumber)
+
+	msg := f.Peer
+	msg.Done = true
+	if failed := msg.failedFrag(); failed != nil {
+		msg.RspBody = append(msg.RspBody[:0], failed.RspBody...)
+		return nil
+	}
+	msg.RspBody = append(msg.RspBody[:0], f.RspBody...)
+	return nil
+}
+
+// Merge merges the replies of SUNION and SINTER split by slot, the union or the intersection of the members.
+// A request not split is answered as is, an error reply of any frag is the reply of the request
+func (rc *SRespCodec) Merge(f *Frag, sfd int) error {
+	if f.Peer.NumFrags() < 2 {
+		return rc.Default(f)
+	}
+	f.Ok = f.Type == codec.RspMultibulk
+	if f.Ok {
+		f.Rsp = rc.parseMGet(f)
+	}
+	f.Done = true
+
+	if f.Peer.FragDoneNumber < f.Peer.NumFrags() {
+		logging.Debugf("[%dm|%df][%dc|%ds] merge frag done %d, waiting for other frags", f.MsgId(), f.Id, f.OwnerFd(), sfd, f.Peer.FragDoneNumber)
+		return codec.Continue
+	}
+	logging.Debugf("[%dm|%df][%dc|%ds] all merge frag done %d, prepare to reply client", f.MsgId(), f.Id, f.OwnerFd(), sfd, f.Peer.FragDoneNumber)
+
+	msg := f.Peer
+	msg.Done = true
+	counts := make(map[string]int)
+	var members [][]byte
+	if failed := msg.failedFrag(); failed != nil {
+		msg.RspBody = append(msg.RspBody[:0], failed.RspBody...)
+		return nil
+	}
+	msg.RangeFrags(func(_ int32, v *Frag) bool {
+		for _, m := range v.Rsp {
+			if counts[string(m)] == 0 {
+				members = append(members, m)
+			}
+			counts[string(m)]++
+		}
+		return true
+	})
+
+	var n int
+	msg.RspBody = msg.RspBody[:0]
+	for _, m := range members {
+		if msg.Type == codec.ReqSinter && counts[string(m)] < msg.NumFrags() {
+			continue
+		}
+		msg.RspBody = append(msg.RspBody, m...)
+		n++
+	}
+	msg.RspBody = append([]byte(fmt.Sprintf("*%d\r\n", n)), msg.RspBody...)
+
+	if len(msg.RspBody) > rc.MsgMaxLength {
+		msg.Error = codec.ErrMsgRspTooLarge
+		msg.RspBody = append(msg.RspBody[:0], codec.ErrMsgRspTooLarge.Bytes()...)
+	}
+	return nil
+}
+
+// Scan replaces the cursor of the master in the reply of SCAN by the one handed to the client, which goes on
+// with the next master once the master is done, the keys are replied as they are
+func (rc *SRespCodec) Scan(f *Frag) error {
+	if f.Type != codec.RspMultibulk {
+		return rc.Default(f)
+	}
+	buf := codec.NewBuffer(f.RspBody)
+	_, _ = buf.ReadLine()
+	line, err := buf.ReadLine()
+	if err != nil || len(line) < 1 || line[0] != '$' {
+		return rc.Default(f)
+	}
+	n, _ := parseLen(line[1:])
+	cursor, err := buf.ReadN(n + 2)
+	if err != nil {
+		return rc.Default(f)
+	}
+	v, err := strconv.ParseUint(string(cursor[:n]), 10, 64)
+	if err != nil {
+		return rc.Default(f)
+	}
+
+	f.Done = true
+	msg := f.Peer
+	msg.Done = true
+	next, ok := msg.Scan.Next(v)
+	if !ok {
+		logging.Warnf("[%dm|%df][%dc] cursor %d of redis too large to scan through the proxy", f.MsgId(), f.Id, f.OwnerFd(), v)
+		msg.Error = codec.ErrScanCursorTooLarge
+		msg.RspBody = append(msg.RspBody[:0], codec.ErrScanCursorTooLarge.Bytes()...)
+		return nil
+	}
+	msg.RspBody = codec.AppendArrayLen(msg.RspBody[:0], 2)
+	msg.RspBody = codec.AppendBulkString(msg.RspBody, next)
+	msg.RspBody = append(msg.RspBody, f.RspBody[buf.ReadSize():]...)
+	return nil
+}
+
 func (rc *SRespCodec) Default(f *Frag) error {
 	f.Done = true
 	msg := f.Peer
@@ -276,15 +438,19 @@ func (rc *SRespCodec) Default(f *Frag) error {
 	return nil
 }
 
-func (rc *SRespCodec) parseMGet(f *Frag) []string {
+// parseMGet splits the multi-bulk reply of the frag into its elements, which are slices of RspBody rather than copies
+func (rc *SRespCodec) parseMGet(f *Frag) [][]byte {
 	buf := codec.NewBuffer(f.RspBody)
 
 	kLenBytes, _ := buf.ReadLine()
 	kLen, _ := parseLen(kLenBytes[1:])
-	var msg = make([]string, kLen)
-	msg = msg[:0]
+	msg := f.Rsp[:0]
+	if cap(msg) < kLen {
+		msg = make([][]byte, 0, kLen)
+	}
 
 	for {
+		start := buf.ReadSize()
 		line, err := buf.ReadLine()
 		if err == codec.EmptyLine {
 			return msg
@@ -292,14 +458,10 @@ func (rc *SRespCodec) parseMGet(f *Frag) []string {
 		if err != nil {
 			return nil
 		}
-		n, _ := parseLen(line[1:])
-		if n < 0 {
-			msg = append(msg, fmt.Sprintf("%s\r\n", line))
-			continue
+		if n, _ := parseLen(line[1:]); n >= 0 {
+			_, _ = buf.ReadN(n + 2)
 		}
-		v, _ := buf.ReadN(n)
-		_, _ = buf.ReadN(2)
-		msg = append(msg, fmt.Sprintf("%s\r\n%s\r\n", line, v))
+		msg = append(msg, f.RspBody[start:buf.ReadSize()])
 	}
 }
 
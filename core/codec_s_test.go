@@ -15,11 +15,18 @@
 package core
 
 import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"rcproxy/core/codec"
+	"rcproxy/core/pkg/hashkit"
+	"rcproxy/core/pkg/logging"
 	"rcproxy/core/pkg/utils"
 )
 
@@ -108,4 +115,303 @@ func TestCDecodeError(t *testing.T) {
 		_, err := r.Decode(c)
 		assert.Equal(t, v.Error, err, "assert error failed, input: %s", v.Input)
 	}
-}
\ No newline at end of file
+}
+
+// TestSDecodeConcurrent decoders on different goroutines must not share the parse buffer, run with -race
+func TestSDecodeConcurrent(t *testing.T) {
+	rc := &SRespCodec{MsgMaxLength: 1 << 20}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value := strings.Repeat(fmt.Sprint(i), 64*(i+1))
+			input := fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			for j := 0; j < 1000; j++ {
+				f := new(Frag)
+				s := new(mockedConn)
+				s.On("Peek").Return([]byte(input))
+				s.On("DequeueInFrag").Return(f)
+				s.On("Fd").Return(1)
+
+				got, err := rc.Decode(s)
+				if !assert.Nil(t, err) {
+					return
+				}
+				assert.Same(t, f, got)
+				assert.Equal(t, codec.RspBulk, got.Type)
+				if !assert.Equal(t, input, string(got.RspBody)) {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSDecodeParseErrors(t *testing.T) {
+	var cases = []struct {
+		Input string
+		Kind  string
+		Count float64
+	}{
+		{Input: "?foo\r\n", Kind: "invalid_resp", Count: 1},
+		{Input: "$1\r\nab\r\n", Kind: "invalid_resp", Count: 1},
+		{Input: "*2\r\n:1\r\n?\r\n", Kind: "invalid_resp", Count: 1},
+		{Input: "+OK\n", Kind: "cr_not_found", Count: 1},
+		// incomplete replies are not malformed
+		{Input: "+OK", Kind: "invalid_resp", Count: 0},
+		{Input: "$3\r\nfo", Kind: "invalid_resp", Count: 0},
+	}
+
+	for _, v := range cases {
+		s := new(mockedConn)
+		s.On("Fd").Return(1)
+		s.On("Peek").Return(utils.S2B(v.Input))
+
+		counter := GlobalStats.ParseErrors.WithLabelValues("server", v.Kind)
+		before := testutil.ToFloat64(counter)
+		r := &SRespCodec{MsgMaxLength: 1024}
+		_, err := r.Decode(s)
+		assert.NotNil(t, err, "input: %q", v.Input)
+		assert.Equal(t, v.Count, testutil.ToFloat64(counter)-before, "input: %q", v.Input)
+	}
+}
+
+func TestSDecodeResp3(t *testing.T) {
+	counter := GlobalStats.ParseErrors.WithLabelValues("server", "resp3")
+	for _, input := range []string{
+		"%1\r\n+foo\r\n:1\r\n",
+		"*2\r\n~1\r\n+a\r\n_\r\n",
+		">2\r\n+message\r\n+bar\r\n",
+		"#t\r\n",
+	} {
+		s := new(mockedConn)
+		s.On("Fd").Return(1)
+		s.On("Peek").Return(utils.S2B(input))
+
+		before := testutil.ToFloat64(counter)
+		r := &SRespCodec{MsgMaxLength: 1024}
+		_, err := r.Decode(s)
+		assert.Equal(t, codec.ErrResp3, err, "input: %q", input)
+		assert.Equal(t, 1.0, testutil.ToFloat64(counter)-before, "input: %q", input)
+	}
+}
+
+func TestSDecodeTooManyElements(t *testing.T) {
+	var cases = []struct {
+		Input string
+		Error error
+	}{
+		// the declared count is enough to abort, the elements are never waited for
+		{Input: "*100000000\r\n", Error: codec.ErrReplyTooManyElements},
+		// nested arrays count towards the limit
+		{Input: "*2\r\n*2\r\n:1\r\n:2\r\n*2\r\n:3\r\n:4\r\n", Error: codec.ErrReplyTooManyElements},
+		{Input: "*2\r\n*2\r\n:1\r\n:2\r\n:3\r\n", Error: nil},
+	}
+
+	for _, v := range cases {
+		f := new(Frag)
+		s := new(mockedConn)
+		s.On("Fd").Return(1)
+		s.On("Peek").Return(utils.S2B(v.Input))
+		s.On("DequeueInFrag").Return(f)
+
+		r := &SRespCodec{MsgMaxLength: 1024, MaxReplyElements: 5}
+		got, err := r.Decode(s)
+		assert.Equal(t, v.Error, err, "input: %q", v.Input)
+		assert.Same(t, f, got, "input: %q", v.Input)
+		if v.Error != nil {
+			assert.Equal(t, codec.ErrMsgRspTooManyElements, f.Error)
+			assert.Equal(t, codec.ErrMsgRspTooManyElements.String(), string(f.RspBody))
+		}
+	}
+}
+
+func TestSDecodeBroadcast(t *testing.T) {
+	var cases = []struct {
+		Rsp    []string
+		Expect string
+	}{
+		{Rsp: []string{"+OK\r\n", "+OK\r\n"}, Expect: "+OK\r\n"},
+		{Rsp: []string{"+OK\r\n", "-ERR DEBUG command not allowed\r\n"}, Expect: "-ERR DEBUG command not allowed\r\n"},
+		{Rsp: []string{"$5\r\nmylib\r\n", "$5\r\nmylib\r\n"}, Expect: "$5\r\nmylib\r\n"},
+		{Rsp: []string{"-ERR Library 'mylib' already exists\r\n", "$5\r\nmylib\r\n"}, Expect: "-ERR Library 'mylib' already exists\r\n"},
+	}
+
+	for _, v := range cases {
+		msg := &Msg{Type: codec.ReqDebug, Body: map[int32]*Frag{}}
+		for i := range v.Rsp {
+			msg.Body[int32(i)] = &Frag{Peer: msg}
+		}
+
+		r := new(SRespCodec)
+		for i, rsp := range v.Rsp {
+			s := new(mockedConn)
+			s.On("Peek").Return(utils.S2B(rsp))
+			s.On("Fd").Return(1)
+			s.On("DequeueInFrag").Return(msg.Body[int32(i)])
+			f, err := r.Decode(s)
+			assert.Nil(t, err)
+
+			msg.FragDoneNumber++
+			err = r.Broadcast(f, 1)
+			if i < len(v.Rsp)-1 {
+				assert.Equal(t, codec.Continue, err)
+				assert.False(t, msg.Done)
+			}
+		}
+		assert.True(t, msg.Done)
+		assert.Equal(t, v.Expect, string(msg.RspBody))
+	}
+}
+
+func TestSDecodeMerge(t *testing.T) {
+	var cases = []struct {
+		Type   codec.Command
+		Rsp    []string
+		Expect []string
+		Error  string
+	}{
+		{Type: codec.ReqSunion, Rsp: []string{"*2\r\n$1\r\na\r\n$1\r\nb\r\n", "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"}, Expect: []string{"a", "b", "c"}},
+		{Type: codec.ReqSinter, Rsp: []string{"*2\r\n$1\r\na\r\n$1\r\nb\r\n", "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"}, Expect: []string{"b"}},
+		{Type: codec.ReqSinter, Rsp: []string{"*1\r\n$1\r\na\r\n", "*0\r\n"}, Expect: []string{}},
+		{Type: codec.ReqSunion, Rsp: []string{"*1\r\n$1\r\na\r\n", "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+			Error: "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+	}
+
+	for _, v := range cases {
+		msg := &Msg{Type: v.Type, Body: map[int32]*Frag{}}
+		for i := range v.Rsp {
+			msg.Body[int32(i)] = &Frag{Peer: msg}
+		}
+
+		r := &SRespCodec{MsgMaxLength: 1024}
+		for i, rsp := range v.Rsp {
+			s := new(mockedConn)
+			s.On("Peek").Return(utils.S2B(rsp))
+			s.On("Fd").Return(1)
+			s.On("DequeueInFrag").Return(msg.Body[int32(i)])
+			f, err := r.Decode(s)
+			assert.Nil(t, err)
+
+			msg.FragDoneNumber++
+			err = r.Merge(f, 1)
+			if i < len(v.Rsp)-1 {
+				assert.Equal(t, codec.Continue, err)
+				assert.False(t, msg.Done)
+			}
+		}
+		assert.True(t, msg.Done)
+		if len(v.Error) > 0 {
+			assert.Equal(t, v.Error, string(msg.RspBody))
+			continue
+		}
+
+		// the members of different slots come in no particular order, like the reply of redis
+		members := make([]string, 0, len(v.Expect))
+		for _, m := range r.parseMGet(&Frag{RspBody: msg.RspBody}) {
+			members = append(members, string(m))
+		}
+		expect := make([]string, 0, len(v.Expect))
+		for _, m := range v.Expect {
+			expect = append(expect, fmt.Sprintf("$%d\r\n%s\r\n", len(m), m))
+		}
+		assert.ElementsMatch(t, expect, members, "rsp: %q", msg.RspBody)
+	}
+}
+
+// mgetReplied returns a MGET of the keys split by slot as CRespCodec.MGet does, each frag holding the reply of redis,
+// the value of a key is nil if value returns false
+func mgetReplied(keys []string, value func(k string) (string, bool)) *Msg {
+	msg := &Msg{Type: codec.ReqMget, Keys: keys, Frags: map[int32][]string{}, Body: map[int32]*Frag{}}
+	for _, k := range keys {
+		slot := hashkit.Hash(k)
+		msg.Frags[slot] = append(msg.Frags[slot], k)
+	}
+	for slot, ks := range msg.Frags {
+		rsp := fmt.Sprintf("*%d\r\n", len(ks))
+		for _, k := range ks {
+			if v, ok := value(k); ok {
+				rsp += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				rsp += "$-1\r\n"
+			}
+		}
+		msg.Body[slot] = &Frag{Peer: msg, Type: codec.RspMultibulk, RspBody: []byte(rsp)}
+	}
+	return msg
+}
+
+// replyMGet reassembles the reply of the MGET as its frags are done
+func replyMGet(r *SRespCodec, msg *Msg) (err error) {
+	msg.FragDoneNumber = 0
+	for _, f := range msg.Body {
+		msg.FragDoneNumber++
+		err = r.MGet(f, 1)
+	}
+	return err
+}
+
+func TestSDecodeScan(t *testing.T) {
+	var cases = []struct {
+		Scan   ScanCursor
+		Rsp    string
+		Expect string
+	}{
+		{Scan: ScanCursor{Nodes: 2, Epoch: 5}, Rsp: "*2\r\n$2\r\n17\r\n*1\r\n$1\r\na\r\n", Expect: "*2\r\n$8\r\n71308288\r\n*1\r\n$1\r\na\r\n"},
+		{Scan: ScanCursor{Nodes: 2, Epoch: 5, Cursor: 17}, Rsp: "*2\r\n$1\r\n0\r\n*0\r\n", Expect: "*2\r\n$4\r\n5121\r\n*0\r\n"},
+		{Scan: ScanCursor{Node: 1, Nodes: 2, Epoch: 5}, Rsp: "*2\r\n$1\r\n0\r\n*2\r\n$1\r\nb\r\n$1\r\nc\r\n", Expect: "*2\r\n$1\r\n0\r\n*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{Scan: ScanCursor{Nodes: 2}, Rsp: "*2\r\n$20\r\n18446744073709551615\r\n*0\r\n", Expect: codec.ErrScanCursorTooLarge.String()},
+		{Scan: ScanCursor{Nodes: 2}, Rsp: "-ERR unknown type\r\n", Expect: "-ERR unknown type\r\n"},
+	}
+
+	for _, v := range cases {
+		msg := &Msg{Type: codec.ReqScan, Scan: v.Scan}
+		msg.SetFrag(0, &Frag{Peer: msg})
+
+		r := &SRespCodec{MsgMaxLength: 1024}
+		s := new(mockedConn)
+		s.On("Peek").Return(utils.S2B(v.Rsp))
+		s.On("Fd").Return(1)
+		s.On("DequeueInFrag").Return(msg.SlotFrag(0))
+		f, err := r.Decode(s)
+		assert.Nil(t, err)
+
+		assert.Nil(t, r.Scan(f))
+		assert.True(t, msg.Done)
+		assert.Equal(t, v.Expect, string(msg.RspBody), "rsp: %q", v.Rsp)
+	}
+}
+
+func TestSDecodeMGet(t *testing.T) {
+	// a nil value, binary values, and a key asked twice
+	keys := []string{"a", "b", "c", "{a}x", "a"}
+	values := map[string]string{"a": "1", "c": "line\r\nbreak\r\n", "{a}x": "\x00\xff"}
+	msg := mgetReplied(keys, func(k string) (string, bool) {
+		v, ok := values[k]
+		return v, ok
+	})
+
+	r := &SRespCodec{MsgMaxLength: 1024}
+	assert.Nil(t, replyMGet(r, msg))
+	assert.True(t, msg.Done)
+	assert.Equal(t, "*5\r\n$1\r\n1\r\n$-1\r\n$13\r\nline\r\nbreak\r\n\r\n$2\r\n\x00\xff\r\n$1\r\n1\r\n", string(msg.RspBody))
+}
+
+func BenchmarkSDecodeMGet(b *testing.B) {
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+	msg := mgetReplied(keys, func(k string) (string, bool) { return "value-of-" + k, true })
+	r := &SRespCodec{MsgMaxLength: 1 << 20}
+	_ = logging.InitializeLogger(logging.WithWriter(ioutil.Discard), logging.WithLogLevel("ERROR"))
+	defer logging.Reset()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = replyMGet(r, msg)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"strconv"
+	"sync"
+)
+
+// flateWriters the writers are reused, each one allocates hundreds of KB
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// compressBulk compresses a bulk string reply whose payload is larger than threshold bytes into
+// &<length>\r\n<DEFLATE stream of the payload>\r\n, for the clients negotiated by PROXY COMPRESS.
+// The other replies, and the payloads not shrinking, are returned as they are.
+func compressBulk(rsp []byte, threshold int) []byte {
+	if len(rsp) <= threshold || rsp[0] != '$' {
+		return rsp
+	}
+	end := bytes.IndexByte(rsp, '\n')
+	if end < 2 || rsp[end-1] != '\r' {
+		return rsp
+	}
+	n, err := parseLen(rsp[1 : end-1])
+	// a single bulk string only, not a pipeline of replies
+	if err != nil || n <= threshold || end+1+n+2 != len(rsp) {
+		return rsp
+	}
+
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	_, _ = w.Write(rsp[end+1 : end+1+n])
+	_ = w.Close()
+	flateWriters.Put(w)
+	if buf.Len() >= n {
+		return rsp
+	}
+
+	out := make([]byte, 0, buf.Len()+24)
+	out = append(out, '&')
+	out = strconv.AppendInt(out, int64(buf.Len()), 10)
+	out = append(out, '\r', '\n')
+	out = append(out, buf.Bytes()...)
+	return append(out, '\r', '\n')
+}
@@ -24,8 +24,10 @@ import (
 	"io"
 	"net"
 	"os"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sys/unix"
 
 	"rcproxy/core/codec"
@@ -54,7 +56,28 @@ type conn struct {
 	inFragQueue  *FragQueue // queue of read redis messages
 	outFragQueue *FragQueue // queue of redis messages to be written
 
+	lastWrites map[int32]time.Time // time of the recent writes by slot, only tracked with read_your_writes
+	lastSweep  int                 // entries of lastWrites the next sweep of the expired writes waits for
+	inflight   prometheus.Gauge    // in-flight requests of the redis node, only for server connections
+
+	createdAt  time.Time // time the connection was established
+	cold       bool      // dialed by Pool.Get, the first frag sent may have waited for the dial, see ColdRequest
+	lastActive time.Time // time of the latest bytes read from the peer
+
 	opened     bool             // connection opened event fired
+	commanded  bool             // a complete command has been read from the client, see ClientHandshakeTimeout
+	requests   int              // complete commands read from the client
+	authed     bool             // whether the client has passed the AUTH command
+	quitting   bool             // QUIT arrived behind pipelined requests, close once their replies are delivered
+	quitReply  []byte           // reply of QUIT, written after the pipelined replies
+	proto      int              // protocol version negotiated by HELLO, 0 means RESP2
+	slowTicks  int              // consecutive ticks the outbound buffer of a client stayed above ClientSlowOutbound
+	deadline   int              // ms, timeout of the next request forwarded to redis, set by PROXY DEADLINE
+	compress   int              // bytes, bulk replies larger are compressed, set by PROXY COMPRESS, 0 disables
+	target     string           // node the next keyless command is sent to, set by PROXY TARGET
+	tag        string           // the reads go to the slave of the tag, set by PROXY TAG
+	libName    string           // client library reported by CLIENT SETINFO
+	libVer     string           // version of the client library reported by CLIENT SETINFO
 	isSlave    bool             // whether redis slave node
 	initStep   int8             // number of steps required for redis connection initialization
 	initStatus InitializeStatus // redis connection initialization status
@@ -75,12 +98,28 @@ func newTCPConn(fd int, el *eventloop, localAddr, remoteAddr net.Addr, connType
 		inFragQueue:  &FragQueue{},
 		outFragQueue: &FragQueue{},
 	}
+	c.createdAt = time.Now()
+	c.lastActive = c.createdAt
+	if connType == ConnServer {
+		c.inflight = GlobalStats.NodeInflight.WithLabelValues(c.RemoteAddr())
+	}
 	c.outboundBuffer, _ = elastic.New(el.engine.opts.WriteBufferCap)
+	c.outboundBuffer.OnSpill = c.outboundSpill
 	c.pollAttachment = netpoll.GetPollAttachment()
 	c.pollAttachment.FD, c.pollAttachment.Callback = fd, c.handleEvents
 	return
 }
 
+// outboundSpill counts the writes buffered beyond WriteBufferCap for a slow peer, a precursor to memory pressure
+func (c *conn) outboundSpill(n int) {
+	label := "client"
+	if c.connType == ConnServer {
+		label = "server"
+	}
+	GlobalStats.OutboundSpills.WithLabelValues(label).Inc()
+	GlobalStats.OutboundSpillBytes.WithLabelValues(label).Add(float64(n))
+}
+
 func (c *conn) releaseTCP() {
 	c.opened = false
 	c.buffer = nil
@@ -105,8 +144,29 @@ func (c *conn) releaseTCP() {
 
 	c.initStep = -1
 	c.initStatus = InitializeNone
+	c.authed = false
+	c.commanded = false
+	c.requests = 0
+	c.quitting = false
+	c.quitReply = nil
+	c.proto = 0
+	c.slowTicks = 0
+	c.deadline = 0
+	c.compress = 0
+	c.target = ""
+	c.tag = ""
+	c.libName = ""
+	c.libVer = ""
+	c.lastWrites = nil
+	c.lastSweep = 0
+	c.inflight = nil
 	c.isSlave = false
 	c.connType = ConnNone
+	// the requests of a closed client are dropped along with the queue
+	for m := c.inMsgQueue.head; m != nil; m = m.prev {
+		atomic.AddInt64(&bufferedBytes, -int64(m.held))
+		m.held = 0
+	}
 	c.inMsgQueue = nil
 	c.inFragQueue = nil
 	c.outFragQueue = nil
@@ -159,9 +219,21 @@ func (c *conn) sread() (f *Frag, err error) {
 		if err != nil {
 			return nil, err
 		}
+		// the frags held back by the init are written now
+		if c.outFragQueue.count > 0 {
+			if err = c.writeOutFrags(); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	f, err = EngineGlobal.sCodec.Decode(c)
+	if err == codec.ErrReplyTooManyElements && f.Owner != nil && f.Peer != nil && !f.Done {
+		// the rest of the reply is left unread, answer the request
+		// with the error and let the caller recycle the connection
+		f.failMsg()
+		return f, err
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -174,18 +246,25 @@ func (c *conn) sread() (f *Frag, err error) {
 		return f, nil
 	}
 
+	// a late reply, MOVED/ASK included, is dropped once its request was answered
+	if f.Done {
+		logging.Warnf("[%dm|%df][%dc|%ds] frag already done, req: %s, res: %s", f.MsgId(), f.Id, f.OwnerFd(), c.fd, f.ReqString(), f.RspBodyString())
+		if f.Peer.Acked {
+			return f, codec.Continue
+		}
+		return nil, codec.Continue
+	}
+
 	switch f.Type {
 	case codec.RspMoved, codec.RspAsk:
 		logging.Warnf("[%dm|%df][%dc|%ds] got res: %s", f.MsgId(), f.Id, f.OwnerFd(), c.fd, f.RspBodyString())
 		return f, codec.MovedOrAsk
 	}
 
-	if f.Done {
-		logging.Warnf("[%dm|%df][%dc|%ds] frag already done, req: %s, res: %s", f.MsgId(), f.Id, f.OwnerFd(), c.fd, f.ReqString(), f.RspBodyString())
-		return nil, codec.Continue
-	}
-
 	f.slowLogCheck(c)
+	if f.cold {
+		GlobalStats.ColdRequest.WithLabelValues().Observe(time.Since(f.Time).Seconds())
+	}
 
 	if EngineGlobal.sCodec.sizeTooLarge(len(f.RspBody)) {
 		f.Error = codec.ErrMsgRspTooLarge
@@ -201,26 +280,38 @@ func (c *conn) sread() (f *Frag, err error) {
 			err = EngineGlobal.sCodec.MSet(f, c.fd)
 		case codec.ReqDel:
 			err = EngineGlobal.sCodec.Del(f, c.fd)
+		case codec.ReqDebug, codec.ReqFunction:
+			err = EngineGlobal.sCodec.Broadcast(f, c.fd)
+		case codec.ReqSunion, codec.ReqSinter:
+			err = EngineGlobal.sCodec.Merge(f, c.fd)
+		case codec.ReqScan:
+			err = EngineGlobal.sCodec.Scan(f)
 		default:
 			err = EngineGlobal.sCodec.Default(f)
 		}
 	}
 
 	if f.Error.NotNil() {
-		msg := f.Peer
-		msg.Error = f.Error
-		msg.FragDoneNumber = len(msg.Body)
-		msg.RspBody = append(msg.RspBody[:0], msg.Error.Bytes()...)
-		msg.Done = true
-		for _, v := range msg.Body {
-			v.Done = true
-		}
+		f.failMsg()
 		return f, nil
 	}
 
 	return f, err
 }
 
+// failMsg answers the whole message of the frag with the frag error.
+func (f *Frag) failMsg() {
+	msg := f.Peer
+	msg.Error = f.Error
+	msg.FragDoneNumber = msg.NumFrags()
+	msg.RspBody = append(msg.RspBody[:0], msg.Error.Bytes()...)
+	msg.Done = true
+	msg.RangeFrags(func(_ int32, v *Frag) bool {
+		v.Done = true
+		return true
+	})
+}
+
 func (c *conn) cread() (*Msg, error) {
 	m, err := EngineGlobal.cCodec.Decode(c)
 	if err != nil {
@@ -324,6 +415,15 @@ func (c *conn) handleWriteSignal(_ interface{}) error {
 		return nil
 	}
 
+	// the frags wait for the AUTH/READONLY pipeline, their replies would be read as the init ones
+	if c.initStatus == Initializing {
+		return nil
+	}
+	return c.writeOutFrags()
+}
+
+// writeOutFrags moves the queued frags to inFragQueue and writes them to redis
+func (c *conn) writeOutFrags() error {
 	var curId uint64
 	var curFd = c.fd
 
@@ -370,8 +470,7 @@ func (c *conn) writeClusterNodes(_ interface{}) error {
 	frag := FragPool.Get()
 	frag.Req = append(frag.Req, constant.ReqClusterNodes...)
 
-	c.EnqueueOutFrag(frag)
-	return nil
+	return c.EnqueueOutFrag(frag)
 }
 
 // ================================== Non-concurrency-safe API's ==================================
@@ -526,25 +625,73 @@ func (c *conn) SetWriteDeadline(_ time.Time) error {
 	return errors.ErrUnsupportedOp
 }
 
+// bufferedBytes bytes of the requests queued by all clients waiting for their replies, see MaxTotalBufferBytes
+var bufferedBytes int64
+
+// BufferedBytes returns the bytes of the requests queued by all clients waiting for their replies
+func BufferedBytes() int64 {
+	return atomic.LoadInt64(&bufferedBytes)
+}
+
 func (c *conn) EnqueueInMsg(msg *Msg) {
+	msg.held = msg.reqLen()
+	atomic.AddInt64(&bufferedBytes, int64(msg.held))
 	c.inMsgQueue.PushTail(msg)
 }
 
+func (c *conn) Pending() int {
+	return c.inMsgQueue.count
+}
+
+func (c *conn) RequestTimeout() int      { return c.deadline }
+func (c *conn) SetRequestTimeout(ms int) { c.deadline = ms }
+
+func (c *conn) CompressThreshold() int         { return c.compress }
+func (c *conn) SetCompressThreshold(bytes int) { c.compress = bytes }
+
+func (c *conn) Target() string        { return c.target }
+func (c *conn) SetTarget(addr string) { c.target = addr }
+
+func (c *conn) Tag() string       { return c.tag }
+func (c *conn) SetTag(tag string) { c.tag = tag }
+
+func (c *conn) LibInfo() (name, ver string) { return c.libName, c.libVer }
+func (c *conn) SetLibInfo(name, ver string) { c.libName, c.libVer = name, ver }
+
+func (c *conn) CreatedAt() time.Time { return c.createdAt }
+func (c *conn) Requests() int        { return c.requests }
+
 func (c *conn) enqueueInFrag(frag *Frag) {
 	c.inFragQueue.PushTail(frag)
-	pushToTimeoutQueue(frag, c.loop.engine.opts.RedisRequestTimeout)
+	timeout := c.loop.engine.opts.RedisRequestTimeout
+	if frag.Peer != nil && frag.Peer.Timeout > 0 {
+		timeout = frag.Peer.Timeout
+	}
+	pushToTimeoutQueue(frag, timeout)
 }
 
-func (c *conn) EnqueueOutFrag(f *Frag) {
+func (c *conn) EnqueueOutFrag(f *Frag) error {
+	// the frags of a node slow to drain would pile up in memory, CLUSTER NODES of the monitor is never refused
+	if max := c.loop.engine.opts.RedisServerMaxPending; max > 0 && f.Owner != nil && c.InFlight() >= max {
+		return codec.ErrPendingLimit
+	}
+	if c.cold && f.Owner != nil {
+		c.cold = false
+		// a preconnected connection was there before the request
+		f.cold = f.Time.Before(c.createdAt)
+	}
 	c.outFragQueue.PushTail(f)
+	if c.inflight != nil {
+		c.inflight.Inc()
+	}
 	logging.Debugfunc(func() string {
 		return fmt.Sprintf("[%dm|%df][%dc|%ds] frag enqueue: %s", f.MsgId(), f.Id, f.OwnerFd(), c.fd, f.ReqString())
 	})
 
 	if err := c.sendWriteSignal(); err != nil {
 		logging.Errorf("[%dm|%df][%dc|%ds] failed to send write signal, err: %s", f.MsgId(), f.Id, f.OwnerFd(), c.fd, err)
-		return
 	}
+	return nil
 }
 
 func (c *conn) DequeueInFrag() *Frag {
@@ -554,6 +701,9 @@ func (c *conn) DequeueInFrag() *Frag {
 	}
 	c.inFragQueue.PopHead()
 	deleteFromTimeoutQueue(f)
+	if c.inflight != nil {
+		c.inflight.Dec()
+	}
 	return f
 }
 
@@ -567,6 +717,8 @@ func (c *conn) dequeueInMsg() *Msg {
 	}
 	head := c.inMsgQueue.head
 	c.inMsgQueue.PopHead()
+	atomic.AddInt64(&bufferedBytes, -int64(head.held))
+	head.held = 0
 	return head
 }
 
@@ -595,6 +747,49 @@ func (c *conn) SetKeepAlivePeriod(d time.Duration) error {
 func (c *conn) ConnType() ConnType { return c.connType }
 func (c *conn) IsOpened() bool     { return c.opened }
 
+// InFlight returns the number of frags sent or waiting to be sent to the redis node
+func (c *conn) InFlight() int { return c.inFragQueue.count + c.outFragQueue.count }
+
+func (c *conn) Authed() bool     { return c.authed }
+func (c *conn) SetAuthed(b bool) { c.authed = b }
+
+func (c *conn) Proto() int {
+	if c.proto < 2 {
+		return 2
+	}
+	return c.proto
+}
+func (c *conn) SetProto(proto int) { c.proto = proto }
+
+func (c *conn) LastWrite(slot int32) (time.Time, bool) {
+	t, ok := c.lastWrites[slot]
+	return t, ok
+}
+
+// minLastSweep entries of lastWrites below which the expired writes are not swept
+const minLastSweep = 64
+
+// SetLastWrite records the write to the slot, the writes older than the window are dropped
+// whenever the entries double since the last sweep, so a client writing all over the slots
+// keeps only those of the window
+func (c *conn) SetLastWrite(slot int32, t time.Time, window time.Duration) {
+	if c.lastWrites == nil {
+		c.lastWrites = make(map[int32]time.Time)
+	}
+	if len(c.lastWrites) >= c.lastSweep {
+		for s, w := range c.lastWrites {
+			if t.Sub(w) >= window {
+				delete(c.lastWrites, s)
+			}
+		}
+		c.lastSweep = 2 * len(c.lastWrites)
+		if c.lastSweep < minLastSweep {
+			c.lastSweep = minLastSweep
+		}
+	}
+	c.lastWrites[slot] = t
+}
+
 func (c *conn) IsSlave() bool     { return c.isSlave }
 func (c *conn) SetIsSlave(b bool) { c.isSlave = b }
 
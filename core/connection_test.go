@@ -30,6 +30,25 @@ func (_ *mockedConn) RemoteAddr() (addr string)
 func (_ *mockedConn) ConnType() ConnType                                          { return ConnClient }
 func (_ *mockedConn) IsOpened() bool                                              { return true }
 func (_ *mockedConn) EnqueueInMsg(_ *Msg)                                         {}
+func (_ *mockedConn) Pending() int                                                { return 0 }
+func (_ *mockedConn) RequestTimeout() int                                         { return 0 }
+func (_ *mockedConn) SetRequestTimeout(int)                                       {}
+func (_ *mockedConn) CompressThreshold() int                                      { return 0 }
+func (_ *mockedConn) SetCompressThreshold(int)                                    {}
+func (_ *mockedConn) Target() string                                              { return "" }
+func (_ *mockedConn) SetTarget(string)                                            {}
+func (_ *mockedConn) Tag() string                                                 { return "" }
+func (_ *mockedConn) SetTag(string)                                               {}
+func (_ *mockedConn) LibInfo() (string, string)                                   { return "", "" }
+func (_ *mockedConn) SetLibInfo(string, string)                                   {}
+func (_ *mockedConn) CreatedAt() time.Time                                        { return time.Time{} }
+func (_ *mockedConn) Requests() int                                               { return 0 }
+func (_ *mockedConn) Authed() bool                                                { return false }
+func (_ *mockedConn) SetAuthed(bool)                                              {}
+func (_ *mockedConn) Proto() int                                                  { return 2 }
+func (_ *mockedConn) SetProto(int)                                                {}
+func (_ *mockedConn) LastWrite(int32) (time.Time, bool)                           { return time.Time{}, false }
+func (_ *mockedConn) SetLastWrite(int32, time.Time, time.Duration)                {}
 func (_ *mockedConn) SetIsSlave(bool)                                             {}
 func (_ *mockedConn) Discard(n int) (discarded int, err error)                    { return }
 func (_ *mockedConn) InboundBuffered() (n int)                                    { return }
@@ -60,7 +79,8 @@ func (_ *mockedConn) SetInitializeStatus(_ InitializeStatus)
 func (_ *mockedConn) InitializeStep() int8                                        { return -1 }
 func (_ *mockedConn) SetInitializeStep(_ int8)                                    {}
 func (_ *mockedConn) IsSlave() bool                                               { return true }
-func (_ *mockedConn) EnqueueOutFrag(_ *Frag)                                      {}
+func (_ *mockedConn) EnqueueOutFrag(_ *Frag) error                                { return nil }
+func (_ *mockedConn) InFlight() int                                               { return 0 }
 func (_ *mockedConn) WriteClusterNodes() error                                    { return nil }
 func (m *mockedConn) Fd() int {
 	return m.Called().Get(0).(int)
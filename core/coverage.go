@@ -0,0 +1,93 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"rcproxy/core/pkg/constant"
+	"rcproxy/core/pkg/logging"
+)
+
+// slotCoverage tracks the slots served by the topology applied, only touched on the event-loop
+type slotCoverage struct {
+	loaded  bool      // a topology has been applied, nothing is known before
+	covered int       // slots served by a master
+	since   time.Time // time some slots got uncovered, zero while all of them are covered
+	alerted bool      // the hook fired for the current loss
+}
+
+// slotCoverageAlert body of the request POSTed to SlotCoverageHook
+type slotCoverageAlert struct {
+	Covered        int       `json:"covered"`
+	Total          int       `json:"total"`
+	UncoveredSince time.Time `json:"uncovered_since"`
+}
+
+var slotCoverageClient = &http.Client{Timeout: 5 * time.Second}
+
+// updateSlotCoverage counts the slots served once a topology is applied
+func (el *eventloop) updateSlotCoverage() {
+	el.coverage.loaded = true
+	el.coverage.covered = EngineGlobal.Slots2Node.Covered()
+	GlobalStats.SlotsCovered.WithLabelValues().Set(float64(el.coverage.covered))
+}
+
+// checkSlotCoverage alerts once the slots stay uncovered for SlotCoverageGrace, a blip shorter than it,
+// such as a failover, is only logged. The hook is called off the event-loop.
+func (el *eventloop) checkSlotCoverage(now time.Time) {
+	cov := &el.coverage
+	if !cov.loaded {
+		return
+	}
+	if cov.covered >= constant.RedisClusterSlots {
+		if !cov.since.IsZero() {
+			logging.Infof("[slot coverage] all slots covered again, uncovered for %v", now.Sub(cov.since))
+		}
+		cov.since, cov.alerted = time.Time{}, false
+		return
+	}
+	if cov.since.IsZero() {
+		cov.since = now
+		logging.Warnf("[slot coverage] %d of %d slots covered", cov.covered, constant.RedisClusterSlots)
+		return
+	}
+
+	grace := time.Duration(el.engine.opts.SlotCoverageGrace) * time.Second
+	if cov.alerted || now.Sub(cov.since) < grace {
+		return
+	}
+	cov.alerted = true
+	logging.Errorf("[slot coverage] %d of %d slots covered for %v", cov.covered, constant.RedisClusterSlots, now.Sub(cov.since))
+	if hook := el.engine.opts.SlotCoverageHook; len(hook) > 0 {
+		go postSlotCoverage(hook, slotCoverageAlert{Covered: cov.covered, Total: constant.RedisClusterSlots, UncoveredSince: cov.since})
+	}
+}
+
+func postSlotCoverage(url string, alert slotCoverageAlert) {
+	body, _ := json.Marshal(alert)
+	rsp, err := slotCoverageClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logging.Errorf("[slot coverage] hook %s failed, err: %s", url, err)
+		return
+	}
+	_ = rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		logging.Errorf("[slot coverage] hook %s failed, status: %s", url, rsp.Status)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core/pkg/constant"
+)
+
+func TestSlotCoverageHook(t *testing.T) {
+	alerts := make(chan slotCoverageAlert, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert slotCoverageAlert
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&alert))
+		alerts <- alert
+	}))
+	t.Cleanup(hook.Close)
+
+	el, _, _ := newTestLoop(t, ConnClient)
+	el.engine.opts.SlotCoverageHook = hook.URL
+	el.engine.opts.SlotCoverageGrace = 10
+
+	rs := &Replicaset{Master: &ClusterNode{Addr: "127.0.0.1:7000", Role: Master}}
+	cover := func(slots int32) {
+		EngineGlobal.Slots2Node.Reset()
+		for i := int32(0); i < slots; i++ {
+			EngineGlobal.Slots2Node.Set(i, rs)
+		}
+		el.updateSlotCoverage()
+	}
+	expectNoAlert := func(msg string) {
+		select {
+		case alert := <-alerts:
+			t.Fatalf("%s, got alert: %+v", msg, alert)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// nothing is alerted before the first topology is applied
+	start := time.Now()
+	el.checkSlotCoverage(start)
+	el.checkSlotCoverage(start.Add(time.Minute))
+	expectNoAlert("no topology applied")
+
+	// a blip shorter than the grace period, such as a failover
+	cover(constant.RedisClusterSlots - 100)
+	assert.Equal(t, float64(constant.RedisClusterSlots-100), testutil.ToFloat64(GlobalStats.SlotsCovered.WithLabelValues()))
+	el.checkSlotCoverage(start)
+	el.checkSlotCoverage(start.Add(9 * time.Second))
+	cover(constant.RedisClusterSlots)
+	el.checkSlotCoverage(start.Add(10 * time.Second))
+	expectNoAlert("transient blip")
+
+	// the grace period restarts with the next loss
+	cover(constant.RedisClusterSlots - 100)
+	lost := start.Add(11 * time.Second)
+	el.checkSlotCoverage(lost)
+	el.checkSlotCoverage(lost.Add(9 * time.Second))
+	expectNoAlert("within the grace period")
+
+	el.checkSlotCoverage(lost.Add(10 * time.Second))
+	select {
+	case alert := <-alerts:
+		assert.Equal(t, constant.RedisClusterSlots-100, alert.Covered)
+		assert.Equal(t, constant.RedisClusterSlots, alert.Total)
+		assert.True(t, lost.Equal(alert.UncoveredSince), "uncovered since: %s", alert.UncoveredSince)
+	case <-time.After(time.Second):
+		t.Fatal("the hook is not called after the grace period")
+	}
+
+	// called once per loss
+	el.checkSlotCoverage(lost.Add(20 * time.Second))
+	expectNoAlert("already alerted")
+}
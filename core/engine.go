@@ -20,6 +20,8 @@
 package core
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net"
 	"os"
 	"strings"
@@ -46,6 +48,8 @@ type engine struct {
 	cond         *sync.Cond     // shutdown signaler
 	eventHandler EventHandler   // user eventHandler
 	inShutdown   int32          // whether the engine is in shutdown
+	tlsConfig    *tls.Config    // terminates the client connections, nil if TLS is not enabled
+	redisTLS     *tls.Config    // encrypts the connections to the redis nodes, nil if TLS is not enabled
 }
 
 func (eng *engine) isInShutdown() bool {
@@ -80,18 +84,26 @@ func (eng *engine) closeEventLoops() {
 	_ = eng.el.poller.Close()
 }
 
+func (eng *engine) newEventloop(ln *listener, p *netpoll.Poller) *eventloop {
+	el := new(eventloop)
+	el.ln = ln
+	el.engine = eng
+	el.poller = p
+	el.buffer = make([]byte, eng.opts.ReadBufferCap)
+	el.sBuffer = make([]byte, eng.opts.ServerReadBufferCap)
+	el.connections = make(map[int]*conn)
+	el.eventHandler = eng.eventHandler
+	el.spareFd = -1
+	return el
+}
+
 func (eng *engine) start() (err error) {
 	ln := eng.ln
 	eng.ln = nil
 	var p *netpoll.Poller
 	if p, err = netpoll.OpenPoller(); err == nil {
-		el := new(eventloop)
-		el.ln = ln
-		el.engine = eng
-		el.poller = p
-		el.buffer = make([]byte, eng.opts.ReadBufferCap)
-		el.connections = make(map[int]*conn)
-		el.eventHandler = eng.eventHandler
+		el := eng.newEventloop(ln, p)
+		el.spareFd = reserveFd()
 		if err = el.poller.AddRead(el.ln.packPollAttachment(el.accept)); err != nil {
 			return
 		}
@@ -101,11 +113,8 @@ func (eng *engine) start() (err error) {
 	}
 
 	if eng.opts.RedisPreconnect {
-		// Initialize connection to the back-end redis cluster
-		for _, pool := range EngineGlobal.ProxyPool {
-			if pool.Get() == nil {
-				return perrors.Errorf("redis preconnect failed, addr: %s", pool.Addr)
-			}
+		if err = eng.preconnect(); err != nil {
+			return
 		}
 	}
 
@@ -114,6 +123,77 @@ func (eng *engine) start() (err error) {
 	return
 }
 
+// preconnect Initialize connection to the back-end redis cluster, best-effort.
+// The nodes are probed concurrently, so that a node down costs a single timeout,
+// the unreachable ones are banned and serving starts as long as a quorum is reachable.
+// While the quorum is not reached, the unreachable nodes are retried with backoff,
+// as redis may be starting along with the proxy.
+func (eng *engine) preconnect() error {
+	pools := make([]*Pool, 0, len(EngineGlobal.ProxyPool))
+	for _, pool := range EngineGlobal.ProxyPool {
+		pools = append(pools, pool)
+	}
+
+	quorum := eng.opts.RedisPreconnectQuorum
+	if quorum < 1 {
+		quorum = len(pools)/2 + 1
+	}
+
+	var reachable int
+	var errs []error
+	pending := pools
+	backoff := time.Duration(eng.opts.RedisPreconnectBackoff) * time.Millisecond
+	for retry := 0; ; retry++ {
+		var failed []*Pool
+		var failedErrs []error
+		for i, err := range dialPools(pending) {
+			if err != nil {
+				failed, failedErrs = append(failed, pending[i]), append(failedErrs, err)
+				continue
+			}
+			reachable++
+		}
+		pending, errs = failed, failedErrs
+		if reachable >= quorum || retry >= eng.opts.RedisPreconnectRetries {
+			break
+		}
+		logging.Warnf("redis preconnect %d of %d nodes reachable, quorum: %d, retry %d in %v", reachable, len(pools), quorum, retry+1, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	for i, pool := range pending {
+		logging.Errorf("redis preconnect failed, addr: %s, baned for period, err: %s", pool.Addr, errs[i])
+		pool.preconnectFailed()
+	}
+	if reachable < quorum {
+		return perrors.Errorf("redis preconnect failed, %d of %d nodes reachable, quorum: %d", reachable, len(pools), quorum)
+	}
+	return nil
+}
+
+// dialPools probes the nodes concurrently and dials a connection to the reachable ones
+func dialPools(pools []*Pool) []error {
+	errs := make([]error, len(pools))
+	var wg sync.WaitGroup
+	for i, pool := range pools {
+		wg.Add(1)
+		go func(i int, pool *Pool) {
+			defer wg.Done()
+			errs[i] = pool.detect()
+		}(i, pool)
+	}
+	wg.Wait()
+
+	for i, pool := range pools {
+		// the connection is registered on the event-loop, which is not thread-safe, so dial here
+		if errs[i] == nil && pool.Get() == nil {
+			errs[i] = perrors.New("dial failed")
+		}
+	}
+	return errs
+}
+
 func (eng *engine) stop(s Engine) {
 	// Wait on a signal for shutdown
 	eng.waitForShutdown()
@@ -133,60 +213,99 @@ func (eng *engine) stop(s Engine) {
 	atomic.StoreInt32(&eng.inShutdown, 1)
 }
 
+// dialTimeout and debugDial are variables so that tests can slow down and observe the dial
+var (
+	dialTimeout = net.DialTimeout
+	debugDial   = logging.Debugfunc
+)
+
+// dialTrace logs the elapsed time of each step of connecting to redis, so that a slow DNS or connect can be pinpointed
+type dialTrace struct {
+	addr        string
+	start, last time.Time
+}
+
+func newDialTrace(addr string) *dialTrace {
+	now := time.Now()
+	return &dialTrace{addr: addr, start: now, last: now}
+}
+
+func (t *dialTrace) step(name string) {
+	now := time.Now()
+	elapsed, total := now.Sub(t.last), now.Sub(t.start)
+	t.last = now
+	debugDial(func() string {
+		return fmt.Sprintf("dial redis %s, %s cost: %s, total: %s", t.addr, name, elapsed, total)
+	})
+}
+
 // Dial establishing a connection with redis
 func (eng *engine) Dial(address string, isSlave bool) (SConn, error) {
-	c, err := net.DialTimeout("tcp", address, time.Duration(eng.opts.RedisConnectionTimeout)*time.Millisecond)
+	trace := newDialTrace(address)
+	c, err := dialTimeout("tcp", address, time.Duration(eng.opts.RedisConnectionTimeout)*time.Millisecond)
+	trace.step("connect")
 	if err != nil {
 		GlobalStats.RedisServerCreateConnError.WithLabelValues(address).Inc()
 		logging.Errorf("failed to dial redis %s, error: %s", address, err)
 		return nil, err
 	}
 
-	defer c.Close()
+	if eng.redisTLS == nil {
+		defer c.Close()
+	}
 
 	sc, ok := c.(syscall.Conn)
 	if !ok {
+		_ = c.Close()
 		return nil, perrors.New("failed to convert net.Conn to syscall.Conn")
 	}
 	rc, err := sc.SyscallConn()
 	if err != nil {
+		_ = c.Close()
 		return nil, perrors.New("failed to get syscall.RawConn from net.Conn")
 	}
 
 	var DupFD int
-	e := rc.Control(func(fd uintptr) {
-		DupFD, err = unix.Dup(int(fd))
-	})
-	if err != nil {
-		return nil, err
-	}
-	if e != nil {
-		return nil, e
-	}
-
-	if err = socket.SetNoDelay(DupFD, 1); err != nil {
-		return nil, err
-	}
-
-	if err = os.NewSyscallError("fcntl nonblock", unix.SetNonblock(DupFD, true)); err != nil {
-		return nil, err
-	}
+	if eng.redisTLS != nil {
+		// the options are set on the socket of the node, the event-loop is given the end of the relay
+		e := rc.Control(func(fd uintptr) {
+			err = eng.setSockopts(int(fd))
+		})
+		if err == nil {
+			err = e
+		}
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		trace.step("sockopt")
 
-	if eng.opts.TCPKeepAlive > 0 {
-		if err = socket.SetKeepAlivePeriod(DupFD, int(eng.opts.TCPKeepAlive/time.Second)); err != nil {
+		DupFD, err = handshakeRedis(c, address, eng.redisTLS, time.Duration(eng.opts.RedisConnectionTimeout)*time.Millisecond)
+		trace.step("tls handshake")
+		if err != nil {
+			GlobalStats.RedisServerCreateConnError.WithLabelValues(address).Inc()
+			logging.Errorf("failed tls handshake with redis %s, error: %s", address, err)
 			return nil, err
 		}
-	}
+	} else {
+		e := rc.Control(func(fd uintptr) {
+			DupFD, err = unix.Dup(int(fd))
+		})
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			return nil, e
+		}
+		trace.step("dup fd")
 
-	if eng.opts.SocketSendBuffer > 0 {
-		if err = socket.SetSendBuffer(DupFD, eng.opts.SocketSendBuffer); err != nil {
+		if err = os.NewSyscallError("fcntl nonblock", unix.SetNonblock(DupFD, true)); err != nil {
 			return nil, err
 		}
-	}
-	if eng.opts.SocketRecvBuffer > 0 {
-		if err = socket.SetRecvBuffer(DupFD, eng.opts.SocketRecvBuffer); err != nil {
+		if err = eng.setSockopts(DupFD); err != nil {
 			return nil, err
 		}
+		trace.step("sockopt")
 	}
 
 	var initStatus InitializeStatus
@@ -212,6 +331,7 @@ func (eng *engine) Dial(address string, isSlave bool) (SConn, error) {
 		return nil, err
 	}
 	eng.el.connections[gc.(*conn).fd] = gc.(*conn)
+	trace.step("poller register")
 
 	if err := eng.el.open(gc.(*conn)); err != nil {
 		return nil, err
@@ -219,6 +339,50 @@ func (eng *engine) Dial(address string, isSlave bool) (SConn, error) {
 	return gc, nil
 }
 
+// setSockopts sets the options of the socket connected to a redis node
+func (eng *engine) setSockopts(fd int) error {
+	if err := socket.SetNoDelay(fd, 1); err != nil {
+		return err
+	}
+
+	if eng.opts.TCPKeepAlive > 0 {
+		if err := socket.SetKeepAlivePeriod(fd, int(eng.opts.TCPKeepAlive/time.Second)); err != nil {
+			return err
+		}
+	}
+
+	if eng.opts.SocketSendBuffer > 0 {
+		if err := socket.SetSendBuffer(fd, eng.opts.SocketSendBuffer); err != nil {
+			return err
+		}
+	}
+	if eng.opts.SocketRecvBuffer > 0 {
+		if err := socket.SetRecvBuffer(fd, eng.opts.SocketRecvBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseServers splits the comma separated redis addrs, tolerating whitespace and empty entries
+func parseServers(servers string) ([]string, error) {
+	var serverList []string
+	for _, addr := range strings.Split(servers, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) < 1 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, perrors.Wrapf(err, "invalid redis addr %q", addr)
+		}
+		serverList = append(serverList, addr)
+	}
+	if len(serverList) < 1 {
+		return nil, perrors.New("redis addr not found")
+	}
+	return serverList, nil
+}
+
 func serve(eventHandler EventHandler, listener *listener, options *Options, protoAddr string) error {
 	eng := new(engine)
 	eng.opts = options
@@ -227,23 +391,40 @@ func serve(eventHandler EventHandler, listener *listener, options *Options, prot
 
 	eng.cond = sync.NewCond(&sync.Mutex{})
 
+	tlsConfig, err := clientTLSConfig(options)
+	if err != nil {
+		logging.Errorf("invalid client tls certificate: %s", err)
+		return err
+	}
+	eng.tlsConfig = tlsConfig
+
+	redisTLS, err := redisTLSConfig(options)
+	if err != nil {
+		logging.Errorf("invalid redis tls ca: %s", err)
+		return err
+	}
+	eng.redisTLS = redisTLS
+
 	e := Engine{
 		eng:         eng,
 		ProxyPool:   make(map[string]*Pool),
-		cCodec:      CRespCodec{options.RedisMsgMaxLength},
-		sCodec:      SRespCodec{options.RedisMsgMaxLength},
+		Opts:        options,
+		cCodec:      NewCRespCodec(options),
+		sCodec:      SRespCodec{MsgMaxLength: options.RedisMsgMaxLength, MaxReplyElements: options.RedisMaxReplyElements},
 		clusterChan: make(chan []byte, 3),
 		ClusterNodes: ClusterNodes{
 			redisAddrs:   options.RedisServers,
 			passwd:       options.RedisPasswd,
 			redisWrapper: new(redisWrapper),
+			probeSem:     make(chan struct{}, options.RedisMaxTopologyProbeConns),
+			tlsConfig:    redisTLS,
 		},
 	}
 
-	serverList := strings.Split(options.RedisServers, ",")
-	if len(serverList) < 1 {
-		logging.Errorf("redis addr not found from conf.redis.servers")
-		return nil
+	serverList, err := parseServers(options.RedisServers)
+	if err != nil {
+		logging.Errorf("invalid conf.redis.servers: %s", err)
+		return err
 	}
 
 	switch eng.eventHandler.OnBoot(e) {
@@ -257,7 +438,7 @@ func serve(eventHandler EventHandler, listener *listener, options *Options, prot
 		e.ProxyAddrs = append(e.ProxyAddrs, addr)
 	}
 	EngineGlobal = &e
-	go EngineGlobal.ClusterNodes.loopClusterNodes()
+	go EngineGlobal.ClusterNodes.superviseClusterNodes(nil)
 	go statsLoop()
 
 	if err := eng.start(); err != nil {
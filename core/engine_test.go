@@ -0,0 +1,183 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || freebsd || dragonfly || darwin
+// +build linux freebsd dragonfly darwin
+
+package core
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"rcproxy/core/internal/netpoll"
+	"rcproxy/core/pkg/logging"
+)
+
+func TestParseServers(t *testing.T) {
+	servers, err := parseServers(" 127.0.0.1:7000, 127.0.0.1:7001 ,,\t127.0.0.1:7002\n, ")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1:7000", "127.0.0.1:7001", "127.0.0.1:7002"}, servers)
+
+	_, err = parseServers("127.0.0.1:7000, 127.0.0.1")
+	assert.EqualError(t, err, `invalid redis addr "127.0.0.1": address 127.0.0.1: missing port in address`)
+
+	_, err = parseServers(" , ")
+	assert.EqualError(t, err, "redis addr not found")
+}
+
+// listenRedis starts a fake redis node answering PONG to anything
+func listenRedis(t *testing.T) string {
+	return listenRedisOn(t, "127.0.0.1:0")
+}
+
+// listenRedisOn starts a fake redis node on the addr
+func listenRedisOn(t *testing.T, addr string) string {
+	ln, err := net.Listen("tcp", addr)
+	assert.Nil(t, err)
+	return serveRedis(t, ln)
+}
+
+// serveRedis answers PONG to anything sent to the connections accepted by the listener
+func serveRedis(t *testing.T, ln net.Listener) string {
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 1024)
+				for {
+					if _, err := c.Read(buf); err != nil {
+						return
+					}
+					_, _ = c.Write([]byte("+PONG\r\n"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// downRedis returns an addr refusing connections
+func downRedis(t *testing.T) string {
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	_ = refused.Close()
+	return refused.Addr().String()
+}
+
+// newPreconnectEngine returns an engine whose proxy pools are the addrs
+func newPreconnectEngine(t *testing.T, addrs ...string) *engine {
+	poller, err := netpoll.OpenPoller()
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = poller.Close() })
+
+	eng := &engine{
+		opts: &Options{
+			ReadBufferCap:          1024,
+			ServerReadBufferCap:    1024,
+			WriteBufferCap:         1024,
+			RedisConnectionTimeout: 200,
+			RedisServerConnections: 1,
+			RedisMonitorInterval:   60000,
+		},
+		eventHandler: &BuiltinEventEngine{},
+	}
+	eng.el = eng.newEventloop(nil, poller)
+	EngineGlobal = &Engine{ProxyPool: make(map[string]*Pool)}
+	for _, addr := range addrs {
+		pool := eng.newPool(addr, false)
+		t.Cleanup(pool.Close)
+		EngineGlobal.ProxyPool[addr] = pool
+	}
+	return eng
+}
+
+func TestPreconnect(t *testing.T) {
+	down := downRedis(t)
+	addrs := []string{listenRedis(t), listenRedis(t), down}
+	eng := newPreconnectEngine(t, addrs...)
+
+	// 2 of 3 nodes are reachable, the majority
+	assert.Nil(t, eng.preconnect())
+	for _, addr := range addrs[:2] {
+		assert.Equal(t, 1, EngineGlobal.ProxyPool[addr].ActiveCount(), "addr: %s", addr)
+		assert.True(t, EngineGlobal.ProxyPool[addr].Available(), "addr: %s", addr)
+	}
+	assert.Equal(t, Banned, EngineGlobal.ProxyPool[down].BanStatus().State)
+	assert.False(t, EngineGlobal.ProxyPool[down].Available())
+
+	eng.opts.RedisPreconnectQuorum = 3
+	assert.EqualError(t, eng.preconnect(), "redis preconnect failed, 2 of 3 nodes reachable, quorum: 3")
+}
+
+func TestPreconnectRetry(t *testing.T) {
+	addr := downRedis(t)
+	eng := newPreconnectEngine(t, addr)
+
+	// without retries the node down at boot fails the start
+	assert.EqualError(t, eng.preconnect(), "redis preconnect failed, 0 of 1 nodes reachable, quorum: 1")
+
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	// the node comes up between the first attempt and the retry
+	eng = newPreconnectEngine(t, addr)
+	eng.opts.RedisPreconnectRetries, eng.opts.RedisPreconnectBackoff = 3, 100
+	time.AfterFunc(50*time.Millisecond, func() { listenRedisOn(t, addr) })
+	assert.Nil(t, eng.preconnect())
+	assert.Equal(t, 1, EngineGlobal.ProxyPool[addr].ActiveCount())
+	assert.True(t, EngineGlobal.ProxyPool[addr].Available())
+	assert.True(t, sink.Contains(logging.LevelWarn, "redis preconnect 0 of 1 nodes reachable, quorum: 1, retry 1 in 100ms"))
+	assert.False(t, sink.Contains(logging.LevelError, "redis preconnect failed"))
+}
+
+func TestDialTrace(t *testing.T) {
+	addr := listenRedis(t)
+	var logs []string
+	dialTimeout, debugDial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		time.Sleep(50 * time.Millisecond)
+		return net.DialTimeout(network, address, timeout)
+	}, func(f func() string) { logs = append(logs, f()) }
+	t.Cleanup(func() { dialTimeout, debugDial = net.DialTimeout, logging.Debugfunc })
+
+	el, _, _ := newTestLoop(t, ConnServer)
+	el.engine.el = el
+	el.engine.opts.RedisConnectionTimeout = 200
+
+	c, err := el.engine.Dial(addr, false)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = unix.Close(c.Fd()) })
+
+	steps := []string{"connect", "dup fd", "sockopt", "poller register"}
+	if assert.Len(t, logs, len(steps)) {
+		for i, step := range steps {
+			assert.True(t, strings.HasPrefix(logs[i], "dial redis "+addr+", "+step+" cost: "), logs[i])
+		}
+	}
+	// the slow connect shows up in its own step
+	cost, err := time.ParseDuration(strings.TrimPrefix(strings.Split(logs[0], ",")[1], " connect cost: "))
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, cost, 50*time.Millisecond)
+}
@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"sync/atomic"
 	"time"
@@ -43,12 +44,18 @@ type eventloop struct {
 	cache        bytes.Buffer    // temporary buffer for scattered bytes
 	engine       *engine         // engine in loop
 	poller       *netpoll.Poller // epoll or kqueue
-	buffer       []byte          // read packet buffer whose capacity is set by user, default value is 64KB
+	buffer       []byte          // read packet buffer of clients whose capacity is set by user, default value is 64KB
+	sBuffer      []byte          // read packet buffer of redis whose capacity is set by user, default value is 64KB
 	cConnCount   int32           // number of active client_connections in event-loop
 	sConnCount   int32           // number of active server_connections in event-loop
 	connections  map[int]*conn   // TCP connection map: fd -> conn
 	eventHandler EventHandler    // user eventHandler
 	nextTicker   time.Time       // next available ticker time
+	coverage     slotCoverage    // slots served by the topology applied, alerting on a loss
+	draining     []*Pool         // pools of the nodes removed from the topology, closed once drained
+	readPaused   int             // number of clients not read since the requests held exceed MaxTotalBufferBytes
+	spareFd      int             // fd held in reserve, released to reject the pending connection when out of fds
+	exhaustedLog time.Time       // last time the fd exhaustion was logged, at most once per second
 }
 
 func (el *eventloop) addCConn(delta int32) {
@@ -67,11 +74,31 @@ func (el *eventloop) loadSConn() int32 {
 	return atomic.LoadInt32(&el.sConnCount)
 }
 
+// closeAllSockets closes all the connections on shutdown, logging how many requests were dropped
+// so that the impact of a deploy can be analysed afterwards
 func (el *eventloop) closeAllSockets() {
+	var clients, msgs, servers, frags int
+	for _, c := range el.connections {
+		switch c.connType {
+		case ConnClient:
+			clients++
+			msgs += c.inMsgQueue.count
+		case ConnServer:
+			servers++
+			frags += c.InFlight()
+		}
+	}
+
 	// Close loops and all outstanding connections
 	for _, c := range el.connections {
 		_ = el.closeConn(c, nil, ConnEof)
 	}
+	if el.spareFd >= 0 {
+		_ = unix.Close(el.spareFd)
+		el.spareFd = -1
+	}
+	logging.Infof("[shutdown] closed %d client connections with %d in-flight requests abandoned, %d redis connections with %d in-flight frags abandoned",
+		clients, msgs, servers, frags)
 }
 
 func (el *eventloop) register(itf interface{}) error {
@@ -85,6 +112,37 @@ func (el *eventloop) register(itf interface{}) error {
 	return el.open(c)
 }
 
+// ConnInfo metadata of a client connection
+type ConnInfo struct {
+	Fd         int
+	RemoteAddr string
+	CreatedAt  time.Time
+	LastActive time.Time
+	InFlight   int    // requests read from the client and not answered yet
+	LibName    string // client library reported by CLIENT SETINFO
+	LibVer     string
+}
+
+// clientConns snapshots the client connections, it must run on the event-loop
+func (el *eventloop) clientConns() []ConnInfo {
+	conns := make([]ConnInfo, 0, el.loadCConn())
+	for _, c := range el.connections {
+		if c.connType != ConnClient {
+			continue
+		}
+		conns = append(conns, ConnInfo{
+			Fd:         c.fd,
+			RemoteAddr: c.RemoteAddr(),
+			CreatedAt:  c.createdAt,
+			LastActive: c.lastActive,
+			InFlight:   c.inMsgQueue.count,
+			LibName:    c.libName,
+			LibVer:     c.libVer,
+		})
+	}
+	return conns
+}
+
 func (el *eventloop) open(c *conn) error {
 	c.opened = true
 	GlobalStats.TotalConnections.WithLabelValues().Inc()
@@ -119,7 +177,11 @@ func (el *eventloop) open(c *conn) error {
 }
 
 func (el *eventloop) read(c *conn) error {
-	n, err := unix.Read(c.fd, el.buffer)
+	buffer := el.buffer
+	if c.connType == ConnServer {
+		buffer = el.sBuffer
+	}
+	n, err := unix.Read(c.fd, buffer)
 	if err != nil || n == 0 {
 		if err == unix.EAGAIN {
 			return nil
@@ -130,7 +192,8 @@ func (el *eventloop) read(c *conn) error {
 		return el.closeConn(c, os.NewSyscallError("read", err), ConnErr)
 	}
 
-	c.buffer = el.buffer[:n]
+	c.buffer = buffer[:n]
+	c.lastActive = time.Now()
 
 	switch c.connType {
 	case ConnClient:
@@ -145,23 +208,54 @@ func (el *eventloop) read(c *conn) error {
 }
 
 func (el *eventloop) cread(c *conn) error {
+	if c.quitting {
+		return nil
+	}
 	for {
+		// the requests held by all clients exceed the limit, the rest is decoded once they drain
+		if c.pollAttachment.ReadPaused || el.overBuffered() {
+			if err := el.pauseRead(c); err != nil {
+				return err
+			}
+			break
+		}
 		r, err := c.cread()
-		if err == codec.ErrInvalidResp {
+		if err == codec.ErrInvalidResp || err == codec.ErrCRNotFound {
 			logging.Warnf("[%dc] client closed because of invalid resp", c.Fd())
 			return el.closeConn(c, nil, ConnErr)
 		}
+		// the payload is never read, so the connection can't be resynchronized
+		if err == codec.ErrReqTooLarge {
+			logging.Warnf("[%dc] client closed because of too large bulk length", c.Fd())
+			if _, err = c.write(codec.ErrMsgReqTooLarge.Bytes()); err != nil {
+				return err
+			}
+			return el.closeConn(c, nil, ProxyEof)
+		}
 		// incomplete message, waiting for next event polling
 		if err != nil {
 			break
 		}
+		c.commanded = true
+		c.requests++
 
 		out, action := el.eventHandler.OnCReact(r, c)
+		// like redis, QUIT takes effect after the requests pipelined before it,
+		// the requests after it are discarded
+		if action == Close && !c.inMsgQueue.Empty() {
+			logging.Debugf("[%dc] client quits after %d pending requests", c.fd, c.inMsgQueue.count)
+			c.quitting, c.quitReply = true, out
+			MsgPool.Put(r)
+			return nil
+		}
 		if out != nil {
 			// Encode data and try to write it back to the peer, this attempt is based on a fact:
 			// the peer socket waits for the response data after sending request data to the server,
 			// which makes the peer socket writable.
-			MsgPool.Put(r)
+			// An acknowledged request is still in flight, it is released once redis replies.
+			if !r.Acked {
+				MsgPool.Put(r)
+			}
 			if _, err = c.write(out); err != nil {
 				return err
 			}
@@ -184,24 +278,76 @@ func (el *eventloop) cread(c *conn) error {
 	return nil
 }
 
+// ackedReply checks the reply of a request the client was answered +OK on forwarding,
+// an error can only be logged and counted since the client has moved on.
+// The request is released once the replies of all its frags are read.
+func ackedReply(f *Frag, s *conn) {
+	msg := f.Peer
+	if msg.acked++; msg.acked < msg.NumFrags() {
+		return
+	}
+	if len(msg.RspBody) > 0 && msg.RspBody[0] == '-' {
+		logging.Warnf("[%dm|%df][%dc|%ds] acknowledged request failed, redis_addr: %s, req: %s, res: %s",
+			f.MsgId(), f.Id, f.OwnerFd(), s.fd, s.RemoteAddr(), f.ReqString(), msg.RspBodyString())
+		GlobalStats.AckedErrors.WithLabelValues(codec.Transform2Str(msg.Type)).Inc()
+	}
+	MsgPool.Put(msg)
+}
+
 func (el *eventloop) sread(s *conn) error {
+	var recycle bool
 Loop:
 	for {
+		if recycle {
+			return el.closeConn(s, codec.ErrReplyTooManyElements, ProxyEof)
+		}
 		r, err := s.sread()
 		if err != nil {
 			switch err {
-			case codec.ErrUnKnown, codec.ErrInvalidResp, codec.ErrInvalidInitializing:
+			case codec.ErrUnKnown, codec.ErrInvalidResp, codec.ErrCRNotFound, codec.ErrInvalidInitializing:
 				logging.Errorf("[%ds] redis response parse failed, error: %s", s.fd, err)
 				continue
 
+			// every reply of a node defaulting to RESP3 fails to parse, so stop sending requests to it
+			case codec.ErrResp3:
+				logging.Errorf("[%ds] redis node %s replied in RESP3, banned for period, check the protocol it defaults to", s.fd, s.RemoteAddr())
+				if pool, ok := EngineGlobal.ProxyPool[s.RemoteAddr()]; ok {
+					pool.protocolMismatch()
+				}
+				return el.closeConn(s, err, ProxyEof)
+
+			// redis refused AUTH or READONLY, the connection never initializes
+			case codec.ErrInitializeRefused:
+				return el.refuseInit(s)
+
+			// the request/response pairing of the connection is broken,
+			// every subsequent reply would be mismatched, so recycle the connection
+			case codec.ErrBackendDesync:
+				logging.Errorf("[%ds] redis connection desync, closed, remote: %s", s.fd, s.RemoteAddr())
+				GlobalStats.BackendDesync.WithLabelValues(s.RemoteAddr()).Inc()
+				return el.closeConn(s, err, ProxyEof)
+
+			// the rest of the oversized reply is never read, relay the error
+			// answered to its request, then recycle the connection
+			case codec.ErrReplyTooManyElements:
+				if r == nil {
+					return el.closeConn(s, err, ProxyEof)
+				}
+				recycle = true
+
 			// process the redis moved/ask packet
 			case codec.MovedOrAsk:
 				addr, slot := r.parseMovedOrAsk()
-				el.eventHandler.OnMoved(addr, slot, s, r)
-				continue
+				if !el.eventHandler.OnMoved(addr, slot, s, r) {
+					continue
+				}
+				r.relayRedirect()
 
 			// The current message has been processed, continue to process the next message
 			case codec.Continue:
+				if r != nil && r.Peer != nil && r.Peer.Acked {
+					ackedReply(r, s)
+				}
 				continue
 
 			// Incomplete message, waiting for next event polling
@@ -217,6 +363,11 @@ Loop:
 			return gerrors.ErrEngineShutdown
 		}
 
+		if r.Peer != nil && r.Peer.Acked {
+			ackedReply(r, s)
+			continue
+		}
+
 		if r.Owner == nil {
 			select {
 			case EngineGlobal.clusterChan <- r.RspBody:
@@ -249,64 +400,169 @@ Loop:
 			continue
 		}
 
-		var bs = make([][]byte, c.inMsgQueue.count)
-		bs = bs[:0]
-		cur := c.inMsgQueue.head
+		el.writeReplies(c)
 
-		var curId uint64
-		var curFd = c.fd
-
-		for cur != nil {
-			curId = cur.Id
-			bs = append(bs, cur.RspBody)
-			logging.Debugfunc(func() string { return fmt.Sprintf("[%dm][%dc] got res: %s", cur.Id, c.Fd(), cur.RspBodyString()) })
-			cur = cur.prev
+		// Check the status of connection every loop since it might be closed
+		// during writing data back to the peer due to some kind of system error.
+		if !s.opened {
+			return nil
 		}
+	}
 
-		for len(bs) > 0 {
-			var r = len(bs)
-			if r >= iovMax {
-				r = iovMax
-			}
+	_, _ = s.inboundBuffer.Write(s.buffer)
+	return el.resumeReads()
+}
 
-			if _, err = c.writev(bs[0:r]); err != nil {
-				logging.Warnf("[%dm][%dc] write to client failed, error: %s, body: %s", cur.Id, c.fd, err, cur.RspBodyString())
-				break
-			}
-			if !c.opened {
-				logging.Warnf("[%dm][%dc] write failed because of client closed", curId, curFd)
-				break
+// refuseInit answers the requests held back by the init with the refusal of redis and closes the connection,
+// the proxy shuts down on invalid auth as it does when a request gets it
+func (el *eventloop) refuseInit(s *conn) error {
+	bs, _ := s.Peek(0)
+	reply, _ := initRefusal(bs)
+	logging.Errorf("[%ds] redis %s refused to initialize the connection, closed, redis response: %s", s.fd, s.RemoteAddr(), utils.FormatRedisRESPMessages(reply))
+
+	var elements int
+	switch t, _ := EngineGlobal.sCodec.readReply(codec.NewBuffer(reply), &elements); t {
+	case codec.RspNeedNtAuth, codec.RspNeedAuth, codec.RspAuthFailed:
+		logging.Errorf("[%ds] rcproxy shutdown because of invalid auth, redis response: %s", s.fd, utils.FormatRedisRESPMessages(reply))
+		return gerrors.ErrEngineShutdown
+	}
+
+	for s.outFragQueue.head != nil {
+		f := s.outFragQueue.head
+		s.dequeueOutFrag()
+		if s.inflight != nil {
+			s.inflight.Dec()
+		}
+		if f.Owner == nil || f.Peer == nil {
+			continue
+		}
+		if f.Done {
+			if f.Peer.Acked {
+				ackedReply(f, s)
 			}
-			bs = bs[r:]
+			continue
 		}
-
-		if _, err = c.writev(bs); err != nil {
-			logging.Warnf("[%dm][%dc] write to client failed, error: %s, body: %s", cur.Id, c.fd, err, cur.RspBodyString())
+		f.Error = codec.Error(reply)
+		f.failMsg()
+		if f.Peer.Acked {
+			ackedReply(f, s)
 			continue
 		}
+		if c := f.Owner.(*conn); c.opened && c.inMsgQueue.AllDone() {
+			el.writeReplies(c)
+		}
+	}
+	return el.closeConn(s, codec.ErrInitializeRefused, ProxyEof)
+}
+
+// writeReplies writes the replies of the queued messages to the client and releases them,
+// then closes the client which sent QUIT behind them
+func (el *eventloop) writeReplies(c *conn) {
+	var bs = make([][]byte, c.inMsgQueue.count)
+	bs = bs[:0]
+	cur := c.inMsgQueue.head
+
+	var curId uint64
+	var curFd = c.fd
+
+	for cur != nil {
+		curId = cur.Id
+		if c.compress > 0 {
+			bs = append(bs, compressBulk(cur.RspBody, c.compress))
+		} else {
+			bs = append(bs, cur.RspBody)
+		}
+		logging.Debugfunc(func() string { return fmt.Sprintf("[%dm][%dc] got res: %s", cur.Id, c.Fd(), cur.RspBodyString()) })
+		cur = cur.prev
+	}
+
+	for len(bs) > 0 {
+		var r = len(bs)
+		if r >= iovMax {
+			r = iovMax
+		}
 
+		if _, err := c.writev(bs[0:r]); err != nil {
+			logging.Warnf("[%dm][%dc] write to client failed, error: %s", curId, c.fd, err)
+			break
+		}
 		if !c.opened {
 			logging.Warnf("[%dm][%dc] write failed because of client closed", curId, curFd)
-			continue
+			break
 		}
+		bs = bs[r:]
+	}
 
-		// release Msg
-		for {
-			msg := c.dequeueInMsg()
-			if msg == nil {
-				break
-			}
-			MsgPool.Put(msg)
+	if _, err := c.writev(bs); err != nil {
+		logging.Warnf("[%dm][%dc] write to client failed, error: %s", curId, c.fd, err)
+		return
+	}
+
+	if !c.opened {
+		logging.Warnf("[%dm][%dc] write failed because of client closed", curId, curFd)
+		return
+	}
+
+	// release Msg
+	for {
+		msg := c.dequeueInMsg()
+		if msg == nil {
+			break
 		}
+		MsgPool.Put(msg)
+	}
 
-		// Check the status of connection every loop since it might be closed
-		// during writing data back to the peer due to some kind of system error.
-		if !s.opened {
-			return nil
+	if c.quitting {
+		if _, err := c.write(c.quitReply); err != nil {
+			logging.Warnf("[%dc] write quit reply failed, error: %s", c.fd, err)
 		}
+		el.closeConn(c, nil, ProxyEof)
 	}
+}
 
-	_, _ = s.inboundBuffer.Write(s.buffer)
+// overBuffered reports whether the requests queued by all clients exceed MaxTotalBufferBytes
+func (el *eventloop) overBuffered() bool {
+	limit := el.engine.opts.MaxTotalBufferBytes
+	return limit > 0 && BufferedBytes() > int64(limit)
+}
+
+// pauseRead stops reading the client until the requests held by all clients drop below MaxTotalBufferBytes,
+// the last line of defense of the proxy memory against a flood of requests redis can't keep up with
+func (el *eventloop) pauseRead(c *conn) error {
+	if c.pollAttachment.ReadPaused {
+		return nil
+	}
+	if el.readPaused++; el.readPaused == 1 {
+		logging.Warnf("[buffer limit] requests held %d bytes over %d, clients paused reading", BufferedBytes(), el.engine.opts.MaxTotalBufferBytes)
+	}
+	GlobalStats.ReadPauses.WithLabelValues().Inc()
+	return el.poller.PauseRead(c.pollAttachment, !c.outboundBuffer.IsEmpty())
+}
+
+// resumeReads reads the paused clients again once the requests held drop below MaxTotalBufferBytes,
+// the requests they sent meanwhile are decoded at once since no readable event may come for them
+func (el *eventloop) resumeReads() error {
+	if el.readPaused < 1 || el.overBuffered() {
+		return nil
+	}
+	logging.Infof("[buffer limit] requests held %d bytes, %d clients resumed reading", BufferedBytes(), el.readPaused)
+	for _, c := range el.connections {
+		if c.connType != ConnClient || !c.pollAttachment.ReadPaused {
+			continue
+		}
+		// the clients left are paused again, they are resumed by the next drain
+		if el.overBuffered() {
+			return nil
+		}
+		el.readPaused--
+		if err := el.poller.ResumeRead(c.pollAttachment, !c.outboundBuffer.IsEmpty()); err != nil {
+			return el.closeConn(c, err, ConnErr)
+		}
+		c.buffer = nil
+		if err := el.cread(c); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -356,8 +612,9 @@ func (el *eventloop) closeConn(c *conn, err error, closeType ConnCloseType) (rer
 			if len(iov) > iovMax {
 				iov = iov[:iovMax]
 			}
-			if n, e := io.Writev(c.fd, iov); e != nil {
-				logging.Errorf("[%d%c] closeConn: error occurs when sending data back to peer, err: %v, iov: %s", c.fd, c.connType, err, utils.FormatRedisIovRESPMessages(iov))
+			if n, e := io.Writev(c.fd, iov); e != nil || n <= 0 {
+				// the peer is gone or not reading, the rest can't be delivered either
+				logging.Errorf("[%d%c] closeConn: error occurs when sending data back to peer, err: %v, iov: %s", c.fd, c.connType, e, utils.FormatRedisIovRESPMessages(iov))
 				break
 			} else {
 				_, _ = c.outboundBuffer.Discard(n)
@@ -382,6 +639,9 @@ func (el *eventloop) closeConn(c *conn, err error, closeType ConnCloseType) (rer
 
 	switch c.connType {
 	case ConnClient:
+		if c.pollAttachment.ReadPaused {
+			el.readPaused--
+		}
 		el.eventHandler.OnCClosed(c, err)
 		el.addCConn(-1)
 		switch closeType {
@@ -393,6 +653,10 @@ func (el *eventloop) closeConn(c *conn, err error, closeType ConnCloseType) (rer
 	case ConnServer:
 		el.eventHandler.OnSClosed(c, err)
 		el.addSConn(-1)
+		// frags left behind by the handler are dropped along with the queues
+		if c.inflight != nil {
+			c.inflight.Sub(float64(c.inFragQueue.count + c.outFragQueue.count))
+		}
 		switch closeType {
 		case ConnEof:
 			GlobalStats.RedisServerEof.WithLabelValues(c.RemoteAddr()).Inc()
@@ -415,52 +679,168 @@ func (el *eventloop) ticker() {
 	}
 	el.nextTicker = now.Add(time.Second)
 
-	if EngineGlobal.ClusterNodes.serverChanged {
-		logging.Infof("[server changed] start load new server, old redis nodes: %+v", EngineGlobal.ProxyAddrs)
+	el.reloadServers()
+	el.checkSlotCoverage(now)
+	el.checkSlowClients()
+	el.checkHandshakes(now)
+	el.closeDrainedPools(now)
+	_ = el.resumeReads()
+
+	for k, v := range EngineGlobal.ProxyPool {
+		v.autoscale()
+		GlobalStats.RedisServerActive.WithLabelValues(k).Set(float64(v.ActiveCount()))
+	}
+
+	el.eventHandler.OnTicker()
+}
 
-		for k, v := range EngineGlobal.ProxyPool {
-			if _, ok := EngineGlobal.ClusterNodes.ServerMap.Get(k); !ok {
-				v.Close()
-				delete(EngineGlobal.ProxyPool, k)
-				logging.Infof("[server changed] remove server %s", k)
+// checkSlowClients flags the clients whose outbound buffer stays above ClientSlowOutbound for ClientSlowTicks,
+// a slow consumer holds the memory of its replies and may be closed rather than degrade the proxy
+func (el *eventloop) checkSlowClients() {
+	opts := el.engine.opts
+	if opts.ClientSlowOutbound < 1 {
+		return
+	}
+	for _, c := range el.connections {
+		if c.connType != ConnClient {
+			continue
+		}
+		buffered := c.OutboundBuffered()
+		if buffered <= opts.ClientSlowOutbound {
+			c.slowTicks = 0
+			continue
+		}
+		if c.slowTicks++; c.slowTicks < opts.ClientSlowTicks {
+			continue
+		}
+		if !opts.ClientSlowDisconnect {
+			// logged once per period, rather than every tick
+			if c.slowTicks == opts.ClientSlowTicks {
+				logging.Warnf("[slow client] [%dc] client %s buffered %d bytes for %ds", c.fd, c.RemoteAddr(), buffered, c.slowTicks)
+				GlobalStats.SlowClients.WithLabelValues("logged").Inc()
 			}
+			continue
+		}
+		logging.Warnf("[slow client] [%dc] client %s buffered %d bytes for %ds, disconnected", c.fd, c.RemoteAddr(), buffered, c.slowTicks)
+		GlobalStats.SlowClients.WithLabelValues("disconnected").Inc()
+		_ = el.closeConn(c, nil, ProxyEof)
+	}
+}
+
+// checkHandshakes closes the clients which have not sent a complete command within ClientHandshakeTimeout
+// since they connected, a defense against the connections opened and left silent or trickling bytes
+func (el *eventloop) checkHandshakes(now time.Time) {
+	timeout := time.Duration(el.engine.opts.ClientHandshakeTimeout) * time.Second
+	if timeout < 1 {
+		return
+	}
+	for _, c := range el.connections {
+		if c.connType != ConnClient || c.commanded || now.Sub(c.createdAt) < timeout {
+			continue
 		}
+		logging.Warnf("[handshake timeout] [%dc] client %s sent no complete command in %s, disconnected", c.fd, c.RemoteAddr(), timeout)
+		GlobalStats.HandshakeTimeouts.WithLabelValues().Inc()
+		_ = el.closeConn(c, nil, ProxyEof)
+	}
+}
 
-		for kv := range EngineGlobal.ClusterNodes.ServerMap.Iter() {
-			k := kv.Key.(string)
-			v := kv.Value.(*ClusterNode)
-			isSlave := v.Role == Slave
-			if pool, ok := EngineGlobal.ProxyPool[kv.Key.(string)]; ok {
-				pool.SetIsSlave(isSlave)
-			} else {
-				EngineGlobal.ProxyPool[k] = el.engine.newPool(k, isSlave)
-				logging.Infof("[server changed] add new server %s, isSlave: %t", k, isSlave)
-			}
+// closeDrainedPools closes the pools of the removed nodes once their requests in flight are answered,
+// the requests still in flight past RedisServerDrainGrace are dropped with the connections
+func (el *eventloop) closeDrainedPools(now time.Time) {
+	n := 0
+	for _, p := range el.draining {
+		if !p.Drained(now) {
+			el.draining[n] = p
+			n++
+			continue
 		}
+		if inflight := p.InFlight(); inflight > 0 {
+			logging.Warnf("[server changed] server %s drain grace expired, %d requests in flight dropped", p.Addr, inflight)
+		} else {
+			logging.Infof("[server changed] server %s drained", p.Addr)
+		}
+		p.Close()
+	}
+	for i := n; i < len(el.draining); i++ {
+		el.draining[i] = nil
+	}
+	el.draining = el.draining[:n]
+}
 
-		EngineGlobal.Slots2Node.Reset()
-		for _, rs := range EngineGlobal.ClusterNodes.Replicasets {
-			for _, slotRange := range rs.Master.Slots {
-				for i := slotRange.Start; i <= slotRange.End; i++ {
-					EngineGlobal.Slots2Node.Set(i, rs)
-				}
+// reloadServers applies the topology updated by the cluster nodes loop to the pools and slots
+func (el *eventloop) reloadServers() {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+	if !EngineGlobal.ClusterNodes.serverChanged {
+		return
+	}
+	now := time.Now()
+	logging.Infof("[server changed] start load new server, old redis nodes: %+v", EngineGlobal.ProxyAddrs)
+
+	for k, v := range EngineGlobal.ProxyPool {
+		if _, ok := EngineGlobal.ClusterNodes.ServerMap.Get(k); !ok {
+			delete(EngineGlobal.ProxyPool, k)
+			if grace := el.engine.opts.RedisServerDrainGrace; grace > 0 && v.InFlight() > 0 {
+				v.Drain(now.Add(time.Duration(grace) * time.Second))
+				el.draining = append(el.draining, v)
+				logging.Infof("[server changed] remove server %s, draining %d requests in flight", k, v.InFlight())
+				continue
 			}
+			v.Close()
+			logging.Infof("[server changed] remove server %s", k)
 		}
+	}
 
-		EngineGlobal.ProxyAddrs = EngineGlobal.ProxyAddrs[:0]
-		for k := range EngineGlobal.ProxyPool {
-			EngineGlobal.ProxyAddrs = append(EngineGlobal.ProxyAddrs, k)
+	for kv := range EngineGlobal.ClusterNodes.ServerMap.Iter() {
+		k := kv.Key.(string)
+		v := kv.Value.(*ClusterNode)
+		isSlave := v.Role == Slave
+		if pool, ok := EngineGlobal.ProxyPool[kv.Key.(string)]; ok {
+			pool.SetIsSlave(isSlave)
+		} else {
+			EngineGlobal.ProxyPool[k] = el.engine.newPool(k, isSlave)
+			logging.Infof("[server changed] add new server %s, isSlave: %t", k, isSlave)
 		}
+	}
 
-		EngineGlobal.ClusterNodes.serverChanged = false
-		logging.Infof("[server changed] end load new server, cost: %s, new redis nodes: %+v", time.Since(now), EngineGlobal.ProxyAddrs)
+	EngineGlobal.Slots2Node.Reset()
+	for _, rs := range EngineGlobal.ClusterNodes.Replicasets {
+		for _, slotRange := range rs.Master.Slots {
+			for i := slotRange.Start; i <= slotRange.End; i++ {
+				EngineGlobal.Slots2Node.Set(i, rs)
+			}
+		}
 	}
 
-	for k, v := range EngineGlobal.ProxyPool {
-		GlobalStats.RedisServerActive.WithLabelValues(k).Set(float64(v.ActiveCount()))
+	EngineGlobal.ProxyAddrs = EngineGlobal.ProxyAddrs[:0]
+	for k := range EngineGlobal.ProxyPool {
+		EngineGlobal.ProxyAddrs = append(EngineGlobal.ProxyAddrs, k)
 	}
 
-	el.eventHandler.OnTicker()
+	el.updateSlotCoverage()
+	EngineGlobal.SetReady()
+
+	EngineGlobal.ClusterNodes.serverChanged = false
+	logging.Infof("[server changed] end load new server, cost: %s, new redis nodes: %+v", time.Since(now), EngineGlobal.ProxyAddrs)
+}
+
+// writeClusterNodes sends the cluster nodes command to the redis node, a random one if addr is empty
+func (el *eventloop) writeClusterNodes(addr string) error {
+	if len(addr) < 1 {
+		if len(EngineGlobal.ProxyAddrs) < 1 {
+			return errors.New("no addr found")
+		}
+		addr = EngineGlobal.ProxyAddrs[rand.Intn(len(EngineGlobal.ProxyAddrs))]
+	}
+	pool, ok := EngineGlobal.ProxyPool[addr]
+	if !ok {
+		return fmt.Errorf("proxy pool[%s] not found", addr)
+	}
+	sConn := pool.Get()
+	if sConn == nil {
+		return fmt.Errorf("proxy.Dial[%s] failed", addr)
+	}
+	return sConn.(*conn).writeClusterNodes(nil)
 }
 
 // allow the maximum processing time of redis,
@@ -484,19 +864,35 @@ func (el *eventloop) msgTimeout() {
 		c := frag.Owner
 		msg := frag.Peer
 
-		for _, v := range msg.Body {
-			if v.Done {
-				continue
+		msg.RangeFrags(func(_ int32, v *Frag) bool {
+			if !v.Done {
+				v.Error = codec.ErrMsgRequestTimeout
+				v.Done = true
 			}
-			v.Error = codec.ErrMsgRequestTimeout
-			v.Done = true
-		}
+			return true
+		})
 		msg.Error = codec.ErrMsgRequestTimeout
+		if msg.Acked {
+			logging.Warnf("[%dm|%df][%dc] acknowledged request timeout, req: %s", frag.MsgId(), frag.Id, frag.OwnerFd(), frag.ReqString())
+			GlobalStats.AckedErrors.WithLabelValues(codec.Transform2Str(msg.Type)).Inc()
+			// no client waits for it, the request is released once the late replies of its frags are read
+			continue
+		}
 		if c == nil || !c.IsOpened() {
 			logging.Warnf("[%dm|%df][%dc] try to send request timeout but client already closed", frag.MsgId(), frag.Id, frag.OwnerFd())
 			continue
 		}
-		c.AsyncWrite(codec.ErrMsgRequestTimeout.Bytes(), nil)
+		// the client which sent QUIT behind the request reads nothing more, answer it
+		// in order with the rest of its queue, then the QUIT reply closes it
+		if cc, ok := c.(*conn); ok && cc.quitting {
+			msg.Done = true
+			msg.RspBody = append(msg.RspBody[:0], codec.ErrMsgRequestTimeout.Bytes()...)
+			if cc.inMsgQueue.AllDone() {
+				el.writeReplies(cc)
+			}
+		} else {
+			c.AsyncWrite(codec.ErrMsgRequestTimeout.Bytes(), nil)
+		}
 		logging.Warnf("[%dm|%df][%dc] request timeout, consider raising config '[proxy]timeout=%d', send res: %s", frag.MsgId(), frag.Id, frag.OwnerFd(), el.engine.opts.RedisRequestTimeout, codec.ErrMsgRequestTimeout.ShortString())
 	}
 }
@@ -0,0 +1,973 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || freebsd || dragonfly || darwin
+// +build linux freebsd dragonfly darwin
+
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"rcproxy/core/codec"
+	"rcproxy/core/internal/netpoll"
+	gerrors "rcproxy/core/pkg/errors"
+	"rcproxy/core/pkg/logging"
+)
+
+// newTestLoop returns an event loop which is not polling, and a connection registered on it,
+// whose peer fd plays the client or the redis server
+func newTestLoop(t *testing.T, connType ConnType) (*eventloop, *conn, int) {
+	EngineGlobal = &Engine{sCodec: SRespCodec{MsgMaxLength: 10000}, cCodec: CRespCodec{MsgMaxLength: 10000}}
+
+	poller, err := netpoll.OpenPoller()
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = poller.Close() })
+
+	eng := &engine{
+		opts:         &Options{ReadBufferCap: 1024, ServerReadBufferCap: 4096, WriteBufferCap: 1024},
+		eventHandler: &BuiltinEventEngine{},
+	}
+	el := eng.newEventloop(nil, poller)
+	c, peer := addTestConn(t, el, connType)
+	return el, c, peer
+}
+
+// addTestConn registers another connection on the event loop, returning it and its peer fd
+func addTestConn(t *testing.T, el *eventloop, connType ConnType) (*conn, int) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = unix.Close(fds[1]) })
+
+	c := newTCPConn(fds[0], el, nil, nil, connType, Initialized, false)
+	c.opened = true
+	el.connections[c.fd] = c
+	assert.Nil(t, el.poller.AddRead(c.pollAttachment))
+	return c, fds[1]
+}
+
+func TestSReadDesync(t *testing.T) {
+	el, s, peer := newTestLoop(t, ConnServer)
+	before := testutil.ToFloat64(GlobalStats.BackendDesync.WithLabelValues(s.RemoteAddr()))
+
+	// no request has been sent on the connection, so the reply can't be paired
+	_, err := unix.Write(peer, []byte("+OK\r\n"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, el.read(s))
+	assert.False(t, s.opened, "desync connection should be closed")
+	_, ok := el.connections[s.fd]
+	assert.False(t, ok)
+	assert.Equal(t, before+1, testutil.ToFloat64(GlobalStats.BackendDesync.WithLabelValues(s.RemoteAddr())))
+}
+
+func TestSReadResp3(t *testing.T) {
+	el, s, peer := newTestLoop(t, ConnServer)
+	pool := &Pool{Addr: s.RemoteAddr()}
+	EngineGlobal.ProxyPool = map[string]*Pool{pool.Addr: pool}
+
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	s.inFragQueue.PushTail(&Frag{Id: 1})
+	_, err := unix.Write(peer, []byte("%1\r\n+foo\r\n:1\r\n"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, el.read(s))
+	assert.False(t, s.opened, "the connection to a node speaking RESP3 should be closed")
+	assert.Equal(t, Banned, pool.BanStatus().State)
+	assert.True(t, sink.Contains(logging.LevelError, "replied in RESP3, banned for period"))
+}
+
+func TestCReadTooLargeBulk(t *testing.T) {
+	el, c, peer := newTestLoop(t, ConnClient)
+
+	// only the header of the bulk is sent, the proxy must not wait for the payload
+	_, err := unix.Write(peer, []byte("*3\r\n$3\r\nset\r\n$3\r\nfoo\r\n$2000000000\r\n"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, el.read(c))
+	assert.False(t, c.opened, "client connection should be closed")
+	assert.Equal(t, 0, c.inboundBuffer.Buffered())
+
+	rsp := make([]byte, 64)
+	n, err := unix.Read(peer, rsp)
+	assert.Nil(t, err)
+	assert.Equal(t, codec.ErrMsgReqTooLarge.String(), string(rsp[:n]))
+}
+
+func TestReadBufferCap(t *testing.T) {
+	el, s, peer := newTestLoop(t, ConnServer)
+	assert.Equal(t, 1024, len(el.buffer))
+	assert.Equal(t, 4096, len(el.sBuffer))
+
+	// a redis reply larger than the client buffer is read at once
+	reply := "$2000\r\n" + strings.Repeat("a", 2000) + "\r\n"
+	_, err := unix.Write(peer, []byte(reply))
+	assert.Nil(t, err)
+
+	s.inFragQueue.PushTail(&Frag{})
+	assert.Nil(t, el.read(s))
+	assert.True(t, s.opened)
+	assert.Equal(t, 0, s.inboundBuffer.Buffered(), "the whole reply should be read by one read")
+}
+
+func TestClientConns(t *testing.T) {
+	el, c, peer := newTestLoop(t, ConnClient)
+	c.lastActive = c.createdAt.Add(-time.Second)
+	el.addCConn(1)
+
+	conns := el.clientConns()
+	assert.Equal(t, 1, len(conns))
+	assert.Equal(t, c.fd, conns[0].Fd)
+	assert.Equal(t, c.createdAt, conns[0].CreatedAt)
+	assert.Equal(t, 0, conns[0].InFlight)
+	assert.Equal(t, "", conns[0].LibName)
+
+	c.SetLibInfo("redis-py", "5.0.1")
+	conns = el.clientConns()
+	assert.Equal(t, "redis-py", conns[0].LibName)
+	assert.Equal(t, "5.0.1", conns[0].LibVer)
+
+	_, err := unix.Write(peer, []byte("*1\r\n$4\r\nPING\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(c))
+	assert.True(t, el.clientConns()[0].LastActive.After(c.createdAt), "reading the peer refreshes the last activity")
+}
+
+func TestNodeInflight(t *testing.T) {
+	el, s, peer := newTestLoop(t, ConnServer)
+	gauge := GlobalStats.NodeInflight.WithLabelValues(s.RemoteAddr())
+	before := testutil.ToFloat64(gauge)
+
+	frags := make([]*Frag, 3)
+	for i := range frags {
+		frags[i] = FragPool.Get()
+		frags[i].Req = append(frags[i].Req, "*1\r\n$4\r\nPING\r\n"...)
+	}
+
+	s.EnqueueOutFrag(frags[0])
+	s.EnqueueOutFrag(frags[1])
+	assert.Equal(t, before+2, testutil.ToFloat64(gauge))
+
+	// written frags wait for their reply and stay in flight
+	assert.Nil(t, s.handleWriteSignal(nil))
+	buf := make([]byte, 64)
+	_, err := unix.Read(peer, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, before+2, testutil.ToFloat64(gauge))
+
+	assert.Equal(t, frags[0], s.DequeueInFrag())
+	assert.Equal(t, before+1, testutil.ToFloat64(gauge))
+
+	// one frag waiting for a reply and one not yet written are dropped on close
+	s.EnqueueOutFrag(frags[2])
+	assert.Equal(t, before+2, testutil.ToFloat64(gauge))
+	assert.Nil(t, el.closeConn(s, nil, ProxyEof))
+	deleteFromTimeoutQueue(frags[1])
+	assert.Equal(t, before, testutil.ToFloat64(gauge))
+}
+
+func TestInitializingHoldsFrags(t *testing.T) {
+	el, s, peer := newTestLoop(t, ConnServer)
+	s.SetInitializeStep(1)
+	s.SetInitializeStatus(Initializing)
+	assert.Nil(t, unix.SetNonblock(peer, true))
+
+	f := FragPool.Get()
+	f.Req = append(f.Req, "*1\r\n$4\r\nPING\r\n"...)
+	assert.Nil(t, s.EnqueueOutFrag(f))
+
+	// nothing is written before the AUTH reply
+	assert.Nil(t, s.handleWriteSignal(nil))
+	buf := make([]byte, 64)
+	_, err := unix.Read(peer, buf)
+	assert.Equal(t, unix.EAGAIN, err)
+	assert.Equal(t, 1, s.outFragQueue.count)
+
+	_, err = unix.Write(peer, []byte("+OK\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+	assert.Equal(t, Initialized, s.InitializeStatus())
+
+	// the held frag goes out once initialized, and waits for its own reply
+	n, err := unix.Read(peer, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "*1\r\n$4\r\nPING\r\n", string(buf[:n]))
+	assert.Equal(t, f, s.inFragQueue.head)
+	assert.Nil(t, el.closeConn(s, nil, ProxyEof))
+}
+
+func TestInitializeRefused(t *testing.T) {
+	el, c, client := newTestLoop(t, ConnClient)
+	s, redis := addTestConn(t, el, ConnServer)
+	el.eventHandler = &forwardHandler{s: s}
+	EngineGlobal.eng = el.engine
+	s.SetInitializeStep(2)
+	s.SetInitializeStatus(Initializing)
+
+	_, err := unix.Write(client, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(c))
+	assert.Equal(t, 1, s.outFragQueue.count)
+
+	// AUTH passes but READONLY is refused, the held GET gets the refusal instead of waiting for good
+	_, err = unix.Write(redis, []byte("+OK\r\n-ERR unknown command 'READONLY'\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+	assert.False(t, s.opened, "a connection which never initializes should be closed")
+	assert.True(t, c.opened)
+	assert.True(t, c.inMsgQueue.Empty())
+
+	buf := make([]byte, 64)
+	n, err := unix.Read(client, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR unknown command 'READONLY'\r\n", string(buf[:n]))
+
+	// invalid auth shuts the proxy down
+	s, redis = addTestConn(t, el, ConnServer)
+	s.SetInitializeStep(1)
+	s.SetInitializeStatus(Initializing)
+	_, err = unix.Write(redis, []byte("-ERR invalid password\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, gerrors.ErrEngineShutdown, el.read(s))
+}
+
+func TestPendingLimit(t *testing.T) {
+	el, s, _ := newTestLoop(t, ConnServer)
+	el.engine.opts.RedisServerMaxPending = 2
+	client, _ := addTestConn(t, el, ConnClient)
+
+	frags := make([]*Frag, 3)
+	for i := range frags {
+		frags[i] = FragPool.Get()
+		frags[i].Owner = client
+		frags[i].Req = append(frags[i].Req, "*1\r\n$4\r\nPING\r\n"...)
+	}
+	assert.Nil(t, s.EnqueueOutFrag(frags[0]))
+	assert.Nil(t, s.EnqueueOutFrag(frags[1]))
+	assert.Equal(t, codec.ErrPendingLimit, s.EnqueueOutFrag(frags[2]))
+	assert.Equal(t, 2, s.InFlight())
+
+	// written frags waiting for their reply are still pending, the node stalled doesn't drain them
+	assert.Nil(t, s.handleWriteSignal(nil))
+	assert.Equal(t, codec.ErrPendingLimit, s.EnqueueOutFrag(frags[2]))
+
+	assert.Equal(t, frags[0], s.DequeueInFrag())
+	deleteFromTimeoutQueue(frags[1])
+	assert.Nil(t, s.EnqueueOutFrag(frags[2]))
+
+	// the monitor is never refused
+	assert.Nil(t, s.EnqueueOutFrag(FragPool.Get()))
+	assert.Equal(t, 3, s.InFlight())
+}
+
+// forwardHandler forwards every request to the redis connection s, and answers QUIT locally.
+// SET and MSET are acknowledged on send if ack is set, MOVED/ASK is relayed to the client if relay is set
+type forwardHandler struct {
+	BuiltinEventEngine
+	s     *conn
+	pool  *Pool // the frags go to a connection of the pool rather than s, if set
+	ack   bool
+	acked *Msg // the last acknowledged request
+	relay bool
+}
+
+func (h *forwardHandler) OnMoved(_ string, _ int32, _ SConn, _ *Frag) bool {
+	return h.relay
+}
+
+func (h *forwardHandler) OnCReact(r *Msg, c CConn) ([]byte, Action) {
+	if r.Type == codec.ReqQuit {
+		return codec.OK.Bytes(), Close
+	}
+	r.RangeFrags(func(_ int32, frag *Frag) bool {
+		frag.Owner = c
+		if h.pool != nil {
+			h.pool.Get().EnqueueOutFrag(frag)
+			return true
+		}
+		h.s.EnqueueOutFrag(frag)
+		return true
+	})
+	if h.ack && (r.Type == codec.ReqSet || r.Type == codec.ReqMset) && c.Pending() == 0 {
+		r.Acked = true
+		h.acked = r
+		return codec.OK.Bytes(), None
+	}
+	c.EnqueueInMsg(r)
+	return nil, None
+}
+
+func TestQuitAfterPipeline(t *testing.T) {
+	el, c, client := newTestLoop(t, ConnClient)
+	s, redis := addTestConn(t, el, ConnServer)
+	el.eventHandler = &forwardHandler{s: s}
+	EngineGlobal.eng = el.engine
+
+	// the PING after QUIT is discarded, as redis does
+	_, err := unix.Write(client, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n*1\r\n$4\r\nQUIT\r\n*1\r\n$4\r\nPING\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(c))
+	assert.True(t, c.opened, "QUIT waits for the pipelined GET")
+
+	assert.Nil(t, s.handleWriteSignal(nil))
+	buf := make([]byte, 64)
+	n, err := unix.Read(redis, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "*2\r\n$3\r\nget\r\n$1\r\na\r\n", string(buf[:n]))
+
+	_, err = unix.Write(redis, []byte("$1\r\n1\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+	assert.False(t, c.opened, "client connection should be closed once the GET is answered")
+
+	n, err = unix.Read(client, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "$1\r\n1\r\n+OK\r\n", string(buf[:n]))
+}
+
+func TestQuitAfterTimeout(t *testing.T) {
+	el, c, client := newTestLoop(t, ConnClient)
+	s, _ := addTestConn(t, el, ConnServer)
+	el.eventHandler = &forwardHandler{s: s}
+	el.engine.opts.RedisRequestTimeout = 10
+	EngineGlobal.eng = el.engine
+
+	_, err := unix.Write(client, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n*1\r\n$4\r\nQUIT\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(c))
+	assert.Nil(t, s.handleWriteSignal(nil))
+
+	// redis never answers the GET
+	time.Sleep(20 * time.Millisecond)
+	el.msgTimeout()
+	assert.False(t, c.opened, "client connection should be closed once the GET timed out")
+
+	buf := make([]byte, 64)
+	n, err := unix.Read(client, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, codec.ErrMsgRequestTimeout.String()+"+OK\r\n", string(buf[:n]))
+}
+
+func TestRelayRedirect(t *testing.T) {
+	el, c, client := newTestLoop(t, ConnClient)
+	s, redis := addTestConn(t, el, ConnServer)
+	el.eventHandler = &forwardHandler{s: s, relay: true}
+	EngineGlobal.eng = el.engine
+
+	_, err := unix.Write(client, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(c))
+	assert.Nil(t, s.handleWriteSignal(nil))
+	buf := make([]byte, 64)
+	_, err = unix.Read(redis, buf)
+	assert.Nil(t, err)
+
+	moved := "-MOVED 15495 127.0.0.1:7002\r\n"
+	_, err = unix.Write(redis, []byte(moved))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+
+	n, err := unix.Read(client, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, moved, string(buf[:n]))
+	assert.True(t, c.inMsgQueue.Empty())
+}
+
+func TestSReadTooManyElements(t *testing.T) {
+	el, c, client := newTestLoop(t, ConnClient)
+	s, redis := addTestConn(t, el, ConnServer)
+	el.eventHandler = &forwardHandler{s: s}
+	EngineGlobal.eng = el.engine
+	EngineGlobal.sCodec.MaxReplyElements = 3
+
+	_, err := unix.Write(client, []byte("*2\r\n$8\r\nSMEMBERS\r\n$1\r\na\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(c))
+	assert.Nil(t, s.handleWriteSignal(nil))
+	buf := make([]byte, 64)
+	_, err = unix.Read(redis, buf)
+	assert.Nil(t, err)
+
+	// only the header of the reply arrives, the proxy must not wait for its elements
+	_, err = unix.Write(redis, []byte("*100000000\r\n$1\r\na\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+	assert.False(t, s.opened, "the connection with the reply left unread should be closed")
+
+	n, err := unix.Read(client, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, codec.ErrMsgRspTooManyElements.String(), string(buf[:n]))
+	assert.True(t, c.inMsgQueue.Empty())
+}
+
+func TestCompressReply(t *testing.T) {
+	el, plain, plainClient := newTestLoop(t, ConnClient)
+	negotiated, client := addTestConn(t, el, ConnClient)
+	s, redis := addTestConn(t, el, ConnServer)
+	el.eventHandler = &forwardHandler{s: s}
+	EngineGlobal.eng = el.engine
+	negotiated.SetCompressThreshold(64)
+
+	value := strings.Repeat("rcproxy", 300)
+	get := func(c *conn, peer int, reply string) string {
+		_, err := unix.Write(peer, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+		assert.Nil(t, err)
+		assert.Nil(t, el.read(c))
+		assert.Nil(t, s.handleWriteSignal(nil))
+		buf := make([]byte, 4096)
+		_, err = unix.Read(redis, buf)
+		assert.Nil(t, err)
+
+		_, err = unix.Write(redis, []byte(reply))
+		assert.Nil(t, err)
+		assert.Nil(t, el.read(s))
+		n, err := unix.Read(peer, buf)
+		assert.Nil(t, err)
+		return string(buf[:n])
+	}
+
+	// the large value round-trips through the compressed reply
+	bulk := fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	rsp := get(negotiated, client, bulk)
+	if assert.True(t, strings.HasPrefix(rsp, "&"), "reply: %q", rsp) {
+		end := strings.Index(rsp, "\r\n")
+		var n int
+		_, err := fmt.Sscanf(rsp[1:end], "%d", &n)
+		assert.Nil(t, err)
+		assert.Equal(t, len(rsp), end+2+n+2)
+		assert.Less(t, n, len(value))
+		payload, err := io.ReadAll(flate.NewReader(bytes.NewReader([]byte(rsp[end+2 : end+2+n]))))
+		assert.Nil(t, err)
+		assert.Equal(t, value, string(payload))
+	}
+
+	// the small values and the other replies are unchanged
+	assert.Equal(t, "$3\r\nfoo\r\n", get(negotiated, client, "$3\r\nfoo\r\n"))
+	assert.Equal(t, "$-1\r\n", get(negotiated, client, "$-1\r\n"))
+
+	// a client not negotiating gets the plain reply
+	assert.Equal(t, bulk, get(plain, plainClient, bulk))
+}
+
+func TestCloseConnFailingPeer(t *testing.T) {
+	el, c, peer := newTestLoop(t, ConnClient)
+	// the peer stops reading, so flushing the residual data fails with EPIPE
+	assert.Nil(t, unix.Shutdown(peer, unix.SHUT_RD))
+	_, _ = c.outboundBuffer.Write([]byte("+OK\r\n"))
+
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	fd := c.fd
+	done := make(chan error, 1)
+	go func() { done <- el.closeConn(c, nil, ConnErr) }()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("closeConn keeps retrying a failing peer")
+	}
+
+	assert.False(t, c.opened)
+	assert.NotContains(t, el.connections, fd)
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	assert.Equal(t, unix.EBADF, err, "fd is leaked")
+	assert.True(t, sink.Contains(logging.LevelError, "broken pipe"))
+}
+
+func TestCloseAllSocketsSummary(t *testing.T) {
+	el, c, _ := newTestLoop(t, ConnClient)
+	idle, _ := addTestConn(t, el, ConnClient)
+	s, _ := addTestConn(t, el, ConnServer)
+
+	c.EnqueueInMsg(&Msg{Id: 1})
+	c.EnqueueInMsg(&Msg{Id: 2})
+	s.inFragQueue.PushTail(&Frag{Id: 1})
+	s.outFragQueue.PushTail(&Frag{Id: 2})
+	s.outFragQueue.PushTail(&Frag{Id: 3})
+
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	el.closeAllSockets()
+	assert.False(t, c.opened)
+	assert.False(t, idle.opened)
+	assert.False(t, s.opened)
+	assert.True(t, sink.Contains(logging.LevelInfo, "[shutdown] closed 2 client connections with 2 in-flight requests abandoned, 1 redis connections with 3 in-flight frags abandoned"))
+}
+
+func TestCheckSlowClients(t *testing.T) {
+	el, c, _ := newTestLoop(t, ConnClient)
+	fast, _ := addTestConn(t, el, ConnClient)
+	el.engine.opts.ClientSlowOutbound = 1024
+	el.engine.opts.ClientSlowTicks = 3
+	GlobalStats.ResetCounters()
+
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	// the client doesn't drain its socket, the replies pile up in the outbound buffer
+	_, _ = c.outboundBuffer.Write(make([]byte, 4096))
+	_, _ = fast.outboundBuffer.Write(make([]byte, 512))
+	for i := 0; i < 2; i++ {
+		el.checkSlowClients()
+	}
+	assert.False(t, sink.Contains(logging.LevelWarn, "[slow client]"), "not sustained yet")
+
+	el.checkSlowClients()
+	el.checkSlowClients()
+	assert.True(t, sink.Contains(logging.LevelWarn, "buffered 4096 bytes for 3s"))
+	assert.Equal(t, 1, len(sink.Lines()), "logged once")
+	assert.Equal(t, float64(1), testutil.ToFloat64(GlobalStats.SlowClients.WithLabelValues("logged")))
+	assert.True(t, c.opened)
+	assert.Equal(t, 0, fast.slowTicks)
+
+	// disconnected once flagged if configured
+	el.engine.opts.ClientSlowDisconnect = true
+	el.checkSlowClients()
+	assert.False(t, c.opened)
+	assert.True(t, fast.opened)
+	assert.Equal(t, float64(1), testutil.ToFloat64(GlobalStats.SlowClients.WithLabelValues("disconnected")))
+}
+
+func TestCheckHandshakes(t *testing.T) {
+	el, silent, _ := newTestLoop(t, ConnClient)
+	talking, peer := addTestConn(t, el, ConnClient)
+	el.engine.opts.ClientHandshakeTimeout = 2
+	GlobalStats.ResetCounters()
+
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	// a partial command is not a handshake
+	_, err := unix.Write(peer, []byte("*1\r\n$4\r\nPI"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(talking))
+	assert.False(t, talking.commanded)
+	_, err = unix.Write(peer, []byte("NG\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(talking))
+	assert.True(t, talking.commanded)
+
+	el.checkHandshakes(silent.createdAt.Add(time.Second))
+	assert.True(t, silent.opened, "still within the timeout")
+
+	el.checkHandshakes(silent.createdAt.Add(3 * time.Second))
+	assert.False(t, silent.opened)
+	assert.True(t, talking.opened)
+	assert.True(t, sink.Contains(logging.LevelWarn, "sent no complete command in 2s, disconnected"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(GlobalStats.HandshakeTimeouts.WithLabelValues()))
+}
+
+func TestAckOnSend(t *testing.T) {
+	el, c, client := newTestLoop(t, ConnClient)
+	s, redis := addTestConn(t, el, ConnServer)
+	el.eventHandler = &forwardHandler{s: s, ack: true}
+	EngineGlobal.eng = el.engine
+	GlobalStats.ResetCounters()
+
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	// answered before redis is even written to
+	_, err := unix.Write(client, []byte("*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(c))
+	buf := make([]byte, 64)
+	n, err := unix.Read(client, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n", string(buf[:n]))
+	assert.Equal(t, 0, c.Pending())
+
+	assert.Nil(t, s.handleWriteSignal(nil))
+	n, err = unix.Read(redis, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n", string(buf[:n]))
+
+	// the error of redis is logged and counted, the client sees nothing more
+	_, err = unix.Write(redis, []byte("-OOM command not allowed when used memory > 'maxmemory'\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+	assert.Equal(t, 0, s.InFlight())
+	assert.True(t, sink.Contains(logging.LevelWarn, "acknowledged request failed"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(GlobalStats.AckedErrors.WithLabelValues("set")))
+	_, _, err = unix.Recvfrom(client, buf, unix.MSG_DONTWAIT)
+	assert.Equal(t, unix.EAGAIN, err)
+	assert.True(t, c.opened)
+}
+
+func TestAckOnSendMultiSlot(t *testing.T) {
+	el, c, client := newTestLoop(t, ConnClient)
+	s, redis := addTestConn(t, el, ConnServer)
+	h := &forwardHandler{s: s, ack: true}
+	el.eventHandler = h
+	EngineGlobal.eng = el.engine
+	GlobalStats.ResetCounters()
+
+	// a and b hash to different slots, the MSET is forwarded as two frags
+	_, err := unix.Write(client, []byte("*5\r\n$4\r\nMSET\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(c))
+	buf := make([]byte, 128)
+	n, err := unix.Read(client, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n", string(buf[:n]))
+	msg := h.acked
+	assert.NotNil(t, msg)
+	assert.Equal(t, 2, msg.NumFrags())
+
+	assert.Nil(t, s.handleWriteSignal(nil))
+	_, err = unix.Read(redis, buf)
+	assert.Nil(t, err)
+
+	// the request is kept while a frag is still in flight
+	_, err = unix.Write(redis, []byte("+OK\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+	assert.Equal(t, 1, s.InFlight())
+	assert.True(t, msg.Acked)
+	assert.NotNil(t, msg.Body)
+
+	// and released once the last one replies
+	_, err = unix.Write(redis, []byte("+OK\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+	assert.Equal(t, 0, s.InFlight())
+	assert.False(t, msg.Acked)
+	assert.Nil(t, msg.Body)
+	assert.Equal(t, float64(0), testutil.ToFloat64(GlobalStats.AckedErrors.WithLabelValues("mset")))
+	assert.True(t, c.opened)
+}
+
+func TestRequestDeadline(t *testing.T) {
+	el, c, _ := newTestLoop(t, ConnClient)
+	s, _ := addTestConn(t, el, ConnServer)
+	el.engine.opts.RedisRequestTimeout = 10000
+
+	hinted := &Msg{Type: codec.ReqGet, Owner: c, Timeout: 20, Body: map[int32]*Frag{}}
+	hinted.Body[0] = &Frag{Id: 1, Owner: c, Peer: hinted}
+	plain := &Msg{Type: codec.ReqGet, Owner: c, Body: map[int32]*Frag{}}
+	plain.Body[0] = &Frag{Id: 2, Owner: c, Peer: plain}
+	t.Cleanup(func() {
+		deleteFromTimeoutQueue(hinted.Body[0])
+		deleteFromTimeoutQueue(plain.Body[0])
+	})
+
+	start := time.Now()
+	s.enqueueInFrag(hinted.Body[0])
+	s.enqueueInFrag(plain.Body[0])
+	assert.WithinDuration(t, start.Add(20*time.Millisecond), hinted.Body[0].Timeout, 10*time.Millisecond)
+	assert.WithinDuration(t, start.Add(10*time.Second), plain.Body[0].Timeout, 10*time.Millisecond)
+
+	// the hinted request times out at its deadline, long before the global timeout
+	time.Sleep(30 * time.Millisecond)
+	el.msgTimeout()
+	assert.Equal(t, codec.ErrMsgRequestTimeout, hinted.Error)
+	assert.True(t, plain.Error.Nil())
+}
+
+func TestAckedTimeout(t *testing.T) {
+	el, c, _ := newTestLoop(t, ConnClient)
+	s, redis := addTestConn(t, el, ConnServer)
+	el.eventHandler = &forwardHandler{s: s, relay: true}
+	el.engine.opts.RedisRequestTimeout = 10
+	GlobalStats.ResetCounters()
+
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	acked := &Msg{Id: 1, Type: codec.ReqSet, Owner: c, Acked: true, Body: map[int32]*Frag{}}
+	frag := &Frag{Id: 1, Owner: c, Peer: acked}
+	acked.Body[0] = frag
+	t.Cleanup(func() { deleteFromTimeoutQueue(frag) })
+	s.enqueueInFrag(frag)
+
+	// no client waits for the reply, the request is counted but kept while its frag is queued
+	time.Sleep(20 * time.Millisecond)
+	el.msgTimeout()
+	assert.True(t, frag.Done)
+	assert.Equal(t, float64(1), testutil.ToFloat64(GlobalStats.AckedErrors.WithLabelValues("set")))
+	assert.Equal(t, uint64(1), acked.Id)
+
+	// a late MOVED is dropped rather than redirected, and the request released
+	_, err := unix.Write(redis, []byte("-MOVED 15495 127.0.0.1:7001\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+	assert.Equal(t, 0, s.InFlight())
+	assert.True(t, sink.Contains(logging.LevelWarn, "frag already done"))
+	assert.False(t, sink.Contains(logging.LevelWarn, "got res"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(GlobalStats.AckedErrors.WithLabelValues("set")))
+	assert.Equal(t, uint64(0), acked.Id)
+	assert.Nil(t, acked.Body)
+}
+
+func TestAcceptFdExhausted(t *testing.T) {
+	el, busy, _ := newTestLoop(t, ConnClient)
+	idle, _ := addTestConn(t, el, ConnClient)
+	recent, _ := addTestConn(t, el, ConnClient)
+	el.ln = &listener{fd: -1}
+	GlobalStats.ResetCounters()
+
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	acceptFunc = func(int) (int, unix.Sockaddr, error) { return -1, nil, unix.EMFILE }
+	t.Cleanup(func() { acceptFunc = unix.Accept })
+
+	// the busy client is the idlest one but has a request in flight
+	now := time.Now()
+	busy.lastActive = now.Add(-time.Hour)
+	busy.inMsgQueue.PushTail(&Msg{})
+	idle.lastActive = now.Add(-time.Minute)
+	recent.lastActive = now
+
+	assert.Nil(t, el.accept(0, 0), "fd exhaustion should not stop the event loop")
+	assert.True(t, busy.opened)
+	assert.False(t, idle.opened)
+	assert.True(t, recent.opened)
+	assert.True(t, sink.Contains(logging.LevelError, "fd exhaustion"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(GlobalStats.AcceptErrors.WithLabelValues("emfile")))
+
+	// every client is busy, the pending connection is accepted with the spare fd and closed
+	// rather than leaving the listener firing again at once
+	recent.inMsgQueue.PushTail(&Msg{})
+	el.spareFd = reserveFd()
+	assert.True(t, el.spareFd >= 0)
+	t.Cleanup(func() { _ = unix.Close(el.spareFd) })
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = unix.Close(fds[1]) })
+	calls := 0
+	acceptFunc = func(int) (int, unix.Sockaddr, error) {
+		if calls++; calls == 1 {
+			return -1, nil, unix.EMFILE
+		}
+		return fds[0], nil, nil
+	}
+	assert.Nil(t, el.accept(0, 0))
+	assert.Equal(t, 2, calls)
+	assert.True(t, busy.opened)
+	assert.True(t, recent.opened)
+	n, err := unix.Read(fds[1], make([]byte, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n, "the pending connection should be closed")
+	assert.True(t, el.spareFd >= 0, "the spare fd should be reserved again")
+
+	exhausted := 0
+	for _, line := range sink.Lines() {
+		if strings.Contains(line, "fd exhaustion") {
+			exhausted++
+		}
+	}
+	assert.Equal(t, 1, exhausted, "fd exhaustion is logged once per second")
+
+	acceptFunc = func(int) (int, unix.Sockaddr, error) { return -1, nil, unix.ECONNABORTED }
+	assert.NotNil(t, el.accept(0, 0))
+}
+
+func TestOutboundSpill(t *testing.T) {
+	_, c, _ := newTestLoop(t, ConnClient)
+	GlobalStats.ResetCounters()
+
+	// the static buffer of WriteBufferCap is filled first, the rest spills
+	_, _ = c.outboundBuffer.Write(make([]byte, 1024))
+	assert.Equal(t, float64(0), testutil.ToFloat64(GlobalStats.OutboundSpills.WithLabelValues("client")))
+	_, _ = c.outboundBuffer.Write(make([]byte, 512))
+	_, _ = c.outboundBuffer.Writev([][]byte{make([]byte, 100), make([]byte, 28)})
+	assert.Equal(t, float64(2), testutil.ToFloat64(GlobalStats.OutboundSpills.WithLabelValues("client")))
+	assert.Equal(t, float64(640), testutil.ToFloat64(GlobalStats.OutboundSpillBytes.WithLabelValues("client")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(GlobalStats.OutboundSpills.WithLabelValues("server")))
+}
+
+func TestColdRequest(t *testing.T) {
+	el, c, client := newTestLoop(t, ConnClient)
+	var s *conn
+	var redis int
+	pool := &Pool{Addr: "127.0.0.1:7000", maxActive: 1, Dial: func(string, bool) (SConn, error) {
+		s, redis = addTestConn(t, el, ConnServer)
+		return s, nil
+	}}
+	el.eventHandler = &forwardHandler{pool: pool}
+	EngineGlobal.eng = el.engine
+	GlobalStats.ResetCounters()
+
+	cold := func() uint64 {
+		m := new(dto.Metric)
+		assert.Nil(t, GlobalStats.ColdRequest.WithLabelValues().(prometheus.Metric).Write(m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	get := func() {
+		_, err := unix.Write(client, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+		assert.Nil(t, err)
+		assert.Nil(t, el.read(c))
+		assert.Nil(t, s.handleWriteSignal(nil))
+		buf := make([]byte, 64)
+		_, err = unix.Read(redis, buf)
+		assert.Nil(t, err)
+		_, err = unix.Write(redis, []byte("$1\r\n1\r\n"))
+		assert.Nil(t, err)
+		assert.Nil(t, el.read(s))
+		_, err = unix.Read(client, buf)
+		assert.Nil(t, err)
+	}
+
+	// the first request waits for the connection to be dialed
+	get()
+	assert.Equal(t, uint64(1), cold())
+
+	// the next ones reuse it
+	get()
+	get()
+	assert.Equal(t, uint64(1), cold())
+	assert.Equal(t, 1, pool.ActiveCount())
+}
+
+func TestDrainRemovedServer(t *testing.T) {
+	el, c, client := newTestLoop(t, ConnClient)
+	s, redis := addTestConn(t, el, ConnServer)
+	stuck, _ := addTestConn(t, el, ConnServer)
+	el.eventHandler = &forwardHandler{s: s}
+	el.engine.opts.RedisServerDrainGrace = 5
+	EngineGlobal.eng = el.engine
+
+	pool := &Pool{Addr: "127.0.0.1:7000", cancel: func() {}}
+	pool.active.pushFront(&poolConn{c: s})
+	stuckPool := &Pool{Addr: "127.0.0.1:7001", cancel: func() {}}
+	stuckPool.active.pushFront(&poolConn{c: stuck})
+	stuck.outFragQueue.PushTail(&Frag{})
+	EngineGlobal.ProxyPool = map[string]*Pool{pool.Addr: pool, stuckPool.Addr: stuckPool}
+
+	_, err := unix.Write(client, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(c))
+	assert.Nil(t, s.handleWriteSignal(nil))
+	buf := make([]byte, 64)
+	_, err = unix.Read(redis, buf)
+	assert.Nil(t, err)
+
+	// both nodes leave the topology while a request is in flight on each
+	EngineGlobal.ClusterNodes.serverChanged = true
+	el.reloadServers()
+	assert.Empty(t, EngineGlobal.ProxyPool)
+	assert.ElementsMatch(t, []*Pool{pool, stuckPool}, el.draining)
+	assert.Nil(t, pool.Get(), "a draining pool takes no new request")
+	assert.True(t, s.opened)
+
+	// the request completes within the grace
+	_, err = unix.Write(redis, []byte("$1\r\n1\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+	n, err := unix.Read(client, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "$1\r\n1\r\n", string(buf[:n]))
+
+	el.closeDrainedPools(time.Now())
+	assert.True(t, pool.closed)
+	assert.Equal(t, 0, pool.ActiveCount())
+	assert.Equal(t, []*Pool{stuckPool}, el.draining)
+
+	// the request never answered is dropped once the grace expires
+	el.closeDrainedPools(time.Now().Add(6 * time.Second))
+	assert.True(t, stuckPool.closed)
+	assert.Equal(t, 0, stuckPool.ActiveCount())
+	assert.Empty(t, el.draining)
+}
+
+func TestMaxTotalBufferBytes(t *testing.T) {
+	el, c, client := newTestLoop(t, ConnClient)
+	s, redis := addTestConn(t, el, ConnServer)
+	el.eventHandler = &forwardHandler{s: s}
+	EngineGlobal.eng = el.engine
+	GlobalStats.ResetCounters()
+
+	// 20 bytes forwarded each, the second GET crosses the limit
+	get := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"
+	before := BufferedBytes()
+	el.engine.opts.MaxTotalBufferBytes = int(before) + 30
+
+	_, err := unix.Write(client, []byte(get+get+get))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(c))
+	assert.Equal(t, 2, c.Pending())
+	assert.Equal(t, before+40, BufferedBytes())
+	assert.True(t, c.pollAttachment.ReadPaused)
+	assert.Equal(t, 1, el.readPaused)
+	assert.Equal(t, float64(1), testutil.ToFloat64(GlobalStats.ReadPauses.WithLabelValues()))
+
+	// the replies drain the requests held, the pending GET is decoded without another readable event
+	assert.Nil(t, s.handleWriteSignal(nil))
+	buf := make([]byte, 128)
+	_, err = unix.Read(redis, buf)
+	assert.Nil(t, err)
+	_, err = unix.Write(redis, []byte("$1\r\n1\r\n$1\r\n2\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, el.read(s))
+	n, err := unix.Read(client, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "$1\r\n1\r\n$1\r\n2\r\n", string(buf[:n]))
+
+	assert.False(t, c.pollAttachment.ReadPaused)
+	assert.Equal(t, 0, el.readPaused)
+	assert.Equal(t, 1, c.Pending())
+	assert.Equal(t, before+20, BufferedBytes())
+
+	// the requests of a closed client are released
+	assert.Nil(t, el.closeConn(c, nil, ProxyEof))
+	assert.Equal(t, before, BufferedBytes())
+}
+
+func TestSetLastWrite(t *testing.T) {
+	_, c, _ := newTestLoop(t, ConnClient)
+	window := time.Second
+	start := time.Now()
+
+	// a client writing all over the slots keeps only the writes of the window
+	for i := int32(0); i < 16384; i++ {
+		c.SetLastWrite(i, start.Add(time.Duration(i)*time.Millisecond), window)
+	}
+	assert.LessOrEqual(t, len(c.lastWrites), 2*1000+minLastSweep)
+	_, ok := c.LastWrite(0)
+	assert.False(t, ok)
+	last, ok := c.LastWrite(16383)
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(16383*time.Millisecond), last)
+
+	// nothing is swept below minLastSweep entries
+	c.lastWrites, c.lastSweep = nil, 0
+	c.SetLastWrite(1, start, window)
+	c.SetLastWrite(2, start.Add(time.Hour), window)
+	assert.Len(t, c.lastWrites, 2)
+}
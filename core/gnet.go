@@ -19,8 +19,10 @@ package core
 import (
 	"context"
 	"io"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"rcproxy/core/pkg/constant"
@@ -68,13 +70,13 @@ const (
 )
 
 // Mapping of slots to redis nodes
-type slotReplicaset [constant.RedisClusterSlots]*replicaset
+type slotReplicaset [constant.RedisClusterSlots]*Replicaset
 
-func (sr *slotReplicaset) Set(slot int32, replicaset *replicaset) {
-	sr[slot] = replicaset
+func (sr *slotReplicaset) Set(slot int32, rs *Replicaset) {
+	sr[slot] = rs
 }
 
-func (sr *slotReplicaset) Get(slot int32) *replicaset {
+func (sr *slotReplicaset) Get(slot int32) *Replicaset {
 	return sr[slot]
 }
 
@@ -85,6 +87,16 @@ func (sr *slotReplicaset) NotExist(slot int32) bool {
 	return false
 }
 
+// Covered number of slots served by a replicaset
+func (sr *slotReplicaset) Covered() (n int) {
+	for _, rs := range sr {
+		if rs != nil {
+			n++
+		}
+	}
+	return
+}
+
 func (sr *slotReplicaset) Reset() {
 	for i := 0; i < constant.RedisClusterSlots; i++ {
 		sr[i] = nil
@@ -117,11 +129,217 @@ type Engine struct {
 
 	// Slots2Node mapping of slots to redis nodes
 	Slots2Node slotReplicaset
+
+	// Opts effective options, including the defaults applied in Run
+	Opts *Options
+
+	// readOnlySlots slots rejecting writes during a migration, only touched on the event-loop
+	readOnlySlots map[int32]struct{}
+
+	// ready set to 1 once the topology is first loaded, requests are not forwarded before it
+	ready int32
 }
 
 // CountConnections counts the number of currently active connections and returns it.
 func (s Engine) CountConnections() (count int) {
-	return int(s.eng.el.loadCConn()) + int(s.eng.el.loadSConn())
+	return s.CountCConnections() + s.CountSConnections()
+}
+
+// CountCConnections counts the number of currently active client connections and returns it.
+func (s Engine) CountCConnections() (count int) {
+	if s.eng == nil || s.eng.el == nil {
+		return 0
+	}
+	return int(s.eng.el.loadCConn())
+}
+
+// ClientConnections snapshots the client connections on the event-loop, so as not to race with it
+func (s Engine) ClientConnections() ([]ConnInfo, error) {
+	if s.eng == nil || s.eng.el == nil {
+		return nil, nil
+	}
+	ch := make(chan []ConnInfo, 1)
+	err := s.eng.el.poller.Trigger(func(_ interface{}) error {
+		ch <- s.eng.el.clientConns()
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case conns := <-ch:
+		return conns, nil
+	case <-time.After(time.Second):
+		return nil, errors.ErrEventLoopBusy
+	}
+}
+
+// SlotReadOnly whether writes to the slot are rejected, called on the event-loop
+func (s *Engine) SlotReadOnly(slot int32) bool {
+	_, ok := s.readOnlySlots[slot]
+	return ok
+}
+
+// Ready whether the topology and the pools have been loaded, so that requests can be routed
+func (s *Engine) Ready() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// SetReady marks the topology loaded, it is never reset afterwards
+func (s *Engine) SetReady() {
+	atomic.StoreInt32(&s.ready, 1)
+}
+
+// SetSlotReadOnly marks the slot read-only or writable on the event-loop, so as not to race with it,
+// then returns the read-only slots in order
+func (s *Engine) SetSlotReadOnly(slot int32, readOnly bool) ([]int32, error) {
+	if slot < 0 || slot >= constant.RedisClusterSlots {
+		return nil, errors.ErrInvalidSlot
+	}
+	var slots []int32
+	err := s.onLoop(func() {
+		if readOnly {
+			if s.readOnlySlots == nil {
+				s.readOnlySlots = make(map[int32]struct{})
+			}
+			s.readOnlySlots[slot] = struct{}{}
+		} else {
+			delete(s.readOnlySlots, slot)
+		}
+		slots = make([]int32, 0, len(s.readOnlySlots))
+		for v := range s.readOnlySlots {
+			slots = append(slots, v)
+		}
+		sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slots, nil
+}
+
+// NodeBan ban state of a redis node
+type NodeBan struct {
+	Addr string
+	BanStatus
+}
+
+// NodeBans snapshots the ban state of the redis nodes on the event-loop, which owns the pools, ordered by addr
+func (s *Engine) NodeBans() ([]NodeBan, error) {
+	var bans []NodeBan
+	err := s.onLoop(func() {
+		bans = make([]NodeBan, 0, len(s.ProxyPool))
+		for addr, pool := range s.ProxyPool {
+			bans = append(bans, NodeBan{Addr: addr, BanStatus: pool.BanStatus()})
+		}
+		sort.Slice(bans, func(i, j int) bool { return bans[i].Addr < bans[j].Addr })
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// ClearBans lifts the bans of all the redis nodes and resets their gradients on the event-loop,
+// returning the number of nodes which were banned
+func (s *Engine) ClearBans() (int, error) {
+	var cleared int
+	err := s.onLoop(func() {
+		for _, pool := range s.ProxyPool {
+			if pool.BanStatus().State == Banned {
+				cleared++
+			}
+			pool.Unban()
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return cleared, nil
+}
+
+// onLoop runs f on the event-loop and waits for it, so as not to race with it
+func (s *Engine) onLoop(f func()) error {
+	// nothing races with an event-loop not running
+	if s.eng == nil || s.eng.el == nil {
+		f()
+		return nil
+	}
+	done := make(chan struct{})
+	err := s.eng.el.poller.Trigger(func(_ interface{}) error {
+		f()
+		close(done)
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(time.Second):
+		return errors.ErrEventLoopBusy
+	}
+}
+
+// RefreshClusterNodes sends the cluster nodes command to addr, a random redis node if empty,
+// rather than waiting for the ticker, then applies the topology at once and returns the number of nodes
+func (s Engine) RefreshClusterNodes(addr string, timeout time.Duration) (int, error) {
+	if s.eng == nil || s.eng.el == nil {
+		return 0, errors.ErrEngineNotRunning
+	}
+	el := s.eng.el
+
+	updated := waitUpdate()
+	defer cancelWait(updated)
+
+	written := make(chan error, 1)
+	if err := el.poller.Trigger(func(_ interface{}) error {
+		written <- el.writeClusterNodes(addr)
+		return nil
+	}, nil); err != nil {
+		return 0, err
+	}
+
+	deadline := time.After(timeout)
+	select {
+	case err := <-written:
+		if err != nil {
+			return 0, err
+		}
+	case <-deadline:
+		return 0, errors.ErrEventLoopBusy
+	}
+
+	var nodes int
+	select {
+	case nodes = <-updated:
+	case <-deadline:
+		return 0, errors.ErrClusterRefreshTimeout
+	}
+
+	reloaded := make(chan struct{})
+	if err := el.poller.Trigger(func(_ interface{}) error {
+		el.reloadServers()
+		close(reloaded)
+		return nil
+	}, nil); err != nil {
+		return 0, err
+	}
+	select {
+	case <-reloaded:
+	case <-deadline:
+		return 0, errors.ErrEventLoopBusy
+	}
+	return nodes, nil
+}
+
+// CountSConnections counts the number of currently active redis server connections and returns it.
+func (s Engine) CountSConnections() (count int) {
+	if s.eng == nil || s.eng.el == nil {
+		return 0
+	}
+	return int(s.eng.el.loadSConn())
 }
 
 // Reader is an interface that consists of a number of methods for reading that Conn must implement.
@@ -276,6 +494,49 @@ type CConn interface {
 	Conn
 
 	EnqueueInMsg(msg *Msg)
+
+	// Pending number of requests read from the client and not answered yet
+	Pending() int
+
+	// Authed whether the client has passed the AUTH command
+	Authed() bool
+	SetAuthed(bool)
+
+	// Proto protocol version negotiated by the HELLO command, RESP2 by default
+	Proto() int
+	SetProto(int)
+
+	// LastWrite time the client last wrote to the slot, for read_your_writes,
+	// the writes older than the window are forgotten
+	LastWrite(slot int32) (time.Time, bool)
+	SetLastWrite(slot int32, t time.Time, window time.Duration)
+
+	// RequestTimeout timeout in ms of the next request forwarded to redis set by PROXY DEADLINE,
+	// 0 means the global RedisRequestTimeout
+	RequestTimeout() int
+	SetRequestTimeout(ms int)
+
+	// CompressThreshold size in bytes above which the bulk replies are compressed, negotiated by PROXY COMPRESS,
+	// 0 means the replies are sent as they are
+	CompressThreshold() int
+	SetCompressThreshold(bytes int)
+
+	// Target address of the node the next keyless command, such as LATENCY, is sent to, set by PROXY TARGET,
+	// empty means the keyless commands are rejected
+	Target() string
+	SetTarget(addr string)
+
+	// Tag of the slave the reads go to, set by PROXY TAG, empty means the reads are routed as usual
+	Tag() string
+	SetTag(tag string)
+
+	// LibInfo client library name and version reported by CLIENT SETINFO, empty if not reported
+	LibInfo() (name, ver string)
+	SetLibInfo(name, ver string)
+
+	// CreatedAt time the client connected, Requests number of complete commands read from it since
+	CreatedAt() time.Time
+	Requests() int
 }
 
 // SConn is an interface of redis server connection.
@@ -291,8 +552,10 @@ type SConn interface {
 	IsSlave() bool
 	SetIsSlave(bool)
 
-	EnqueueOutFrag(frag *Frag)
+	// EnqueueOutFrag queues the frag to be written, codec.ErrPendingLimit if too many are pending already
+	EnqueueOutFrag(frag *Frag) error
 	DequeueInFrag() *Frag
+	InFlight() int
 
 	WriteClusterNodes() error
 }
@@ -325,8 +588,9 @@ type (
 		// OnCReact fires when a client socket receives data from the peer.
 		OnCReact(packet *Msg, c CConn) (out []byte, action Action)
 
-		// OnMoved fires when a redis connection return moved/ask error
-		OnMoved(addr string, slot int32, c SConn, f *Frag)
+		// OnMoved fires when a redis connection return moved/ask error.
+		// The redirect is relayed to the client as it is if relay is true, rather than followed.
+		OnMoved(addr string, slot int32, c SConn, f *Frag) (relay bool)
 
 		// OnTicker fires every second for cluster nodes loop
 		OnTicker()
@@ -379,7 +643,8 @@ func (es *BuiltinEventEngine) OnCReact(_ *Msg, _ CConn) (_ []byte, _ Action) {
 }
 
 // OnMoved fires when a redis connection return moved/ask error
-func (es *BuiltinEventEngine) OnMoved(_ string, _ int32, _ SConn, _ *Frag) {
+func (es *BuiltinEventEngine) OnMoved(_ string, _ int32, _ SConn, _ *Frag) (relay bool) {
+	return
 }
 
 // OnTicker fires every second for cluster nodes loop
@@ -402,7 +667,12 @@ var MaxStreamBufferCap = 64 * 1024 // 64KB
 // The "tcp" network scheme is assumed when one is not specified.
 func Run(eventHandler EventHandler, protoAddr string, opts ...Option) (err error) {
 	options := loadOptions(opts...)
-	options.ReadBufferCap = MaxStreamBufferCap
+	if options.ReadBufferCap < 1 {
+		options.ReadBufferCap = MaxStreamBufferCap
+	}
+	if options.ServerReadBufferCap < 1 {
+		options.ServerReadBufferCap = MaxStreamBufferCap
+	}
 	options.WriteBufferCap = MaxStreamBufferCap
 
 	if options.RedisMsgMaxLength < 1 {
@@ -411,9 +681,31 @@ func Run(eventHandler EventHandler, protoAddr string, opts ...Option) (err error
 	if options.RedisServerConnections < 1 {
 		options.RedisServerConnections = 1
 	}
+	if options.ClientSlowTicks < 1 {
+		options.ClientSlowTicks = 3
+	}
+	if options.RedisScaleUpInflight < 1 {
+		options.RedisScaleUpInflight = 32
+	}
 	if options.RedisConnectionTimeout < 1 {
 		options.RedisConnectionTimeout = 200
 	}
+	if options.RedisPreconnectBackoff < 1 {
+		options.RedisPreconnectBackoff = 500
+	}
+	if options.RedisMonitorInterval < 1 {
+		options.RedisMonitorInterval = 5000
+	}
+	if options.RedisMaxTopologyProbeConns < 1 {
+		options.RedisMaxTopologyProbeConns = 4
+	}
+	if options.SlotCoverageGrace < 1 {
+		options.SlotCoverageGrace = 30
+	}
+	if len(options.CommandMetrics) < 1 {
+		options.CommandMetrics = CommandMetricsFamily
+	}
+	GlobalStats.CommandMetrics = options.CommandMetrics
 
 	network, addr := parseProtoAddr(protoAddr)
 
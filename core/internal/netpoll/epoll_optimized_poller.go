@@ -226,16 +226,39 @@ func (p *Poller) AddWrite(pa *PollAttachment) error {
 
 // ModRead renews the given file-descriptor with readable event in the poller.
 func (p *Poller) ModRead(pa *PollAttachment) error {
-	var ev epollevent
-	ev.events = readEvents
-	*(**PollAttachment)(unsafe.Pointer(&ev.data)) = pa
-	return os.NewSyscallError("epoll_ctl mod", epollCtl(p.fd, unix.EPOLL_CTL_MOD, pa.FD, &ev))
+	return p.mod(pa, readEvents)
 }
 
 // ModReadWrite renews the given file-descriptor with readable and writable events in the poller.
 func (p *Poller) ModReadWrite(pa *PollAttachment) error {
+	return p.mod(pa, readWriteEvents)
+}
+
+// PauseRead stops reporting the readable event of the given file-descriptor until ResumeRead,
+// the writable event is kept if writing, ModRead and ModReadWrite leave the readable event paused.
+func (p *Poller) PauseRead(pa *PollAttachment, writing bool) error {
+	pa.ReadPaused = true
+	if writing {
+		return p.mod(pa, readWriteEvents)
+	}
+	return p.mod(pa, readEvents)
+}
+
+// ResumeRead reports the readable event of the given file-descriptor paused by PauseRead again.
+func (p *Poller) ResumeRead(pa *PollAttachment, writing bool) error {
+	pa.ReadPaused = false
+	if writing {
+		return p.mod(pa, readWriteEvents)
+	}
+	return p.mod(pa, readEvents)
+}
+
+func (p *Poller) mod(pa *PollAttachment, events uint32) error {
+	if pa.ReadPaused {
+		events &^= readEvents
+	}
 	var ev epollevent
-	ev.events = readWriteEvents
+	ev.events = events
 	*(**PollAttachment)(unsafe.Pointer(&ev.data)) = pa
 	return os.NewSyscallError("epoll_ctl mod", epollCtl(p.fd, unix.EPOLL_CTL_MOD, pa.FD, &ev))
 }
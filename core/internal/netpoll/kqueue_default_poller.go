@@ -233,6 +233,25 @@ func (p *Poller) ModReadWrite(pa *PollAttachment) error {
 	return os.NewSyscallError("kevent add", err)
 }
 
+// PauseRead stops reporting the readable event of the given file-descriptor until ResumeRead,
+// the writable event is left as it is.
+func (p *Poller) PauseRead(pa *PollAttachment, _ bool) error {
+	pa.ReadPaused = true
+	_, err := unix.Kevent(p.fd, []unix.Kevent_t{
+		{Ident: uint64(pa.FD), Flags: unix.EV_DISABLE, Filter: unix.EVFILT_READ},
+	}, nil, nil)
+	return os.NewSyscallError("kevent disable", err)
+}
+
+// ResumeRead reports the readable event of the given file-descriptor paused by PauseRead again.
+func (p *Poller) ResumeRead(pa *PollAttachment, _ bool) error {
+	pa.ReadPaused = false
+	_, err := unix.Kevent(p.fd, []unix.Kevent_t{
+		{Ident: uint64(pa.FD), Flags: unix.EV_ENABLE, Filter: unix.EVFILT_READ},
+	}, nil, nil)
+	return os.NewSyscallError("kevent enable", err)
+}
+
 // Delete removes the given file-descriptor from the poller.
 func (p *Poller) Delete(_ int) error {
 	return nil
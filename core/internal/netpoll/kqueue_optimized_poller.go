@@ -249,6 +249,31 @@ func (p *Poller) ModReadWrite(pa *PollAttachment) error {
 	return os.NewSyscallError("kevent add", err)
 }
 
+// PauseRead stops reporting the readable event of the given file-descriptor until ResumeRead,
+// the writable event is left as it is.
+func (p *Poller) PauseRead(pa *PollAttachment, _ bool) error {
+	pa.ReadPaused = true
+	var evs [1]unix.Kevent_t
+	evs[0].Ident = uint64(pa.FD)
+	evs[0].Flags = unix.EV_DISABLE
+	evs[0].Filter = unix.EVFILT_READ
+	evs[0].Udata = (*byte)(unsafe.Pointer(pa))
+	_, err := unix.Kevent(p.fd, evs[:], nil, nil)
+	return os.NewSyscallError("kevent disable", err)
+}
+
+// ResumeRead reports the readable event of the given file-descriptor paused by PauseRead again.
+func (p *Poller) ResumeRead(pa *PollAttachment, _ bool) error {
+	pa.ReadPaused = false
+	var evs [1]unix.Kevent_t
+	evs[0].Ident = uint64(pa.FD)
+	evs[0].Flags = unix.EV_ENABLE
+	evs[0].Filter = unix.EVFILT_READ
+	evs[0].Udata = (*byte)(unsafe.Pointer(pa))
+	_, err := unix.Kevent(p.fd, evs[:], nil, nil)
+	return os.NewSyscallError("kevent enable", err)
+}
+
 // Delete removes the given file-descriptor from the poller.
 func (p *Poller) Delete(_ int) error {
 	return nil
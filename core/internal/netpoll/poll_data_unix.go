@@ -31,7 +31,7 @@ func PutPollAttachment(pa *PollAttachment) {
 	if pa == nil {
 		return
 	}
-	pa.FD, pa.Callback = 0, nil
+	pa.FD, pa.Callback, pa.ReadPaused = 0, nil, false
 	pollAttachmentPool.Put(pa)
 }
 
@@ -39,4 +39,7 @@ func PutPollAttachment(pa *PollAttachment) {
 type PollAttachment struct {
 	FD       int
 	Callback PollEventHandler
+
+	// ReadPaused whether the readable event is not reported, see Poller.PauseRead
+	ReadPaused bool
 }
@@ -49,8 +49,12 @@ type Msg struct {
 	Owner CConn // client conn
 
 	Id uint64
-	// for request
+	// for request, the frags by slot, nil as long as the request is hashed to a single slot, see SetFrag
 	Body map[int32]*Frag
+	// for request hashed to a single slot, the common case, so that no map is allocated for it
+	Frag     *Frag
+	FragSlot int32
+	Single   bool
 	// for response
 	RspBody []byte
 	Error   codec.Error
@@ -58,13 +62,25 @@ type Msg struct {
 	// for frag ref
 	Fd2Slot        map[int]int32
 	Keys           []string
+	Args           []string              // for commands answered by the proxy itself
 	Frags          map[int32][]string    // for mget/del
 	Frags2         map[int32][][2]string // for mset
 	FragDoneNumber int                   // number of finished frags
 	DelNum         int                   // for del
 
-	Type codec.Command // request command type
-	Done bool          // all frags Done
+	Type  codec.Command // request command type
+	Done  bool          // all frags Done
+	Acked bool          // answered +OK once forwarded, the reply of redis is only checked, see server.WithAckOnSend
+
+	Timeout int    // ms, overrides RedisRequestTimeout for the request, set by PROXY DEADLINE
+	Node    string // node the keyless request is sent to whatever its slot, set by PROXY TARGET
+
+	Scan ScanCursor // position of the SCAN forwarded to the master r.Node, see SRespCodec.Scan
+
+	DryRun bool // decoded for PROXY EXPLAIN, never forwarded and not counted in the stats, see CRespCodec.DryRun
+
+	held  int // bytes of the request accounted in BufferedBytes while queued by the client
+	acked int // frags of the acknowledged request read back from redis, see ackedReply
 }
 
 type msgPool struct {
@@ -85,11 +101,22 @@ func (p *msgPool) Put(m *Msg) {
 	m.Owner = nil
 
 	m.Body = nil
+	m.Frag = nil
+	m.FragSlot = 0
+	m.Single = false
 	m.RspBody = m.RspBody[:0]
 	m.Done = false
+	m.Acked = false
+	m.Timeout = 0
+	m.Node = ""
+	m.Scan = ScanCursor{}
+	m.DryRun = false
+	m.held = 0
+	m.acked = 0
 	m.Error = ""
 	m.Fd2Slot = nil
 	m.Keys = m.Keys[:0]
+	m.Args = m.Args[:0]
 	m.Frags = nil
 	m.Frags2 = nil
 	m.FragDoneNumber = 0
@@ -101,6 +128,15 @@ func (p *msgPool) Put(m *Msg) {
 	p.Pool.Put(m)
 }
 
+// reqLen returns the bytes of the request forwarded in its frags
+func (m *Msg) reqLen() (n int) {
+	m.RangeFrags(func(_ int32, f *Frag) bool {
+		n += len(f.Req)
+		return true
+	})
+	return
+}
+
 // Frag client requests may be split into multiple frag and requested to different redis nodes
 type Frag struct {
 	prev *Frag
@@ -116,10 +152,11 @@ type Frag struct {
 	Error   codec.Error
 	Req     []byte
 	RspBody []byte
-	Rsp     []string // for mget
+	Rsp     [][]byte // for mget, the elements of RspBody sharing its memory
 	Type    codec.Command
 	Ok      bool // for mset
 	Done    bool // is the current frag completed
+	cold    bool // the first frag sent on a connection dialed after the frag was made, see ColdRequest
 }
 
 func (f *Frag) MsgId() uint64 {
@@ -129,23 +166,86 @@ func (f *Frag) MsgId() uint64 {
 	return f.Peer.Id
 }
 
+// slowlogSlowerThan returns the threshold of slow query of the command, the one of its family if set
+func (opts *Options) slowlogSlowerThan(command codec.Command) int64 {
+	if v, ok := opts.RedisSlowlogFamilies[codec.Family(command)]; ok {
+		return v
+	}
+	return opts.RedisSlowlogSlowerThan
+}
+
 func (f *Frag) slowLogCheck(s SConn) {
 	if f.Owner == nil || f.Peer == nil {
 		return
 	}
-	if EngineGlobal.eng.opts.RedisSlowlogSlowerThan < 1 {
+	slowerThan := EngineGlobal.eng.opts.slowlogSlowerThan(f.MsgType())
+	if slowerThan < 1 {
 		return
 	}
 
 	costTime := int64(time.Since(f.Time) / time.Millisecond)
 	GlobalStats.Request.WithLabelValues().Observe(float64(costTime))
 
-	if costTime < EngineGlobal.eng.opts.RedisSlowlogSlowerThan {
+	if costTime < slowerThan {
 		return
 	}
 
 	logging.Warnf(constant.TitleSlowLog+" [%dm|%df][%dc|%ds] remote_addr=%s redis_addr=%s cost_time=%dms request_type=%s request_len=%d response_len=%d key=%s",
-		f.MsgId(), f.Id, f.OwnerFd(), s.Fd(), f.Owner.RemoteAddr(), s.RemoteAddr(), costTime, codec.Transform2Str(f.MsgType()), len(f.Req), len(f.RspBody), f.Key)
+		f.MsgId(), f.Id, f.OwnerFd(), s.Fd(), f.Owner.RemoteAddr(), s.RemoteAddr(), costTime, codec.Transform2Str(f.MsgType()), len(f.Req), len(f.RspBody), f.LogKey())
+}
+
+// Redacted replaces the arguments of the requests which must not be logged
+const Redacted = "<redacted>"
+
+// redacted whether the request of the frag must not be logged, AUTH has the password as its key,
+// and the keys matching RedisLogRedactKeys may hold secrets
+func (f *Frag) redacted() bool {
+	if f.MsgType() == codec.ReqAuth {
+		return true
+	}
+	if EngineGlobal == nil || EngineGlobal.eng == nil {
+		return false
+	}
+	for _, pattern := range EngineGlobal.eng.opts.RedisLogRedactKeys {
+		if matchGlob(pattern, f.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// LogKey the key of the frag to be logged, Redacted if it must not be
+func (f *Frag) LogKey() string {
+	if f.redacted() {
+		return Redacted
+	}
+	return f.Key
+}
+
+// matchGlob matches s against a pattern of the redis KEYS flavour, limited to * and ?
+func matchGlob(pattern, s string) bool {
+	var p, i, star, mark = 0, 0, -1, 0
+	for i < len(s) {
+		// a * in the pattern is always a wildcard, even facing a * in s
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
 }
 
 func (f *Frag) OwnerFd() int {
@@ -166,6 +266,9 @@ func (f *Frag) ReqString() string {
 	if f == nil || len(f.Req) < 1 {
 		return ""
 	}
+	if f.redacted() {
+		return "[ " + codec.Transform2Str(f.MsgType()) + " " + Redacted + " ]"
+	}
 	var buf bytes.Buffer
 	buf.WriteByte('[')
 	buf.WriteByte(' ')
@@ -216,19 +319,91 @@ func (p *fragPool) Get() *Frag {
 	return f
 }
 
+// SetFrag adds the frag of the slot to the request, kept in Frag until a second slot shows up,
+// then all the frags are moved to Body
+func (m *Msg) SetFrag(slot int32, f *Frag) {
+	if m.Body == nil && (!m.Single || m.FragSlot == slot) {
+		m.Frag, m.FragSlot, m.Single = f, slot, true
+		return
+	}
+	if m.Body == nil {
+		m.Body = make(map[int32]*Frag, 2)
+		m.Body[m.FragSlot] = m.Frag
+		m.Frag, m.FragSlot, m.Single = nil, 0, false
+	}
+	m.Body[slot] = f
+}
+
+// growBody allocates Body up front for a request split into n slots
+func (m *Msg) growBody(n int) {
+	if n > 1 {
+		m.Body = make(map[int32]*Frag, n)
+	}
+}
+
+// SlotFrag returns the frag of the slot, nil if the request has none
+func (m *Msg) SlotFrag(slot int32) *Frag {
+	if m.Single {
+		if m.FragSlot == slot {
+			return m.Frag
+		}
+		return nil
+	}
+	return m.Body[slot]
+}
+
+// NumFrags returns the number of frags of the request
+func (m *Msg) NumFrags() int {
+	if m.Single {
+		return 1
+	}
+	return len(m.Body)
+}
+
+// RangeFrags calls fn for every frag of the request until fn returns false
+func (m *Msg) RangeFrags(fn func(slot int32, f *Frag) bool) {
+	if m.Single {
+		fn(m.FragSlot, m.Frag)
+		return
+	}
+	for slot, f := range m.Body {
+		if !fn(slot, f) {
+			return
+		}
+	}
+}
+
+// failedFrag returns a frag whose reply is not Ok, nil if all of them are
+func (m *Msg) failedFrag() (failed *Frag) {
+	m.RangeFrags(func(_ int32, f *Frag) bool {
+		if !f.Ok {
+			failed = f
+		}
+		return f.Ok
+	})
+	return failed
+}
+
 func (m *Msg) BodyString() string {
-	if m == nil || len(m.Body) < 1 {
+	if m == nil || m.NumFrags() < 1 {
 		return ""
 	}
 	var buf bytes.Buffer
 	buf.WriteByte('[')
-	for slot, v := range m.Body {
+	m.RangeFrags(func(slot int32, v *Frag) bool {
 		buf.WriteByte('{')
 		buf.WriteByte(' ')
 		buf.WriteString(strconv.FormatUint(uint64(slot), 10))
 		buf.WriteByte(' ')
 		buf.WriteString("=>")
 		buf.WriteByte(' ')
+		if v.redacted() {
+			buf.WriteString(codec.Transform2Str(m.Type))
+			buf.WriteByte(' ')
+			buf.WriteString(Redacted)
+			buf.WriteByte('}')
+			return true
+		}
 		for _, b := range v.Req {
 			if b == '\r' {
 				continue
@@ -240,7 +415,8 @@ func (m *Msg) BodyString() string {
 			buf.WriteByte(b)
 		}
 		buf.WriteByte('}')
-	}
+		return true
+	})
 	buf.WriteByte(']')
 	return buf.String()
 }
@@ -266,6 +442,21 @@ func (m *Msg) RspBodyString() string {
 	return buf.String()
 }
 
+// relayRedirect answers the message of the frag with the moved/ask reply, so that a cluster-aware client follows it itself.
+// The other frags of the message are discarded, as on a frag error.
+func (f *Frag) relayRedirect() {
+	f.Done = true
+	msg := f.Peer
+	msg.Error = codec.Error(f.RspBody)
+	msg.FragDoneNumber = msg.NumFrags()
+	msg.RspBody = append(msg.RspBody[:0], f.RspBody...)
+	msg.Done = true
+	msg.RangeFrags(func(_ int32, v *Frag) bool {
+		v.Done = true
+		return true
+	})
+}
+
 func (f *Frag) parseMovedOrAsk() (addr string, slot int32) {
 	if len(f.RspBody) < 10 {
 		return "", 0
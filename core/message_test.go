@@ -15,9 +15,14 @@
 package core
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core/codec"
+	"rcproxy/core/pkg/logging"
 )
 
 func TestFragQueue(t *testing.T) {
@@ -80,3 +85,119 @@ func TestMsgQueue(t *testing.T) {
 	q.PopTail()
 	assert.Equal(t, nil, nil)
 }
+
+func TestSlowlogSlowerThan(t *testing.T) {
+	opts := &Options{
+		RedisSlowlogSlowerThan: 10,
+		RedisSlowlogFamilies:   map[string]int64{"string": 5, "sortedsets": 50},
+	}
+
+	var cases = []struct {
+		command codec.Command
+		expect  int64
+	}{
+		{codec.ReqGet, 5},     // a light family, catching anomalies sooner
+		{codec.ReqZrange, 50}, // a heavy family, less noise
+		{codec.ReqHget, 10},   // no threshold of its family, the global one
+		{codec.ReqEval, 10},
+	}
+	for _, v := range cases {
+		assert.Equal(t, v.expect, opts.slowlogSlowerThan(v.command), "command: %s", codec.Transform2Str(v.command))
+	}
+}
+
+func TestRedactedLogs(t *testing.T) {
+	EngineGlobal = &Engine{eng: &engine{opts: &Options{RedisSlowlogSlowerThan: 1}}}
+	WithRedisLogRedactKeys(" session:*, *:token ,")(EngineGlobal.eng.opts)
+	assert.Equal(t, []string{"session:*", "*:token"}, EngineGlobal.eng.opts.RedisLogRedactKeys)
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	c := new(mockedConn)
+	c.On("Fd").Return(1)
+	slow := func(command codec.Command, key, req string) *Frag {
+		f := &Frag{Key: key, Req: []byte(req), Owner: c, Time: time.Now().Add(-time.Second)}
+		f.Peer = &Msg{Type: command, Body: map[int32]*Frag{0: f}}
+		f.slowLogCheck(c)
+		return f
+	}
+
+	// the password of AUTH is never logged
+	auth := slow(codec.ReqAuth, "s3cret", "*2\r\n$4\r\nauth\r\n$6\r\ns3cret\r\n")
+	assert.True(t, sink.Contains(logging.LevelWarn, "request_type=auth"))
+	assert.True(t, sink.Contains(logging.LevelWarn, "key=<redacted>"))
+	assert.False(t, sink.Contains(logging.LevelWarn, "s3cret"))
+	assert.NotContains(t, auth.ReqString(), "s3cret")
+	assert.NotContains(t, auth.Peer.BodyString(), "s3cret")
+
+	// so are the keys matching a pattern, with their values
+	for _, key := range []string{"session:42", "user:1:token"} {
+		set := slow(codec.ReqSet, key, fmt.Sprintf("*3\r\n$3\r\nset\r\n$%d\r\n%s\r\n$5\r\nvalue\r\n", len(key), key))
+		assert.False(t, sink.Contains(logging.LevelWarn, key), "key: %s", key)
+		assert.Equal(t, "[ set <redacted> ]", set.ReqString())
+		assert.Equal(t, "[{ 0 => set <redacted>}]", set.Peer.BodyString())
+	}
+
+	get := slow(codec.ReqGet, "sessions", "*2\r\n$3\r\nget\r\n$8\r\nsessions\r\n")
+	assert.True(t, sink.Contains(logging.LevelWarn, "key=sessions"))
+	assert.Equal(t, "[ *2 $3 get $8 sessions ]", get.ReqString())
+}
+
+func TestSetFrag(t *testing.T) {
+	m := &Msg{}
+	a, b := &Frag{Key: "a"}, &Frag{Key: "b"}
+
+	m.SetFrag(15495, a)
+	assert.True(t, m.Single)
+	assert.Nil(t, m.Body)
+	assert.Equal(t, 1, m.NumFrags())
+	assert.Equal(t, a, m.SlotFrag(15495))
+	assert.Nil(t, m.SlotFrag(3300))
+
+	// a second slot moves both frags to the map
+	m.SetFrag(3300, b)
+	assert.False(t, m.Single)
+	assert.Nil(t, m.Frag)
+	assert.Equal(t, 2, m.NumFrags())
+	assert.Equal(t, a, m.SlotFrag(15495))
+	assert.Equal(t, b, m.SlotFrag(3300))
+
+	seen := map[int32]*Frag{}
+	m.RangeFrags(func(slot int32, f *Frag) bool {
+		seen[slot] = f
+		return true
+	})
+	assert.Equal(t, map[int32]*Frag{15495: a, 3300: b}, seen)
+
+	MsgPool.Put(m)
+	assert.False(t, m.Single)
+	assert.Nil(t, m.Body)
+	assert.Equal(t, 0, m.NumFrags())
+}
+
+func TestMatchGlob(t *testing.T) {
+	var cases = []struct {
+		pattern, key string
+		expect       bool
+	}{
+		{"session:*", "session:42", true},
+		{"session:*", "session:", true},
+		{"session:*", "sessions", false},
+		{"*:token", "user:1:token", true},
+		{"*:token", "user:1:tokens", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:12", false},
+		{"*", "", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		// a * of the key is matched by the wildcard like any other byte
+		{"a*b", "a*xb", true},
+		{"a*b", "a*b", true},
+		{"a*b", "a*x", false},
+		{"*?", "*", true},
+	}
+	for _, v := range cases {
+		assert.Equal(t, v.expect, matchGlob(v.pattern, v.key), "pattern: %s, key: %s", v.pattern, v.key)
+	}
+}
@@ -16,6 +16,7 @@
 package core
 
 import (
+	"strings"
 	"time"
 )
 
@@ -39,14 +40,20 @@ type Options struct {
 
 	// ============================= Options for both server-side and client-side =============================
 
-	// ReadBufferCap is the maximum number of bytes that can be read from the peer when the readable event comes.
+	// ReadBufferCap is the maximum number of bytes that can be read from the client when the readable event comes.
 	// The default value is 64KB, it can either be reduced to avoid starving the subsequent connections or increased
 	// to read more data from a socket.
-	//
-	// Note that ReadBufferCap will always be converted to the least power of two integer value greater than
-	// or equal to its real amount.
 	ReadBufferCap int
 
+	// ServerReadBufferCap is the maximum number of bytes that can be read from redis when the readable event comes.
+	// The default value is 64KB, redis replies such as HGETALL or a big ZRANGE benefit from a larger one,
+	// while clients mostly send small commands.
+	//
+	// The read buffers are shared by all the connections of the event-loop, one for clients and one for redis,
+	// since a packet left incomplete is copied to the inbound buffer of its connection before the next read.
+	// So a large buffer costs its size once, rather than once per connection.
+	ServerReadBufferCap int
+
 	// WriteBufferCap is the maximum number of bytes that a static outbound buffer can hold,
 	// if the data exceeds this value, the overflow will be stored in the elastic linked list buffer.
 	// The default value is 64KB.
@@ -64,6 +71,29 @@ type Options struct {
 	// SocketSendBuffer sets the maximum socket send buffer in bytes.
 	SocketSendBuffer int
 
+	// ClientSlowOutbound bytes buffered for a client above which it is considered reading its socket slowly,
+	// it is flagged once the buffer stays above for ClientSlowTicks seconds, 0 disables the detection
+	ClientSlowOutbound int
+
+	// ClientSlowTicks seconds the outbound buffer of a client stays above ClientSlowOutbound to be flagged
+	ClientSlowTicks int
+
+	// ClientSlowDisconnect whether to close a flagged slow client, rather than only logging it
+	ClientSlowDisconnect bool
+
+	// ClientHandshakeTimeout seconds a client may stay connected without sending a complete command,
+	// it is closed afterwards so that a connection opened and left silent doesn't hold a slot, 0 disables (unit: s)
+	ClientHandshakeTimeout int
+
+	// MaxTotalBufferBytes maximum bytes of the requests queued by all clients waiting for their replies,
+	// the clients are not read until the requests drain below it, 0 means no limit
+	MaxTotalBufferBytes int
+
+	// ClientTLSCert and ClientTLSKey the certificate and key files the client connections are terminated with,
+	// the plaintext clients are rejected once set, empty disables TLS
+	ClientTLSCert string
+	ClientTLSKey  string
+
 	// ============================= Options for redis server =============================
 
 	// RedisServers address of the redis nodes
@@ -73,6 +103,21 @@ type Options struct {
 	// If the maximum allowed packet length is exceeded, an error is reported
 	RedisMsgMaxLength int
 
+	// RedisMaxKeysPerCommand maximum number of keys of a single MGET/DEL/MSET, 0 means no limit
+	RedisMaxKeysPerCommand int
+
+	// RedisMaxValueSize maximum length in bytes of a value written, such as the value of SET, 0 means no limit
+	RedisMaxValueSize int
+
+	// RedisMaxReplyElements maximum number of elements of an array reply, such as the reply of SMEMBERS, 0 means no limit
+	RedisMaxReplyElements int
+
+	// RedisCrossSlotBehavior how to answer the multi-key requests across slots, see CrossSlotError
+	RedisCrossSlotBehavior string
+
+	// RedisCommandCase case of the command names forwarded to redis, see CommandCaseLower
+	RedisCommandCase string
+
 	// RedisConnectionTimeout timeout of rcproxy with redis (unit: ms)
 	RedisConnectionTimeout int
 
@@ -82,14 +127,69 @@ type Options struct {
 	// RedisServerConnections maximum number of connections to each redis node, best practice value is 1
 	RedisServerConnections int
 
+	// RedisServerConnectionsMax maximum number of connections to each redis node when the in-flight depth
+	// sustains above RedisScaleUpInflight, not greater than RedisServerConnections disables auto-scaling
+	RedisServerConnectionsMax int
+
+	// RedisScaleUpInflight in-flight requests per connection above which a redis node is considered loaded
+	RedisScaleUpInflight int
+
+	// RedisServerDrainGrace seconds the connections to a node removed from the topology are kept open
+	// for the requests in flight to complete, 0 closes them at once dropping those requests (unit: s)
+	RedisServerDrainGrace int
+
+	// RedisServerMaxPending maximum requests pending on a connection to a redis node, written or waiting to be,
+	// the next ones are answered a retryable error and the node is banned, 0 means no limit
+	RedisServerMaxPending int
+
+	// RedisTLS whether the connections to the redis nodes are encrypted, RedisTLSCA the CA bundle the nodes are
+	// verified with, the system roots if empty, RedisTLSInsecure skips the verification of the nodes
+	RedisTLS         bool
+	RedisTLSCA       string
+	RedisTLSInsecure bool
+
 	// RedisPasswd redis password
 	RedisPasswd string
 
 	// RedisPreconnect whether to initialize redis connections in advance
 	RedisPreconnect bool
 
+	// RedisPreconnectQuorum minimum number of redis nodes reachable by preconnect to start serving,
+	// 0 means the majority of them
+	RedisPreconnectQuorum int
+
+	// RedisPreconnectRetries times preconnect retries the unreachable nodes while the quorum is not reached
+	RedisPreconnectRetries int
+
+	// RedisPreconnectBackoff wait before the first preconnect retry, doubled on each of the next ones (unit: ms)
+	RedisPreconnectBackoff int
+
 	// RedisSlowlogSlowerThan threshold of redis slow query
 	RedisSlowlogSlowerThan int64
+
+	// RedisSlowlogFamilies threshold of redis slow query per command family, see codec.Family,
+	// the families not set fall back to RedisSlowlogSlowerThan
+	RedisSlowlogFamilies map[string]int64
+
+	// RedisLogRedactKeys patterns of the keys whose requests are logged as <redacted>, * and ? are supported,
+	// the password of AUTH is never logged
+	RedisLogRedactKeys []string
+
+	// RedisMonitorInterval interval of probing each redis node (unit: ms)
+	RedisMonitorInterval int
+
+	// RedisMaxTopologyProbeConns maximum number of probe connections opened at once by topology discovery,
+	// so that discovering a large topology change doesn't compete with the requests for fds and node capacity
+	RedisMaxTopologyProbeConns int
+
+	// SlotCoverageHook url POSTed once some slots stay served by no master for SlotCoverageGrace, empty disables it
+	SlotCoverageHook string
+
+	// SlotCoverageGrace seconds the slots may stay uncovered before alerting, so that a failover doesn't page (unit: s)
+	SlotCoverageGrace int
+
+	// CommandMetrics granularity of the per command metrics, see CommandMetricsFamily
+	CommandMetrics string
 }
 
 // WithTCPKeepAlive sets up the SO_KEEPALIVE socket option with duration.
@@ -128,6 +228,20 @@ func WithRedisMsgMaxLength(length int) Option {
 	}
 }
 
+// WithRedisMaxKeysPerCommand sets up maximum number of keys of a single MGET/DEL/MSET
+func WithRedisMaxKeysPerCommand(num int) Option {
+	return func(opts *Options) {
+		opts.RedisMaxKeysPerCommand = num
+	}
+}
+
+// WithRedisMaxValueSize sets up maximum length in bytes of a value written
+func WithRedisMaxValueSize(size int) Option {
+	return func(opts *Options) {
+		opts.RedisMaxValueSize = size
+	}
+}
+
 // WithRedisPasswd sets up redis password
 func WithRedisPasswd(passwd string) Option {
 	return func(opts *Options) {
@@ -142,6 +256,27 @@ func WithRedisPreconnect(preconnect bool) Option {
 	}
 }
 
+// WithRedisPreconnectQuorum sets up minimum number of redis nodes reachable by preconnect to start serving
+func WithRedisPreconnectQuorum(quorum int) Option {
+	return func(opts *Options) {
+		opts.RedisPreconnectQuorum = quorum
+	}
+}
+
+// WithRedisPreconnectRetries sets up times preconnect retries the unreachable nodes while the quorum is not reached
+func WithRedisPreconnectRetries(retries int) Option {
+	return func(opts *Options) {
+		opts.RedisPreconnectRetries = retries
+	}
+}
+
+// WithRedisPreconnectBackoff sets up wait before the first preconnect retry (unit: ms)
+func WithRedisPreconnectBackoff(backoff int) Option {
+	return func(opts *Options) {
+		opts.RedisPreconnectBackoff = backoff
+	}
+}
+
 // WithRedisConnectTimeout sets up connect timeout of rcproxy with redis (unit: ms)
 func WithRedisConnectTimeout(num int) Option {
 	return func(opts *Options) {
@@ -149,6 +284,69 @@ func WithRedisConnectTimeout(num int) Option {
 	}
 }
 
+// WithRedisMonitorInterval sets up interval of probing each redis node
+func WithRedisMonitorInterval(interval int) Option {
+	return func(opts *Options) {
+		opts.RedisMonitorInterval = interval
+	}
+}
+
+// WithRedisMaxTopologyProbeConns sets up maximum number of probe connections opened at once by topology discovery
+func WithRedisMaxTopologyProbeConns(conns int) Option {
+	return func(opts *Options) {
+		opts.RedisMaxTopologyProbeConns = conns
+	}
+}
+
+// WithClientReadBufferCap sets up ReadBufferCap for reading from the clients
+func WithClientReadBufferCap(readBufferCap int) Option {
+	return func(opts *Options) {
+		opts.ReadBufferCap = readBufferCap
+	}
+}
+
+// WithServerReadBufferCap sets up ServerReadBufferCap for reading from redis
+func WithServerReadBufferCap(readBufferCap int) Option {
+	return func(opts *Options) {
+		opts.ServerReadBufferCap = readBufferCap
+	}
+}
+
+// WithRedisCommandCase sets up case of the command names forwarded to redis
+func WithRedisCommandCase(commandCase string) Option {
+	return func(opts *Options) {
+		opts.RedisCommandCase = commandCase
+	}
+}
+
+// WithRedisCrossSlotBehavior sets up how to answer the multi-key requests across slots
+func WithRedisCrossSlotBehavior(behavior string) Option {
+	return func(opts *Options) {
+		opts.RedisCrossSlotBehavior = behavior
+	}
+}
+
+// WithClientSlowOutbound sets up bytes buffered for a client above which it is considered reading slowly
+func WithClientSlowOutbound(bytes int) Option {
+	return func(opts *Options) {
+		opts.ClientSlowOutbound = bytes
+	}
+}
+
+// WithClientSlowTicks sets up seconds the outbound buffer of a client stays above the threshold to be flagged
+func WithClientSlowTicks(ticks int) Option {
+	return func(opts *Options) {
+		opts.ClientSlowTicks = ticks
+	}
+}
+
+// WithClientSlowDisconnect sets up whether to close a flagged slow client
+func WithClientSlowDisconnect(disconnect bool) Option {
+	return func(opts *Options) {
+		opts.ClientSlowDisconnect = disconnect
+	}
+}
+
 // WithRedisRequestTimeout sets up maximum request timeout with redis, otherwise return an error to the client
 func WithRedisRequestTimeout(timeout int) Option {
 	return func(opts *Options) {
@@ -163,9 +361,115 @@ func WithRedisServerConnections(num int) Option {
 	}
 }
 
+// WithSlowlogFamilies sets up threshold of redis slow query per command family
+func WithSlowlogFamilies(thresholds map[string]int64) Option {
+	return func(opts *Options) {
+		opts.RedisSlowlogFamilies = thresholds
+	}
+}
+
+// WithRedisServerConnectionsMax sets up maximum number of connections to each redis node under sustained load
+func WithRedisServerConnectionsMax(num int) Option {
+	return func(opts *Options) {
+		opts.RedisServerConnectionsMax = num
+	}
+}
+
+// WithRedisScaleUpInflight sets up in-flight requests per connection above which a redis node is considered loaded
+func WithRedisScaleUpInflight(num int) Option {
+	return func(opts *Options) {
+		opts.RedisScaleUpInflight = num
+	}
+}
+
 // WithSlowlogSlowerThan sets up threshold of redis slow query
 func WithSlowlogSlowerThan(num int64) Option {
 	return func(opts *Options) {
 		opts.RedisSlowlogSlowerThan = num
 	}
 }
+
+// WithSlotCoverageHook sets up the url POSTed when the slots stay uncovered for the grace period
+func WithSlotCoverageHook(url string) Option {
+	return func(opts *Options) {
+		opts.SlotCoverageHook = url
+	}
+}
+
+// WithSlotCoverageGrace sets up seconds the slots may stay uncovered before alerting
+func WithSlotCoverageGrace(grace int) Option {
+	return func(opts *Options) {
+		opts.SlotCoverageGrace = grace
+	}
+}
+
+// WithRedisLogRedactKeys sets up the comma separated patterns of the keys whose requests are not logged
+func WithRedisLogRedactKeys(patterns string) Option {
+	return func(opts *Options) {
+		opts.RedisLogRedactKeys = opts.RedisLogRedactKeys[:0]
+		for _, p := range strings.Split(patterns, ",") {
+			if p = strings.TrimSpace(p); len(p) > 0 {
+				opts.RedisLogRedactKeys = append(opts.RedisLogRedactKeys, p)
+			}
+		}
+	}
+}
+
+// WithClientHandshakeTimeout sets up seconds a client may stay connected without sending a complete command
+func WithClientHandshakeTimeout(timeout int) Option {
+	return func(opts *Options) {
+		opts.ClientHandshakeTimeout = timeout
+	}
+}
+
+// WithRedisServerDrainGrace sets up seconds the connections to a removed node are kept for the requests in flight
+func WithRedisServerDrainGrace(grace int) Option {
+	return func(opts *Options) {
+		opts.RedisServerDrainGrace = grace
+	}
+}
+
+// WithMaxTotalBufferBytes sets up maximum bytes of the requests queued by all clients waiting for their replies
+func WithMaxTotalBufferBytes(max int) Option {
+	return func(opts *Options) {
+		opts.MaxTotalBufferBytes = max
+	}
+}
+
+// WithCommandMetrics sets up the granularity of the per command metrics, family, exact or off
+func WithCommandMetrics(granularity string) Option {
+	return func(opts *Options) {
+		opts.CommandMetrics = granularity
+	}
+}
+
+// WithRedisMaxReplyElements sets up maximum number of elements of an array reply
+func WithRedisMaxReplyElements(max int) Option {
+	return func(opts *Options) {
+		opts.RedisMaxReplyElements = max
+	}
+}
+
+// WithClientTLS sets up the certificate and key files the client connections are terminated with
+func WithClientTLS(certFile, keyFile string) Option {
+	return func(opts *Options) {
+		opts.ClientTLSCert = certFile
+		opts.ClientTLSKey = keyFile
+	}
+}
+
+// WithRedisServerMaxPending sets up maximum requests pending on a connection to a redis node
+func WithRedisServerMaxPending(max int) Option {
+	return func(opts *Options) {
+		opts.RedisServerMaxPending = max
+	}
+}
+
+// WithRedisTLS sets up the TLS of the connections to the redis nodes, the CA bundle and whether to skip the verification
+func WithRedisTLS(enabled bool, caFile string, insecureSkipVerify bool) Option {
+	return func(opts *Options) {
+		opts.RedisTLS = enabled
+		opts.RedisTLSCA = caFile
+		opts.RedisTLSInsecure = insecureSkipVerify
+	}
+}
@@ -193,3 +193,26 @@ func TestMixedBuffer_WriteTo(t *testing.T) {
 	require.NotNil(t, mb.ringBuffer)
 	require.True(t, mb.IsEmpty())
 }
+
+func TestMixedBuffer_OnSpill(t *testing.T) {
+	const maxStaticSize = 4 * 1024
+	mb, _ := New(maxStaticSize)
+	var spills, spilled int
+	mb.OnSpill = func(n int) {
+		spills++
+		spilled += n
+	}
+
+	// the ring-buffer grows up to the static size first
+	_, err := mb.Write(make([]byte, maxStaticSize))
+	require.NoError(t, err)
+	require.Zero(t, spills)
+
+	_, err = mb.Write(make([]byte, 100))
+	require.NoError(t, err)
+	_, err = mb.Writev([][]byte{make([]byte, 10), make([]byte, 20)})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, spills)
+	require.EqualValues(t, 130, spilled)
+	require.EqualValues(t, 130, mb.listBuffer.Buffered())
+}
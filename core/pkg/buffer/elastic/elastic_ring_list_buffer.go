@@ -30,6 +30,9 @@ type Buffer struct {
 	maxStaticBytes int
 	ringBuffer     RingBuffer
 	listBuffer     linkedlist.Buffer
+
+	// OnSpill is called with the number of bytes of a write which went to the list-buffer, if set.
+	OnSpill func(n int)
 }
 
 // New instantiates an elastic.Buffer and returns it.
@@ -82,6 +85,7 @@ func (mb *Buffer) Discard(n int) (discarded int, err error) {
 func (mb *Buffer) Write(p []byte) (n int, err error) {
 	if !mb.listBuffer.IsEmpty() || mb.ringBuffer.Buffered() >= mb.maxStaticBytes {
 		mb.listBuffer.PushBack(p)
+		mb.spill(len(p))
 		return len(p), nil
 	}
 	if mb.ringBuffer.Len() >= mb.maxStaticBytes {
@@ -89,6 +93,7 @@ func (mb *Buffer) Write(p []byte) (n int, err error) {
 		if n = len(p); n > writable {
 			_, _ = mb.ringBuffer.Write(p[:writable])
 			mb.listBuffer.PushBack(p[writable:])
+			mb.spill(n - writable)
 			return
 		}
 	}
@@ -103,6 +108,7 @@ func (mb *Buffer) Writev(bs [][]byte) (int, error) {
 			mb.listBuffer.PushBack(b)
 			n += len(b)
 		}
+		mb.spill(n)
 		return n, nil
 	}
 
@@ -110,13 +116,14 @@ func (mb *Buffer) Writev(bs [][]byte) (int, error) {
 	if mb.ringBuffer.Len() < mb.maxStaticBytes {
 		writable = mb.maxStaticBytes - mb.ringBuffer.Buffered()
 	}
-	var pos, cum int
+	var pos, cum, spilled int
 	for i, b := range bs {
 		pos = i
 		cum += len(b)
 		if len(b) > writable {
 			_, _ = mb.ringBuffer.Write(b[:writable])
 			mb.listBuffer.PushBack(b[writable:])
+			spilled += len(b) - writable
 			break
 		}
 		n, _ := mb.ringBuffer.Write(b)
@@ -124,19 +131,30 @@ func (mb *Buffer) Writev(bs [][]byte) (int, error) {
 	}
 	for pos++; pos < len(bs); pos++ {
 		cum += len(bs[pos])
+		spilled += len(bs[pos])
 		mb.listBuffer.PushBack(bs[pos])
 	}
+	mb.spill(spilled)
 	return cum, nil
 }
 
 // ReadFrom implements io.ReaderFrom.
 func (mb *Buffer) ReadFrom(r io.Reader) (int64, error) {
 	if !mb.listBuffer.IsEmpty() || mb.ringBuffer.Buffered() >= mb.maxStaticBytes {
-		return mb.listBuffer.ReadFrom(r)
+		n, err := mb.listBuffer.ReadFrom(r)
+		mb.spill(int(n))
+		return n, err
 	}
 	return mb.ringBuffer.ReadFrom(r)
 }
 
+// spill reports the bytes written to the list-buffer to OnSpill.
+func (mb *Buffer) spill(n int) {
+	if n > 0 && mb.OnSpill != nil {
+		mb.OnSpill(n)
+	}
+}
+
 // WriteTo implements io.WriterTo.
 func (mb *Buffer) WriteTo(w io.Writer) (n int64, err error) {
 	if n, err = mb.ringBuffer.WriteTo(w); err != nil {
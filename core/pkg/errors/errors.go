@@ -31,6 +31,14 @@ var (
 	ErrUnsupportedOp = errors.New("unsupported operation")
 	// ErrNegativeSize occurs when trying to pass a negative size to a buffer.
 	ErrNegativeSize = errors.New("negative size is invalid")
+	// ErrEventLoopBusy occurs when a task triggered on the event-loop is not done in time.
+	ErrEventLoopBusy = errors.New("event-loop is busy")
+	// ErrInvalidSlot occurs when a slot is out of the range of redis cluster slots.
+	ErrInvalidSlot = errors.New("invalid slot")
+	// ErrEngineNotRunning occurs when calling the event-loop before the server is started.
+	ErrEngineNotRunning = errors.New("server is not running")
+	// ErrClusterRefreshTimeout occurs when the topology is not updated in time after sending the cluster nodes command.
+	ErrClusterRefreshTimeout = errors.New("cluster nodes refresh timeout")
 
 	// ================================================= codec errors =================================================.
 
@@ -56,19 +56,18 @@ var crc16tab = [256]uint32{
 	0x6e17, 0x7e36, 0x4e55, 0x5e74, 0x2e93, 0x3eb2, 0x0ed1, 0x1ef0,
 }
 
+// Hash returns the slot of the key, only the hash tag is hashed if any, like redis: the part between the first {
+// and the first } after it, unless empty
 func Hash(key string) int32 {
-	if len(key) < 1 {
+	s := strings.IndexByte(key, '{')
+	if s < 0 {
 		return hash(key)
 	}
-	s := strings.Index(key, "{")
-	if s >= 0 {
-		e := strings.Index(key, "}")
-		if s+1 >= e {
-			return hash(key)
-		}
-		return hash(key[s+1 : e])
+	e := strings.IndexByte(key[s+1:], '}')
+	if e < 1 {
+		return hash(key)
 	}
-	return hash(key)
+	return hash(key[s+1 : s+1+e])
 }
 
 func hash(key string) int32 {
@@ -40,4 +40,32 @@ func BenchmarkCrc16Hasher_Hash(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		Hash("jioj{jio}fiejjkeofijo")
 	}
-}
\ No newline at end of file
+}
+
+func Test_Crc16HashTagSameSlot(t *testing.T) {
+	if a, b := Hash("{user}:a"), Hash("{user}:b"); a != b || a != Hash("user") {
+		t.Fatalf("crc16 hash tag error, {user}:a: %d, {user}:b: %d, user: %d", a, b, Hash("user"))
+	}
+	if a, b := Hash("{user1}:profile"), Hash("{user1}:session"); a != b {
+		t.Fatalf("crc16 hash tag error, {user1}:profile: %d, {user1}:session: %d", a, b)
+	}
+	// the first } after the first {
+	if v := Hash("a}b{user}"); v != Hash("user") {
+		t.Fatalf("crc16 hash tag error, need: %d got: %d", Hash("user"), v)
+	}
+	if v := Hash("{user}}"); v != Hash("user") {
+		t.Fatalf("crc16 hash tag error, need: %d got: %d", Hash("user"), v)
+	}
+	if v := Hash("{{user}"); v != Hash("{user") {
+		t.Fatalf("crc16 hash tag error, need: %d got: %d", Hash("{user"), v)
+	}
+}
+
+func Test_Crc16HashTagDegenerate(t *testing.T) {
+	// without a non-empty tag the whole key is hashed
+	for _, key := range []string{"{}key", "{", "}", "key{", "}{", "{}{user}", "key}{"} {
+		if v := Hash(key); v != hash(key) {
+			t.Fatalf("crc16 hash tag error, key: %q, need: %d got: %d", key, hash(key), v)
+		}
+	}
+}
@@ -110,3 +110,12 @@ func Errorf(format string, v ...interface{}) {
 		logObj.fWriter.Errorf(format, v...)
 	}
 }
+
+// Auditf writes to the dedicated audit sink at info level, whatever the log level
+func Auditf(format string, v ...interface{}) {
+	if logObj == nil {
+		fmt.Printf("[INFO] "+format+"\n", v...)
+		return
+	}
+	logObj.aWriter.Infof(format, v...)
+}
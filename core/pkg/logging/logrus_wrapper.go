@@ -17,6 +17,7 @@ package logging
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -51,12 +52,14 @@ var LevelMapperRev = map[string]logrus.Level{
 type logger struct {
 	iWriter *logrus.Logger
 	fWriter *logrus.Logger
+	aWriter *logrus.Logger // audit sink, see Auditf
 }
 
 type logOptions struct {
 	path      string
 	level     string
 	expireDay int
+	writer    io.Writer // writes the logs to it rather than the files under path, see WithWriter
 }
 
 var defaultLogOptions = logOptions{
@@ -79,6 +82,13 @@ func WithExpireDay(v int) logOptionsFunc {
 	}
 }
 
+// WithWriter writes all the logs to w rather than the rotated files, such as a MemorySink in tests
+func WithWriter(w io.Writer) logOptionsFunc {
+	return func(o *logOptions) {
+		o.writer = w
+	}
+}
+
 func WithLogLevel(l string) logOptionsFunc {
 	return func(o *logOptions) {
 		o.level = l
@@ -95,6 +105,16 @@ func InitializeLogger(opt ...logOptionsFunc) error {
 		o(&opts)
 	}
 
+	if opts.writer != nil {
+		logObj = &logger{
+			iWriter: newSinkWriter(opts.writer),
+			fWriter: newSinkWriter(opts.writer),
+			aWriter: newSinkWriter(opts.writer),
+		}
+		logObj.setLevel(opts.level)
+		return nil
+	}
+
 	if err := os.MkdirAll(opts.path, os.FileMode(0755)); err != nil {
 		fmt.Printf("[logging] mkdir failed, path: %s\n", opts.path)
 		return err
@@ -110,17 +130,42 @@ func InitializeLogger(opt ...logOptionsFunc) error {
 		return err
 	}
 
+	// the file is only created once something is audited
+	aWriter, err := newWriter(opts.path, "rcproxy.audit.log", opts.expireDay)
+	if err != nil {
+		return err
+	}
+
 	logObj = &logger{
 		iWriter: iWriter,
 		fWriter: fWriter,
+		aWriter: aWriter,
 	}
-	if v, ok := LevelMapperRev[opts.level]; ok {
-		logObj.iWriter.SetLevel(v)
-		logObj.fWriter.SetLevel(v)
-	}
+	logObj.setLevel(opts.level)
 	return nil
 }
 
+// Reset drops the initialized logger, the logs go to stdout until InitializeLogger is called again
+func Reset() {
+	logObj = nil
+}
+
+// setLevel sets the level of the logs but the audit ones, which are always written
+func (l *logger) setLevel(level string) {
+	if v, ok := LevelMapperRev[level]; ok {
+		l.iWriter.SetLevel(v)
+		l.fWriter.SetLevel(v)
+	}
+	l.aWriter.SetLevel(logrus.InfoLevel)
+}
+
+func newSinkWriter(w io.Writer) *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(w)
+	logger.Formatter = &textFormatter{}
+	return logger
+}
+
 func newWriter(filepath, fileName string, expireDay int) (logger *logrus.Logger, err error) {
 	var fileWithFullPath string
 	if strings.HasPrefix(filepath, "/") {
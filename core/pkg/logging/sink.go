@@ -0,0 +1,52 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"strings"
+	"sync"
+)
+
+// MemorySink keeps the log lines in memory, so that tests can assert on the emitted logs
+// instead of scraping the files, see WithWriter
+type MemorySink struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+// Write is called by logrus with one formatted entry at a time
+func (s *MemorySink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// Lines returns the entries logged so far
+func (s *MemorySink) Lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+// Contains reports whether an entry of the level, such as LevelWarn, contains substr
+func (s *MemorySink) Contains(level, substr string) bool {
+	for _, line := range s.Lines() {
+		if strings.HasPrefix(line, level) && strings.Contains(line, substr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySink(t *testing.T) {
+	sink := new(MemorySink)
+	assert.Nil(t, InitializeLogger(WithWriter(sink), WithLogLevel(LevelInfo)))
+	t.Cleanup(Reset)
+
+	Debugf("dropped by the level")
+	Warnf("unauthorized connection from %s", "10.0.0.1")
+
+	assert.Equal(t, 1, len(sink.Lines()))
+	assert.True(t, sink.Contains(LevelWarn, "unauthorized connection from 10.0.0.1"))
+	assert.False(t, sink.Contains(LevelInfo, "unauthorized connection"))
+
+	// reset, the logger can be initialized again
+	Reset()
+	again := new(MemorySink)
+	assert.Nil(t, InitializeLogger(WithWriter(again)))
+	Infof("initialized again")
+	assert.True(t, again.Contains(LevelInfo, "initialized again"))
+	assert.Equal(t, 1, len(sink.Lines()))
+}
+
+func TestAuditf(t *testing.T) {
+	sink := new(MemorySink)
+	assert.Nil(t, InitializeLogger(WithWriter(sink), WithLogLevel(LevelError)))
+	t.Cleanup(Reset)
+
+	Infof("dropped by the level")
+	Auditf("client conn open, remote: %s", "10.0.0.1:5000")
+
+	assert.Equal(t, 1, len(sink.Lines()))
+	assert.True(t, sink.Contains(LevelInfo, "client conn open, remote: 10.0.0.1:5000"), "audited whatever the level")
+}
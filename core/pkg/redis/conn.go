@@ -19,6 +19,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -81,6 +82,7 @@ type dialOptions struct {
 	readTimeout  time.Duration
 	writeTimeout time.Duration
 	dialer       *net.Dialer
+	tlsConfig    *tls.Config
 }
 
 // DialReadTimeout specifies the timeout for reading a single command reply.
@@ -104,6 +106,13 @@ func DialConnectTimeout(d time.Duration) DialOption {
 	}}
 }
 
+// DialTLS specifies the TLS config the connection is encrypted with, plaintext if nil.
+func DialTLS(config *tls.Config) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.tlsConfig = config
+	}}
+}
+
 // Dial connects to the Redis server at the given address
 func Dial(address, passwd string, options ...DialOption) (Conn, error) {
 	do := dialOptions{
@@ -124,6 +133,19 @@ func Dial(address, passwd string, options ...DialOption) (Conn, error) {
 		return nil, err
 	}
 
+	if do.tlsConfig != nil {
+		tlsConn := tls.Client(netConn, TLSConfigFor(do.tlsConfig, address))
+		if do.dialer.Timeout > 0 {
+			_ = tlsConn.SetDeadline(time.Now().Add(do.dialer.Timeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		netConn = tlsConn
+	}
+
 	c := &conn{
 		conn:         netConn,
 		bw:           bufio.NewWriterSize(netConn, 4096*10),
@@ -142,6 +164,21 @@ func Dial(address, passwd string, options ...DialOption) (Conn, error) {
 	return c, nil
 }
 
+// TLSConfigFor returns the config verifying the server at the given address, the host of the address
+// is used as the server name unless the config sets one.
+func TLSConfigFor(config *tls.Config, address string) *tls.Config {
+	if config.ServerName != "" {
+		return config
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return config
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
 func (c *conn) Close() error {
 	err := c.err
 	if c.err == nil {
@@ -17,7 +17,9 @@ package core
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"math/rand"
 	"time"
 
 	"rcproxy/core/pkg/logging"
@@ -30,21 +32,23 @@ type Pool struct {
 	Addr   string
 	Passwd string
 
+	tlsConfig *tls.Config // encrypts the probe connections, nil if TLS is not enabled
+
 	maxActive int        // maximum number of connections to each redis node.
 	active    activeList // active connections. Note that all connections are active.
 
-	// LiftBanOrder if the redis node is continuously offline, add gradient to LiftBanTime here.
-	// For example, the initial probe failure is disabled for 1 second,
-	// the second probe is disabled for 2 seconds,
-	// and the third probe is disabled for 4 seconds.
-	// The maximum value of LiftBanOrder is 5.
-	LiftBanOrder int32
-	LiftBanTime  time.Time // If the redis node is offline, set the remaining disable time.
-	AutoBanFlag  bool      // set to true if the redis node is offline.
+	scale poolScale // grows maxActive under sustained load and shrinks it back when idle, see autoscale.
+
+	ban banState // whether the redis node serves traffic, see BanState.
 
 	isSlave bool // whether it is a slave node.
 	closed  bool // set to true when the pool is closed.
 
+	drainDeadline time.Time // set when the node left the topology, the pool is closed once drained or past it, see Drain.
+
+	monitorInterval time.Duration       // interval of probing the redis node.
+	jitter          func(n int64) int64 // returns a random delay in [0, n), spreads the first probe.
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -52,15 +56,23 @@ type Pool struct {
 func (eng *engine) newPool(addr string, isSlave bool) *Pool {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	p := &Pool{
-		Addr:         addr,
-		Passwd:       eng.opts.RedisPasswd,
-		Dial:         eng.Dial,
-		isSlave:      isSlave,
-		maxActive:    eng.opts.RedisServerConnections,
-		AutoBanFlag:  false,
-		LiftBanOrder: 0,
-		ctx:          ctx,
-		cancel:       cancelFunc,
+		Addr:      addr,
+		Passwd:    eng.opts.RedisPasswd,
+		Dial:      eng.Dial,
+		tlsConfig: eng.redisTLS,
+		isSlave:   isSlave,
+		maxActive: eng.opts.RedisServerConnections,
+		ctx:       ctx,
+		cancel:    cancelFunc,
+
+		scale: poolScale{
+			min:      eng.opts.RedisServerConnections,
+			max:      eng.opts.RedisServerConnectionsMax,
+			inflight: eng.opts.RedisScaleUpInflight,
+		},
+
+		monitorInterval: time.Duration(eng.opts.RedisMonitorInterval) * time.Millisecond,
+		jitter:          rand.Int63n,
 	}
 	go p.monitor()
 	return p
@@ -71,6 +83,10 @@ func (p *Pool) Get() SConn {
 		logging.Errorf("get on closed pool, addr: %s", p.Addr)
 		return nil
 	}
+	if !p.drainDeadline.IsZero() {
+		logging.Errorf("get on draining pool, addr: %s", p.Addr)
+		return nil
+	}
 
 	var c SConn
 	var err error
@@ -80,21 +96,34 @@ func (p *Pool) Get() SConn {
 			logging.Errorf("failed to dial, addr: %s, err: %s", p.Addr, err)
 			return nil
 		}
+		markCold(c)
 		p.active.pushFront(&poolConn{c: c})
 		return c
 	}
 
-	for {
-		if p.active.count < 1 {
-			break
-		}
+	// a connection still initializing, AUTH or READONLY in flight, is passed over for a ready one, so that
+	// the request doesn't wait for the init. The first of them is handed out when none is ready, the frags
+	// are held until its init completes, see handleWriteSignal.
+	var initializing *poolConn
+	for n := p.active.count; n > 0; n-- {
 		pc := p.active.back
 		p.active.popBack()
 		if !pc.c.IsOpened() {
 			continue
 		}
 		p.active.pushFront(pc)
-		return pc.c
+		if pc.c.InitializeStatus() == Initialized {
+			return pc.c
+		}
+		if initializing == nil {
+			initializing = pc
+		}
+	}
+	if initializing != nil {
+		// next time round it is the last one tried
+		p.active.remove(initializing)
+		p.active.pushFront(initializing)
+		return initializing.c
 	}
 
 	c, err = p.dial()
@@ -102,16 +131,36 @@ func (p *Pool) Get() SConn {
 		logging.Errorf("failed to dial, addr: %s, err: %s", p.Addr, err)
 		return nil
 	}
+	markCold(c)
 	p.active.pushFront(&poolConn{c: c})
 	return c
 }
 
+// markCold flags a connection newly dialed, the first request sent on it is timed as cold
+func markCold(c SConn) {
+	if sc, ok := c.(*conn); ok {
+		sc.cold = true
+	}
+}
+
 // ActiveCount returns the number of active connections in the pool.
 // Note that all connections are active
 func (p *Pool) ActiveCount() int {
 	return p.active.count
 }
 
+// Drain stops the pool from handing out connections while keeping the open ones,
+// so that the requests in flight complete, the pool is to be closed once Drained
+func (p *Pool) Drain(deadline time.Time) {
+	p.drainDeadline = deadline
+	p.cancel()
+}
+
+// Drained reports whether a draining pool has no request in flight left or its deadline has passed
+func (p *Pool) Drained(now time.Time) bool {
+	return p.InFlight() == 0 || !now.Before(p.drainDeadline)
+}
+
 // Close releases the resources used by the pool.
 func (p *Pool) Close() {
 	if p.closed {
@@ -136,6 +185,73 @@ func (p *Pool) Release() {
 	return
 }
 
+const (
+	scaleUpTicks   = 3  // seconds of in-flight depth above the threshold before allowing one more connection
+	scaleDownTicks = 30 // seconds of quiet before recycling an idle surplus connection
+)
+
+// poolScale holds the bounds and the sustained load samples of the pool auto-scaling
+type poolScale struct {
+	min, max int // bounds of maxActive, auto-scaling is disabled unless max > min
+	inflight int // in-flight requests per connection above which the pool is considered loaded
+
+	hot, quiet int // consecutive ticks above the threshold and below it with one connection less
+}
+
+// InFlight returns the number of requests sent to the redis node and not answered yet
+func (p *Pool) InFlight() int {
+	n := 0
+	for pc := p.active.front; pc != nil; pc = pc.next {
+		n += pc.c.InFlight()
+	}
+	return n
+}
+
+// autoscale samples the in-flight depth of the pool, it is called every second by the event loop.
+// When the depth stays above the threshold per connection for scaleUpTicks, Get is allowed to open one
+// more connection up to the max, when the load fits in one connection less for scaleDownTicks,
+// an idle connection beyond the min is closed
+func (p *Pool) autoscale() {
+	s := &p.scale
+	if p.closed || s.max <= s.min {
+		return
+	}
+
+	n := p.InFlight()
+	switch {
+	case n > s.inflight*p.active.count:
+		s.quiet = 0
+		if s.hot++; s.hot >= scaleUpTicks && p.maxActive < s.max && p.active.count >= p.maxActive {
+			s.hot = 0
+			p.maxActive++
+			logging.Infof("[autoscale] addr %s in-flight %d, grow to %d connections", p.Addr, n, p.maxActive)
+		}
+	case n <= s.inflight*(p.active.count-1):
+		s.hot = 0
+		if s.quiet++; s.quiet >= scaleDownTicks && p.maxActive > s.min {
+			s.quiet = 0
+			p.maxActive--
+			p.recycleIdle()
+			logging.Infof("[autoscale] addr %s in-flight %d, shrink to %d connections", p.Addr, n, p.maxActive)
+		}
+	default:
+		s.hot, s.quiet = 0, 0
+	}
+}
+
+// recycleIdle closes the least recently used connections without in-flight requests until the pool
+// fits in maxActive, the busy ones are kept and recycled by a later tick
+func (p *Pool) recycleIdle() {
+	for pc := p.active.back; pc != nil && p.active.count > p.maxActive; {
+		prev := pc.prev
+		if !pc.c.IsOpened() || pc.c.InFlight() == 0 {
+			p.active.remove(pc)
+			pc.c.Close()
+		}
+		pc = prev
+	}
+}
+
 func (p *Pool) dial() (SConn, error) {
 	if p.Dial != nil {
 		return p.Dial(p.Addr, p.isSlave)
@@ -151,8 +267,24 @@ func (p *Pool) SetIsSlave(isSlave bool) {
 	}
 }
 
+// monitorDelay returns the delay of the first probe, spread within the interval,
+// so that the pools of a large cluster don't probe their nodes in lockstep
+func (p *Pool) monitorDelay() time.Duration {
+	if p.monitorInterval <= 0 {
+		return 0
+	}
+	return time.Duration(p.jitter(int64(p.monitorInterval)))
+}
+
 func (p *Pool) monitor() {
-	ticker := time.NewTicker(5 * time.Second)
+	select {
+	case <-p.ctx.Done():
+		return
+	case <-time.After(p.monitorDelay()):
+	}
+
+	ticker := time.NewTicker(p.monitorInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-p.ctx.Done():
@@ -163,27 +295,17 @@ func (p *Pool) monitor() {
 			}
 			err := p.detect()
 			if err == nil {
-				p.LiftBanOrder = 0
-				if p.AutoBanFlag {
-					logging.Errorf("[monitor] addr %s reconnected", p.Addr)
-				}
-				p.AutoBanFlag = false
+				p.probeSucceeded()
 				break
-			} else {
-				time.Sleep(5 * time.Second)
-				err = p.detect()
-				if err == nil {
-					p.LiftBanOrder = 0
-					if p.AutoBanFlag {
-						logging.Errorf("[monitor] addr %s reconnected", p.Addr)
-					}
-					p.AutoBanFlag = false
+			}
+			if !p.probeFailed() {
+				time.Sleep(p.monitorInterval)
+				if err = p.detect(); err == nil {
+					p.probeSucceeded()
 					break
 				}
+				p.probeFailed()
 			}
-
-			p.LiftBanTime = time.Now().Add(60 * time.Second)
-			p.AutoBanFlag = true
 			logging.Errorf("[monitor] addr %s disconnected, baned for period, err: %s", p.Addr, err)
 		}
 	}
@@ -196,6 +318,7 @@ func (p *Pool) detect() error {
 		redis.DialConnectTimeout(1*time.Second),
 		redis.DialReadTimeout(3*time.Second),
 		redis.DialWriteTimeout(3*time.Second),
+		redis.DialTLS(p.tlsConfig),
 	)
 	if err != nil {
 		return err
@@ -249,3 +372,18 @@ func (l *activeList) popBack() {
 	}
 	pc.next, pc.prev = nil, nil
 }
+
+func (l *activeList) remove(pc *poolConn) {
+	if pc.prev == nil {
+		l.front = pc.next
+	} else {
+		pc.prev.next = pc.next
+	}
+	if pc.next == nil {
+		l.back = pc.prev
+	} else {
+		pc.next.prev = pc.prev
+	}
+	l.count--
+	pc.next, pc.prev = nil, nil
+}
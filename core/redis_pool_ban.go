@@ -0,0 +1,219 @@
+// Copyright (c) 2022 The rcproxy Authors
+// Copyright (c) 2011 Twitter, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package core
+
+import (
+	"sync"
+	"time"
+
+	"rcproxy/core/pkg/logging"
+)
+
+// minSlowStartWeight the share of reads a slave takes right after it was lifted from ban
+const minSlowStartWeight = 0.1
+
+// BanState state of the redis node, shared by the request path and the pool monitor
+//
+//	Healthy  --monitor probe failed--> Probing  --monitor probe failed again--> Banned
+//	Healthy  --request dial or preconnect failed-->  Banned
+//	Probing  --monitor probe succeeded--> Healthy
+//	Banned   --ban period expired or monitor probe succeeded--> HalfOpen
+//	HalfOpen --request dial succeeded--> Healthy
+//	HalfOpen --request dial failed--> Banned, for a longer period
+type BanState int32
+
+const (
+	// Healthy the node serves traffic
+	Healthy BanState = iota
+	// Probing the monitor failed to reach the node once, it still serves traffic until the next probe
+	Probing
+	// Banned the node serves no traffic until LiftBanTime
+	Banned
+	// HalfOpen the node serves traffic on trial, the ban gradient is kept until a request succeeds
+	HalfOpen
+)
+
+// monitorBanPeriod how long the node is banned when the monitor fails to reach it twice in a row
+const monitorBanPeriod = 60 * time.Second
+
+// maxLiftBanOrder the maximum value of LiftBanOrder
+const maxLiftBanOrder = 5
+
+var banStateNames = map[BanState]string{
+	Healthy:  "healthy",
+	Probing:  "probing",
+	Banned:   "banned",
+	HalfOpen: "half-open",
+}
+
+func (s BanState) String() string {
+	return banStateNames[s]
+}
+
+func (s BanState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// BanStatus snapshot of the ban state of a pool
+type BanStatus struct {
+	State BanState
+
+	// LiftBanOrder if the redis node is continuously offline, add gradient to LiftBanTime here.
+	// For example, the initial probe failure is disabled for 1 second,
+	// the second probe is disabled for 2 seconds,
+	// and the third probe is disabled for 4 seconds.
+	// The maximum value of LiftBanOrder is 5.
+	LiftBanOrder int32
+	LiftBanTime  time.Time // If the redis node is offline, set the remaining disable time.
+	UnbanTime    time.Time // time the redis node was lifted from ban, reads are ramped up from it.
+}
+
+// banState the ban state machine of a pool, the request path runs in the event-loop
+// while the monitor runs in its own goroutine, so every transition holds the lock
+type banState struct {
+	mu sync.Mutex
+	BanStatus
+}
+
+// BanStatus returns a snapshot of the ban state
+func (p *Pool) BanStatus() BanStatus {
+	p.ban.mu.Lock()
+	defer p.ban.mu.Unlock()
+	return p.ban.BanStatus
+}
+
+// Available whether the node may serve traffic, lifting the ban once its period expired
+func (p *Pool) Available() bool {
+	p.ban.mu.Lock()
+	defer p.ban.mu.Unlock()
+	if p.ban.State != Banned {
+		return true
+	}
+	if time.Now().Before(p.ban.LiftBanTime) {
+		return false
+	}
+	p.halfOpen()
+	return true
+}
+
+// ReportFailure the request path failed to reach the node, ban it for base * 2^LiftBanOrder
+func (p *Pool) ReportFailure(base time.Duration) {
+	p.ban.mu.Lock()
+	defer p.ban.mu.Unlock()
+	p.banFor(base * time.Duration(1<<p.ban.LiftBanOrder))
+	if p.ban.LiftBanOrder < maxLiftBanOrder {
+		p.ban.LiftBanOrder++
+	}
+}
+
+// ReportSuccess the request path reached the node, the node is healthy again
+func (p *Pool) ReportSuccess() {
+	p.ban.mu.Lock()
+	defer p.ban.mu.Unlock()
+	if p.ban.State == Banned {
+		// the ban is not over yet, it is lifted by Available or the monitor
+		return
+	}
+	p.ban.State = Healthy
+	p.ban.LiftBanOrder = 0
+}
+
+// Unban lifts the ban of the redis node at once, and resets the gradient
+func (p *Pool) Unban() {
+	p.ban.mu.Lock()
+	defer p.ban.mu.Unlock()
+	if p.ban.State == Banned {
+		p.ban.UnbanTime = time.Now()
+	}
+	p.ban.State = Healthy
+	p.ban.LiftBanOrder = 0
+	p.ban.LiftBanTime = time.Time{}
+}
+
+// preconnectFailed preconnect failed to reach the node, it is banned until the monitor reaches it
+func (p *Pool) preconnectFailed() {
+	p.ban.mu.Lock()
+	defer p.ban.mu.Unlock()
+	p.banFor(monitorBanPeriod)
+}
+
+// protocolMismatch the node replied in RESP3, it is banned until the monitor reaches it
+func (p *Pool) protocolMismatch() {
+	p.ban.mu.Lock()
+	defer p.ban.mu.Unlock()
+	p.banFor(monitorBanPeriod)
+}
+
+// probeSucceeded the monitor reached the node
+func (p *Pool) probeSucceeded() {
+	p.ban.mu.Lock()
+	defer p.ban.mu.Unlock()
+	switch p.ban.State {
+	case Probing:
+		p.ban.State = Healthy
+	case Banned:
+		logging.Errorf("[monitor] addr %s reconnected", p.Addr)
+		// on trial, a request failure still bans it with a longer period
+		p.halfOpen()
+	}
+}
+
+// probeFailed the monitor failed to reach the node, it is banned on the second failure in a row
+func (p *Pool) probeFailed() (banned bool) {
+	p.ban.mu.Lock()
+	defer p.ban.mu.Unlock()
+	switch p.ban.State {
+	case Healthy, HalfOpen:
+		p.ban.State = Probing
+		return false
+	}
+	p.banFor(monitorBanPeriod)
+	return true
+}
+
+// banFor bans the node for the period, never shortening a longer ban, the lock must be held
+func (p *Pool) banFor(period time.Duration) {
+	if liftBanTime := time.Now().Add(period); p.ban.State != Banned || liftBanTime.After(p.ban.LiftBanTime) {
+		p.ban.LiftBanTime = liftBanTime
+	}
+	p.ban.State = Banned
+}
+
+// halfOpen lifts the ban on trial, the lock must be held
+func (p *Pool) halfOpen() {
+	p.ban.State = HalfOpen
+	p.ban.UnbanTime = time.Now()
+}
+
+// SlowStartWeight returns the fraction in (0, 1] of reads a slave should take,
+// growing linearly within window after the slave was lifted from ban
+func (p *Pool) SlowStartWeight(window time.Duration) float64 {
+	p.ban.mu.Lock()
+	unbanTime := p.ban.UnbanTime
+	p.ban.mu.Unlock()
+
+	if window <= 0 || unbanTime.IsZero() {
+		return 1
+	}
+	elapsed := time.Since(unbanTime)
+	if elapsed >= window {
+		return 1
+	}
+	weight := float64(elapsed) / float64(window)
+	if weight < minSlowStartWeight {
+		return minSlowStartWeight
+	}
+	return weight
+}
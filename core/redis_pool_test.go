@@ -15,7 +15,9 @@
 package core
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -50,3 +52,264 @@ func TestActiveList(t *testing.T) {
 	assert.Same(t, pc3, l.front)
 	assert.Same(t, pc3, l.back)
 }
+
+func TestMonitorDelay(t *testing.T) {
+	eng := &engine{opts: &Options{RedisMonitorInterval: 5000}}
+
+	delays := make(map[time.Duration]struct{})
+	for i := 0; i < 10; i++ {
+		p := eng.newPool("127.0.0.1:7000", false)
+		p.Close()
+		d := p.monitorDelay()
+		assert.GreaterOrEqual(t, d, time.Duration(0))
+		assert.Less(t, d, 5*time.Second)
+		delays[d] = struct{}{}
+	}
+	assert.Greater(t, len(delays), 1, "monitors should not all fire at the same instant")
+
+	// the delay is injectable
+	p := &Pool{monitorInterval: 5 * time.Second, jitter: func(n int64) int64 { return n / 2 }}
+	assert.Equal(t, 2500*time.Millisecond, p.monitorDelay())
+}
+
+func TestBanTransitions(t *testing.T) {
+	p := &Pool{Addr: "127.0.0.1:7000"}
+	assert.Equal(t, Healthy, p.BanStatus().State)
+	assert.True(t, p.Available())
+
+	// the monitor bans the node on the second failure in a row
+	assert.False(t, p.probeFailed())
+	assert.Equal(t, Probing, p.BanStatus().State)
+	assert.True(t, p.Available())
+	p.probeSucceeded()
+	assert.Equal(t, Healthy, p.BanStatus().State)
+
+	assert.False(t, p.probeFailed())
+	assert.True(t, p.probeFailed())
+	assert.Equal(t, Banned, p.BanStatus().State)
+	assert.False(t, p.Available())
+
+	// a monitor success lifts the ban on trial, a request success makes it healthy
+	p.probeSucceeded()
+	st := p.BanStatus()
+	assert.Equal(t, HalfOpen, st.State)
+	assert.False(t, st.UnbanTime.IsZero())
+	assert.True(t, p.Available())
+	p.ReportSuccess()
+	assert.Equal(t, Healthy, p.BanStatus().State)
+}
+
+func TestBanGradient(t *testing.T) {
+	p := &Pool{Addr: "127.0.0.1:7000"}
+	for i := int32(1); i <= 7; i++ {
+		p.ReportFailure(time.Millisecond)
+		st := p.BanStatus()
+		assert.Equal(t, Banned, st.State)
+		if i < maxLiftBanOrder {
+			assert.Equal(t, i, st.LiftBanOrder)
+		} else {
+			assert.Equal(t, int32(maxLiftBanOrder), st.LiftBanOrder)
+		}
+		assert.False(t, p.Available())
+
+		// the ban expires, the node is on trial and the gradient is kept
+		time.Sleep(time.Until(st.LiftBanTime))
+		assert.True(t, p.Available())
+		assert.Equal(t, HalfOpen, p.BanStatus().State)
+	}
+
+	p.ReportSuccess()
+	st := p.BanStatus()
+	assert.Equal(t, Healthy, st.State)
+	assert.Equal(t, int32(0), st.LiftBanOrder)
+
+	p.ReportFailure(time.Minute)
+	p.Unban()
+	st = p.BanStatus()
+	assert.Equal(t, Healthy, st.State)
+	assert.Equal(t, int32(0), st.LiftBanOrder)
+	assert.True(t, st.LiftBanTime.IsZero())
+}
+
+func TestBanRequestFailureMonitorSuccessRace(t *testing.T) {
+	// a request failure while the ban is being lifted by the monitor keeps the node on trial with a longer ban
+	p := &Pool{Addr: "127.0.0.1:7000"}
+	p.ReportFailure(time.Minute)
+	p.probeSucceeded()
+	p.ReportFailure(time.Minute)
+	st := p.BanStatus()
+	assert.Equal(t, Banned, st.State)
+	assert.Equal(t, int32(2), st.LiftBanOrder)
+	assert.Greater(t, time.Until(st.LiftBanTime), time.Minute)
+
+	// a request success never lifts a ban, only its expiry or the monitor does
+	p.ReportSuccess()
+	assert.Equal(t, Banned, p.BanStatus().State)
+
+	// the monitor never shortens a longer ban
+	p = &Pool{Addr: "127.0.0.1:7000"}
+	p.ReportFailure(10 * time.Minute)
+	liftBanTime := p.BanStatus().LiftBanTime
+	p.probeFailed()
+	assert.Equal(t, liftBanTime, p.BanStatus().LiftBanTime)
+
+	// the request path and the monitor hammer the state concurrently, run with -race
+	p = &Pool{Addr: "127.0.0.1:7000"}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if p.Available() {
+				p.ReportFailure(time.Microsecond)
+			}
+			p.ReportSuccess()
+			p.SlowStartWeight(time.Second)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			p.probeFailed()
+			p.probeSucceeded()
+		}
+	}()
+	wg.Wait()
+
+	p.probeSucceeded()
+	p.ReportSuccess()
+	assert.Equal(t, Healthy, p.BanStatus().State)
+}
+
+type scaledConn struct {
+	SConn
+	inflight     int
+	closed       bool
+	initializing bool
+}
+
+func (c *scaledConn) IsOpened() bool { return !c.closed }
+func (c *scaledConn) InFlight() int  { return c.inflight }
+func (c *scaledConn) InitializeStatus() InitializeStatus {
+	if c.initializing {
+		return Initializing
+	}
+	return Initialized
+}
+func (c *scaledConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPoolAutoscale(t *testing.T) {
+	var conns []*scaledConn
+	p := &Pool{
+		Addr:      "127.0.0.1:7000",
+		maxActive: 1,
+		scale:     poolScale{min: 1, max: 3, inflight: 10},
+		Dial: func(string, bool) (SConn, error) {
+			c := &scaledConn{}
+			conns = append(conns, c)
+			return c, nil
+		},
+	}
+	p.Get()
+	assert.Equal(t, 1, p.ActiveCount())
+
+	// a short burst doesn't grow the pool
+	conns[0].inflight = 50
+	p.autoscale()
+	conns[0].inflight = 0
+	p.autoscale()
+	p.Get()
+	assert.Equal(t, 1, p.ActiveCount())
+
+	// sustained load grows it one connection at a time, up to the max
+	conns[0].inflight = 50
+	for i := 0; i < scaleUpTicks; i++ {
+		p.autoscale()
+	}
+	assert.Equal(t, 2, p.maxActive)
+	p.Get()
+	assert.Equal(t, 2, p.ActiveCount())
+	for i := 0; i < 3*scaleUpTicks; i++ {
+		p.autoscale()
+		p.Get()
+	}
+	assert.Equal(t, 3, p.maxActive)
+	assert.Equal(t, 3, p.ActiveCount())
+
+	// idle, the surplus connections without in-flight requests are recycled down to the min
+	conns[0].inflight = 0
+	conns[2].inflight = 1
+	for i := 0; i < scaleDownTicks; i++ {
+		p.autoscale()
+	}
+	assert.Equal(t, 2, p.maxActive)
+	assert.Equal(t, 2, p.ActiveCount())
+	assert.Equal(t, 1, countClosed(conns))
+	for i := 0; i < scaleDownTicks; i++ {
+		p.autoscale()
+	}
+	assert.Equal(t, 1, p.maxActive)
+	assert.Equal(t, 1, p.ActiveCount())
+	assert.False(t, conns[2].closed, "a connection with in-flight requests is kept")
+	for i := 0; i < 2*scaleDownTicks; i++ {
+		p.autoscale()
+	}
+	assert.Equal(t, 1, p.maxActive, "never below the min")
+	assert.Equal(t, 1, p.ActiveCount())
+
+	// disabled when max is not above min
+	p = &Pool{maxActive: 1, scale: poolScale{min: 1, max: 1, inflight: 10}}
+	p.active.pushFront(&poolConn{c: &scaledConn{inflight: 100}})
+	for i := 0; i < 2*scaleUpTicks; i++ {
+		p.autoscale()
+	}
+	assert.Equal(t, 1, p.maxActive)
+}
+
+func countClosed(conns []*scaledConn) int {
+	n := 0
+	for _, c := range conns {
+		if c.closed {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPoolGetInitializing(t *testing.T) {
+	var conns []*scaledConn
+	p := &Pool{
+		Addr:      "127.0.0.1:7000",
+		maxActive: 3,
+		Dial: func(string, bool) (SConn, error) {
+			c := &scaledConn{initializing: true}
+			conns = append(conns, c)
+			return c, nil
+		},
+	}
+	for i := 0; i < 3; i++ {
+		p.Get()
+	}
+
+	// none is ready, they are handed out in turn, the frags wait for the init
+	assert.Same(t, conns[0], p.Get())
+	assert.Same(t, conns[1], p.Get())
+
+	// the ready one is handed out whatever its turn
+	conns[2].initializing = false
+	for i := 0; i < 3; i++ {
+		assert.Same(t, conns[2], p.Get())
+	}
+	conns[0].initializing = false
+	assert.Same(t, conns[0], p.Get())
+	assert.Same(t, conns[2], p.Get())
+
+	// a closed one is dropped on the way
+	conns[0].closed = true
+	assert.Same(t, conns[2], p.Get())
+	assert.Equal(t, 2, p.ActiveCount())
+	assert.Equal(t, 3, len(conns), "no dial while the pool has connections")
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// the cursor handed to the clients packs, from the low bits, the index of the master being scanned,
+// the epoch of the masters and the cursor of the master
+const (
+	scanNodeBits   = 10
+	scanEpochBits  = 12
+	scanCursorBits = 64 - scanNodeBits - scanEpochBits
+
+	// ScanMaxNodes the masters a SCAN goes through at most
+	ScanMaxNodes = 1 << scanNodeBits
+)
+
+// ScanCursor position of a SCAN going through the masters sorted by addr one at a time, each from its cursor 0
+type ScanCursor struct {
+	Node   int    // index of the master being scanned
+	Nodes  int    // number of masters, not handed to the client
+	Epoch  uint64 // fingerprint of the masters, the scan restarts once they changed, see ScanEpoch
+	Cursor uint64 // cursor of the master
+}
+
+// ParseScanCursor decodes the cursor handed to a client, false if it is not a cursor
+func ParseScanCursor(s string) (ScanCursor, bool) {
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return ScanCursor{}, false
+	}
+	return ScanCursor{
+		Node:   int(v & (1<<scanNodeBits - 1)),
+		Epoch:  v >> scanNodeBits & (1<<scanEpochBits - 1),
+		Cursor: v >> (scanNodeBits + scanEpochBits),
+	}, true
+}
+
+// ScanEpoch fingerprints the masters sorted by addr, so that a cursor handed out before they changed is told apart
+func ScanEpoch(masters []string) uint64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(strings.Join(masters, ",")))
+	return uint64(h.Sum32()) & (1<<scanEpochBits - 1)
+}
+
+// Next returns the cursor handed to the client after the master answered its page with the cursor,
+// "0" once the last master is done, false if the cursor of the master doesn't fit
+func (s ScanCursor) Next(cursor uint64) (string, bool) {
+	if cursor == 0 {
+		s.Node++
+		if s.Node >= s.Nodes {
+			return "0", true
+		}
+	}
+	if cursor >= 1<<scanCursorBits {
+		return "", false
+	}
+	v := cursor<<(scanNodeBits+scanEpochBits) | s.Epoch<<scanNodeBits | uint64(s.Node)
+	return strconv.FormatUint(v, 10), true
+}
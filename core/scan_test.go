@@ -0,0 +1,63 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanCursor(t *testing.T) {
+	start, ok := ParseScanCursor("0")
+	assert.True(t, ok)
+	assert.Equal(t, ScanCursor{}, start)
+	_, ok = ParseScanCursor("-1")
+	assert.False(t, ok)
+	_, ok = ParseScanCursor("abc")
+	assert.False(t, ok)
+
+	var cases = []struct {
+		Cursor ScanCursor
+		Node   uint64
+		Expect string
+	}{
+		// the master goes on
+		{Cursor: ScanCursor{Node: 0, Nodes: 2, Epoch: 5}, Node: 17, Expect: "71308288"},
+		// the master is done, the next one starts from 0
+		{Cursor: ScanCursor{Node: 0, Nodes: 2, Epoch: 5, Cursor: 17}, Node: 0, Expect: "5121"},
+		// the last master is done
+		{Cursor: ScanCursor{Node: 1, Nodes: 2, Epoch: 5, Cursor: 17}, Node: 0, Expect: "0"},
+	}
+	for _, v := range cases {
+		next, ok := v.Cursor.Next(v.Node)
+		assert.True(t, ok)
+		assert.Equal(t, v.Expect, next, "cursor: %+v, node: %d", v.Cursor, v.Node)
+	}
+
+	// handed back by the client
+	cursor, ok := ParseScanCursor("71308288")
+	assert.True(t, ok)
+	assert.Equal(t, ScanCursor{Node: 0, Epoch: 5, Cursor: 17}, cursor)
+	cursor, _ = ParseScanCursor("5121")
+	assert.Equal(t, ScanCursor{Node: 1, Epoch: 5}, cursor)
+
+	_, ok = ScanCursor{Nodes: 2}.Next(1 << scanCursorBits)
+	assert.False(t, ok, "the cursor of the master doesn't fit")
+
+	assert.Equal(t, ScanEpoch([]string{"127.0.0.1:7000", "127.0.0.1:7001"}), ScanEpoch([]string{"127.0.0.1:7000", "127.0.0.1:7001"}))
+	assert.NotEqual(t, ScanEpoch([]string{"127.0.0.1:7000", "127.0.0.1:7001"}), ScanEpoch([]string{"127.0.0.1:7000", "127.0.0.1:7002"}))
+	assert.Less(t, ScanEpoch([]string{"127.0.0.1:7000"}), uint64(1<<scanEpochBits))
+}
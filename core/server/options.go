@@ -14,6 +14,11 @@
 
 package server
 
+import (
+	"math/rand"
+	"strings"
+)
+
 type Option func(opts *Options)
 
 func loadOptions(options ...Option) *Options {
@@ -26,22 +31,193 @@ func loadOptions(options ...Option) *Options {
 
 type Options struct {
 	Password           string
+	Version            string
+	ServerName         string // identity reported by HELLO and PROXY INFO, see DefaultServerName
 	DisableSlave       bool
+	ReadOnly           bool // reject write commands, for read-only deployments such as analytics replicas
 	ServerRetryTimeout int
+	SlowStartWindow    int               // ms
+	SlavePolicy        string            // how to pick a live slave for reads, see SlavePolicyRandom
+	ReadWeights        map[string]int    // weight of the slaves picked for reads by addr, the others weigh 1, see pickSlave
+	NodeTags           map[string]string // tag of the slaves by addr, the reads of a client tagged by PROXY TAG go to its slave
+	Selector           Selector          // picks the live slave for reads and draws its slow start share, random unless set
+	ReadYourWrites     int               // ms, reads of a slot go to the master within the window after the client wrote it
+	MovedCacheWindow   int               // ms, a slot is routed to the node of its last MOVED within the window, see WithMovedCacheWindow
+	DebugSubcommands   []string          // DEBUG subcommands fanned out to every master, the others are rejected
+	AckOnSend          []string          // write commands answered +OK once forwarded, unsafe, see WithAckOnSend
+	MaxConnsPerIP      int               // client connections accepted from a single ip, 0 means no limit
+	CompressThreshold  int               // bytes, bulk replies larger are compressed for the clients negotiated by PROXY COMPRESS
+	AuditConns         bool              // log the open and close of every client connection to the audit sink, see WithAuditConns
+	CommandCase        string            // case of the command names in the requests built by the proxy, see core.CommandCaseLower
+	// PassthroughRedirects relays MOVED/ASK to the clients rather than following them, for cluster-aware clients
+	PassthroughRedirects bool
 }
 
+// DefaultServerName is the identity reported when no server name is configured
+const DefaultServerName = "rcproxy"
+
+// Selector picks one of n candidates, whose weights are spread over n when weighted
+type Selector interface {
+	// Pick returns an index in [0, n)
+	Pick(n int) int
+}
+
+// randomSelector picks uniformly at random, the default Selector
+type randomSelector struct{}
+
+func (randomSelector) Pick(n int) int { return rand.Intn(n) }
+
+const (
+	// SlavePolicyRandom reads from a random live slave
+	SlavePolicyRandom = "random"
+	// SlavePolicyAffinity reads a slot from the same live slave for a given client, improving slave cache hit rates
+	SlavePolicyAffinity = "slave_affinity"
+)
+
 func WithRedisPassword(passwd string) Option {
 	return func(opts *Options) {
 		opts.Password = passwd
 	}
 }
 
+func WithVersion(version string) Option {
+	return func(opts *Options) {
+		opts.Version = version
+	}
+}
+
+func WithServerName(name string) Option {
+	return func(opts *Options) {
+		opts.ServerName = name
+	}
+}
+
 func WithServerRetryTimeout(timeout int) Option {
 	return func(opts *Options) {
 		opts.ServerRetryTimeout = timeout
 	}
 }
 
+func WithSlowStartWindow(window int) Option {
+	return func(opts *Options) {
+		opts.SlowStartWindow = window
+	}
+}
+
+func WithSlavePolicy(policy string) Option {
+	return func(opts *Options) {
+		opts.SlavePolicy = policy
+	}
+}
+
+// WithReadWeights biases the random pick of a live slave for reads by the weight of its addr, such as to
+// prefer the slaves in the zone of the proxy, the slaves not listed weigh 1
+func WithReadWeights(weights map[string]int) Option {
+	return func(opts *Options) {
+		opts.ReadWeights = weights
+	}
+}
+
+// WithSelector replaces the random pick of the live slave for reads and the draw of its slow start share,
+// such as by a deterministic one in the tests
+func WithSelector(selector Selector) Option {
+	return func(opts *Options) {
+		opts.Selector = selector
+	}
+}
+
+// WithNodeTags tags the slaves by addr, a client which sent PROXY TAG reads from the live slave of its tag,
+// such as a canary, while the untagged clients are routed as usual
+func WithNodeTags(tags map[string]string) Option {
+	return func(opts *Options) {
+		opts.NodeTags = tags
+	}
+}
+
+func WithReadYourWrites(window int) Option {
+	return func(opts *Options) {
+		opts.ReadYourWrites = window
+	}
+}
+
+// WithMovedCacheWindow routes a slot to the node of its last MOVED for window ms, sparing a MOVED per request
+// while a slot is resharded until the topology is refreshed, which drops the cached targets. 0 disables it
+func WithMovedCacheWindow(window int) Option {
+	return func(opts *Options) {
+		opts.MovedCacheWindow = window
+	}
+}
+
+// WithCompressThreshold allows the clients to negotiate the compression of the bulk replies larger than threshold bytes,
+// 0 disables the negotiation
+func WithCompressThreshold(threshold int) Option {
+	return func(opts *Options) {
+		opts.CompressThreshold = threshold
+	}
+}
+
+// WithAuditConns logs every client connection opened with its address, and closed with its library, duration and
+// number of requests, to the audit sink rather than the debug logs, for compliance
+func WithAuditConns(audit bool) Option {
+	return func(opts *Options) {
+		opts.AuditConns = audit
+	}
+}
+
+// WithCommandCase sets up the case of the command names in the requests the proxy builds itself, such as TIME,
+// as the ones of the clients are forwarded in the core.CommandCaseLower or core.CommandCaseUpper case
+func WithCommandCase(commandCase string) Option {
+	return func(opts *Options) {
+		opts.CommandCase = commandCase
+	}
+}
+
+// WithPassthroughRedirects relays MOVED/ASK to the clients rather than following them in the proxy,
+// only cluster-aware clients reaching the redis nodes directly can follow them
+func WithPassthroughRedirects(passthrough bool) Option {
+	return func(opts *Options) {
+		opts.PassthroughRedirects = passthrough
+	}
+}
+
+func WithReadOnly(readOnly bool) Option {
+	return func(opts *Options) {
+		opts.ReadOnly = readOnly
+	}
+}
+
+// WithDebugSubcommands allows the comma separated DEBUG subcommands, such as set-active-expire
+func WithDebugSubcommands(subcommands string) Option {
+	return func(opts *Options) {
+		opts.DebugSubcommands = opts.DebugSubcommands[:0]
+		for _, sub := range strings.Split(subcommands, ",") {
+			if sub = strings.ToLower(strings.TrimSpace(sub)); len(sub) > 0 {
+				opts.DebugSubcommands = append(opts.DebugSubcommands, sub)
+			}
+		}
+	}
+}
+
+// WithAckOnSend answers the comma separated write commands, such as set, with +OK as soon as they are forwarded
+// rather than waiting for redis. It is unsafe: the errors of redis are only logged and counted, never seen by the
+// client. Only the commands whose success reply is +OK are allowed, see codec.OkReplyCommands
+func WithAckOnSend(commands string) Option {
+	return func(opts *Options) {
+		opts.AckOnSend = opts.AckOnSend[:0]
+		for _, cmd := range strings.Split(commands, ",") {
+			if cmd = strings.ToLower(strings.TrimSpace(cmd)); len(cmd) > 0 {
+				opts.AckOnSend = append(opts.AckOnSend, cmd)
+			}
+		}
+	}
+}
+
+func WithMaxConnsPerIP(max int) Option {
+	return func(opts *Options) {
+		opts.MaxConnsPerIP = max
+	}
+}
+
 func WithDisableRedisSlave(disable bool) Option {
 	return func(opts *Options) {
 		opts.DisableSlave = disable
@@ -17,6 +17,7 @@ package server
 import (
 	"fmt"
 	"strconv"
+	"time"
 
 	"rcproxy/core"
 )
@@ -27,9 +28,19 @@ const AuthCmd = "*2\r\n$4\r\nauth\r\n$%s\r\n%s\r\n"
 
 func NewListenServer(opts ...Option) *listenServer {
 	options := loadOptions(opts...)
+	if len(options.ServerName) < 1 {
+		options.ServerName = DefaultServerName
+	}
+	if options.Selector == nil {
+		options.Selector = randomSelector{}
+	}
 
 	server := &listenServer{
-		Options: options,
+		Options:     options,
+		startTime:   time.Now(),
+		ipConns:     make(map[string]int),
+		countedConn: make(map[int]string),
+		moved:       make(map[int32]movedTarget),
 	}
 	return server
 }
@@ -38,6 +49,22 @@ type listenServer struct {
 	*core.BuiltinEventEngine
 
 	*Options
+
+	startTime time.Time // time the proxy was started, reported by PROXY INFO
+
+	// client connections per ip and the ip of the connections counted, only touched on the event-loop
+	ipConns     map[string]int
+	countedConn map[int]string
+
+	// targets of the last MOVED by slot, see WithMovedCacheWindow, only touched on the event-loop
+	moved map[int32]movedTarget
+}
+
+// movedTarget is where a slot was last moved to, valid until expiry while the slot belongs to the same replicaset
+type movedTarget struct {
+	addr   string
+	rs     *core.Replicaset
+	expiry time.Time
 }
 
 // OnBoot fires when rcproxy is ready for accepting connections.
@@ -15,24 +15,44 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"rcproxy/core"
 	"rcproxy/core/authip"
 	"rcproxy/core/codec"
+	"rcproxy/core/pkg/constant"
 	"rcproxy/core/pkg/logging"
 )
 
 // OnCOpened fires when a new client connection has been opened.
 func (ls *listenServer) OnCOpened(c core.CConn) (out []byte, action core.Action) {
+	// audited before the checks, so that every close audited has its open
+	if ls.AuditConns {
+		logging.Auditf("[audit] client conn open, fd: %d, local: %s, remote: %s", c.Fd(), c.LocalAddr(), c.RemoteAddr())
+	}
 	access := strings.Split(c.RemoteAddr(), ":")
 	if !authip.IpMap.Validate(access[0]) {
 		logging.Warnf("[%dc] unauthorized access from %s", c.Fd(), access[0])
 		return nil, core.Close
 	}
+	if ls.MaxConnsPerIP > 0 {
+		if ls.ipConns[access[0]] >= ls.MaxConnsPerIP {
+			logging.Warnf("[%dc] too many connections from %s, max: %d", c.Fd(), access[0], ls.MaxConnsPerIP)
+			core.GlobalStats.RejectedConns.WithLabelValues("max_conns_per_ip").Inc()
+			return codec.ErrMaxConnsPerIP.Bytes(), core.Close
+		}
+		ls.ipConns[access[0]]++
+		ls.countedConn[c.Fd()] = access[0]
+	}
 
 	logging.Debugf("[%dc] conn open, local: %s, remote: %s", c.Fd(), c.LocalAddr(), c.RemoteAddr())
 	return nil, core.None
@@ -42,74 +62,567 @@ func (ls *listenServer) OnCOpened(c core.CConn) (out []byte, action core.Action)
 func (ls *listenServer) OnCReact(r *core.Msg, c core.CConn) (out []byte, action core.Action) {
 	logging.Debugfunc(func() string { return fmt.Sprintf("[%dm][%dc] got req: %s", r.Id, c.Fd(), r.BodyString()) })
 
-	if r.Type <= codec.UNKNOWN || r.Type >= codec.Sentinel {
-		logging.Warnf("[%dm][%dc] unknown command, type: %d, body: %s", r.Id, c.Fd(), r.Type, r.BodyString())
-		return codec.ErrUnKnownCommand.Bytes(), core.None
+	if err := ls.malformed(r, c); err.NotNil() {
+		return err.Bytes(), core.None
 	}
 
 	switch r.Type {
-	case codec.ReqTooLarge:
-		logging.Infof("[%dm][%dc] request message too large", r.Id, c.Fd())
-		return codec.ErrMsgReqTooLarge.Bytes(), core.None
-	case codec.ReqWrongArgumentsNumber:
-		logging.Infof("[%dm][%dc] wrong arguments number, type: %d, body: %s", r.Id, c.Fd(), r.Type, r.BodyString())
-		return codec.ErrMsgReqWrongArgumentsNumber.Bytes(), core.None
 	case codec.ReqPing:
 		logging.Debugf("[%dm][%dc] got res: [ +PONG ]", r.Id, c.Fd())
 		return codec.PONG.Bytes(), core.None
 	case codec.ReqQuit:
 		logging.Debugf("[%dm][%dc] got res: [ +OK ]", r.Id, c.Fd())
 		return codec.OK.Bytes(), core.Close
+	case codec.ReqAsking:
+		// the proxy follows ASK redirections itself, so the flag of the client has nothing to affect
+		logging.Debugf("[%dm][%dc] got res: [ +OK ]", r.Id, c.Fd())
+		return codec.OK.Bytes(), core.None
+	case codec.ReqProxy:
+		return ls.proxy(r, c), core.None
+	case codec.ReqHello:
+		return ls.hello(r, c), core.None
+	case codec.ReqSelect:
+		return ls.selectDB(r, c), core.None
+	case codec.ReqCluster:
+		if rsp := ls.cluster(r, c); rsp != nil {
+			return rsp, core.None
+		}
+	case codec.ReqWait:
+		return ls.reject(r, c, "wait", codec.ErrWait), core.None
+	case codec.ReqFailover:
+		return ls.reject(r, c, "failover", codec.ErrFailover), core.None
+	case codec.ReqDebug:
+		if rsp := ls.debug(r, c); rsp != nil {
+			return rsp, core.None
+		}
+	case codec.ReqTime:
+		if rsp := ls.serverTime(r); rsp != nil {
+			return rsp, core.None
+		}
+	case codec.ReqClient:
+		return ls.client(r, c), core.None
+	case codec.ReqCommand:
+		return ls.command(r, c), core.None
+	case codec.ReqObject:
+		return ls.object(r, c), core.None
+	case codec.ReqLatency:
+		if rsp := ls.keyless(r, c); rsp != nil {
+			return rsp, core.None
+		}
+	case codec.ReqFunction:
+		if rsp := ls.function(r, c); rsp != nil {
+			return rsp, core.None
+		}
+	case codec.ReqScan:
+		if rsp := ls.scan(r, c); rsp != nil {
+			return rsp, core.None
+		}
+	}
+
+	if err := ls.forbidden(r, c); err.NotNil() {
+		return err.Bytes(), core.None
 	}
 
 	core.GlobalStats.ReqCmdIncr(r.Type)
 
-	for slot, frag := range r.Body {
-		if r.Type == codec.ReqAuth {
-			if len(ls.Password) < 1 {
-				return codec.ErrAuthNeedNtPassword.Bytes(), core.None
+	// PROXY DEADLINE applies to the next request forwarded only
+	if ms := c.RequestTimeout(); ms > 0 {
+		r.Timeout = ms
+		c.SetRequestTimeout(0)
+	}
+
+	// a request hashed to a single slot, the common case, is forwarded without going through the map
+	if r.Single {
+		if rsp := ls.forward(r, c, r.FragSlot, r.Frag); rsp != nil {
+			return rsp, core.None
+		}
+	} else {
+		for slot, frag := range r.Body {
+			if rsp := ls.forward(r, c, slot, frag); rsp != nil {
+				return rsp, core.None
 			}
-			if ls.Password != frag.Key {
-				return codec.ErrAuthInvalidPassword.Bytes(), core.None
+		}
+	}
+
+	// the +OK must not overtake the replies of the requests pipelined before
+	if ls.ackOnSend(r.Type) && c.Pending() == 0 {
+		logging.Debugf("[%dm][%dc] acknowledged on send, type: %d", r.Id, c.Fd(), r.Type)
+		r.Acked = true
+		return codec.OK.Bytes(), core.None
+	}
+
+	c.EnqueueInMsg(r)
+	return
+}
+
+// malformed returns the error of a request the codec failed to make a command of, Nil otherwise
+func (ls *listenServer) malformed(r *core.Msg, c core.CConn) codec.Error {
+	if r.Type <= codec.UNKNOWN || r.Type >= codec.Sentinel {
+		logging.Warnf("[%dm][%dc] unknown command, type: %d, body: %s", r.Id, c.Fd(), r.Type, r.BodyString())
+		return codec.ErrUnKnownCommand
+	}
+
+	switch r.Type {
+	case codec.ReqTooLarge:
+		logging.Infof("[%dm][%dc] request message too large", r.Id, c.Fd())
+		return codec.ErrMsgReqTooLarge
+	case codec.ReqTooManyKeys:
+		logging.Infof("[%dm][%dc] too many keys in request", r.Id, c.Fd())
+		return codec.ErrMsgReqTooManyKeys
+	case codec.ReqValueTooLarge:
+		logging.Infof("[%dm][%dc] value too large in request", r.Id, c.Fd())
+		return codec.ErrValueTooLarge
+	case codec.ReqCrossSlot:
+		logging.Infof("[%dm][%dc] keys in request don't hash to the same slot", r.Id, c.Fd())
+		return codec.ErrCrossSlot
+	case codec.ReqWrongArgumentsNumber:
+		logging.Infof("[%dm][%dc] wrong arguments number, type: %d, body: %s", r.Id, c.Fd(), r.Type, r.BodyString())
+		return codec.ErrMsgReqWrongArgumentsNumber
+	}
+	return ""
+}
+
+// forbidden returns the error of a request the proxy refuses to forward in its current state, Nil otherwise
+func (ls *listenServer) forbidden(r *core.Msg, c core.CConn) codec.Error {
+	// between the listener accepting and the first topology load the slots map to no node
+	if !core.EngineGlobal.Ready() {
+		logging.Debugf("[%dm][%dc] proxy is not ready, type: %d", r.Id, c.Fd(), r.Type)
+		return codec.ErrProxyInitializing
+	}
+
+	if ls.ReadOnly && isWrite(r) {
+		logging.Debugf("[%dm][%dc] write command rejected by read-only proxy, type: %d", r.Id, c.Fd(), r.Type)
+		return codec.ErrReadOnlyProxy
+	}
+
+	// checked before any frag is forwarded, so that a multi-key write is not half done
+	if isWrite(r) {
+		var err codec.Error
+		r.RangeFrags(func(slot int32, _ *core.Frag) bool {
+			if core.EngineGlobal.SlotReadOnly(slot) {
+				logging.Debugf("[%dm][%dc] write command rejected by read-only slot %d, type: %d", r.Id, c.Fd(), slot, r.Type)
+				err = codec.ErrReadOnlySlot
+			} else if rs := core.EngineGlobal.Slots2Node.Get(slot); rs != nil && rs.Orphaned {
+				logging.Debugf("[%dm][%dc] write command rejected, master of slot %d is filtered, type: %d", r.Id, c.Fd(), slot, r.Type)
+				err = codec.ErrOrphanedSlot
 			}
-			return codec.OK.Bytes(), core.None
+			return !err.NotNil()
+		})
+		if err.NotNil() {
+			return err
 		}
-		if core.EngineGlobal.Slots2Node.NotExist(slot) {
-			logging.Errorf("[%dm|%df][%dc] waiting for slot loading, type: %d, body: %s", r.Id, frag.Id, c.Fd(), r.Type, frag.ReqString())
-			return codec.ErrUnKnownSlot.Bytes(), core.None
+	}
+	return ""
+}
+
+// forward enqueues the frag of the slot to the redis node serving it,
+// the reply to the client is returned if the frag can't be forwarded, nil otherwise
+func (ls *listenServer) forward(r *core.Msg, c core.CConn, slot int32, frag *core.Frag) []byte {
+	if r.Type == codec.ReqAuth {
+		if err := ls.auth(frag.Key, c); err.NotNil() {
+			return err.Bytes()
+		}
+		return codec.OK.Bytes()
+	}
+	if core.EngineGlobal.Slots2Node.NotExist(slot) {
+		logging.Errorf("[%dm|%df][%dc] waiting for slot loading, type: %d, body: %s", r.Id, frag.Id, c.Fd(), r.Type, frag.ReqString())
+		return codec.ErrUnKnownSlot.Bytes()
+	}
+	sConn, err, retry, addr := ls.getConn(r, slot)
+	if err != nil {
+		if retry {
+			sConn, err, _, addr = ls.getConn(r, slot)
 		}
-		sConn, err, retry, addr := ls.getConn(r, slot)
 		if err != nil {
-			if retry {
-				sConn, err, _, addr = ls.getConn(r, slot)
-			}
-			if err != nil {
-				switch err {
-				case codec.AddrNotFound:
-					logging.Errorf("[%dm|%df][%dc] unknown redis server, type: %d, body: %s", r.Id, frag.Id, c.Fd(), r.Type, frag.Req)
-					return codec.ErrAddrNotFoundError.Bytes(), core.None
-				case codec.UnKnownProxyPool:
-					logging.Errorf("[%dm|%df][%dc] unknown redis node %s", r.Id, frag.Id, c.Fd(), addr)
-					return codec.ErrUnKnownProxyPoolError.Bytes(), core.None
-				case codec.UnKnownProxyPoolConn:
-					logging.Errorf("[%dm|%df][%dc] redis node %s dial failed", r.Id, frag.Id, c.Fd(), addr)
-					return codec.ErrUnKnownProxyPoolConnError.Bytes(), core.None
-				}
-				logging.Errorf("[%dm|%df][%dc] unknown getConn %s error, please check here, err: %s", r.Id, frag.Id, c.Fd(), addr, err)
-				return codec.ErrUnKnown.Bytes(), core.None
+			switch err {
+			case codec.AddrNotFound:
+				logging.Errorf("[%dm|%df][%dc] unknown redis server, type: %d, body: %s", r.Id, frag.Id, c.Fd(), r.Type, frag.Req)
+				return codec.ErrAddrNotFoundError.Bytes()
+			case codec.UnKnownProxyPool:
+				logging.Errorf("[%dm|%df][%dc] unknown redis node %s", r.Id, frag.Id, c.Fd(), addr)
+				return codec.ErrUnKnownProxyPoolError.Bytes()
+			case codec.UnKnownProxyPoolConn:
+				logging.Errorf("[%dm|%df][%dc] redis node %s dial failed", r.Id, frag.Id, c.Fd(), addr)
+				return codec.ErrUnKnownProxyPoolConnError.Bytes()
 			}
+			logging.Errorf("[%dm|%df][%dc] unknown getConn %s error, please check here, err: %s", r.Id, frag.Id, c.Fd(), addr, err)
+			return codec.ErrUnKnown.Bytes()
 		}
-		frag.Owner = c
+	}
+	if err := ls.checkVersion(r, addr); err.NotNil() {
+		logging.Warnf("[%dm|%df][%dc] redis node %s too old, type: %d, body: %s", r.Id, frag.Id, c.Fd(), addr, r.Type, frag.ReqString())
+		return err.Bytes()
+	}
+	frag.Owner = c
 
-		logging.Debugfunc(func() string {
-			return fmt.Sprintf("[%dm|%df][%dc|%ds] key '%s' maps to server '%s' in slot %d", r.Id, frag.Id, c.Fd(), sConn.Fd(), frag.Key, addr, slot)
-		})
+	logging.Debugfunc(func() string {
+		return fmt.Sprintf("[%dm|%df][%dc|%ds] key '%s' maps to server '%s' in slot %d", r.Id, frag.Id, c.Fd(), sConn.Fd(), frag.LogKey(), addr, slot)
+	})
 
-		sConn.EnqueueOutFrag(frag)
+	if err := sConn.EnqueueOutFrag(frag); err != nil {
+		// reads go to the other slaves or the master meanwhile, the client retries the rest
+		logging.Warnf("[%dm|%df][%dc|%ds] redis node %s slow to drain, %d requests pending, banned", r.Id, frag.Id, c.Fd(), sConn.Fd(), addr, sConn.InFlight())
+		if pool, ok := core.EngineGlobal.ProxyPool[addr]; ok {
+			pool.ReportFailure(time.Duration(ls.ServerRetryTimeout) * time.Millisecond)
+		}
+		return codec.ErrMsgPendingLimit.Bytes()
 	}
+	return nil
+}
 
-	c.EnqueueInMsg(r)
-	return
+// isWrite whether the request changes the dataset, the functions loaded included
+func isWrite(r *core.Msg) bool {
+	if r.Type == codec.ReqFunction && len(r.Args) > 0 {
+		switch strings.ToLower(r.Args[0]) {
+		case "load", "delete", "flush", "restore":
+			return true
+		}
+	}
+	return codec.WriteCommands[r.Type]
+}
+
+func (ls *listenServer) ackOnSend(command codec.Command) bool {
+	if len(ls.AckOnSend) < 1 || !codec.OkReplyCommands[command] {
+		return false
+	}
+	name := codec.Transform2Str(command)
+	for _, v := range ls.AckOnSend {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVersion rejects a command the redis node of addr is too old for,
+// rather than letting the node return a confusing error
+func (ls *listenServer) checkVersion(r *core.Msg, addr string) codec.Error {
+	if _, ok := codec.CommandMinVersion[r.Type]; !ok {
+		return ""
+	}
+	v, ok := core.EngineGlobal.ClusterNodes.ServerMap.Get(addr)
+	if !ok {
+		return ""
+	}
+	if min, old := codec.RequiredVersion(r.Type, v.(*core.ClusterNode).Version); old {
+		return codec.ErrRequiresVersion(min)
+	}
+	return ""
+}
+
+// cluster answers the CLUSTER command. The admin subcommands are rejected,
+// since the proxy can't tell which node they are meant for.
+// The reply is returned only when the command is not forwarded.
+func (ls *listenServer) cluster(r *core.Msg, c core.CConn) []byte {
+	switch sub := strings.ToLower(r.Args[0]); sub {
+	case "failover":
+		return ls.reject(r, c, "cluster_failover", codec.ErrClusterFailover)
+	case "setslot", "addslots", "delslots", "set-config-epoch":
+		return ls.reject(r, c, "cluster_"+strings.ReplaceAll(sub, "-", "_"), codec.ErrClusterAdmin(strings.ToUpper(sub)))
+	case "getkeysinslot":
+		return ls.getKeysInSlot(r)
+	case "help":
+		return help("CLUSTER",
+			"GETKEYSINSLOT <slot> <count>", "Return key names stored by the master owning the slot.",
+			"SETSLOT|ADDSLOTS|DELSLOTS|SET-CONFIG-EPOCH", "Rejected, reconfigure the cluster directly on the target node.")
+	}
+	return codec.ErrUnKnownSubcommand.Bytes()
+}
+
+// getKeysInSlot forwards CLUSTER GETKEYSINSLOT to the master owning the slot
+func (ls *listenServer) getKeysInSlot(r *core.Msg) []byte {
+	if len(r.Args) != 3 {
+		return codec.ErrMsgReqWrongArgumentsNumber.Bytes()
+	}
+	slot, err := strconv.Atoi(r.Args[1])
+	if err != nil || slot < 0 || slot >= constant.RedisClusterSlots {
+		return codec.ErrInvalidSlot.Bytes()
+	}
+
+	frag := core.FragPool.Get()
+	frag.Key = "getkeysinslot"
+	frag.Peer = r
+	frag.Req = append(frag.Req[:0], ls.request("cluster", r.Args)...)
+	r.SetFrag(int32(slot), frag)
+	return nil
+}
+
+// keyless forwards a command without key, such as LATENCY, to the node chosen by PROXY TARGET,
+// which applies to the next keyless command only. Without target the command is rejected.
+// The reply is returned only when the command is not forwarded.
+func (ls *listenServer) keyless(r *core.Msg, c core.CConn) []byte {
+	name := codec.Transform2Str(r.Type)
+	addr := c.Target()
+	if len(addr) < 1 {
+		return ls.reject(r, c, name, codec.ErrNoTarget)
+	}
+	// the target is kept for the retry of a request refused
+	if err := ls.forbidden(r, c); err.NotNil() {
+		return err.Bytes()
+	}
+	c.SetTarget("")
+
+	req := ls.request(name, r.Args)
+
+	// any loaded slot carries the frag, the node is given by r.Node, see route
+	for slot := int32(0); slot < constant.RedisClusterSlots; slot++ {
+		if core.EngineGlobal.Slots2Node.NotExist(slot) {
+			continue
+		}
+		r.Node = addr
+		frag := core.FragPool.Get()
+		frag.Key = name
+		frag.Peer = r
+		frag.Req = append(frag.Req[:0], req...)
+		r.SetFrag(slot, frag)
+		return nil
+	}
+	return codec.ErrUnKnownSlot.Bytes()
+}
+
+// debug fans the allowed DEBUG subcommands out to every master, as the test suites expect them to apply
+// to the whole cluster. The others are rejected, the reply is returned only when the command is not forwarded.
+func (ls *listenServer) debug(r *core.Msg, c core.CConn) []byte {
+	sub := strings.ToLower(r.Args[0])
+	allowed := false
+	for _, v := range ls.DebugSubcommands {
+		if v == sub {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return ls.reject(r, c, "debug", codec.ErrDebug)
+	}
+	return ls.broadcast(r, "debug", sub)
+}
+
+// broadcast sends the command with the arguments of r to every master, the replies are merged by
+// SRespCodec.Broadcast. The reply is returned only when no master serves a slot.
+func (ls *listenServer) broadcast(r *core.Msg, cmd, sub string) []byte {
+	req := ls.request(cmd, r.Args)
+
+	// every master is reached through the first slot it serves
+	masters := make(map[string]bool)
+	for slot := int32(0); slot < constant.RedisClusterSlots; slot++ {
+		if core.EngineGlobal.Slots2Node.NotExist(slot) {
+			continue
+		}
+		addr := core.EngineGlobal.Slots2Node.Get(slot).Master.Addr
+		if masters[addr] {
+			continue
+		}
+		masters[addr] = true
+
+		frag := core.FragPool.Get()
+		frag.Key = sub
+		frag.Peer = r
+		frag.Req = append(frag.Req[:0], req...)
+		r.SetFrag(slot, frag)
+	}
+	if r.NumFrags() < 1 {
+		return codec.ErrUnKnownSlot.Bytes()
+	}
+	return nil
+}
+
+// scan forwards SCAN to the master the cursor of the client is at, with the cursor of the master and the other
+// arguments as they are. The masters are scanned in turn by addr, the reply of each goes on with the next one once
+// it is done, see core.ScanCursor. A cursor handed out before the masters changed restarts the scan, keys may be
+// returned again then, as redis allows. The reply is returned only when the command is not forwarded.
+func (ls *listenServer) scan(r *core.Msg, c core.CConn) []byte {
+	cursor, ok := core.ParseScanCursor(r.Args[0])
+	if !ok {
+		return codec.ErrInvalidCursor.Bytes()
+	}
+
+	masters, first := masterSlots()
+	if len(masters) < 1 {
+		return codec.ErrUnKnownSlot.Bytes()
+	}
+	if len(masters) > core.ScanMaxNodes {
+		return ls.reject(r, c, "scan", codec.ErrScanTooManyNodes)
+	}
+
+	epoch := core.ScanEpoch(masters)
+	if cursor != (core.ScanCursor{}) && (cursor.Epoch != epoch || cursor.Node >= len(masters)) {
+		logging.Warnf("[%dm][%dc] masters changed during scan, restarted, cursor: %s", r.Id, c.Fd(), r.Args[0])
+		cursor = core.ScanCursor{}
+	}
+	cursor.Nodes, cursor.Epoch = len(masters), epoch
+
+	args := append([]string{strconv.FormatUint(cursor.Cursor, 10)}, r.Args[1:]...)
+	req := ls.request("scan", args)
+	r.Scan = cursor
+	r.Node = masters[cursor.Node]
+	frag := core.FragPool.Get()
+	frag.Key = "scan"
+	frag.Peer = r
+	frag.Req = append(frag.Req[:0], req...)
+	r.SetFrag(first[r.Node], frag)
+	return nil
+}
+
+// masterSlots returns the masters of the loaded slots sorted by addr, with the first slot each serves,
+// which is the slot a request to the master is set to
+func masterSlots() ([]string, map[string]int32) {
+	first := make(map[string]int32)
+	var masters []string
+	for slot := int32(0); slot < constant.RedisClusterSlots; slot++ {
+		if core.EngineGlobal.Slots2Node.NotExist(slot) {
+			continue
+		}
+		addr := core.EngineGlobal.Slots2Node.Get(slot).Master.Addr
+		if _, ok := first[addr]; !ok {
+			first[addr] = slot
+			masters = append(masters, addr)
+		}
+	}
+	sort.Strings(masters)
+	return masters, first
+}
+
+// request encodes the command with its arguments as sent by the client, the name in the case of CommandCase
+func (ls *listenServer) request(cmd string, args []string) []byte {
+	if ls.CommandCase == core.CommandCaseUpper {
+		cmd = strings.ToUpper(cmd)
+	}
+	req := codec.AppendArrayLen(nil, len(args)+1)
+	req = codec.AppendBulkString(req, cmd)
+	for _, arg := range args {
+		req = codec.AppendBulkString(req, arg)
+	}
+	return req
+}
+
+// function answers the FUNCTION command. The libraries are loaded into every master, so that FCALL finds
+// its function whatever the slot of the keys, and read from a random master, which has them all.
+// The reply is returned only when the command is not forwarded.
+func (ls *listenServer) function(r *core.Msg, c core.CConn) []byte {
+	switch sub := strings.ToLower(r.Args[0]); sub {
+	case "load", "delete", "flush", "restore":
+		return ls.broadcast(r, "function", sub)
+	case "list", "dump":
+		masters, first := masterSlots()
+		if len(masters) < 1 {
+			return codec.ErrUnKnownSlot.Bytes()
+		}
+		frag := core.FragPool.Get()
+		frag.Key = sub
+		frag.Peer = r
+		frag.Req = append(frag.Req[:0], ls.request("function", r.Args)...)
+		r.SetFrag(first[masters[rand.Intn(len(masters))]], frag)
+		return nil
+	}
+	// STATS and KILL are about the function running on a node
+	return ls.reject(r, c, "function", codec.ErrFunction)
+}
+
+// serverTime forwards TIME to a random master, rather than answering with the clock of the proxy,
+// so that a client checking the clock skew sees the time of redis.
+// The reply is returned only when the command is not forwarded.
+func (ls *listenServer) serverTime(r *core.Msg) []byte {
+	masters, first := masterSlots()
+	if len(masters) < 1 {
+		return codec.ErrUnKnownSlot.Bytes()
+	}
+	frag := core.FragPool.Get()
+	frag.Key = "time"
+	frag.Peer = r
+	frag.Req = append(frag.Req[:0], ls.request("time", nil)...)
+	r.SetFrag(first[masters[rand.Intn(len(masters))]], frag)
+	return nil
+}
+
+// reject refuses a command which must be run directly on the redis node
+func (ls *listenServer) reject(r *core.Msg, c core.CConn, cmd string, err codec.Error) []byte {
+	logging.Warnf("[%dm][%dc] %s rejected, client: %s", r.Id, c.Fd(), cmd, c.RemoteAddr())
+	if !r.DryRun {
+		core.GlobalStats.RejectedCmd.WithLabelValues(cmd).Inc()
+	}
+	return err.Bytes()
+}
+
+// selectDB answers SELECT by the proxy, only the db 0 exists in a redis cluster
+func (ls *listenServer) selectDB(r *core.Msg, c core.CConn) []byte {
+	db, err := strconv.Atoi(r.Args[0])
+	if err != nil {
+		return codec.ErrInvalidDBIndex.Bytes()
+	}
+	if db != 0 {
+		return ls.reject(r, c, "select", codec.ErrSelectCluster)
+	}
+	return codec.OK.Bytes()
+}
+
+// auth validates the password against the proxy credentials, shared by AUTH and HELLO
+func (ls *listenServer) auth(password string, c core.CConn) codec.Error {
+	if len(ls.Password) < 1 {
+		return codec.ErrAuthNeedNtPassword
+	}
+	if ls.Password != password {
+		return codec.ErrAuthInvalidPassword
+	}
+	c.SetAuthed(true)
+	return ""
+}
+
+// hello answers HELLO [protover [AUTH username password] [SETNAME clientname]].
+// RESP3 is accepted and recorded on the connection, but replies stay in RESP2 framing.
+func (ls *listenServer) hello(r *core.Msg, c core.CConn) []byte {
+	proto := c.Proto()
+	args := r.Args
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return codec.ErrProtoVersion.Bytes()
+		}
+		if v < 2 || v > 3 {
+			return codec.ErrNoProto.Bytes()
+		}
+		proto = v
+		args = args[1:]
+	}
+
+	for len(args) > 0 {
+		switch strings.ToLower(args[0]) {
+		case "auth":
+			if len(args) < 3 {
+				return codec.ErrSyntax.Bytes()
+			}
+			// the proxy has no users, only the password is checked
+			if err := ls.auth(args[2], c); err.NotNil() {
+				return err.Bytes()
+			}
+			args = args[3:]
+		case "setname":
+			if len(args) < 2 {
+				return codec.ErrSyntax.Bytes()
+			}
+			// client names are not supported, accepted for compatibility
+			args = args[2:]
+		default:
+			return codec.ErrSyntax.Bytes()
+		}
+	}
+	c.SetProto(proto)
+
+	rsp := codec.AppendArrayLen(nil, 14)
+	rsp = codec.AppendBulkString(rsp, "server")
+	rsp = codec.AppendBulkString(rsp, ls.ServerName)
+	rsp = codec.AppendBulkString(rsp, "version")
+	rsp = codec.AppendBulkString(rsp, ls.Version)
+	rsp = codec.AppendBulkString(rsp, "proto")
+	rsp = codec.AppendInteger(rsp, int64(proto))
+	rsp = codec.AppendBulkString(rsp, "id")
+	rsp = codec.AppendInteger(rsp, int64(c.Fd()))
+	rsp = codec.AppendBulkString(rsp, "mode")
+	rsp = codec.AppendBulkString(rsp, "cluster")
+	rsp = codec.AppendBulkString(rsp, "role")
+	rsp = codec.AppendBulkString(rsp, "master")
+	rsp = codec.AppendBulkString(rsp, "modules")
+	rsp = codec.AppendArrayLen(rsp, 0)
+	return rsp
 }
 
 // getConn Get an available connection from the redis connection pool
@@ -126,71 +639,162 @@ func (ls *listenServer) getConn(r *core.Msg, slot int32) (core.SConn, error, boo
 
 	conn := pool.Get()
 	if conn == nil {
-		pool.LiftBanTime = time.Now().Add(time.Duration(ls.ServerRetryTimeout) * time.Duration(1<<pool.LiftBanOrder) * time.Millisecond)
-		if pool.LiftBanOrder >= 5 {
-			pool.LiftBanOrder = 5
-		} else {
-			pool.LiftBanOrder++
-		}
-		pool.AutoBanFlag = true
+		pool.ReportFailure(time.Duration(ls.ServerRetryTimeout) * time.Millisecond)
 		logging.Errorf("[%dm] addr %s disconnected, baned for period", r.Id, addr)
 		return nil, codec.UnKnownProxyPoolConn, isSlave, addr
 	}
-	pool.LiftBanOrder = 0
+	pool.ReportSuccess()
 	return conn, nil, false, addr
 }
 
 // liveSlaves to avoid frequent memory alloc, set liveSlaves as a global variable
 // The main process is a single-threaded service, so don't worry about the concurrency safety
-var liveSlaves []string
+var liveSlaves []*core.Pool
 
 func (ls *listenServer) route(r *core.Msg, slot int32) (string, bool) {
+	if len(r.Node) > 0 {
+		return r.Node, false
+	}
+	if addr, ok := ls.movedTarget(slot); ok {
+		return addr, false
+	}
+	rs := core.EngineGlobal.Slots2Node.Get(slot)
+	// the master is filtered out of the topology, the writes are refused by forbidden and the slaves take all the reads
+	if rs.Orphaned {
+		return ls.routeSlave(r, slot, rs)
+	}
 	if ls.DisableSlave {
 		return core.EngineGlobal.Slots2Node.Get(slot).Master.Addr, false
 	}
+	// the commands numbered after the writes go to the masters too, but only the writes are tracked,
+	// CLUSTER GETKEYSINSLOT or FUNCTION LIST don't make the next reads of the client go to the master
 	if r.Type > codec.ReqWriteCmdStart {
+		if ls.ReadYourWrites > 0 && r.Owner != nil && isWrite(r) {
+			r.Owner.SetLastWrite(slot, time.Now(), time.Duration(ls.ReadYourWrites)*time.Millisecond)
+		}
 		return core.EngineGlobal.Slots2Node.Get(slot).Master.Addr, false
 	}
 
-	if r.Type == codec.ReqHscan || r.Type == codec.ReqSscan || r.Type == codec.ReqZscan {
+	// TIME is answered by a master too, see serverTime
+	if r.Type == codec.ReqHscan || r.Type == codec.ReqSscan || r.Type == codec.ReqZscan || r.Type == codec.ReqTime {
 		return core.EngineGlobal.Slots2Node.Get(slot).Master.Addr, false
 	}
 
+	// the client reads what it has just written, which a lagging slave may not have yet
+	if ls.ReadYourWrites > 0 && r.Owner != nil {
+		if t, ok := r.Owner.LastWrite(slot); ok && time.Since(t) < time.Duration(ls.ReadYourWrites)*time.Millisecond {
+			return core.EngineGlobal.Slots2Node.Get(slot).Master.Addr, false
+		}
+	}
+
+	return ls.routeSlave(r, slot, rs)
+}
+
+// routeSlave routes the read to a live slave of the replicaset, or to its master if there is none
+func (ls *listenServer) routeSlave(r *core.Msg, slot int32, rs *core.Replicaset) (string, bool) {
 	liveSlaves = liveSlaves[:0]
 
-	for _, v := range core.EngineGlobal.Slots2Node.Get(slot).Slaves {
+	for _, v := range rs.Slaves {
 		pool, ok := core.EngineGlobal.ProxyPool[v.Addr]
 		if !ok {
 			logging.Warnf("[%dm] redis pool %s not found", r.Id, v.Addr)
 			continue
 		}
 
-		if pool.AutoBanFlag {
-			if pool.LiftBanTime.Before(time.Now()) {
-				logging.Warnf("[%dm] addr %s ever disconnected, don't cost ban period, skip this slave!", r.Id, v.Addr)
-				continue
-			} else {
-				logging.Warnf("[%dm] addr %s ever disconnected, cost ban period, pick up it to live slaves!", r.Id, v.Addr)
-				pool.AutoBanFlag = false
-				liveSlaves = append(liveSlaves, v.Addr)
-			}
-		} else {
-			pool.AutoBanFlag = false
-			liveSlaves = append(liveSlaves, v.Addr)
+		if !pool.Available() {
+			logging.Warnf("[%dm] addr %s ever disconnected, don't cost ban period, skip this slave!", r.Id, v.Addr)
+			continue
 		}
+		liveSlaves = append(liveSlaves, pool)
+	}
 
-		if len(liveSlaves) == 0 {
-			continue
+	if len(liveSlaves) > 0 {
+		if pool := ls.taggedSlave(r, liveSlaves); pool != nil {
+			return pool.Addr, true
+		}
+		pool := liveSlaves[ls.pickSlave(r, slot, liveSlaves)]
+		// a slave lately lifted from ban takes only part of its reads, the rest go to the master
+		if rs.Orphaned || ls.slowStarted(pool) {
+			return pool.Addr, true
 		}
+	} else if len(rs.Slaves) > 0 && !r.DryRun {
+		// the read capacity of the slot is degraded, its master takes the reads of the slaves
+		core.GlobalStats.SlaveFallback.WithLabelValues(rs.Master.Addr).Inc()
+	}
 
-		return liveSlaves[rand.Intn(len(liveSlaves))], true
+	return rs.Master.Addr, false
+}
+
+// taggedSlave returns the live slave of the tag the client set by PROXY TAG, nil if there is none,
+// then the read is routed as if the client was untagged
+func (ls *listenServer) taggedSlave(r *core.Msg, slaves []*core.Pool) *core.Pool {
+	if r.Owner == nil || len(r.Owner.Tag()) < 1 {
+		return nil
+	}
+	for _, pool := range slaves {
+		if ls.NodeTags[pool.Addr] == r.Owner.Tag() {
+			return pool
+		}
+	}
+	return nil
+}
+
+// pickSlave returns the index of the live slave to read from
+func (ls *listenServer) pickSlave(r *core.Msg, slot int32, slaves []*core.Pool) int {
+	n := len(slaves)
+	if ls.SlavePolicy == SlavePolicyAffinity && r.Owner != nil {
+		// stable as long as the live slaves don't change, otherwise the client fails over to another slave
+		return (int(slot) + r.Owner.Fd()) % n
+	}
+	if len(ls.ReadWeights) < 1 {
+		return ls.Selector.Pick(n)
+	}
+
+	total := 0
+	for _, pool := range slaves {
+		total += ls.readWeight(pool.Addr)
+	}
+	x := ls.Selector.Pick(total)
+	for i, pool := range slaves {
+		if x -= ls.readWeight(pool.Addr); x < 0 {
+			return i
+		}
+	}
+	return n - 1
+}
+
+// slowStartScale the resolution of the share of the reads drawn by slowStarted
+const slowStartScale = 1000
+
+// slowStarted whether the slave takes the read, drawn by the Selector in proportion to its slow start weight,
+// no draw is made once the slave is out of the slow start window
+func (ls *listenServer) slowStarted(pool *core.Pool) bool {
+	weight := pool.SlowStartWeight(time.Duration(ls.SlowStartWindow) * time.Millisecond)
+	if weight >= 1 {
+		return true
 	}
+	return ls.Selector.Pick(slowStartScale) < int(weight*slowStartScale)
+}
 
-	return core.EngineGlobal.Slots2Node.Get(slot).Master.Addr, false
+// readWeight returns the weight of the slave in the random pick for reads, 1 unless set by ReadWeights
+func (ls *listenServer) readWeight(addr string) int {
+	if w, ok := ls.ReadWeights[addr]; ok {
+		return w
+	}
+	return 1
 }
 
-// OnMoved process the redis moved/ask packet
-func (ls *listenServer) OnMoved(addr string, slot int32, s core.SConn, f *core.Frag) {
+// OnMoved process the redis moved/ask packet.
+// The frag goes to the node named by the redirect, even when it was read from a slave,
+// the slave selection of route is not applied again, since the target is the node taking over the slot.
+// With PassthroughRedirects the redirect is relayed to the client instead.
+func (ls *listenServer) OnMoved(addr string, slot int32, s core.SConn, f *core.Frag) (relay bool) {
+	if ls.PassthroughRedirects {
+		logging.Debugf("[%dm|%df][%dc|%ds] moved/ask relayed to client, old_addr: %s new_addr: %s, slot: %d",
+			f.MsgId(), f.Id, f.OwnerFd(), s.Fd(), s.RemoteAddr(), addr, slot)
+		return true
+	}
+
 	f.RspBody = f.RspBody[:0]
 
 	logging.Infof("[%dm|%df][%dc|%ds] moved/ask happen, old_addr: %s new_addr: %s, slot: %d, req: %s",
@@ -201,27 +805,503 @@ func (ls *listenServer) OnMoved(addr string, slot int32, s core.SConn, f *core.F
 	if !ok {
 		logging.Errorf("[%dm|%df][%dc|%ds] moved/ask happen, proxy pool get addr %s failed",
 			f.MsgId(), f.Id, f.OwnerFd(), s.Fd(), addr)
-		return
+		return false
 	}
 
 	sConn := pool.Get()
 	if sConn == nil {
 		logging.Errorf("[%dm|%df][%dc|%ds] proxy dial %s failed",
 			f.MsgId(), f.Id, f.OwnerFd(), s.Fd(), addr)
-		return
+		return false
 	}
 
+	// ASK is a one-off redirection of a migrating key, only MOVED tells the new owner of the slot
+	if f.Type == codec.RspMoved && ls.MovedCacheWindow > 0 {
+		ls.moved[slot] = movedTarget{
+			addr:   addr,
+			rs:     core.EngineGlobal.Slots2Node.Get(slot),
+			expiry: time.Now().Add(time.Duration(ls.MovedCacheWindow) * time.Millisecond),
+		}
+	}
+
+	if f.Peer.Fd2Slot == nil {
+		f.Peer.Fd2Slot = make(map[int]int32, 1)
+	}
 	delete(f.Peer.Fd2Slot, s.Fd())
 	f.Peer.Fd2Slot[sConn.Fd()] = slot
 
-	sConn.EnqueueOutFrag(f)
+	if err := sConn.EnqueueOutFrag(f); err != nil {
+		// the frag left the timeout queue with the old connection, answer the whole message
+		// with the retryable error rather than letting the client wait forever
+		logging.Warnf("[%dm|%df][%dc|%ds] moved/ask happen, redis node %s slow to drain, %d requests pending, banned",
+			f.MsgId(), f.Id, f.OwnerFd(), s.Fd(), addr, sConn.InFlight())
+		pool.ReportFailure(time.Duration(ls.ServerRetryTimeout) * time.Millisecond)
+		f.RspBody = append(f.RspBody[:0], codec.ErrMsgPendingLimit.Bytes()...)
+		return true
+	}
+	return false
+}
+
+// movedTarget returns where the slot was last moved to, the target is dropped once expired or once the topology
+// refresh assigned the slot a new replicaset
+func (ls *listenServer) movedTarget(slot int32) (string, bool) {
+	m, ok := ls.moved[slot]
+	if !ok {
+		return "", false
+	}
+	if core.EngineGlobal.Slots2Node.Get(slot) != m.rs || time.Now().After(m.expiry) {
+		delete(ls.moved, slot)
+		return "", false
+	}
+	return m.addr, true
 }
 
 // OnCClosed fires when a client connection has been closed.
 func (ls *listenServer) OnCClosed(c core.CConn, err error) {
+	// a connection rejected on open was not counted
+	if ip, ok := ls.countedConn[c.Fd()]; ok {
+		delete(ls.countedConn, c.Fd())
+		if ls.ipConns[ip]--; ls.ipConns[ip] < 1 {
+			delete(ls.ipConns, ip)
+		}
+	}
+	lib, ver := c.LibInfo()
+	if ls.AuditConns {
+		logging.Auditf("[audit] client conn closed, fd: %d, local: %s, remote: %s, lib: %s %s, duration: %s, requests: %d, err: %v",
+			c.Fd(), c.LocalAddr(), c.RemoteAddr(), lib, ver, time.Since(c.CreatedAt()).Round(time.Millisecond), c.Requests(), err)
+	}
 	if err != nil {
-		logging.Errorf("[%dc] client conn closed, local: %s, remote: %s, err: %s", c.Fd(), c.LocalAddr(), c.RemoteAddr(), err)
+		logging.Errorf("[%dc] client conn closed, local: %s, remote: %s, lib: %s %s, err: %s", c.Fd(), c.LocalAddr(), c.RemoteAddr(), lib, ver, err)
 		return
 	}
-	logging.Debugf("[%dc] client conn closed, local: %s, remote: %s", c.Fd(), c.LocalAddr(), c.RemoteAddr())
+	logging.Debugf("[%dc] client conn closed, local: %s, remote: %s, lib: %s %s", c.Fd(), c.LocalAddr(), c.RemoteAddr(), lib, ver)
+}
+
+// proxy answers the PROXY command locally without forwarding it to redis,
+// so that redis-cli can inspect the proxy where the http port is unreachable.
+// Subcommands which change the state of the proxy are refused until the client is authorized.
+func (ls *listenServer) proxy(r *core.Msg, c core.CConn) []byte {
+	sub := strings.ToLower(r.Args[0])
+	logging.Debugf("[%dm][%dc] proxy subcommand %s", r.Id, c.Fd(), sub)
+
+	switch sub {
+	case "deadline", "compress", "target", "tag":
+		if !ls.authorized(c) {
+			logging.Warnf("[%dm][%dc] proxy subcommand %s refused, client not authenticated", r.Id, c.Fd(), sub)
+			return codec.ErrNoAuth.Bytes()
+		}
+	}
+
+	switch sub {
+	case "info":
+		return ls.proxyInfo()
+	case "stats":
+		return ls.proxyStats()
+	case "nodes":
+		return ls.proxyNodes()
+	case "deadline":
+		return ls.proxyDeadline(r, c)
+	case "compress":
+		return ls.proxyCompress(r, c)
+	case "explain":
+		return ls.proxyExplain(r, c)
+	case "target":
+		return ls.proxyTarget(r, c)
+	case "tag":
+		return ls.proxyTag(r, c)
+	case "help":
+		return help("PROXY",
+			"INFO", "Return the server name, version, uptime and connections of the proxy.",
+			"STATS", "Return the counters and gauges of the proxy, one per line.",
+			"NODES", "Return the redis cluster topology known by the proxy.",
+			"DEADLINE <ms>", "Set the timeout of the next request forwarded to redis.",
+			"COMPRESS <DEFLATE|NONE>", "Compress the large bulk replies to this client.",
+			"EXPLAIN <command> [<arg> ...]", "Return how the command would be routed, without running it.",
+			"TARGET <addr>", "Send the next keyless command, such as LATENCY, to the redis node of addr.",
+			"TAG <tag|NONE>", "Send the reads of this client to the slave tagged so in node_tags.")
+	}
+	return codec.ErrUnKnownSubcommand.Bytes()
+}
+
+// proxyDeadline sets the timeout in ms of the next request of the client forwarded to redis,
+// so that a latency-critical caller fails fast rather than waiting for the global request timeout
+func (ls *listenServer) proxyDeadline(r *core.Msg, c core.CConn) []byte {
+	if len(r.Args) != 2 {
+		return codec.ErrMsgReqWrongArgumentsNumber.Bytes()
+	}
+	ms, err := strconv.Atoi(r.Args[1])
+	if err != nil || ms < 1 {
+		return codec.ErrSyntax.Bytes()
+	}
+	c.SetRequestTimeout(ms)
+	return codec.OK.Bytes()
+}
+
+// proxyCompress negotiates the compression of the large bulk replies to the client, DEFLATE or NONE,
+// see docs/command.md for the wire format. The requests of the client are never compressed.
+func (ls *listenServer) proxyCompress(r *core.Msg, c core.CConn) []byte {
+	if len(r.Args) != 2 {
+		return codec.ErrMsgReqWrongArgumentsNumber.Bytes()
+	}
+	if ls.CompressThreshold < 1 {
+		return codec.ErrCompressDisabled.Bytes()
+	}
+	switch strings.ToLower(r.Args[1]) {
+	case "deflate":
+		c.SetCompressThreshold(ls.CompressThreshold)
+	case "none":
+		c.SetCompressThreshold(0)
+	default:
+		return codec.ErrSyntax.Bytes()
+	}
+	return codec.OK.Bytes()
+}
+
+// proxyTarget pins the next keyless command of the client, such as LATENCY, to the redis node of addr,
+// as the node-local diagnostics can't be routed by a key
+func (ls *listenServer) proxyTarget(r *core.Msg, c core.CConn) []byte {
+	if len(r.Args) != 2 {
+		return codec.ErrMsgReqWrongArgumentsNumber.Bytes()
+	}
+	if _, ok := core.EngineGlobal.ProxyPool[r.Args[1]]; !ok {
+		return codec.ErrAddrNotFoundError.Bytes()
+	}
+	c.SetTarget(r.Args[1])
+	return codec.OK.Bytes()
+}
+
+// proxyTag routes the reads of the client to the slave of the tag in NodeTags, such as to direct
+// test traffic to a canary node, NONE routes them as usual again
+func (ls *listenServer) proxyTag(r *core.Msg, c core.CConn) []byte {
+	if len(r.Args) != 2 {
+		return codec.ErrMsgReqWrongArgumentsNumber.Bytes()
+	}
+	if strings.EqualFold(r.Args[1], "none") {
+		c.SetTag("")
+		return codec.OK.Bytes()
+	}
+	for _, tag := range ls.NodeTags {
+		if tag == r.Args[1] {
+			c.SetTag(tag)
+			return codec.OK.Bytes()
+		}
+	}
+	return codec.ErrUnknownTag.Bytes()
+}
+
+// client answers the CLIENT command locally, the backend connections are shared by all clients
+// so that nothing about a single client is forwarded to redis
+func (ls *listenServer) client(r *core.Msg, c core.CConn) []byte {
+	if len(r.Args) < 1 {
+		return codec.ErrMsgReqWrongArgumentsNumber.Bytes()
+	}
+	sub := strings.ToLower(r.Args[0])
+	logging.Debugf("[%dm][%dc] client subcommand %s", r.Id, c.Fd(), sub)
+
+	switch sub {
+	case "setinfo":
+		return ls.clientSetinfo(r, c)
+	case "tracking":
+		// the invalidations are RESP3 pushes of the node holding the key, see docs/command.md
+		return ls.reject(r, c, "client_tracking", codec.ErrClientTracking)
+	case "help":
+		return help("CLIENT",
+			"SETINFO <LIB-NAME|LIB-VER> <value>", "Set the client library name or version.")
+	}
+	return codec.ErrUnKnownSubcommand.Bytes()
+}
+
+// clientSetinfo records the library name or version reported by the client library,
+// which shows up in /connections and the close log of the connection
+func (ls *listenServer) clientSetinfo(r *core.Msg, c core.CConn) []byte {
+	if len(r.Args) != 3 {
+		return codec.ErrMsgReqWrongArgumentsNumber.Bytes()
+	}
+	val := r.Args[2]
+	// the same restriction as redis, so that the value is safe to print
+	for i := 0; i < len(val); i++ {
+		if val[i] < '!' || val[i] > '~' {
+			return codec.ErrClientSetinfo.Bytes()
+		}
+	}
+
+	name, ver := c.LibInfo()
+	switch strings.ToLower(r.Args[1]) {
+	case "lib-name":
+		name = val
+	case "lib-ver":
+		ver = val
+	default:
+		return codec.ErrUnrecognizedOption.Bytes()
+	}
+	c.SetLibInfo(name, ver)
+	return codec.OK.Bytes()
+}
+
+// command answers COMMAND GETKEYS locally by the key positions the proxy routes with,
+// so that a client may leave the key extraction to the proxy
+func (ls *listenServer) command(r *core.Msg, c core.CConn) []byte {
+	sub := strings.ToLower(r.Args[0])
+	logging.Debugf("[%dm][%dc] command subcommand %s", r.Id, c.Fd(), sub)
+
+	switch sub {
+	case "getkeys":
+		return ls.commandGetkeys(r)
+	case "help":
+		return help("COMMAND",
+			"GETKEYS <command> [<arg> ...]", "Return the keys the proxy routes the command by.")
+	}
+	return codec.ErrUnKnownSubcommand.Bytes()
+}
+
+// object answers OBJECT HELP only, so that the tools probing it don't break, the other subcommands
+// are not supported
+func (ls *listenServer) object(r *core.Msg, c core.CConn) []byte {
+	sub := strings.ToLower(r.Args[0])
+	logging.Debugf("[%dm][%dc] object subcommand %s", r.Id, c.Fd(), sub)
+
+	if sub == "help" {
+		return help("OBJECT")
+	}
+	return codec.ErrUnKnownSubcommand.Bytes()
+}
+
+// help replies the HELP subcommand of a command answered by the proxy in the format of redis,
+// lines are the pairs of a subcommand and its description, HELP itself is appended
+func help(command string, lines ...string) []byte {
+	lines = append(lines, "HELP", "Print this help.")
+	rsp := codec.AppendArrayLen(nil, len(lines)+1)
+	rsp = codec.AppendSimpleString(rsp, command+" <subcommand> [<arg> [value] [opt] ...]. Subcommands are:")
+	for i, line := range lines {
+		if i%2 == 1 {
+			line = "    " + line
+		}
+		rsp = codec.AppendSimpleString(rsp, line)
+	}
+	return rsp
+}
+
+// commandGetkeys replies the keys of the command following GETKEYS as a multibulk
+func (ls *listenServer) commandGetkeys(r *core.Msg) []byte {
+	if len(r.Args) < 2 {
+		return codec.ErrMsgReqWrongArgumentsNumber.Bytes()
+	}
+	args := r.Args[2:]
+	command := codec.Transform2Type([]byte(r.Args[1]), len(args))
+	switch {
+	case command == codec.UNKNOWN:
+		return codec.ErrUnKnownCommand.Bytes()
+	case command == codec.ReqWrongArgumentsNumber:
+		return codec.ErrMsgReqWrongArgumentsNumber.Bytes()
+	}
+
+	keys := codec.Keys(command, args)
+	if len(keys) < 1 {
+		return codec.ErrNoKeyArguments.Bytes()
+	}
+	rsp := codec.AppendArrayLen(nil, len(keys))
+	for _, key := range keys {
+		rsp = codec.AppendBulkString(rsp, key)
+	}
+	return rsp
+}
+
+// explainConn feeds the command to explain to the codec as if the client sent it, the rest is the client itself
+type explainConn struct {
+	core.CConn
+	buf []byte
+}
+
+func (c *explainConn) Peek(_ int) ([]byte, error) { return c.buf, nil }
+func (c *explainConn) Discard(n int) (int, error) {
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// proxyExplain reports how the command following EXPLAIN would be routed, through the codec, the checks
+// and the routing of OnCReact, without forwarding or counting anything. A line per frag gives its slot, key and node,
+// unless the command is rejected or answered by the proxy. A read may go to another slave next time.
+func (ls *listenServer) proxyExplain(r *core.Msg, c core.CConn) []byte {
+	if len(r.Args) < 2 {
+		return codec.ErrMsgReqWrongArgumentsNumber.Bytes()
+	}
+	req := codec.AppendArrayLen(nil, len(r.Args)-1)
+	for _, arg := range r.Args[1:] {
+		req = codec.AppendBulkString(req, arg)
+	}
+	rc := core.NewCRespCodec(core.EngineGlobal.Opts)
+	rc.DryRun = true
+	m, err := rc.Decode(&explainConn{CConn: c, buf: req})
+	if err != nil {
+		return codec.ErrSyntax.Bytes()
+	}
+	defer core.MsgPool.Put(m)
+	// not bound to the client, so that explaining a write doesn't count as a write of the client
+	m.Owner = nil
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "command:%s\n", strings.ToLower(r.Args[1]))
+	explained := func() []byte {
+		return codec.AppendBulkString(nil, buf.String())
+	}
+
+	rejected := ls.malformed(m, c)
+	if rejected.Nil() {
+		var rsp []byte
+		switch m.Type {
+		case codec.ReqPing, codec.ReqQuit, codec.ReqAsking, codec.ReqAuth:
+			fallthrough
+		case codec.ReqProxy, codec.ReqHello, codec.ReqClient, codec.ReqCommand, codec.ReqSelect:
+			buf.WriteString("answered:proxy\n")
+			return explained()
+		case codec.ReqCluster:
+			rsp = ls.cluster(m, c)
+		case codec.ReqWait:
+			rsp = ls.reject(m, c, "wait", codec.ErrWait)
+		case codec.ReqFailover:
+			rsp = ls.reject(m, c, "failover", codec.ErrFailover)
+		case codec.ReqDebug:
+			rsp = ls.debug(m, c)
+		case codec.ReqFunction:
+			rsp = ls.function(m, c)
+		case codec.ReqScan:
+			rsp = ls.scan(m, c)
+		case codec.ReqTime:
+			ls.serverTime(m)
+		case codec.ReqLatency:
+			// not through keyless, which would use up the target of the client
+			if len(c.Target()) < 1 {
+				rsp = codec.ErrNoTarget.Bytes()
+				break
+			}
+			fmt.Fprintf(&buf, "node:%s\n", c.Target())
+			return explained()
+		}
+		switch {
+		case len(rsp) > 0 && rsp[0] == '-':
+			rejected = codec.Error(rsp)
+		case rsp != nil:
+			buf.WriteString("answered:proxy\n")
+			return explained()
+		default:
+			rejected = ls.forbidden(m, c)
+		}
+	}
+	if rejected.NotNil() {
+		fmt.Fprintf(&buf, "rejected:%s\n", rejected.ShortString())
+		return explained()
+	}
+
+	slots := make([]int32, 0, m.NumFrags())
+	m.RangeFrags(func(slot int32, _ *core.Frag) bool {
+		slots = append(slots, slot)
+		return true
+	})
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	for _, slot := range slots {
+		fmt.Fprintf(&buf, "slot:%d key:%s", slot, m.SlotFrag(slot).Key)
+		if core.EngineGlobal.Slots2Node.NotExist(slot) {
+			fmt.Fprintf(&buf, " rejected:%s\n", codec.ErrUnKnownSlot.ShortString())
+			continue
+		}
+		addr, isSlave := ls.route(m, slot)
+		role := "master"
+		if isSlave {
+			role = "slave"
+		}
+		fmt.Fprintf(&buf, " node:%s role:%s", addr, role)
+		if err := ls.checkVersion(m, addr); err.NotNil() {
+			fmt.Fprintf(&buf, " rejected:%s", err.ShortString())
+		}
+		buf.WriteString("\n")
+	}
+	return explained()
+}
+
+// authorized whether the client may run mutating PROXY subcommands,
+// which is always the case when no password is configured
+func (ls *listenServer) authorized(c core.CConn) bool {
+	return len(ls.Password) < 1 || c.Authed()
+}
+
+// proxyInfo reports the version and connections of the proxy in the INFO format
+func (ls *listenServer) proxyInfo() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Proxy\r\n")
+	fmt.Fprintf(&buf, "server_name:%s\r\n", ls.ServerName)
+	fmt.Fprintf(&buf, "version:%s\r\n", ls.Version)
+	fmt.Fprintf(&buf, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(&buf, "uptime_in_seconds:%d\r\n", int64(time.Since(ls.startTime)/time.Second))
+	buf.WriteString("\r\n# Connections\r\n")
+	fmt.Fprintf(&buf, "client_connections:%d\r\n", core.EngineGlobal.CountCConnections())
+	fmt.Fprintf(&buf, "server_connections:%d\r\n", core.EngineGlobal.CountSConnections())
+	fmt.Fprintf(&buf, "redis_nodes:%d\r\n", len(core.EngineGlobal.ProxyPool))
+	return codec.AppendBulkString(nil, buf.String())
+}
+
+// proxyStats reports the counters and gauges exposed by /metrics, one "name{labels}:value" per line
+func (ls *listenServer) proxyStats() []byte {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		logging.Errorf("failed to gather metrics, err: %s", err)
+		return codec.ErrUnKnown.Bytes()
+	}
+
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), "rcproxy_") {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var v float64
+			switch {
+			case m.Counter != nil:
+				v = m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				v = m.GetGauge().GetValue()
+			default:
+				continue
+			}
+			buf.WriteString(mf.GetName())
+			if len(m.GetLabel()) > 0 {
+				buf.WriteByte('{')
+				for i, l := range m.GetLabel() {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fmt.Fprintf(&buf, "%s=%q", l.GetName(), l.GetValue())
+				}
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(':')
+			buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+			buf.WriteString("\r\n")
+		}
+	}
+	return codec.AppendBulkString(nil, buf.String())
+}
+
+// proxyNodes reports the redis cluster topology known by the proxy, one node per line:
+// <name> <addr> <master|slave> <master id> <version> <slots...>
+func (ls *listenServer) proxyNodes() []byte {
+	nodes := core.GetClusterNodes()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Addr < nodes[j].Addr })
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		role := "master"
+		if n.Role == core.Slave {
+			role = "slave"
+		}
+		fmt.Fprintf(&buf, "%s %s %s %s %s", n.Name, n.Addr, role, n.MasterId, n.Version)
+		for _, slots := range n.Slots {
+			if slots.Start == slots.End {
+				fmt.Fprintf(&buf, " %d", slots.Start)
+				continue
+			}
+			fmt.Fprintf(&buf, " %d-%d", slots.Start, slots.End)
+		}
+		buf.WriteString("\n")
+	}
+	return codec.AppendBulkString(nil, buf.String())
 }
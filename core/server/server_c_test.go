@@ -0,0 +1,1741 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core"
+	"rcproxy/core/codec"
+	"rcproxy/core/pkg/constant"
+	"rcproxy/core/pkg/hashkit"
+	"rcproxy/core/pkg/logging"
+)
+
+type mockedCConn struct {
+	core.CConn
+	fd         int
+	remote     string
+	authed     bool
+	proto      int
+	lastWrites map[int32]time.Time
+	deadline   int
+	compress   int
+	target     string
+	tag        string
+	libName    string
+	libVer     string
+	createdAt  time.Time
+	requests   int
+	msgs       []*core.Msg
+	buf        []byte
+}
+
+func (m *mockedCConn) Fd() int {
+	if m.fd < 1 {
+		return 1
+	}
+	return m.fd
+}
+func (m *mockedCConn) RemoteAddr() string {
+	if len(m.remote) < 1 {
+		return "127.0.0.1:50000"
+	}
+	return m.remote
+}
+func (m *mockedCConn) LocalAddr() string          { return "127.0.0.1:9736" }
+func (m *mockedCConn) Peek(_ int) ([]byte, error) { return m.buf, nil }
+func (m *mockedCConn) Discard(n int) (int, error) {
+	m.buf = m.buf[n:]
+	return n, nil
+}
+func (m *mockedCConn) EnqueueInMsg(r *core.Msg) { m.msgs = append(m.msgs, r) }
+func (m *mockedCConn) Pending() int             { return len(m.msgs) }
+func (m *mockedCConn) RequestTimeout() int      { return m.deadline }
+func (m *mockedCConn) SetRequestTimeout(ms int) { m.deadline = ms }
+func (m *mockedCConn) Authed() bool             { return m.authed }
+func (m *mockedCConn) SetAuthed(auth bool)      { m.authed = auth }
+func (m *mockedCConn) Proto() int {
+	if m.proto < 2 {
+		return 2
+	}
+	return m.proto
+}
+func (m *mockedCConn) SetProto(proto int) { m.proto = proto }
+func (m *mockedCConn) LastWrite(slot int32) (time.Time, bool) {
+	t, ok := m.lastWrites[slot]
+	return t, ok
+}
+func (m *mockedCConn) SetLastWrite(slot int32, t time.Time, _ time.Duration) {
+	if m.lastWrites == nil {
+		m.lastWrites = make(map[int32]time.Time)
+	}
+	m.lastWrites[slot] = t
+}
+func (m *mockedCConn) CompressThreshold() int      { return m.compress }
+func (m *mockedCConn) SetCompressThreshold(n int)  { m.compress = n }
+func (m *mockedCConn) Target() string              { return m.target }
+func (m *mockedCConn) SetTarget(addr string)       { m.target = addr }
+func (m *mockedCConn) Tag() string                 { return m.tag }
+func (m *mockedCConn) SetTag(tag string)           { m.tag = tag }
+func (m *mockedCConn) LibInfo() (string, string)   { return m.libName, m.libVer }
+func (m *mockedCConn) SetLibInfo(name, ver string) { m.libName, m.libVer = name, ver }
+func (m *mockedCConn) CreatedAt() time.Time        { return m.createdAt }
+func (m *mockedCConn) Requests() int               { return m.requests }
+
+type mockedSConn struct {
+	core.SConn
+	addr  string
+	frags []*core.Frag
+	full  bool // refuses the frags as if too many were pending
+}
+
+func (m *mockedSConn) Fd() int                                 { return 2 }
+func (m *mockedSConn) IsOpened() bool                          { return true }
+func (m *mockedSConn) RemoteAddr() string                      { return m.addr }
+func (m *mockedSConn) InFlight() int                           { return len(m.frags) }
+func (m *mockedSConn) InitializeStatus() core.InitializeStatus { return core.Initialized }
+func (m *mockedSConn) EnqueueOutFrag(f *core.Frag) error {
+	if m.full {
+		return codec.ErrPendingLimit
+	}
+	m.frags = append(m.frags, f)
+	return nil
+}
+
+func initEngine() {
+	core.EngineGlobal = &core.Engine{ProxyPool: map[string]*core.Pool{}}
+}
+
+// newMockedPool returns a pool whose connections record the frags instead of sending them
+func newMockedPool(addr string) *core.Pool {
+	return &core.Pool{
+		Addr: addr,
+		Dial: func(addr string, isSlave bool) (core.SConn, error) {
+			return &mockedSConn{addr: addr}, nil
+		},
+	}
+}
+
+// initTopology every slot is served by master 127.0.0.1:7000 and its slaves 127.0.0.1:7001...
+func initTopology(slaves int) {
+	initEngine()
+	master := &core.ClusterNode{Name: "a", Addr: "127.0.0.1:7000", Role: core.Master}
+	rs := &core.Replicaset{Master: master}
+	core.EngineGlobal.ProxyPool[master.Addr] = newMockedPool(master.Addr)
+	for i := 1; i <= slaves; i++ {
+		slave := &core.ClusterNode{Addr: fmt.Sprintf("127.0.0.1:%d", 7000+i), Role: core.Slave, MasterId: "a"}
+		rs.Slaves = append(rs.Slaves, slave)
+		core.EngineGlobal.ProxyPool[slave.Addr] = newMockedPool(slave.Addr)
+	}
+	for i := int32(0); i < constant.RedisClusterSlots; i++ {
+		core.EngineGlobal.Slots2Node.Set(i, rs)
+	}
+	core.EngineGlobal.SetReady()
+}
+
+// bulkString returns the payload of a bulk string reply
+func bulkString(t *testing.T, rsp []byte) string {
+	s := string(rsp)
+	assert.True(t, strings.HasPrefix(s, "$"), "expect bulk string, got: %q", s)
+	assert.True(t, strings.HasSuffix(s, "\r\n"), "expect bulk string, got: %q", s)
+	return s[strings.Index(s, "\r\n")+2 : len(s)-2]
+}
+
+func proxyMsg(args ...string) *core.Msg {
+	return &core.Msg{Type: codec.ReqProxy, Args: args}
+}
+
+func TestProxyInfo(t *testing.T) {
+	initEngine()
+	ls := NewListenServer(WithVersion("v1.0.0"))
+
+	rsp, action := ls.OnCReact(proxyMsg("INFO"), &mockedCConn{})
+	assert.Equal(t, core.None, action)
+
+	info := bulkString(t, rsp)
+	assert.True(t, strings.HasPrefix(info, "# Proxy\r\n"), info)
+	assert.Contains(t, info, "server_name:rcproxy\r\n")
+	assert.Contains(t, info, "version:v1.0.0\r\n")
+	assert.Contains(t, info, "uptime_in_seconds:0\r\n")
+	assert.Contains(t, info, "client_connections:0\r\n")
+	assert.Contains(t, info, "server_connections:0\r\n")
+	assert.Contains(t, info, "redis_nodes:0\r\n")
+}
+
+func TestProxyStats(t *testing.T) {
+	initEngine()
+	ls := NewListenServer()
+	core.GlobalStats.ReqCmd.WithLabelValues("get").Add(3)
+
+	rsp, _ := ls.OnCReact(proxyMsg("stats"), &mockedCConn{})
+	stats := bulkString(t, rsp)
+	for _, line := range strings.Split(strings.TrimSuffix(stats, "\r\n"), "\r\n") {
+		assert.True(t, strings.HasPrefix(line, "rcproxy_"), line)
+		assert.Contains(t, line, ":")
+	}
+	assert.Contains(t, stats, "rcproxy_cmd{cmd=\"get\"}:3\r\n")
+}
+
+func TestProxyNodes(t *testing.T) {
+	initEngine()
+	ls := NewListenServer()
+	core.EngineGlobal.ClusterNodes.ServerMap.Insert("127.0.0.1:7001", &core.ClusterNode{
+		Name: "b", Addr: "127.0.0.1:7001", Role: core.Slave, MasterId: "a", Version: "6.2.6",
+	})
+	core.EngineGlobal.ClusterNodes.ServerMap.Insert("127.0.0.1:7000", &core.ClusterNode{
+		Name: "a", Addr: "127.0.0.1:7000", Role: core.Master, Version: "6.2.6",
+		Slots: []core.Slots{{Start: 0, End: 8191}, {Start: 16383, End: 16383}},
+	})
+
+	rsp, _ := ls.OnCReact(proxyMsg("nodes"), &mockedCConn{})
+	assert.Equal(t, "a 127.0.0.1:7000 master  6.2.6 0-8191 16383\n"+
+		"b 127.0.0.1:7001 slave a 6.2.6\n", bulkString(t, rsp))
+}
+
+func TestProxyUnknownSubcommand(t *testing.T) {
+	initEngine()
+	ls := NewListenServer()
+
+	rsp, _ := ls.OnCReact(proxyMsg("foo"), &mockedCConn{})
+	assert.Equal(t, codec.ErrUnKnownSubcommand.Bytes(), rsp)
+}
+
+func TestProxyAuthorized(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer(WithRedisPassword("secret"))
+	c := &mockedCConn{}
+
+	// the read subcommands are answered to anyone
+	rsp, _ := ls.OnCReact(proxyMsg("INFO"), c)
+	assert.NotEqual(t, codec.ErrNoAuth.Bytes(), rsp)
+
+	for _, args := range [][]string{{"DEADLINE", "10"}, {"COMPRESS", "NONE"}, {"TARGET", "127.0.0.1:7000"}, {"TAG", "NONE"}} {
+		rsp, _ = ls.OnCReact(proxyMsg(args...), c)
+		assert.Equal(t, codec.ErrNoAuth.String(), string(rsp), "PROXY %v", args)
+	}
+	assert.Equal(t, 0, c.RequestTimeout())
+	assert.Empty(t, c.Target())
+
+	c.SetAuthed(true)
+	rsp, _ = ls.OnCReact(proxyMsg("TARGET", "127.0.0.1:7000"), c)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+	assert.Equal(t, "127.0.0.1:7000", c.Target())
+
+	// no password, no auth
+	rsp, _ = NewListenServer().OnCReact(proxyMsg("DEADLINE", "10"), &mockedCConn{})
+	assert.Equal(t, codec.OK.String(), string(rsp))
+}
+
+func TestRouteExpireFamily(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer()
+
+	var cases = []struct {
+		cmd     string
+		isSlave bool
+	}{
+		{"ttl", true},
+		{"pttl", true},
+		{"expiretime", true},
+		{"pexpiretime", true},
+		{"expire", false},
+		{"expireat", false},
+		{"pexpire", false},
+		{"pexpireat", false},
+		{"persist", false},
+	}
+
+	for _, v := range cases {
+		cmd, ok := codec.CommandStr2Type[v.cmd]
+		assert.True(t, ok, "unknown command %s", v.cmd)
+
+		r := &core.Msg{Type: cmd}
+
+		addr, isSlave := ls.route(r, 0)
+		assert.Equal(t, v.isSlave, isSlave, "assert routing target of %s", v.cmd)
+		if v.isSlave {
+			assert.Equal(t, "127.0.0.1:7001", addr, "assert routing target of %s", v.cmd)
+		} else {
+			assert.Equal(t, "127.0.0.1:7000", addr, "assert routing target of %s", v.cmd)
+		}
+	}
+}
+
+// slaveShare routes n reads of slot 0 and returns the share served by the slave
+func slaveShare(ls *listenServer, n int) float64 {
+	var slaves int
+	for i := 0; i < n; i++ {
+		if _, isSlave := ls.route(&core.Msg{Type: codec.ReqGet}, 0); isSlave {
+			slaves++
+		}
+	}
+	return float64(slaves) / float64(n)
+}
+
+func TestRouteSlowStart(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer(WithSlowStartWindow(2000))
+	pool := core.EngineGlobal.ProxyPool["127.0.0.1:7001"]
+
+	pool.ReportFailure(time.Millisecond)
+	assert.Equal(t, float64(0), slaveShare(ls, 100), "share while banned")
+	time.Sleep(2 * time.Millisecond)
+
+	justUnbanned := slaveShare(ls, 10000)
+	assert.Equal(t, core.HalfOpen, pool.BanStatus().State)
+	assert.InDelta(t, 0.1, justUnbanned, 0.05, "share right after unban")
+
+	time.Sleep(time.Second - time.Since(pool.BanStatus().UnbanTime))
+	halfway := slaveShare(ls, 10000)
+	assert.InDelta(t, 0.5, halfway, 0.1, "share halfway through the window")
+	assert.Greater(t, halfway, justUnbanned)
+
+	time.Sleep(time.Second)
+	assert.Equal(t, float64(1), slaveShare(ls, 10000), "share after the window")
+}
+
+func TestRouteSlaveFallback(t *testing.T) {
+	initTopology(2)
+	ls := NewListenServer()
+	fallback := core.GlobalStats.SlaveFallback.WithLabelValues("127.0.0.1:7000")
+	before := testutil.ToFloat64(fallback)
+
+	// a write goes to the master as usual
+	addr, _ := ls.route(&core.Msg{Type: codec.ReqSet}, 100)
+	assert.Equal(t, "127.0.0.1:7000", addr)
+	assert.Equal(t, before, testutil.ToFloat64(fallback))
+
+	core.EngineGlobal.ProxyPool["127.0.0.1:7001"].ReportFailure(time.Minute)
+	core.EngineGlobal.ProxyPool["127.0.0.1:7002"].ReportFailure(time.Minute)
+
+	c := &mockedCConn{}
+	r := decode(t, "*2\r\n$3\r\nGET\r\n$1\r\na\r\n")
+	rsp, _ := ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{r}, c.msgs)
+	sConn := core.EngineGlobal.ProxyPool["127.0.0.1:7000"].Get().(*mockedSConn)
+	assert.Equal(t, 1, len(sConn.frags), "the read is served by the master")
+	assert.Equal(t, before+1, testutil.ToFloat64(fallback))
+}
+
+func TestRouteOrphaned(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer(WithDisableRedisSlave(true), WithSlowStartWindow(60000))
+	rs := core.EngineGlobal.Slots2Node.Get(0)
+	rs.Orphaned = true
+
+	// the slave serves the reads even if the proxy reads from the masters only
+	addr, isSlave := ls.route(&core.Msg{Type: codec.ReqGet}, 0)
+	assert.True(t, isSlave)
+	assert.Equal(t, "127.0.0.1:7001", addr)
+
+	// and right after its ban as it is the only node left
+	core.EngineGlobal.ProxyPool["127.0.0.1:7001"].ReportFailure(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	assert.Equal(t, float64(1), slaveShare(ls, 100))
+
+	c := &mockedCConn{}
+	set := &core.Msg{Type: codec.ReqSet, Body: map[int32]*core.Frag{0: {Key: "foo"}}}
+	rsp, _ := ls.OnCReact(set, c)
+	assert.Equal(t, codec.ErrOrphanedSlot.Bytes(), rsp)
+	assert.Equal(t, 0, len(c.msgs))
+
+	get := &core.Msg{Type: codec.ReqGet, Body: map[int32]*core.Frag{0: {Key: "foo"}}}
+	rsp, _ = ls.OnCReact(get, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{get}, c.msgs)
+}
+
+func TestRouteSlaveAffinity(t *testing.T) {
+	initTopology(3)
+	ls := NewListenServer(WithSlavePolicy(SlavePolicyAffinity))
+	c := &mockedCConn{}
+	r := &core.Msg{Type: codec.ReqGet, Owner: c}
+
+	addr, isSlave := ls.route(r, 100)
+	assert.True(t, isSlave)
+	for i := 0; i < 100; i++ {
+		again, _ := ls.route(r, 100)
+		assert.Equal(t, addr, again, "same slot of the same client should go to the same slave")
+	}
+
+	// the slave is banned, reads fail over to another slave, consistently
+	pool := core.EngineGlobal.ProxyPool[addr]
+	pool.ReportFailure(time.Minute)
+
+	failover, isSlave := ls.route(r, 100)
+	assert.True(t, isSlave)
+	assert.NotEqual(t, addr, failover)
+	for i := 0; i < 100; i++ {
+		again, _ := ls.route(r, 100)
+		assert.Equal(t, failover, again)
+	}
+}
+
+func helloReply(proto int) string {
+	return "*14\r\n$6\r\nserver\r\n$7\r\nrcproxy\r\n$7\r\nversion\r\n$6\r\nv1.0.0\r\n" +
+		fmt.Sprintf("$5\r\nproto\r\n:%d\r\n$2\r\nid\r\n:1\r\n", proto) +
+		"$4\r\nmode\r\n$7\r\ncluster\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"
+}
+
+func TestHello(t *testing.T) {
+	var cases = []struct {
+		args   []string
+		expect string
+		proto  int
+		authed bool
+	}{
+		{args: nil, expect: helloReply(2), proto: 2},
+		{args: []string{"2"}, expect: helloReply(2), proto: 2},
+		{args: []string{"3", "AUTH", "user", "pass"}, expect: helloReply(3), proto: 3, authed: true},
+		{args: []string{"3", "AUTH", "user", "wrong"}, expect: codec.ErrAuthInvalidPassword.String(), proto: 2},
+		{args: []string{"3", "SETNAME", "app"}, expect: helloReply(3), proto: 3},
+		{args: []string{"3", "AUTH", "user"}, expect: codec.ErrSyntax.String(), proto: 2},
+		{args: []string{"4"}, expect: codec.ErrNoProto.String(), proto: 2},
+		{args: []string{"three"}, expect: codec.ErrProtoVersion.String(), proto: 2},
+	}
+
+	initEngine()
+	ls := NewListenServer(WithVersion("v1.0.0"), WithRedisPassword("pass"))
+	for _, v := range cases {
+		c := &mockedCConn{}
+		rsp, action := ls.OnCReact(&core.Msg{Type: codec.ReqHello, Args: v.args}, c)
+		assert.Equal(t, core.None, action)
+		assert.Equal(t, v.expect, string(rsp), "HELLO %v", v.args)
+		assert.Equal(t, v.proto, c.Proto(), "HELLO %v", v.args)
+		assert.Equal(t, v.authed, c.Authed(), "HELLO %v", v.args)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	var cases = []struct {
+		input  string
+		expect string
+	}{
+		{input: "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n", expect: codec.OK.String()},
+		{input: "*2\r\n$6\r\nselect\r\n$1\r\n1\r\n", expect: codec.ErrSelectCluster.String()},
+		{input: "*2\r\n$6\r\nselect\r\n$2\r\ndb\r\n", expect: codec.ErrInvalidDBIndex.String()},
+		{input: "*1\r\n$6\r\nselect\r\n", expect: codec.ErrMsgReqWrongArgumentsNumber.String()},
+	}
+
+	initEngine()
+	ls := NewListenServer()
+	rejected := core.GlobalStats.RejectedCmd.WithLabelValues("select")
+	before := testutil.ToFloat64(rejected)
+	for _, v := range cases {
+		rsp, action := ls.OnCReact(decode(t, v.input), &mockedCConn{})
+		assert.Equal(t, core.None, action)
+		assert.Equal(t, v.expect, string(rsp), "input: %q", v.input)
+	}
+	assert.Equal(t, before+1, testutil.ToFloat64(rejected))
+}
+
+func TestServerName(t *testing.T) {
+	initEngine()
+	ls := NewListenServer(WithVersion("v1.0.0"), WithServerName("rcproxy-blue"))
+
+	rsp, _ := ls.OnCReact(&core.Msg{Type: codec.ReqHello}, &mockedCConn{})
+	assert.True(t, strings.HasPrefix(string(rsp), "*14\r\n$6\r\nserver\r\n$12\r\nrcproxy-blue\r\n"), string(rsp))
+
+	rsp, _ = ls.OnCReact(proxyMsg("INFO"), &mockedCConn{})
+	assert.Contains(t, bulkString(t, rsp), "server_name:rcproxy-blue\r\n")
+}
+
+func TestRouteReadYourWrites(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer(WithReadYourWrites(50))
+	c := &mockedCConn{}
+
+	_, isSlave := ls.route(&core.Msg{Type: codec.ReqGet, Owner: c}, 100)
+	assert.True(t, isSlave, "no write yet")
+
+	_, isSlave = ls.route(&core.Msg{Type: codec.ReqSet, Owner: c}, 100)
+	assert.False(t, isSlave)
+
+	_, isSlave = ls.route(&core.Msg{Type: codec.ReqGet, Owner: c}, 100)
+	assert.False(t, isSlave, "read within the window goes to the master")
+	_, isSlave = ls.route(&core.Msg{Type: codec.ReqGet, Owner: c}, 101)
+	assert.True(t, isSlave, "other slots are not affected")
+	_, isSlave = ls.route(&core.Msg{Type: codec.ReqGet, Owner: &mockedCConn{}}, 100)
+	assert.True(t, isSlave, "other clients are not affected")
+
+	time.Sleep(60 * time.Millisecond)
+	_, isSlave = ls.route(&core.Msg{Type: codec.ReqGet, Owner: c}, 100)
+	assert.True(t, isSlave, "read after the window goes to the slave")
+}
+
+func TestReadOnlyProxy(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer(WithReadOnly(true))
+
+	c := &mockedCConn{}
+	set := &core.Msg{Type: codec.ReqSet, Body: map[int32]*core.Frag{0: {Key: "foo"}}}
+	rsp, _ := ls.OnCReact(set, c)
+	assert.Equal(t, codec.ErrReadOnlyProxy.Bytes(), rsp)
+	assert.Equal(t, 0, len(c.msgs))
+
+	get := &core.Msg{Type: codec.ReqGet, Body: map[int32]*core.Frag{0: {Key: "foo"}}}
+	rsp, _ = ls.OnCReact(get, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{get}, c.msgs)
+	assert.Equal(t, c, get.Body[0].Owner)
+
+	// the commands numbered among the writes but not changing the dataset are forwarded
+	c = &mockedCConn{target: "127.0.0.1:7000"}
+	for _, req := range []string{
+		"*2\r\n$7\r\nLATENCY\r\n$6\r\nLATEST\r\n",
+		"*2\r\n$8\r\nFUNCTION\r\n$4\r\nLIST\r\n",
+		"*3\r\n$6\r\nSUNION\r\n$4\r\n{a}x\r\n$4\r\n{a}y\r\n",
+	} {
+		rsp, _ = ls.OnCReact(decode(t, req), c)
+		assert.Nil(t, rsp, "%q", req)
+	}
+	assert.Equal(t, 3, len(c.msgs))
+
+	rsp, _ = ls.OnCReact(decode(t, "*3\r\n$8\r\nFUNCTION\r\n$4\r\nLOAD\r\n$8\r\n#!lua...\r\n"), c)
+	assert.Equal(t, codec.ErrReadOnlyProxy.Bytes(), rsp)
+}
+
+func TestReadOnlySlot(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer()
+	_, err := core.EngineGlobal.SetSlotReadOnly(7, true)
+	assert.Nil(t, err)
+
+	c := &mockedCConn{}
+	set := &core.Msg{Type: codec.ReqSet, Body: map[int32]*core.Frag{7: {Key: "foo"}}}
+	rsp, _ := ls.OnCReact(set, c)
+	assert.Equal(t, codec.ErrReadOnlySlot.Bytes(), rsp)
+	assert.Equal(t, 0, len(c.msgs))
+
+	// none of the keys is written if one of them is in a read-only slot
+	del := &core.Msg{Type: codec.ReqDel, Body: map[int32]*core.Frag{3: {Key: "bar"}, 7: {Key: "foo"}}}
+	rsp, _ = ls.OnCReact(del, c)
+	assert.Equal(t, codec.ErrReadOnlySlot.Bytes(), rsp)
+	assert.Nil(t, del.Body[3].Owner)
+
+	get := &core.Msg{Type: codec.ReqGet, Body: map[int32]*core.Frag{7: {Key: "foo"}}}
+	rsp, _ = ls.OnCReact(get, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{get}, c.msgs)
+
+	_, err = core.EngineGlobal.SetSlotReadOnly(7, false)
+	assert.Nil(t, err)
+	set = &core.Msg{Type: codec.ReqSet, Body: map[int32]*core.Frag{7: {Key: "foo"}}}
+	rsp, _ = ls.OnCReact(set, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{get, set}, c.msgs)
+}
+
+func TestGetKeysInSlot(t *testing.T) {
+	initTopology(1)
+	rs := &core.Replicaset{Master: &core.ClusterNode{Name: "b", Addr: "127.0.0.1:7100", Role: core.Master}}
+	core.EngineGlobal.ProxyPool[rs.Master.Addr] = newMockedPool(rs.Master.Addr)
+	for i := int32(8192); i < constant.RedisClusterSlots; i++ {
+		core.EngineGlobal.Slots2Node.Set(i, rs)
+	}
+	ls := NewListenServer(WithReadOnly(true))
+
+	c := &mockedCConn{}
+	r := decode(t, "*4\r\n$7\r\nCLUSTER\r\n$13\r\nGETKEYSINSLOT\r\n$5\r\n12539\r\n$2\r\n10\r\n")
+	rsp, action := ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, core.None, action)
+	assert.Equal(t, []*core.Msg{r}, c.msgs)
+
+	// only the owner of the slot is asked for its keys, though a read-only proxy
+	sConn := core.EngineGlobal.ProxyPool[rs.Master.Addr].Get().(*mockedSConn)
+	if assert.Equal(t, 1, len(sConn.frags)) {
+		assert.Equal(t, "*4\r\n$7\r\ncluster\r\n$13\r\nGETKEYSINSLOT\r\n$5\r\n12539\r\n$2\r\n10\r\n", string(sConn.frags[0].Req))
+		assert.Equal(t, r.SlotFrag(12539), sConn.frags[0])
+	}
+	assert.Equal(t, 0, len(core.EngineGlobal.ProxyPool["127.0.0.1:7000"].Get().(*mockedSConn).frags))
+
+	// the multibulk reply is relayed as it is
+	reply := "*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+	frag := sConn.frags[0]
+	frag.RspBody = append(frag.RspBody[:0], reply...)
+	assert.Nil(t, (&core.SRespCodec{MsgMaxLength: 1024}).Default(frag))
+	assert.Equal(t, reply, string(r.RspBody))
+
+	cases := []struct {
+		input  string
+		expect codec.Error
+	}{
+		{"*4\r\n$7\r\ncluster\r\n$13\r\ngetkeysinslot\r\n$5\r\n16384\r\n$2\r\n10\r\n", codec.ErrInvalidSlot},
+		{"*4\r\n$7\r\ncluster\r\n$13\r\ngetkeysinslot\r\n$2\r\n-1\r\n$2\r\n10\r\n", codec.ErrInvalidSlot},
+		{"*4\r\n$7\r\ncluster\r\n$13\r\ngetkeysinslot\r\n$3\r\nfoo\r\n$2\r\n10\r\n", codec.ErrInvalidSlot},
+		{"*3\r\n$7\r\ncluster\r\n$13\r\ngetkeysinslot\r\n$1\r\n0\r\n", codec.ErrMsgReqWrongArgumentsNumber},
+	}
+	for _, v := range cases {
+		c := &mockedCConn{}
+		rsp, _ := ls.OnCReact(decode(t, v.input), c)
+		assert.Equal(t, v.expect.Bytes(), rsp, "input: %q", v.input)
+		assert.Equal(t, 0, len(c.msgs), "input: %q", v.input)
+	}
+
+	// a read, it doesn't send the next reads of the client to the master, sent in the case configured
+	ls = NewListenServer(WithReadYourWrites(1000), WithCommandCase(core.CommandCaseUpper))
+	c = &mockedCConn{}
+	r = decode(t, "*4\r\n$7\r\nCLUSTER\r\n$13\r\nGETKEYSINSLOT\r\n$5\r\n12539\r\n$2\r\n10\r\n")
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Empty(t, c.lastWrites)
+	assert.Equal(t, "*4\r\n$7\r\nCLUSTER\r\n$13\r\nGETKEYSINSLOT\r\n$5\r\n12539\r\n$2\r\n10\r\n", string(r.SlotFrag(12539).Req))
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	ls := NewListenServer(WithMaxConnsPerIP(2))
+	rejected := core.GlobalStats.RejectedConns.WithLabelValues("max_conns_per_ip")
+	before := testutil.ToFloat64(rejected)
+
+	a1 := &mockedCConn{fd: 11, remote: "10.0.0.1:50001"}
+	a2 := &mockedCConn{fd: 12, remote: "10.0.0.1:50002"}
+	a3 := &mockedCConn{fd: 13, remote: "10.0.0.1:50003"}
+	for _, c := range []*mockedCConn{a1, a2} {
+		out, action := ls.OnCOpened(c)
+		assert.Nil(t, out)
+		assert.Equal(t, core.None, action)
+	}
+
+	// the third connection of the ip is rejected, another ip connects fine
+	out, action := ls.OnCOpened(a3)
+	assert.Equal(t, codec.ErrMaxConnsPerIP.Bytes(), out)
+	assert.Equal(t, core.Close, action)
+	assert.Equal(t, before+1, testutil.ToFloat64(rejected))
+	out, action = ls.OnCOpened(&mockedCConn{fd: 14, remote: "10.0.0.2:50001"})
+	assert.Nil(t, out)
+	assert.Equal(t, core.None, action)
+
+	// closing the rejected connection frees no room
+	ls.OnCClosed(a3, nil)
+	_, action = ls.OnCOpened(&mockedCConn{fd: 15, remote: "10.0.0.1:50004"})
+	assert.Equal(t, core.Close, action)
+	ls.OnCClosed(&mockedCConn{fd: 15, remote: "10.0.0.1:50004"}, nil)
+
+	ls.OnCClosed(a1, nil)
+	_, action = ls.OnCOpened(&mockedCConn{fd: 16, remote: "10.0.0.1:50005"})
+	assert.Equal(t, core.None, action)
+	assert.Equal(t, map[string]int{"10.0.0.1": 2, "10.0.0.2": 1}, ls.ipConns)
+}
+
+func TestAuditConns(t *testing.T) {
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink), logging.WithLogLevel(logging.LevelWarn)))
+	t.Cleanup(logging.Reset)
+
+	// off by default
+	c := &mockedCConn{fd: 11, remote: "10.0.0.1:50001", createdAt: time.Now().Add(-2 * time.Second), requests: 3}
+	ls := NewListenServer()
+	ls.OnCOpened(c)
+	ls.OnCClosed(c, nil)
+	assert.Empty(t, sink.Lines())
+
+	ls = NewListenServer(WithAuditConns(true))
+	ls.OnCOpened(c)
+	assert.True(t, sink.Contains(logging.LevelInfo, "[audit] client conn open, fd: 11, local: 127.0.0.1:9736, remote: 10.0.0.1:50001"))
+	c.SetLibInfo("redis-py", "5.0.1")
+	ls.OnCClosed(c, nil)
+	assert.True(t, sink.Contains(logging.LevelInfo, "[audit] client conn closed, fd: 11, local: 127.0.0.1:9736, remote: 10.0.0.1:50001, lib: redis-py 5.0.1, duration: 2"))
+	assert.True(t, sink.Contains(logging.LevelInfo, "s, requests: 3, err: <nil>"))
+	assert.Equal(t, 2, len(sink.Lines()), "audited whatever the log level")
+}
+
+// decode decodes the request sent by the client
+func decode(t *testing.T, input string) *core.Msg {
+	rc := &core.CRespCodec{MsgMaxLength: 1024}
+	r, err := rc.Decode(&mockedCConn{buf: []byte(input)})
+	assert.Nil(t, err, "input: %q", input)
+	return r
+}
+
+func TestMaxValueSize(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer()
+	rc := &core.CRespCodec{MsgMaxLength: 1024, MaxValueSize: 4}
+
+	var cases = []struct {
+		input  string
+		expect codec.Command
+	}{
+		{"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$4\r\nfour\r\n", codec.ReqSet},
+		{"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nfives\r\n", codec.ReqValueTooLarge},
+		{"*4\r\n$4\r\nHSET\r\n$1\r\nh\r\n$1\r\nf\r\n$5\r\nfives\r\n", codec.ReqValueTooLarge},
+		{"*5\r\n$4\r\nMSET\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$5\r\nfives\r\n", codec.ReqValueTooLarge},
+		// the keys and the reads are not limited
+		{"*5\r\n$4\r\nMSET\r\n$5\r\nlarge\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n", codec.ReqMset},
+		{"*2\r\n$3\r\nGET\r\n$5\r\nlarge\r\n", codec.ReqGet},
+		{"*4\r\n$6\r\nLRANGE\r\n$1\r\nl\r\n$1\r\n0\r\n$5\r\n10000\r\n", codec.ReqLrange},
+		{"*4\r\n$4\r\nEVAL\r\n$8\r\nreturn 1\r\n$1\r\n1\r\n$1\r\nk\r\n", codec.ReqEval},
+		// the second key of SMOVE or ZUNIONSTORE is no value, unlike the member moved
+		{"*4\r\n$5\r\nSMOVE\r\n$3\r\n{s}\r\n$6\r\n{s}dst\r\n$1\r\nm\r\n", codec.ReqSmove},
+		{"*4\r\n$5\r\nSMOVE\r\n$3\r\n{s}\r\n$1\r\nd\r\n$5\r\nfives\r\n", codec.ReqValueTooLarge},
+		{"*4\r\n$11\r\nZUNIONSTORE\r\n$1\r\nz\r\n$1\r\n1\r\n$5\r\nlarge\r\n", codec.ReqZunionstore},
+	}
+	for _, v := range cases {
+		c := &mockedCConn{buf: []byte(v.input + "*1\r\n$4\r\nPING\r\n")}
+		r, err := rc.Decode(c)
+		assert.Nil(t, err, "input: %q", v.input)
+		assert.Equal(t, v.expect, r.Type, "input: %q", v.input)
+
+		rsp, action := ls.OnCReact(r, c)
+		assert.Equal(t, core.None, action)
+		if v.expect == codec.ReqValueTooLarge {
+			assert.Equal(t, codec.ErrValueTooLarge.String(), string(rsp), "input: %q", v.input)
+		} else {
+			assert.Nil(t, rsp, "input: %q", v.input)
+		}
+
+		// the rejected request is consumed, the connection goes on with the next one
+		next, err := rc.Decode(c)
+		assert.Nil(t, err, "input: %q", v.input)
+		assert.Equal(t, codec.ReqPing, next.Type, "input: %q", v.input)
+	}
+	// one frag each, but the MSET split in two slots
+	assert.Equal(t, 8, len(core.EngineGlobal.ProxyPool["127.0.0.1:7000"].Get().(*mockedSConn).frags))
+}
+
+func TestSetVariants(t *testing.T) {
+	var cases = []struct {
+		input  string
+		expect codec.Command
+	}{
+		{"*4\r\n$5\r\nSETEX\r\n$1\r\nk\r\n$2\r\n10\r\n$1\r\nv\r\n", codec.ReqSetex},
+		{"*4\r\n$6\r\nPSETEX\r\n$1\r\nk\r\n$5\r\n10000\r\n$1\r\nv\r\n", codec.ReqPsetex},
+		{"*3\r\n$5\r\nSETNX\r\n$1\r\nk\r\n$1\r\nv\r\n", codec.ReqSetnx},
+		{"*5\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n$2\r\nEX\r\n$2\r\n10\r\n", codec.ReqSet},
+		{"*3\r\n$5\r\nSETEX\r\n$1\r\nk\r\n$2\r\n10\r\n", codec.ReqWrongArgumentsNumber},
+		{"*3\r\n$6\r\nPSETEX\r\n$1\r\nk\r\n$5\r\n10000\r\n", codec.ReqWrongArgumentsNumber},
+		{"*2\r\n$5\r\nSETNX\r\n$1\r\nk\r\n", codec.ReqWrongArgumentsNumber},
+		{"*2\r\n$3\r\nSET\r\n$1\r\nk\r\n", codec.ReqWrongArgumentsNumber},
+	}
+
+	initTopology(1)
+	ls := NewListenServer()
+	for _, v := range cases {
+		r := decode(t, v.input)
+		assert.Equal(t, v.expect, r.Type, "input: %q", v.input)
+
+		if r.Type == codec.ReqWrongArgumentsNumber {
+			rsp, _ := ls.OnCReact(r, &mockedCConn{})
+			assert.Equal(t, codec.ErrMsgReqWrongArgumentsNumber.Bytes(), rsp, "input: %q", v.input)
+			continue
+		}
+		r.RangeFrags(func(slot int32, _ *core.Frag) bool {
+			addr, isSlave := ls.route(r, slot)
+			assert.False(t, isSlave, "input: %q", v.input)
+			assert.Equal(t, "127.0.0.1:7000", addr, "input: %q", v.input)
+			return true
+		})
+	}
+}
+
+func TestRejectNodeAdmin(t *testing.T) {
+	var cases = []struct {
+		input  string
+		cmd    string
+		expect codec.Error
+	}{
+		{"*2\r\n$7\r\nCLUSTER\r\n$8\r\nFAILOVER\r\n", "cluster_failover", codec.ErrClusterFailover},
+		{"*3\r\n$7\r\ncluster\r\n$8\r\nfailover\r\n$8\r\nTAKEOVER\r\n", "cluster_failover", codec.ErrClusterFailover},
+		{"*4\r\n$7\r\nCLUSTER\r\n$7\r\nSETSLOT\r\n$3\r\n100\r\n$6\r\nSTABLE\r\n", "cluster_setslot", codec.ErrClusterAdmin("SETSLOT")},
+		{"*4\r\n$7\r\ncluster\r\n$8\r\naddslots\r\n$1\r\n1\r\n$1\r\n2\r\n", "cluster_addslots", codec.ErrClusterAdmin("ADDSLOTS")},
+		{"*3\r\n$7\r\nCLUSTER\r\n$8\r\nDELSLOTS\r\n$1\r\n1\r\n", "cluster_delslots", codec.ErrClusterAdmin("DELSLOTS")},
+		{"*3\r\n$7\r\nCLUSTER\r\n$16\r\nSET-CONFIG-EPOCH\r\n$1\r\n1\r\n", "cluster_set_config_epoch", codec.ErrClusterAdmin("SET-CONFIG-EPOCH")},
+		{"*1\r\n$8\r\nFAILOVER\r\n", "failover", codec.ErrFailover},
+		{"*3\r\n$4\r\nWAIT\r\n$1\r\n1\r\n$3\r\n100\r\n", "wait", codec.ErrWait},
+	}
+
+	initTopology(1)
+	ls := NewListenServer()
+	for _, v := range cases {
+		before := testutil.ToFloat64(core.GlobalStats.RejectedCmd.WithLabelValues(v.cmd))
+
+		c := &mockedCConn{}
+		rsp, action := ls.OnCReact(decode(t, v.input), c)
+		assert.Equal(t, core.None, action)
+		assert.Equal(t, v.expect.Bytes(), rsp, "input: %q", v.input)
+		assert.Equal(t, 0, len(c.msgs), "nothing is forwarded, input: %q", v.input)
+		assert.Equal(t, before+1, testutil.ToFloat64(core.GlobalStats.RejectedCmd.WithLabelValues(v.cmd)), "input: %q", v.input)
+	}
+
+	rsp, _ := ls.OnCReact(decode(t, "*2\r\n$7\r\nCLUSTER\r\n$5\r\nRESET\r\n"), &mockedCConn{})
+	assert.Equal(t, codec.ErrUnKnownSubcommand.Bytes(), rsp)
+}
+
+func TestTooManyKeys(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer()
+	rc := &core.CRespCodec{MsgMaxLength: 1024, MaxKeys: 2}
+
+	var cases = []struct {
+		input  string
+		expect codec.Command
+	}{
+		{"*3\r\n$4\r\nMGET\r\n$1\r\na\r\n$1\r\nb\r\n", codec.ReqMget},
+		{"*4\r\n$4\r\nMGET\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", codec.ReqTooManyKeys},
+		{"*4\r\n$3\r\nDEL\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", codec.ReqTooManyKeys},
+		{"*5\r\n$4\r\nMSET\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n", codec.ReqMset},
+		{"*7\r\n$4\r\nMSET\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n$1\r\nc\r\n$1\r\n3\r\n", codec.ReqTooManyKeys},
+	}
+	for _, v := range cases {
+		c := &mockedCConn{buf: []byte(v.input + "*1\r\n$4\r\nPING\r\n")}
+		r, err := rc.Decode(c)
+		assert.Nil(t, err, "input: %q", v.input)
+		assert.Equal(t, v.expect, r.Type, "input: %q", v.input)
+		if v.expect != codec.ReqTooManyKeys {
+			continue
+		}
+		assert.Equal(t, 0, r.NumFrags(), "input: %q", v.input)
+		rsp, action := ls.OnCReact(r, c)
+		assert.Equal(t, codec.ErrMsgReqTooManyKeys.String(), string(rsp), "input: %q", v.input)
+		assert.Equal(t, core.None, action)
+
+		// the rejected request is consumed, the connection goes on with the next one
+		next, err := rc.Decode(c)
+		assert.Nil(t, err, "input: %q", v.input)
+		assert.Equal(t, codec.ReqPing, next.Type, "input: %q", v.input)
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer()
+
+	// PFADD is single key, routed by it
+	r := decode(t, "*4\r\n$5\r\nPFADD\r\n$3\r\nhll\r\n$1\r\na\r\n$1\r\nb\r\n")
+	assert.Equal(t, codec.ReqPfadd, r.Type)
+	assert.Equal(t, 1, r.NumFrags())
+	assert.Equal(t, "hll", r.SlotFrag(hashkit.Hash("hll")).Key)
+
+	// PFMERGE of the keys of the same hash tag is forwarded as a whole
+	c := &mockedCConn{}
+	input := "*4\r\n$7\r\nPFMERGE\r\n$6\r\n{u}dst\r\n$5\r\n{u}s1\r\n$5\r\n{u}s2\r\n"
+	r = decode(t, input)
+	assert.Equal(t, codec.ReqPfmerge, r.Type)
+	assert.Equal(t, 1, r.NumFrags())
+	rsp, _ := ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	sConn := core.EngineGlobal.ProxyPool["127.0.0.1:7000"].Get().(*mockedSConn)
+	if assert.Equal(t, 1, len(sConn.frags)) {
+		assert.Equal(t, strings.Replace(input, "PFMERGE", "pfmerge", 1), string(sConn.frags[0].Req))
+	}
+
+	// PFCOUNT over keys of different slots is rejected by the proxy
+	r = decode(t, "*3\r\n$7\r\nPFCOUNT\r\n$1\r\na\r\n$1\r\nb\r\n")
+	assert.Equal(t, codec.ReqCrossSlot, r.Type)
+	assert.Equal(t, 0, r.NumFrags())
+	rsp, action := ls.OnCReact(r, c)
+	assert.Equal(t, codec.ErrCrossSlot.String(), string(rsp))
+	assert.Equal(t, core.None, action)
+	assert.Equal(t, codec.ReqPfcount, decode(t, "*2\r\n$7\r\nPFCOUNT\r\n$1\r\na\r\n").Type)
+
+	// PFCOUNT is a read, PFADD and PFMERGE are writes
+	assert.Less(t, uint32(codec.ReqPfcount), uint32(codec.ReqWriteCmdStart))
+	assert.Greater(t, uint32(codec.ReqPfadd), uint32(codec.ReqWriteCmdStart))
+	assert.Greater(t, uint32(codec.ReqPfmerge), uint32(codec.ReqWriteCmdStart))
+}
+
+func TestCrossSlotBehavior(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer()
+	input := "*3\r\n$6\r\nSUNION\r\n$1\r\na\r\n$1\r\nb\r\n"
+
+	// error, the default, rejects keys across slots
+	rc := &core.CRespCodec{MsgMaxLength: 1024}
+	r, err := rc.Decode(&mockedCConn{buf: []byte(input)})
+	assert.Nil(t, err)
+	assert.Equal(t, codec.ReqCrossSlot, r.Type)
+	rsp, _ := ls.OnCReact(r, &mockedCConn{})
+	assert.Equal(t, codec.ErrCrossSlot.String(), string(rsp))
+
+	// serial splits the request into one per slot
+	rc.CrossSlot = core.CrossSlotSerial
+	r, err = rc.Decode(&mockedCConn{buf: []byte(input)})
+	assert.Nil(t, err)
+	assert.Equal(t, codec.ReqSunion, r.Type)
+	assert.Equal(t, 2, r.NumFrags())
+	assert.Equal(t, "*2\r\n$6\r\nsunion\r\n$1\r\na\r\n", string(r.SlotFrag(hashkit.Hash("a")).Req))
+	assert.Equal(t, "*2\r\n$6\r\nsunion\r\n$1\r\nb\r\n", string(r.SlotFrag(hashkit.Hash("b")).Req))
+
+	// keys of the same slot are forwarded as one request in both behaviors
+	for _, behavior := range []string{core.CrossSlotError, core.CrossSlotSerial} {
+		rc.CrossSlot = behavior
+		r, err = rc.Decode(&mockedCConn{buf: []byte("*3\r\n$6\r\nSINTER\r\n$4\r\n{u}a\r\n$4\r\n{u}b\r\n")})
+		assert.Nil(t, err)
+		assert.Equal(t, codec.ReqSinter, r.Type, "behavior: %s", behavior)
+		assert.Equal(t, 1, r.NumFrags(), "behavior: %s", behavior)
+	}
+}
+
+func TestAckOnSend(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer(WithAckOnSend("SET, incr"))
+	set := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+
+	// answered once forwarded
+	c := &mockedCConn{}
+	r := decode(t, set)
+	rsp, action := ls.OnCReact(r, c)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+	assert.Equal(t, core.None, action)
+	assert.True(t, r.Acked)
+	assert.Equal(t, 0, len(c.msgs))
+	sConn := core.EngineGlobal.ProxyPool["127.0.0.1:7000"].Get().(*mockedSConn)
+	assert.Equal(t, 1, len(sConn.frags))
+
+	// INCR isn't answered +OK by redis, it is never acknowledged
+	r = decode(t, "*2\r\n$4\r\nINCR\r\n$1\r\na\r\n")
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.False(t, r.Acked)
+
+	// the INCR is pending, the +OK of the SET would overtake its reply
+	r = decode(t, set)
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.False(t, r.Acked)
+	assert.Equal(t, 2, len(c.msgs))
+}
+
+func TestProxyDeadline(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer()
+	c := &mockedCConn{}
+	get := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"
+
+	var cases = []struct {
+		args   []string
+		expect codec.Error
+	}{
+		{[]string{"deadline"}, codec.ErrMsgReqWrongArgumentsNumber},
+		{[]string{"deadline", "fast"}, codec.ErrSyntax},
+		{[]string{"deadline", "0"}, codec.ErrSyntax},
+	}
+	for _, v := range cases {
+		rsp, _ := ls.OnCReact(proxyMsg(v.args...), c)
+		assert.Equal(t, v.expect.String(), string(rsp), "args: %v", v.args)
+	}
+	assert.Equal(t, 0, c.RequestTimeout())
+
+	rsp, _ := ls.OnCReact(proxyMsg("DEADLINE", "50"), c)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+
+	// a local command doesn't take the deadline
+	rsp, _ = ls.OnCReact(decode(t, "*1\r\n$4\r\nPING\r\n"), c)
+	assert.Equal(t, codec.PONG.String(), string(rsp))
+
+	// the next request forwarded takes it, the one after falls back to the global timeout
+	r := decode(t, get)
+	ls.OnCReact(r, c)
+	assert.Equal(t, 50, r.Timeout)
+	r = decode(t, get)
+	ls.OnCReact(r, c)
+	assert.Equal(t, 0, r.Timeout)
+}
+
+func TestNotReady(t *testing.T) {
+	initEngine()
+	ls := NewListenServer()
+	c := &mockedCConn{}
+
+	// answered by the proxy itself regardless of the topology
+	rsp, _ := ls.OnCReact(decode(t, "*1\r\n$4\r\nPING\r\n"), c)
+	assert.Equal(t, "+PONG\r\n", string(rsp))
+
+	r := decode(t, "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n")
+	rsp, action := ls.OnCReact(r, c)
+	assert.Equal(t, codec.ErrProxyInitializing.String(), string(rsp))
+	assert.Equal(t, core.None, action)
+	assert.Empty(t, c.msgs)
+
+	initTopology(0)
+	r = decode(t, "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n")
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{r}, c.msgs)
+}
+
+func TestTime(t *testing.T) {
+	initTopology(2)
+	ls := NewListenServer()
+	c := &mockedCConn{}
+
+	r := decode(t, "*1\r\n$4\r\nTIME\r\n")
+	assert.Equal(t, codec.ReqTime, r.Type)
+	rsp, _ := ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{r}, c.msgs)
+
+	// forwarded to the master, never to a slave
+	sConn := core.EngineGlobal.ProxyPool["127.0.0.1:7000"].Get().(*mockedSConn)
+	if !assert.Equal(t, 1, len(sConn.frags)) || !assert.Equal(t, 1, r.NumFrags()) {
+		return
+	}
+	frag := sConn.frags[0]
+	assert.Equal(t, "*1\r\n$4\r\ntime\r\n", string(frag.Req))
+
+	// the two-element array reply of redis is relayed
+	reply := "*2\r\n$10\r\n1714000000\r\n$6\r\n123456\r\n"
+	frag.RspBody = append(frag.RspBody[:0], reply...)
+	assert.Nil(t, (&core.SRespCodec{MsgMaxLength: 1024}).Default(frag))
+	assert.Equal(t, reply, string(r.RspBody))
+
+	r = decode(t, "*2\r\n$4\r\nTIME\r\n$3\r\nnow\r\n")
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Equal(t, codec.ErrMsgReqWrongArgumentsNumber.Bytes(), rsp)
+
+	// a covered slot carries it, in the case of the command names forwarded
+	initEngine()
+	core.EngineGlobal.SetReady()
+	ls = NewListenServer(WithCommandCase(core.CommandCaseUpper))
+	rsp, _ = ls.OnCReact(decode(t, "*1\r\n$4\r\nTIME\r\n"), c)
+	assert.Equal(t, codec.ErrUnKnownSlot.Bytes(), rsp)
+
+	rs := &core.Replicaset{Master: &core.ClusterNode{Name: "a", Addr: "127.0.0.1:7000", Role: core.Master}}
+	core.EngineGlobal.ProxyPool[rs.Master.Addr] = newMockedPool(rs.Master.Addr)
+	for i := int32(100); i < 200; i++ {
+		core.EngineGlobal.Slots2Node.Set(i, rs)
+	}
+	for i := 0; i < 10; i++ {
+		r = decode(t, "*1\r\n$4\r\nTIME\r\n")
+		rsp, _ = ls.OnCReact(r, c)
+		assert.Nil(t, rsp)
+		if assert.NotNil(t, r.SlotFrag(100)) {
+			assert.Equal(t, "*1\r\n$4\r\nTIME\r\n", string(r.SlotFrag(100).Req))
+		}
+	}
+}
+
+func TestProxyCompress(t *testing.T) {
+	initTopology(0)
+	c := &mockedCConn{}
+
+	// the negotiation fails unless the proxy enables it
+	rsp, _ := NewListenServer().OnCReact(proxyMsg("COMPRESS", "DEFLATE"), c)
+	assert.Equal(t, codec.ErrCompressDisabled.String(), string(rsp))
+	assert.Equal(t, 0, c.CompressThreshold())
+
+	ls := NewListenServer(WithCompressThreshold(1024))
+	var cases = []struct {
+		args   []string
+		expect codec.Error
+	}{
+		{[]string{"compress"}, codec.ErrMsgReqWrongArgumentsNumber},
+		{[]string{"compress", "lz4"}, codec.ErrSyntax},
+	}
+	for _, v := range cases {
+		rsp, _ := ls.OnCReact(proxyMsg(v.args...), c)
+		assert.Equal(t, v.expect.String(), string(rsp), "args: %v", v.args)
+	}
+	assert.Equal(t, 0, c.CompressThreshold())
+
+	rsp, _ = ls.OnCReact(proxyMsg("COMPRESS", "DEFLATE"), c)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+	assert.Equal(t, 1024, c.CompressThreshold())
+
+	rsp, _ = ls.OnCReact(proxyMsg("COMPRESS", "none"), c)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+	assert.Equal(t, 0, c.CompressThreshold())
+}
+
+func TestClientSetinfo(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer()
+	c := &mockedCConn{}
+
+	r := decode(t, "*4\r\n$6\r\nCLIENT\r\n$7\r\nSETINFO\r\n$8\r\nlib-name\r\n$8\r\nredis-py\r\n")
+	assert.Equal(t, codec.ReqClient, r.Type)
+	rsp, action := ls.OnCReact(r, c)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+	assert.Equal(t, core.None, action)
+
+	r = decode(t, "*4\r\n$6\r\nclient\r\n$7\r\nsetinfo\r\n$7\r\nLIB-VER\r\n$5\r\n5.0.1\r\n")
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+	name, ver := c.LibInfo()
+	assert.Equal(t, "redis-py", name)
+	assert.Equal(t, "5.0.1", ver)
+
+	var cases = []struct {
+		args   []string
+		expect codec.Error
+	}{
+		{[]string{}, codec.ErrMsgReqWrongArgumentsNumber},
+		{[]string{"setinfo", "lib-name"}, codec.ErrMsgReqWrongArgumentsNumber},
+		{[]string{"setinfo", "lib-name", "a", "b"}, codec.ErrMsgReqWrongArgumentsNumber},
+		{[]string{"setinfo", "lib-name", "redis py"}, codec.ErrClientSetinfo},
+		{[]string{"setinfo", "lib-path", "x"}, codec.ErrUnrecognizedOption},
+		{[]string{"kill", "127.0.0.1:6379"}, codec.ErrUnKnownSubcommand},
+	}
+	for _, v := range cases {
+		rsp, _ := ls.OnCReact(&core.Msg{Type: codec.ReqClient, Args: v.args}, c)
+		assert.Equal(t, v.expect.String(), string(rsp), "args: %v", v.args)
+	}
+	// a rejected value keeps what was reported before
+	name, ver = c.LibInfo()
+	assert.Equal(t, "redis-py", name)
+	assert.Equal(t, "5.0.1", ver)
+}
+
+func TestClientTracking(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer()
+	c := &mockedCConn{}
+	rejected := core.GlobalStats.RejectedCmd.WithLabelValues("client_tracking")
+	before := testutil.ToFloat64(rejected)
+
+	r := decode(t, "*3\r\n$6\r\nCLIENT\r\n$8\r\nTRACKING\r\n$2\r\non\r\n")
+	rsp, action := ls.OnCReact(r, c)
+	assert.Equal(t, "-ERR client tracking not supported by proxy\r\n", string(rsp))
+	assert.Equal(t, core.None, action)
+	assert.Equal(t, before+1, testutil.ToFloat64(rejected))
+	assert.Empty(t, c.msgs)
+}
+
+func TestCommandGetkeys(t *testing.T) {
+	initEngine()
+	ls := NewListenServer()
+	c := &mockedCConn{}
+
+	r := decode(t, "*4\r\n$7\r\nCOMMAND\r\n$7\r\nGETKEYS\r\n$3\r\nget\r\n$3\r\nfoo\r\n")
+	assert.Equal(t, codec.ReqCommand, r.Type)
+	rsp, action := ls.OnCReact(r, c)
+	assert.Equal(t, "*1\r\n$3\r\nfoo\r\n", string(rsp))
+	assert.Equal(t, core.None, action)
+
+	var cases = []struct {
+		args   []string
+		expect string
+	}{
+		{[]string{"getkeys", "MSET", "a", "1", "b", "2"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"getkeys", "eval", "return 1", "1", "a", "x"}, "*1\r\n$1\r\na\r\n"},
+		{[]string{"getkeys", "smove", "a", "b", "m"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"getkeys", "zunionstore", "d", "2", "a", "b", "weights", "1", "2"}, "*3\r\n$1\r\nd\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"getkeys", "nosuchcommand", "a"}, codec.ErrUnKnownCommand.String()},
+		{[]string{"getkeys", "get"}, codec.ErrMsgReqWrongArgumentsNumber.String()},
+		{[]string{"getkeys", "ping"}, codec.ErrNoKeyArguments.String()},
+		{[]string{"getkeys"}, codec.ErrMsgReqWrongArgumentsNumber.String()},
+		{[]string{"docs"}, codec.ErrUnKnownSubcommand.String()},
+	}
+	for _, v := range cases {
+		rsp, _ := ls.OnCReact(&core.Msg{Type: codec.ReqCommand, Args: v.args}, c)
+		assert.Equal(t, v.expect, string(rsp), "args: %v", v.args)
+	}
+	assert.Empty(t, c.msgs)
+}
+
+func TestProxyExplain(t *testing.T) {
+	initTopology(0)
+	core.EngineGlobal.Opts = &core.Options{RedisMsgMaxLength: 1024, RedisCrossSlotBehavior: core.CrossSlotError}
+	ls := NewListenServer()
+	c := &mockedCConn{}
+
+	var cases = []struct {
+		args   []string
+		expect string
+	}{
+		{[]string{"explain", "GET", "foo"}, "command:get\nslot:12182 key:foo node:127.0.0.1:7000 role:master\n"},
+		// split by slot rather than rejected
+		{[]string{"explain", "mget", "a", "b"}, "command:mget\nslot:3300 key:b node:127.0.0.1:7000 role:master\nslot:15495 key:a node:127.0.0.1:7000 role:master\n"},
+		{[]string{"explain", "sunion", "a", "b"}, "command:sunion\nrejected:" + codec.ErrCrossSlot.ShortString() + "\n"},
+		{[]string{"explain", "wait", "1", "0"}, "command:wait\nrejected:" + codec.ErrWait.ShortString() + "\n"},
+		{[]string{"explain", "nosuchcommand", "a"}, "command:nosuchcommand\nrejected:" + codec.ErrUnKnownCommand.ShortString() + "\n"},
+		{[]string{"explain", "get"}, "command:get\nrejected:" + codec.ErrMsgReqWrongArgumentsNumber.ShortString() + "\n"},
+		{[]string{"explain", "proxy", "deadline", "10"}, "command:proxy\nanswered:proxy\n"},
+	}
+	before := decode(t, "*1\r\n$4\r\nPING\r\n").Id
+	requests := testutil.ToFloat64(core.GlobalStats.TotalRequests.WithLabelValues())
+	rejected := testutil.ToFloat64(core.GlobalStats.RejectedCmd.WithLabelValues("wait"))
+	fragments := testutil.ToFloat64(core.GlobalStats.Fragments.WithLabelValues("mget"))
+	for _, v := range cases {
+		rsp, action := ls.OnCReact(proxyMsg(v.args...), c)
+		assert.Equal(t, core.None, action)
+		assert.Equal(t, v.expect, bulkString(t, rsp), "args: %v", v.args)
+	}
+	rsp, _ := ls.OnCReact(proxyMsg("explain"), c)
+	assert.Equal(t, codec.ErrMsgReqWrongArgumentsNumber.String(), string(rsp))
+
+	// nothing is run or forwarded
+	assert.Empty(t, c.msgs)
+	assert.Equal(t, 0, c.RequestTimeout())
+	assert.Empty(t, core.EngineGlobal.ProxyPool["127.0.0.1:7000"].Get().(*mockedSConn).frags)
+
+	// nor counted, and no request id is used up
+	assert.Equal(t, requests, testutil.ToFloat64(core.GlobalStats.TotalRequests.WithLabelValues()))
+	assert.Equal(t, rejected, testutil.ToFloat64(core.GlobalStats.RejectedCmd.WithLabelValues("wait")))
+	assert.Equal(t, fragments, testutil.ToFloat64(core.GlobalStats.Fragments.WithLabelValues("mget")))
+	assert.Equal(t, before+1, decode(t, "*1\r\n$4\r\nPING\r\n").Id)
+
+	// the state of the proxy is taken into account
+	_, err := core.EngineGlobal.SetSlotReadOnly(12182, true)
+	assert.Nil(t, err)
+	rsp, _ = ls.OnCReact(proxyMsg("explain", "set", "foo", "bar"), c)
+	assert.Equal(t, "command:set\nrejected:"+codec.ErrReadOnlySlot.ShortString()+"\n", bulkString(t, rsp))
+	_, err = core.EngineGlobal.SetSlotReadOnly(12182, false)
+	assert.Nil(t, err)
+}
+
+func TestAsking(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer()
+	c := &mockedCConn{}
+
+	r := decode(t, "*1\r\n$6\r\nASKING\r\n")
+	assert.Equal(t, codec.ReqAsking, r.Type)
+	rsp, action := ls.OnCReact(r, c)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+	assert.Equal(t, core.None, action)
+
+	// the following command is routed as usual
+	get := decode(t, "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n")
+	rsp, action = ls.OnCReact(get, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, core.None, action)
+	assert.Equal(t, []*core.Msg{get}, c.msgs)
+
+	assert.Equal(t, codec.ReqWrongArgumentsNumber, decode(t, "*2\r\n$6\r\nASKING\r\n$3\r\nfoo\r\n").Type)
+}
+
+func TestVersionGate(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer()
+	master := core.EngineGlobal.Slots2Node.Get(0).Master
+	core.EngineGlobal.ClusterNodes.ServerMap.Set(master.Addr, master)
+
+	getdel := "*2\r\n$6\r\nGETDEL\r\n$3\r\nfoo\r\n"
+	master.Version = "6.0.16"
+	c := &mockedCConn{}
+	rsp, action := ls.OnCReact(decode(t, getdel), c)
+	assert.Equal(t, "-ERR command requires Redis >= 6.2.0 on the target node\r\n", string(rsp))
+	assert.Equal(t, core.None, action)
+	assert.Equal(t, 0, len(c.msgs))
+
+	// the commands every version supports are not affected
+	rsp, _ = ls.OnCReact(decode(t, "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"), c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, 1, len(c.msgs))
+
+	master.Version = "6.2.6"
+	rsp, _ = ls.OnCReact(decode(t, getdel), c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, 2, len(c.msgs))
+}
+
+func TestPendingLimit(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer(WithServerRetryTimeout(1000))
+	slave := core.EngineGlobal.ProxyPool["127.0.0.1:7001"]
+	stalled := &mockedSConn{addr: slave.Addr, full: true}
+	slave.Dial = func(_ string, _ bool) (core.SConn, error) { return stalled, nil }
+
+	// reads go to the slave until it is banned for a queue full of pending requests
+	c := &mockedCConn{}
+	rsp, _ := ls.OnCReact(decode(t, "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"), c)
+	assert.Equal(t, codec.ErrMsgPendingLimit.String(), string(rsp))
+	assert.Empty(t, c.msgs)
+	assert.False(t, slave.Available())
+
+	r := decode(t, "*2\r\n$3\r\nGET\r\n$1\r\na\r\n")
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{r}, c.msgs)
+	master := core.EngineGlobal.ProxyPool["127.0.0.1:7000"].Get().(*mockedSConn)
+	assert.Equal(t, 1, len(master.frags))
+}
+
+func TestMovedPendingLimit(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer(WithServerRetryTimeout(1000))
+	target := "127.0.0.1:7100"
+	pool := &core.Pool{Addr: target, Dial: func(string, bool) (core.SConn, error) {
+		return &mockedSConn{addr: target, full: true}, nil
+	}}
+	core.EngineGlobal.ProxyPool[target] = pool
+
+	// the redirect lands on a connection with too many requests pending
+	master := &mockedSConn{addr: "127.0.0.1:7000"}
+	f := &core.Frag{Type: codec.RspMoved, Peer: &core.Msg{Fd2Slot: map[int]int32{master.Fd(): 100}}}
+	assert.True(t, ls.OnMoved(target, 100, master, f), "the message is answered rather than dropped")
+	assert.Equal(t, codec.ErrMsgPendingLimit.String(), string(f.RspBody))
+	assert.False(t, pool.Available())
+}
+
+func TestMovedFromSlave(t *testing.T) {
+	initTopology(2)
+	ls := NewListenServer()
+
+	// the slot moved to a new master during a failover
+	target := "127.0.0.1:7100"
+	core.EngineGlobal.ProxyPool[target] = newMockedPool(target)
+	dialed := map[string]*mockedSConn{}
+	for addr, pool := range core.EngineGlobal.ProxyPool {
+		addr := addr
+		pool.Dial = func(_ string, _ bool) (core.SConn, error) {
+			if _, ok := dialed[addr]; !ok {
+				dialed[addr] = &mockedSConn{addr: addr}
+			}
+			return dialed[addr], nil
+		}
+	}
+
+	slave := &mockedSConn{addr: "127.0.0.1:7001"}
+	for i := 0; i < 20; i++ {
+		f := &core.Frag{Peer: &core.Msg{Id: uint64(i), Fd2Slot: map[int]int32{slave.Fd(): 100}}}
+		ls.OnMoved(target, 100, slave, f)
+	}
+
+	assert.Equal(t, 1, len(dialed), "only the target is dialed, got: %v", dialed)
+	if assert.NotNil(t, dialed[target]) {
+		assert.Equal(t, 20, len(dialed[target].frags))
+	}
+}
+
+func TestMovedPassthrough(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer(WithPassthroughRedirects(true))
+	target := "127.0.0.1:7100"
+	dialed := false
+	core.EngineGlobal.ProxyPool[target] = &core.Pool{Addr: target, Dial: func(string, bool) (core.SConn, error) {
+		dialed = true
+		return &mockedSConn{addr: target}, nil
+	}}
+
+	moved := "-MOVED 100 127.0.0.1:7100\r\n"
+	master := &mockedSConn{addr: "127.0.0.1:7000"}
+	f := &core.Frag{Peer: &core.Msg{Fd2Slot: map[int]int32{master.Fd(): 100}}, RspBody: []byte(moved)}
+	assert.True(t, ls.OnMoved(target, 100, master, f))
+	assert.False(t, dialed, "the redirect must not be followed")
+	assert.Equal(t, moved, string(f.RspBody))
+
+	// followed by default
+	assert.False(t, NewListenServer().OnMoved(target, 100, master, f))
+	assert.True(t, dialed)
+}
+
+func TestMovedCache(t *testing.T) {
+	initTopology(0)
+	ls := NewListenServer(WithMovedCacheWindow(1000))
+	target := "127.0.0.1:7100"
+	core.EngineGlobal.ProxyPool[target] = newMockedPool(target)
+
+	master := &mockedSConn{addr: "127.0.0.1:7000"}
+	get := &core.Msg{Type: codec.ReqGet}
+	ask := &core.Frag{Type: codec.RspAsk, Peer: &core.Msg{Fd2Slot: map[int]int32{master.Fd(): 100}}}
+	ls.OnMoved(target, 100, master, ask)
+	addr, _ := ls.route(get, 100)
+	assert.Equal(t, "127.0.0.1:7000", addr, "ask is not cached")
+
+	moved := &core.Frag{Type: codec.RspMoved, Peer: &core.Msg{Fd2Slot: map[int]int32{master.Fd(): 100}}}
+	ls.OnMoved(target, 100, master, moved)
+	addr, _ = ls.route(get, 100)
+	assert.Equal(t, target, addr, "the next request goes to the moved-to node")
+	addr, _ = ls.route(&core.Msg{Type: codec.ReqSet}, 100)
+	assert.Equal(t, target, addr)
+	addr, _ = ls.route(get, 101)
+	assert.Equal(t, "127.0.0.1:7000", addr)
+
+	// the topology refresh assigns the slot a new replicaset
+	rs := &core.Replicaset{Master: &core.ClusterNode{Name: "b", Addr: target, Role: core.Master}}
+	core.EngineGlobal.Slots2Node.Set(100, rs)
+	addr, _ = ls.route(get, 100)
+	assert.Equal(t, target, addr)
+	assert.Empty(t, ls.moved)
+
+	// expired
+	ls = NewListenServer(WithMovedCacheWindow(1))
+	ls.OnMoved("127.0.0.1:7000", 100, master, moved)
+	time.Sleep(2 * time.Millisecond)
+	addr, _ = ls.route(get, 100)
+	assert.Equal(t, target, addr)
+	assert.Empty(t, ls.moved)
+
+	// disabled by default
+	ls = NewListenServer()
+	ls.OnMoved("127.0.0.1:7000", 100, master, moved)
+	assert.Empty(t, ls.moved)
+}
+
+func TestDebug(t *testing.T) {
+	initTopology(1)
+	rs := &core.Replicaset{Master: &core.ClusterNode{Name: "b", Addr: "127.0.0.1:7100", Role: core.Master}}
+	core.EngineGlobal.ProxyPool[rs.Master.Addr] = newMockedPool(rs.Master.Addr)
+	for i := int32(8192); i < constant.RedisClusterSlots; i++ {
+		core.EngineGlobal.Slots2Node.Set(i, rs)
+	}
+	activeExpire := "*3\r\n$5\r\nDEBUG\r\n$17\r\nSET-ACTIVE-EXPIRE\r\n$1\r\n0\r\n"
+	before := testutil.ToFloat64(core.GlobalStats.RejectedCmd.WithLabelValues("debug"))
+
+	// DEBUG is rejected by default
+	c := &mockedCConn{}
+	rsp, action := NewListenServer().OnCReact(decode(t, activeExpire), c)
+	assert.Equal(t, codec.ErrDebug.String(), string(rsp))
+	assert.Equal(t, core.None, action)
+
+	ls := NewListenServer(WithDebugSubcommands(" set-active-expire, QUICKLIST-PACKED-THRESHOLD ,"))
+	rsp, _ = ls.OnCReact(decode(t, "*3\r\n$5\r\nDEBUG\r\n$6\r\nOBJECT\r\n$3\r\nfoo\r\n"), c)
+	assert.Equal(t, codec.ErrDebug.String(), string(rsp))
+	assert.Equal(t, 0, len(c.msgs))
+	assert.Equal(t, before+2, testutil.ToFloat64(core.GlobalStats.RejectedCmd.WithLabelValues("debug")))
+
+	// the allowed subcommand is sent to each master once
+	r := decode(t, activeExpire)
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{r}, c.msgs)
+	if assert.Equal(t, 2, r.NumFrags()) {
+		for _, slot := range []int32{0, 8192} {
+			assert.Equal(t, "*3\r\n$5\r\ndebug\r\n$17\r\nSET-ACTIVE-EXPIRE\r\n$1\r\n0\r\n", string(r.SlotFrag(slot).Req), "slot: %d", slot)
+		}
+	}
+}
+
+func TestFcall(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer()
+	c := &mockedCConn{}
+
+	r := decode(t, "*5\r\n$5\r\nFCALL\r\n$6\r\nmyfunc\r\n$1\r\n1\r\n$3\r\nfoo\r\n$3\r\nbar\r\n")
+	assert.Equal(t, codec.ReqFcall, r.Type)
+	rsp, _ := ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{r}, c.msgs)
+	if f := r.SlotFrag(hashkit.Hash("foo")); assert.NotNil(t, f) {
+		assert.Equal(t, "foo", f.Key)
+		assert.Equal(t, "*5\r\n$5\r\nfcall\r\n$6\r\nmyfunc\r\n$1\r\n1\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", string(f.Req))
+	}
+	addr, _ := ls.route(r, hashkit.Hash("foo"))
+	assert.Equal(t, "127.0.0.1:7000", addr, "fcall may write")
+
+	r = decode(t, "*4\r\n$8\r\nFCALL_RO\r\n$6\r\nmyfunc\r\n$1\r\n1\r\n$3\r\nfoo\r\n")
+	assert.Equal(t, codec.ReqFcallRo, r.Type)
+	assert.NotNil(t, r.SlotFrag(hashkit.Hash("foo")))
+
+	// no key to route by
+	r = decode(t, "*3\r\n$5\r\nFCALL\r\n$6\r\nmyfunc\r\n$1\r\n0\r\n")
+	assert.Equal(t, codec.ReqWrongArgumentsNumber, r.Type)
+}
+
+func TestFunction(t *testing.T) {
+	initTopology(1)
+	rs := &core.Replicaset{Master: &core.ClusterNode{Name: "b", Addr: "127.0.0.1:7100", Role: core.Master}}
+	core.EngineGlobal.ProxyPool[rs.Master.Addr] = newMockedPool(rs.Master.Addr)
+	for i := int32(8192); i < constant.RedisClusterSlots; i++ {
+		core.EngineGlobal.Slots2Node.Set(i, rs)
+	}
+	ls := NewListenServer()
+	c := &mockedCConn{}
+
+	// the library is loaded into each master once
+	load := "*3\r\n$8\r\nFUNCTION\r\n$4\r\nLOAD\r\n$8\r\n#!lua...\r\n"
+	r := decode(t, load)
+	rsp, _ := ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{r}, c.msgs)
+	if assert.Equal(t, 2, r.NumFrags()) {
+		for _, slot := range []int32{0, 8192} {
+			assert.Equal(t, "*3\r\n$8\r\nfunction\r\n$4\r\nLOAD\r\n$8\r\n#!lua...\r\n", string(r.SlotFrag(slot).Req), "slot: %d", slot)
+		}
+	}
+
+	// a single master has them all
+	r = decode(t, "*2\r\n$8\r\nFUNCTION\r\n$4\r\nLIST\r\n")
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, 1, r.NumFrags())
+
+	before := testutil.ToFloat64(core.GlobalStats.RejectedCmd.WithLabelValues("function"))
+	rsp, _ = ls.OnCReact(decode(t, "*2\r\n$8\r\nFUNCTION\r\n$5\r\nSTATS\r\n"), c)
+	assert.Equal(t, codec.ErrFunction.String(), string(rsp))
+	assert.Equal(t, before+1, testutil.ToFloat64(core.GlobalStats.RejectedCmd.WithLabelValues("function")))
+	assert.Equal(t, 2, len(c.msgs))
+
+	// read from a covered slot only
+	for i := int32(0); i < 8192; i++ {
+		core.EngineGlobal.Slots2Node.Set(i, nil)
+	}
+	for i := 0; i < 10; i++ {
+		r = decode(t, "*2\r\n$8\r\nFUNCTION\r\n$4\r\nDUMP\r\n")
+		rsp, _ = ls.OnCReact(r, c)
+		assert.Nil(t, rsp)
+		assert.NotNil(t, r.SlotFrag(8192))
+	}
+}
+
+func TestScan(t *testing.T) {
+	initTopology(1)
+	rs := &core.Replicaset{Master: &core.ClusterNode{Name: "b", Addr: "127.0.0.1:7100", Role: core.Master}}
+	core.EngineGlobal.ProxyPool[rs.Master.Addr] = newMockedPool(rs.Master.Addr)
+	for i := int32(8192); i < constant.RedisClusterSlots; i++ {
+		core.EngineGlobal.Slots2Node.Set(i, rs)
+	}
+	epoch := core.ScanEpoch([]string{"127.0.0.1:7000", "127.0.0.1:7100"})
+	ls := NewListenServer()
+	c := &mockedCConn{}
+
+	scan := func(cursor string) *core.Msg {
+		r := decode(t, fmt.Sprintf("*6\r\n$4\r\nSCAN\r\n$%d\r\n%s\r\n$5\r\nMATCH\r\n$6\r\nuser:*\r\n$5\r\nCOUNT\r\n$3\r\n100\r\n", len(cursor), cursor))
+		rsp, _ := ls.OnCReact(r, c)
+		assert.Nil(t, rsp, "cursor: %s", cursor)
+		return r
+	}
+	var cases = []struct {
+		cursor string
+		node   string
+		slot   int32
+		scan   core.ScanCursor
+	}{
+		// the masters are scanned in turn by addr, from the master of the slave never the slave
+		{cursor: "0", node: "127.0.0.1:7000", slot: 0, scan: core.ScanCursor{Nodes: 2, Epoch: epoch}},
+		{cursor: scanNext(t, core.ScanCursor{Nodes: 2, Epoch: epoch}, 17), node: "127.0.0.1:7000", slot: 0, scan: core.ScanCursor{Nodes: 2, Epoch: epoch, Cursor: 17}},
+		{cursor: scanNext(t, core.ScanCursor{Nodes: 2, Epoch: epoch}, 0), node: "127.0.0.1:7100", slot: 8192, scan: core.ScanCursor{Node: 1, Nodes: 2, Epoch: epoch}},
+		{cursor: scanNext(t, core.ScanCursor{Node: 1, Nodes: 2, Epoch: epoch}, 33), node: "127.0.0.1:7100", slot: 8192, scan: core.ScanCursor{Node: 1, Nodes: 2, Epoch: epoch, Cursor: 33}},
+		// handed out before the masters changed
+		{cursor: scanNext(t, core.ScanCursor{Node: 1, Nodes: 2, Epoch: epoch ^ 1}, 33), node: "127.0.0.1:7000", slot: 0, scan: core.ScanCursor{Nodes: 2, Epoch: epoch}},
+		{cursor: scanNext(t, core.ScanCursor{Node: 2, Nodes: 3, Epoch: epoch}, 33), node: "127.0.0.1:7000", slot: 0, scan: core.ScanCursor{Nodes: 2, Epoch: epoch}},
+	}
+	for _, v := range cases {
+		r := scan(v.cursor)
+		assert.Equal(t, v.node, r.Node, "cursor: %s", v.cursor)
+		assert.Equal(t, v.scan, r.Scan, "cursor: %s", v.cursor)
+		if assert.Equal(t, 1, r.NumFrags(), "cursor: %s", v.cursor) {
+			cursor := strconv.FormatUint(v.scan.Cursor, 10)
+			expect := fmt.Sprintf("*6\r\n$4\r\nscan\r\n$%d\r\n%s\r\n$5\r\nMATCH\r\n$6\r\nuser:*\r\n$5\r\nCOUNT\r\n$3\r\n100\r\n", len(cursor), cursor)
+			assert.Equal(t, expect, string(r.SlotFrag(v.slot).Req), "cursor: %s", v.cursor)
+		}
+	}
+	assert.Equal(t, len(cases), len(c.msgs))
+
+	rsp, _ := ls.OnCReact(decode(t, "*2\r\n$4\r\nSCAN\r\n$3\r\nabc\r\n"), c)
+	assert.Equal(t, codec.ErrInvalidCursor.String(), string(rsp))
+	rsp, _ = ls.OnCReact(decode(t, "*1\r\n$4\r\nSCAN\r\n"), c)
+	assert.Equal(t, codec.ErrMsgReqWrongArgumentsNumber.String(), string(rsp))
+}
+
+// scanNext returns the cursor handed to the client after the master answered the cursor
+func scanNext(t *testing.T, s core.ScanCursor, cursor uint64) string {
+	v, ok := s.Next(cursor)
+	assert.True(t, ok)
+	return v
+}
+
+func TestProxyTarget(t *testing.T) {
+	initTopology(1)
+	ls := NewListenServer()
+	c := &mockedCConn{}
+	latest := "*2\r\n$7\r\nLATENCY\r\n$6\r\nLATEST\r\n"
+	before := testutil.ToFloat64(core.GlobalStats.RejectedCmd.WithLabelValues("latency"))
+
+	// a keyless command has no node to go to unless targeted
+	rsp, action := ls.OnCReact(decode(t, latest), c)
+	assert.Equal(t, codec.ErrNoTarget.String(), string(rsp))
+	assert.Equal(t, core.None, action)
+	assert.Empty(t, c.msgs)
+	assert.Equal(t, before+1, testutil.ToFloat64(core.GlobalStats.RejectedCmd.WithLabelValues("latency")))
+
+	var cases = []struct {
+		args   []string
+		expect codec.Error
+	}{
+		{[]string{"target"}, codec.ErrMsgReqWrongArgumentsNumber},
+		{[]string{"target", "127.0.0.1:7999"}, codec.ErrAddrNotFoundError},
+	}
+	for _, v := range cases {
+		rsp, _ := ls.OnCReact(proxyMsg(v.args...), c)
+		assert.Equal(t, v.expect.String(), string(rsp), "args: %v", v.args)
+	}
+	assert.Equal(t, "", c.Target())
+
+	// the slave is targeted, although the command would go to a master otherwise
+	rsp, _ = ls.OnCReact(proxyMsg("TARGET", "127.0.0.1:7001"), c)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+	r := decode(t, latest)
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []*core.Msg{r}, c.msgs)
+	sConn := core.EngineGlobal.ProxyPool["127.0.0.1:7001"].Get().(*mockedSConn)
+	if assert.Equal(t, 1, len(sConn.frags)) {
+		assert.Equal(t, "*2\r\n$7\r\nlatency\r\n$6\r\nLATEST\r\n", string(sConn.frags[0].Req))
+	}
+	assert.Empty(t, core.EngineGlobal.ProxyPool["127.0.0.1:7000"].Get().(*mockedSConn).frags)
+
+	// the target applies to the next keyless command only
+	rsp, _ = ls.OnCReact(decode(t, latest), c)
+	assert.Equal(t, codec.ErrNoTarget.String(), string(rsp))
+
+	// a refused command keeps the target for its retry, sent in the case of the command names forwarded
+	initEngine()
+	ls = NewListenServer(WithCommandCase(core.CommandCaseUpper))
+	c = &mockedCConn{target: "127.0.0.1:7001"}
+	r = decode(t, latest)
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Equal(t, codec.ErrProxyInitializing.String(), string(rsp))
+	assert.Equal(t, 0, r.NumFrags())
+	assert.Equal(t, "127.0.0.1:7001", c.Target())
+
+	initTopology(1)
+	r = decode(t, latest)
+	rsp, _ = ls.OnCReact(r, c)
+	assert.Nil(t, rsp)
+	assert.Empty(t, c.Target())
+	sConn = core.EngineGlobal.ProxyPool["127.0.0.1:7001"].Get().(*mockedSConn)
+	if assert.Equal(t, 1, len(sConn.frags)) {
+		assert.Equal(t, "*2\r\n$7\r\nLATENCY\r\n$6\r\nLATEST\r\n", string(sConn.frags[0].Req))
+	}
+}
+
+func TestHelp(t *testing.T) {
+	initEngine()
+	ls := NewListenServer()
+	c := &mockedCConn{}
+
+	for command, expect := range map[string]int{"OBJECT": 3, "CLIENT": 5, "CLUSTER": 7, "COMMAND": 5, "PROXY": 19} {
+		input := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$4\r\nhelp\r\n", len(command), command)
+		rsp, action := ls.OnCReact(decode(t, input), c)
+		assert.Equal(t, core.None, action)
+		assert.True(t, strings.HasPrefix(string(rsp), fmt.Sprintf("*%d\r\n+%s <subcommand>", expect, command)), "%s: %q", command, rsp)
+		assert.Equal(t, expect, strings.Count(string(rsp), "\r\n+"), command)
+		assert.True(t, strings.HasSuffix(string(rsp), "+HELP\r\n+    Print this help.\r\n"), command)
+	}
+
+	rsp, _ := ls.OnCReact(decode(t, "*3\r\n$6\r\nOBJECT\r\n$8\r\nENCODING\r\n$3\r\nfoo\r\n"), c)
+	assert.Equal(t, codec.ErrUnKnownSubcommand.String(), string(rsp))
+	assert.Empty(t, c.msgs)
+}
+
+func TestRouteReadWeights(t *testing.T) {
+	initTopology(2)
+	ls := NewListenServer(WithReadWeights(map[string]int{"127.0.0.1:7001": 3}))
+
+	reads := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		addr, isSlave := ls.route(&core.Msg{Type: codec.ReqGet}, 0)
+		assert.True(t, isSlave)
+		reads[addr]++
+	}
+	assert.InDelta(t, 0.75, float64(reads["127.0.0.1:7001"])/10000, 0.03)
+	assert.InDelta(t, 0.25, float64(reads["127.0.0.1:7002"])/10000, 0.03)
+
+	// the weights don't revive a banned slave
+	core.EngineGlobal.ProxyPool["127.0.0.1:7001"].ReportFailure(time.Minute)
+	for i := 0; i < 100; i++ {
+		addr, _ := ls.route(&core.Msg{Type: codec.ReqGet}, 0)
+		assert.Equal(t, "127.0.0.1:7002", addr)
+	}
+}
+
+// sequenceSelector picks the indexes queued, in order
+type sequenceSelector struct {
+	picks []int
+	ns    []int // the n of each pick
+}
+
+func (s *sequenceSelector) Pick(n int) int {
+	s.ns = append(s.ns, n)
+	i := s.picks[0]
+	s.picks = s.picks[1:]
+	return i
+}
+
+func TestRouteSelector(t *testing.T) {
+	initTopology(2)
+
+	selector := &sequenceSelector{picks: []int{1, 0, 1}}
+	ls := NewListenServer(WithSelector(selector))
+	for _, expect := range []string{"127.0.0.1:7002", "127.0.0.1:7001", "127.0.0.1:7002"} {
+		addr, isSlave := ls.route(&core.Msg{Type: codec.ReqGet}, 0)
+		assert.True(t, isSlave)
+		assert.Equal(t, expect, addr)
+	}
+	assert.Equal(t, []int{2, 2, 2}, selector.ns)
+
+	// the weights are spread over the pick, 7001 weighs 3 out of 4
+	selector = &sequenceSelector{picks: []int{0, 2, 3}}
+	ls = NewListenServer(WithSelector(selector), WithReadWeights(map[string]int{"127.0.0.1:7001": 3}))
+	for _, expect := range []string{"127.0.0.1:7001", "127.0.0.1:7001", "127.0.0.1:7002"} {
+		addr, _ := ls.route(&core.Msg{Type: codec.ReqGet}, 0)
+		assert.Equal(t, expect, addr)
+	}
+	assert.Equal(t, []int{4, 4, 4}, selector.ns)
+
+	// a banned slave is out of the pick, the master takes the reads once no slave is live
+	selector = &sequenceSelector{picks: []int{0}}
+	ls = NewListenServer(WithSelector(selector))
+	core.EngineGlobal.ProxyPool["127.0.0.1:7001"].ReportFailure(time.Minute)
+	addr, _ := ls.route(&core.Msg{Type: codec.ReqGet}, 0)
+	assert.Equal(t, "127.0.0.1:7002", addr)
+	assert.Equal(t, []int{1}, selector.ns)
+	core.EngineGlobal.ProxyPool["127.0.0.1:7002"].ReportFailure(time.Minute)
+	addr, isSlave := ls.route(&core.Msg{Type: codec.ReqGet}, 0)
+	assert.Equal(t, "127.0.0.1:7000", addr)
+	assert.False(t, isSlave)
+
+	// a slave in slow start takes the read if the draw falls in its share, 10% right after the ban
+	initTopology(1)
+	selector = &sequenceSelector{picks: []int{0, 99, 0, 100}}
+	ls = NewListenServer(WithSelector(selector), WithSlowStartWindow(60000))
+	core.EngineGlobal.ProxyPool["127.0.0.1:7001"].ReportFailure(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	addr, isSlave = ls.route(&core.Msg{Type: codec.ReqGet}, 0)
+	assert.Equal(t, "127.0.0.1:7001", addr)
+	assert.True(t, isSlave)
+	addr, isSlave = ls.route(&core.Msg{Type: codec.ReqGet}, 0)
+	assert.Equal(t, "127.0.0.1:7000", addr)
+	assert.False(t, isSlave)
+	assert.Equal(t, []int{1, slowStartScale, 1, slowStartScale}, selector.ns)
+
+	// the default picks at random
+	assert.Equal(t, randomSelector{}, NewListenServer().Selector)
+}
+
+func TestRouteTagged(t *testing.T) {
+	initTopology(2)
+	ls := NewListenServer(WithNodeTags(map[string]string{"127.0.0.1:7002": "canary"}))
+	tagged, untagged := &mockedCConn{}, &mockedCConn{}
+
+	rsp, _ := ls.OnCReact(proxyMsg("TAG", "beta"), tagged)
+	assert.Equal(t, codec.ErrUnknownTag.String(), string(rsp))
+	rsp, _ = ls.OnCReact(proxyMsg("TAG", "canary"), tagged)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+
+	reads := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		addr, isSlave := ls.route(&core.Msg{Type: codec.ReqGet, Owner: tagged}, 0)
+		assert.True(t, isSlave)
+		assert.Equal(t, "127.0.0.1:7002", addr, "the reads of the tagged client go to the canary")
+
+		addr, _ = ls.route(&core.Msg{Type: codec.ReqGet, Owner: untagged}, 0)
+		reads[addr]++
+	}
+	assert.Greater(t, reads["127.0.0.1:7001"], 0, "the untagged client reads from every slave")
+	assert.Greater(t, reads["127.0.0.1:7002"], 0, "the untagged client reads from every slave")
+
+	// the writes of the tagged client still go to the master
+	addr, isSlave := ls.route(&core.Msg{Type: codec.ReqSet, Owner: tagged}, 0)
+	assert.False(t, isSlave)
+	assert.Equal(t, "127.0.0.1:7000", addr)
+
+	rsp, _ = ls.OnCReact(proxyMsg("TAG", "NONE"), tagged)
+	assert.Equal(t, codec.OK.String(), string(rsp))
+	assert.Equal(t, "", tagged.Tag())
+}
@@ -25,6 +25,15 @@ import (
 
 var GlobalStats ProxyStats
 
+const (
+	// CommandMetricsFamily counts the requests by command family, and the common commands on their own as well
+	CommandMetricsFamily = "family"
+	// CommandMetricsExact counts the requests by command name, one series per command sent
+	CommandMetricsExact = "exact"
+	// CommandMetricsOff counts no request by command, for the lowest overhead
+	CommandMetricsOff = "off"
+)
+
 type ConnCloseType int
 
 const (
@@ -37,7 +46,12 @@ const (
 )
 
 type ProxyStats struct {
+	// CommandMetrics granularity of the per command counters ReqCmd and Fragments, see CommandMetricsFamily
+	CommandMetrics string
+
 	Request *prometheus.HistogramVec
+	// ColdRequest latency of the requests which waited for the connection to redis to be dialed
+	ColdRequest *prometheus.HistogramVec
 
 	TotalConnections *prometheus.CounterVec
 	CurrConnections  *prometheus.GaugeVec
@@ -55,9 +69,23 @@ type ProxyStats struct {
 	RedisServerEof             *prometheus.CounterVec
 	RedisServerErr             *prometheus.CounterVec
 	RedisServerActive          *prometheus.GaugeVec
+	NodeInflight               *prometheus.GaugeVec
 	RedisServerCreateConnError *prometheus.CounterVec
+	BackendDesync              *prometheus.CounterVec
+	RejectedCmd                *prometheus.CounterVec
+	ParseErrors                *prometheus.CounterVec
+	SlowClients                *prometheus.CounterVec
+	HandshakeTimeouts          *prometheus.CounterVec
+	AcceptErrors               *prometheus.CounterVec
+	ReadPauses                 *prometheus.CounterVec
+	OutboundSpills             *prometheus.CounterVec
+	OutboundSpillBytes         *prometheus.CounterVec
+	AckedErrors                *prometheus.CounterVec
+	SlaveFallback              *prometheus.CounterVec
+	RejectedConns              *prometheus.CounterVec
 
-	TimeoutTree *prometheus.GaugeVec
+	TimeoutTree  *prometheus.GaugeVec
+	SlotsCovered *prometheus.GaugeVec
 }
 
 func init() {
@@ -87,6 +115,12 @@ func NewProxyStats(namespace string) ProxyStats {
 			Help:      "request latency",
 			Buckets:   []float64{10, 20, 50, 100, 200, 500},
 		}, nil),
+		ColdRequest: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "cold_request_seconds",
+			Help:      "latency of the first request sent on a connection dialed for it, which pays the dial",
+			Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1},
+		}, nil),
 		ClientConnectionsClientEof: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "client_connections_client_eof",
@@ -122,83 +156,166 @@ func NewProxyStats(namespace string) ProxyStats {
 			Name:      "redis_connections_create_conn_error",
 			Help:      "number of connection timeouts between proxy and redis",
 		}, []string{"addr"}),
+		BackendDesync: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "backend_desync_total",
+			Help:      "redis connections closed because a reply arrived without pending request",
+		}, []string{"addr"}),
+		RejectedCmd: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rejected_commands",
+			Help:      "commands rejected by the proxy, which must be run directly on the redis node",
+		}, []string{"cmd"}),
+		ParseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "parse_errors_total",
+			Help:      "malformed resp received from clients or redis",
+		}, []string{"side", "kind"}),
+		SlowClients: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "slow_clients_total",
+			Help:      "clients whose outbound buffer stayed above the threshold, logged or disconnected",
+		}, []string{"action"}),
+		HandshakeTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_handshake_timeouts_total",
+			Help:      "clients closed since they sent no complete command within the handshake timeout",
+		}, []string{}),
+		AcceptErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "accept_errors_total",
+			Help:      "client connections failed to be accepted since the process or the system ran out of fds",
+		}, []string{"errno"}),
+		ReadPauses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_read_pauses_total",
+			Help:      "clients paused reading since the requests queued by all clients exceeded max_total_buffer_bytes",
+		}, []string{}),
+		OutboundSpills: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "outbound_spills_total",
+			Help:      "writes to a slow peer which overflowed the static outbound buffer into the elastic one",
+		}, []string{"type"}),
+		OutboundSpillBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "outbound_spill_bytes_total",
+			Help:      "bytes buffered beyond the static outbound buffer for a slow peer",
+		}, []string{"type"}),
+		AckedErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "acked_errors_total",
+			Help:      "errors and timeouts of the requests acknowledged on send, which the clients never see",
+		}, []string{"cmd"}),
+		SlaveFallback: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "slave_fallback_total",
+			Help:      "reads sent to the master since none of the slaves of the slot was available",
+		}, []string{"slot_owner"}),
+		RejectedConns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rejected_client_connections_total",
+			Help:      "client connections closed on open since a limit was reached",
+		}, []string{"reason"}),
 		RedisServerActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "redis_connections_active",
 			Help:      "number of active connections between proxy and redis",
 		}, []string{"addr"}),
+		NodeInflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_inflight",
+			Help:      "number of requests sent or waiting to be sent to redis and not yet answered",
+		}, []string{"addr"}),
 		TimeoutTree: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "timeout_tree",
 			Help:      "timeout tree health level",
 		}, []string{"type"}),
+		SlotsCovered: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "slots_covered",
+			Help:      "slots served by a master in the topology applied, 16384 when the cluster is fully covered",
+		}, []string{}),
 	}
 	prometheus.MustRegister(
 		stats.TotalConnections, stats.CurrConnections, stats.TotalRequests,
 		stats.ClientConnectionsClientEof, stats.ClientConnectionsClientErr,
 		stats.RedisServerCreateConnError, stats.RedisServerEof, stats.RedisServerErr,
-		stats.RedisServerActive, stats.Request, stats.TimeoutTree, stats.ReqCmd,
+		stats.RedisServerActive, stats.NodeInflight, stats.Request, stats.ColdRequest, stats.TimeoutTree, stats.ReqCmd, stats.Fragments,
+		stats.BackendDesync, stats.RejectedCmd, stats.ParseErrors, stats.SlowClients, stats.HandshakeTimeouts,
+		stats.AcceptErrors, stats.ReadPauses, stats.OutboundSpills, stats.OutboundSpillBytes, stats.AckedErrors, stats.SlaveFallback, stats.RejectedConns, stats.SlotsCovered,
 	)
 	return stats
 }
 
+// ResetCounters zeroes the counters and histograms, for test environments.
+// Gauges are kept, since they track live state such as the number of connections.
+// The collectors stay registered, so there is no duplicate registration.
+func (s *ProxyStats) ResetCounters() {
+	s.Request.Reset()
+	s.ColdRequest.Reset()
+	s.TotalConnections.Reset()
+	s.TotalRequests.Reset()
+	s.ClientConnectionsClientEof.Reset()
+	s.ClientConnectionsClientErr.Reset()
+	s.Fragments.Reset()
+	s.ReqCmd.Reset()
+	s.RedisServerEof.Reset()
+	s.RedisServerErr.Reset()
+	s.RedisServerCreateConnError.Reset()
+	s.BackendDesync.Reset()
+	s.RejectedCmd.Reset()
+	s.ParseErrors.Reset()
+	s.SlowClients.Reset()
+	s.HandshakeTimeouts.Reset()
+	s.AcceptErrors.Reset()
+	s.ReadPauses.Reset()
+	s.OutboundSpills.Reset()
+	s.OutboundSpillBytes.Reset()
+	s.AckedErrors.Reset()
+	s.SlaveFallback.Reset()
+	s.RejectedConns.Reset()
+}
+
+// parseErrorKinds labels the codec errors meaning malformed resp.
+// ShortLine and ErrLFNotFound are left out, they mostly mean the rest of the message is not read yet.
+var parseErrorKinds = map[error]string{
+	codec.ErrInvalidResp: "invalid_resp",
+	codec.ErrResp3:       "resp3",
+	codec.BadLine:        "bad_line",
+	codec.ErrCRNotFound:  "cr_not_found",
+}
+
+// ParseErrorIncr counts err returned by the codec of side, client or server, if it means malformed resp
+func (s *ProxyStats) ParseErrorIncr(side string, err error) {
+	if kind, ok := parseErrorKinds[err]; ok {
+		s.ParseErrors.WithLabelValues(side, kind).Inc()
+	}
+}
+
 func (s *ProxyStats) ReqCmdIncr(cmd codec.Command) {
+	switch s.CommandMetrics {
+	case CommandMetricsOff:
+		return
+	case CommandMetricsExact:
+		s.ReqCmd.WithLabelValues(codec.Transform2Str(cmd)).Inc()
+		return
+	}
+	// the heavy or common commands are counted on their own as well as in their family
 	switch cmd {
-	// for del
-	case codec.ReqDel:
-		GlobalStats.ReqCmd.WithLabelValues(codec.Transform2Str(cmd)).Inc()
-	// for uniq key
-	case codec.ReqGet, codec.ReqSet, codec.ReqMget, codec.ReqMset, codec.ReqSort:
-		GlobalStats.ReqCmd.WithLabelValues(codec.Transform2Str(cmd)).Inc()
-		fallthrough
-	// for string
-	case codec.ReqSetex, codec.ReqSetnx, codec.ReqSetrange, codec.ReqGetrange, codec.ReqStrlen:
-		GlobalStats.ReqCmd.WithLabelValues("string").Inc()
-
-	// for bitmap
-	case codec.ReqBitcount, codec.ReqSetbit, codec.ReqGetbit:
-		GlobalStats.ReqCmd.WithLabelValues("bitmap").Inc()
-
-	// for incr/decr
-	case codec.ReqIncr, codec.ReqDecr, codec.ReqDecrby, codec.ReqIncrby, codec.ReqIncrbyfloat:
-		GlobalStats.ReqCmd.WithLabelValues("incr_decr").Inc()
-
-	// for hash
-	case codec.ReqHexists, codec.ReqHget, codec.ReqHgetall, codec.ReqHkeys, codec.ReqHlen, codec.ReqHmget, codec.ReqHmset, codec.ReqHdel:
-		fallthrough
-	case codec.ReqHincrby, codec.ReqHincrbyfloat, codec.ReqHset, codec.ReqHsetnx, codec.ReqHscan, codec.ReqHvals:
-		GlobalStats.ReqCmd.WithLabelValues("hashs").Inc()
-
-	// for list
-	case codec.ReqLrem:
-		GlobalStats.ReqCmd.WithLabelValues(codec.Transform2Str(cmd)).Inc()
-		fallthrough
-	case codec.ReqLpush, codec.ReqRpush, codec.ReqRpushx, codec.ReqLpushx, codec.ReqLpop, codec.ReqRpop, codec.ReqRpoplpush:
-		fallthrough
-	case codec.ReqLrange, codec.ReqLset, codec.ReqLtrim, codec.ReqLindex, codec.ReqLlen, codec.ReqLinsert:
-		GlobalStats.ReqCmd.WithLabelValues("lists").Inc()
-
-	// for set
-	case codec.ReqSadd, codec.ReqSpop, codec.ReqSrem, codec.ReqSscan, codec.ReqSmove:
-		fallthrough
-	case codec.ReqSrandmember, codec.ReqScard, codec.ReqSismember, codec.ReqSmembers:
-		fallthrough
-	case codec.ReqSunion, codec.ReqSdiff, codec.ReqSinter, codec.ReqSinterstore, codec.ReqSdiffstore, codec.ReqSunionstore:
-		GlobalStats.ReqCmd.WithLabelValues("sets").Inc()
-
-	// for zset
-	case codec.ReqZadd, codec.ReqZcount, codec.ReqZincrby, codec.ReqZscan, codec.ReqZcard, codec.ReqZscore:
-		fallthrough
-	case codec.ReqZrange, codec.ReqZrank, codec.ReqZrangebyscore, codec.ReqZrevrange, codec.ReqZrangebylex, codec.ReqZrevrank:
-		fallthrough
-	case codec.ReqZinterstore, codec.ReqZrevrangebyscore, codec.ReqZunionstore, codec.ReqZremrangebyscore:
-		fallthrough
-	case codec.ReqZrem, codec.ReqZremrangebylex, codec.ReqZremrangebyrank:
-		GlobalStats.ReqCmd.WithLabelValues("sortedsets").Inc()
-
-	default:
-		GlobalStats.ReqCmd.WithLabelValues("other").Inc()
+	case codec.ReqGet, codec.ReqSet, codec.ReqMget, codec.ReqMset, codec.ReqSort, codec.ReqLrem:
+		s.ReqCmd.WithLabelValues(codec.Transform2Str(cmd)).Inc()
+	}
+	s.ReqCmd.WithLabelValues(codec.Family(cmd)).Inc()
+}
+
+// FragmentsIncr counts a multi-key request split by slot, by command name unless CommandMetrics is off,
+// only a handful of commands are split
+func (s *ProxyStats) FragmentsIncr(cmd codec.Command) {
+	if s.CommandMetrics == CommandMetricsOff {
+		return
 	}
+	s.Fragments.WithLabelValues(codec.Transform2Str(cmd)).Inc()
 }
 
 // statsLoop some statistics do not need to be put into the event loop, split out and executed per second
@@ -0,0 +1,67 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core/codec"
+)
+
+func TestCommandMetrics(t *testing.T) {
+	t.Cleanup(func() { GlobalStats.CommandMetrics = "" })
+	commands := []codec.Command{codec.ReqGet, codec.ReqSet, codec.ReqHget, codec.ReqHset, codec.ReqLpush, codec.ReqZadd, codec.ReqMget}
+
+	var cases = []struct {
+		mode      string
+		series    int
+		fragments int
+	}{
+		// get, set, mget on their own and the families string, hashs, lists, sortedsets
+		{CommandMetricsFamily, 7, 1},
+		{"", 7, 1},
+		{CommandMetricsExact, 7, 1},
+		{CommandMetricsOff, 0, 0},
+	}
+	for _, v := range cases {
+		GlobalStats.ResetCounters()
+		GlobalStats.CommandMetrics = v.mode
+		for _, cmd := range commands {
+			GlobalStats.ReqCmdIncr(cmd)
+			GlobalStats.ReqCmdIncr(cmd)
+		}
+		GlobalStats.FragmentsIncr(codec.ReqMget)
+		assert.Equal(t, v.series, testutil.CollectAndCount(GlobalStats.ReqCmd), "mode %q", v.mode)
+		assert.Equal(t, v.fragments, testutil.CollectAndCount(GlobalStats.Fragments), "mode %q", v.mode)
+	}
+
+	// exact counts the commands of a family apart
+	GlobalStats.ResetCounters()
+	GlobalStats.CommandMetrics = CommandMetricsExact
+	GlobalStats.ReqCmdIncr(codec.ReqHget)
+	GlobalStats.ReqCmdIncr(codec.ReqHset)
+	assert.Equal(t, float64(1), testutil.ToFloat64(GlobalStats.ReqCmd.WithLabelValues("hget")))
+	assert.Equal(t, 2, testutil.CollectAndCount(GlobalStats.ReqCmd))
+
+	// exported by /metrics
+	GlobalStats.FragmentsIncr(codec.ReqMget)
+	n, err := testutil.GatherAndCount(prometheus.DefaultGatherer, "rcproxy_fragments")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || freebsd || dragonfly || darwin
+// +build linux freebsd dragonfly darwin
+
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"rcproxy/core/codec"
+	"rcproxy/core/pkg/logging"
+	"rcproxy/core/pkg/redis"
+)
+
+// tlsHandshakeTimeout bounds the handshake of a client, so that a silent connection doesn't hold a goroutine
+var tlsHandshakeTimeout = 10 * time.Second
+
+// clientTLSConfig loads the certificate the client connections are terminated with, nil if TLS is not enabled
+func clientTLSConfig(opts *Options) (*tls.Config, error) {
+	if len(opts.ClientTLSCert) < 1 && len(opts.ClientTLSKey) < 1 {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(opts.ClientTLSCert, opts.ClientTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// terminateTLS runs the TLS handshake of an accepted client off the event-loop, then relays the plaintext
+// through a socket pair whose end on the event-loop is opened as the client connection, so that the codec
+// never sees a TLS record. Each client costs two goroutines copying between the TLS connection and the pair.
+func (el *eventloop) terminateTLS(nfd int, remoteAddr net.Addr, config *tls.Config) {
+	f := os.NewFile(uintptr(nfd), "client")
+	nc, err := net.FileConn(f)
+	_ = f.Close()
+	if err != nil {
+		logging.Errorf("[tls] client %s wrap failed: %v", remoteAddr, err)
+		return
+	}
+
+	tc := tls.Server(nc, config)
+	_ = tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err = tc.Handshake(); err != nil {
+		var re tls.RecordHeaderError
+		if errors.As(err, &re) && re.Conn != nil {
+			logging.Warnf("[tls] plaintext client %s rejected, TLS is required", remoteAddr)
+			_, _ = re.Conn.Write(codec.ErrTLSRequired.Bytes())
+		} else {
+			logging.Warnf("[tls] client %s handshake failed: %v", remoteAddr, err)
+		}
+		_ = nc.Close()
+		return
+	}
+	_ = tc.SetDeadline(time.Time{})
+
+	fd, err := relayTLS(tc)
+	if err != nil {
+		logging.Errorf("[tls] client %s relay failed: %v", remoteAddr, err)
+		return
+	}
+
+	err = el.poller.Trigger(func(_ interface{}) error {
+		return el.openClient(fd, remoteAddr)
+	}, nil)
+	if err != nil {
+		logging.Errorf("[tls] client %s open failed: %v", remoteAddr, err)
+		_ = unix.Close(fd)
+	}
+}
+
+// redisTLSConfig builds the config the connections to the redis nodes are encrypted with, nil if TLS is not enabled
+func redisTLSConfig(opts *Options) (*tls.Config, error) {
+	if !opts.RedisTLS {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: opts.RedisTLSInsecure}
+	if len(opts.RedisTLSCA) > 0 {
+		pem, err := os.ReadFile(opts.RedisTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", opts.RedisTLSCA)
+		}
+	}
+	return config, nil
+}
+
+// handshakeRedis runs the TLS handshake of a connection dialed to a redis node, then returns the end on the
+// event-loop of the socket pair the plaintext is relayed through, the connection is closed on failure
+func handshakeRedis(c net.Conn, address string, config *tls.Config, timeout time.Duration) (int, error) {
+	tc := tls.Client(c, redis.TLSConfigFor(config, address))
+	if timeout > 0 {
+		_ = tc.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		_ = c.Close()
+		return 0, err
+	}
+	_ = tc.SetDeadline(time.Time{})
+	return relayTLS(tc)
+}
+
+// relayTLS copies between the TLS connection and a socket pair, returning the nonblocking end of the pair
+// that is opened on the event-loop, the TLS connection is closed on failure or once either side is
+func relayTLS(tc *tls.Conn) (int, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		_ = tc.Close()
+		return 0, os.NewSyscallError("socketpair", err)
+	}
+	if err = unix.SetNonblock(fds[0], true); err != nil {
+		_ = unix.Close(fds[0])
+		_ = unix.Close(fds[1])
+		_ = tc.Close()
+		return 0, os.NewSyscallError("fcntl nonblock", err)
+	}
+	f := os.NewFile(uintptr(fds[1]), "tls-plaintext")
+	pc, err := net.FileConn(f)
+	_ = f.Close()
+	if err != nil {
+		_ = unix.Close(fds[0])
+		_ = tc.Close()
+		return 0, err
+	}
+
+	relay := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		_ = dst.Close()
+		_ = src.Close()
+	}
+	go relay(pc, tc)
+	go relay(tc, pc)
+	return fds[0], nil
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"rcproxy/core/codec"
+	gerrors "rcproxy/core/pkg/errors"
+	"rcproxy/core/pkg/logging"
+	"rcproxy/core/pkg/redis"
+)
+
+// writeTestCert writes a self-signed certificate and its key, returning the files
+func writeTestCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rcproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "rcproxy.crt"), filepath.Join(dir, "rcproxy.key")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+// acceptTestClient returns the fd of a client connection accepted by a listener and the client end
+func acceptTestClient(t *testing.T) (int, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	accepted, err := ln.Accept()
+	assert.Nil(t, err)
+	defer accepted.Close()
+	f, err := accepted.(*net.TCPConn).File()
+	assert.Nil(t, err)
+	defer f.Close()
+	nfd, err := unix.Dup(int(f.Fd()))
+	assert.Nil(t, err)
+	return nfd, client
+}
+
+// openedHandler reports the address of the clients opened
+type openedHandler struct {
+	forwardHandler
+	opened chan string
+}
+
+func (h *openedHandler) OnCOpened(c CConn) ([]byte, Action) {
+	h.opened <- c.RemoteAddr()
+	return nil, None
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	config, err := clientTLSConfig(&Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, config, "TLS is disabled by default")
+
+	certFile, keyFile := writeTestCert(t)
+	config, err = clientTLSConfig(&Options{ClientTLSCert: certFile, ClientTLSKey: keyFile})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(config.Certificates))
+
+	_, err = clientTLSConfig(&Options{ClientTLSCert: certFile, ClientTLSKey: certFile})
+	assert.NotNil(t, err)
+}
+
+func TestTerminateTLS(t *testing.T) {
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	el, _, _ := newTestLoop(t, ConnServer)
+	el.ln = &listener{}
+	handler := &openedHandler{opened: make(chan string, 1)}
+	el.eventHandler = handler
+	exited := make(chan struct{})
+	go func() {
+		_ = el.poller.Polling(el.callback, func() {}, func() {})
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		_ = el.poller.UrgentTrigger(func(_ interface{}) error { return gerrors.ErrEngineShutdown }, nil)
+		<-exited
+	})
+
+	certFile, keyFile := writeTestCert(t)
+	config, err := clientTLSConfig(&Options{ClientTLSCert: certFile, ClientTLSKey: keyFile})
+	assert.Nil(t, err)
+
+	// the plaintext request reaches the codec, the reply is encrypted back
+	nfd, client := acceptTestClient(t)
+	remoteAddr := client.LocalAddr()
+	go el.terminateTLS(nfd, remoteAddr, config)
+	tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	_ = tc.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err = tc.Write([]byte("*1\r\n$4\r\nQUIT\r\n"))
+	assert.Nil(t, err)
+	rsp, err := io.ReadAll(tc)
+	assert.Nil(t, err)
+	assert.Equal(t, codec.OK.String(), string(rsp), "closed once answered")
+	assert.Equal(t, remoteAddr.String(), <-handler.opened, "opened with the address of the client rather than the socket pair")
+
+	// a plaintext client is rejected
+	nfd, client = acceptTestClient(t)
+	go el.terminateTLS(nfd, client.LocalAddr(), config)
+	_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err = client.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	assert.Nil(t, err)
+	rsp, _ = io.ReadAll(client)
+	assert.Equal(t, codec.ErrTLSRequired.String(), string(rsp))
+	assert.True(t, sink.Contains(logging.LevelWarn, "plaintext client "+client.LocalAddr().String()+" rejected"))
+}
+
+// listenRedisTLS starts a fake redis node answering PONG over TLS with the certificate
+func listenRedisTLS(t *testing.T, certFile, keyFile string) string {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.Nil(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.Nil(t, err)
+	return serveRedis(t, ln)
+}
+
+func TestRedisTLSConfig(t *testing.T) {
+	config, err := redisTLSConfig(&Options{RedisTLSCA: "ca.crt"})
+	assert.Nil(t, err)
+	assert.Nil(t, config, "TLS is disabled by default")
+
+	certFile, keyFile := writeTestCert(t)
+	config, err = redisTLSConfig(&Options{RedisTLS: true, RedisTLSCA: certFile})
+	assert.Nil(t, err)
+	assert.NotNil(t, config.RootCAs)
+	assert.False(t, config.InsecureSkipVerify)
+
+	_, err = redisTLSConfig(&Options{RedisTLS: true, RedisTLSCA: keyFile})
+	assert.EqualError(t, err, "no certificate found in "+keyFile)
+}
+
+func TestDialRedisTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	addr := listenRedisTLS(t, certFile, keyFile)
+
+	// the probe connections
+	config, err := redisTLSConfig(&Options{RedisTLS: true, RedisTLSCA: certFile})
+	assert.Nil(t, err)
+	rc, err := redis.Dial(addr, "", redis.DialTLS(config))
+	assert.Nil(t, err)
+	rsp, err := rc.Do("PING")
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", rsp)
+	_ = rc.Close()
+
+	_, err = redis.Dial(addr, "", redis.DialTLS(&tls.Config{}))
+	assert.NotNil(t, err, "the certificate is not signed by the system roots")
+	rc, err = redis.Dial(addr, "")
+	assert.Nil(t, err)
+	_, err = rc.Do("PING")
+	assert.NotNil(t, err, "plaintext is refused by the node")
+	_ = rc.Close()
+
+	// the connections of the event-loop see the plaintext relayed
+	el, _, _ := newTestLoop(t, ConnServer)
+	el.engine.el = el
+	el.engine.opts.RedisConnectionTimeout = 3000
+	el.engine.redisTLS = config
+	c, err := el.engine.Dial(addr, false)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = unix.Close(c.Fd()) })
+	assert.Equal(t, addr, c.RemoteAddr(), "opened with the address of the node rather than the socket pair")
+
+	_, err = unix.Write(c.Fd(), []byte("*1\r\n$4\r\nPING\r\n"))
+	assert.Nil(t, err)
+	buf := make([]byte, 64)
+	assert.Eventually(t, func() bool {
+		n, err := unix.Read(c.Fd(), buf)
+		return err == nil && string(buf[:n]) == "+PONG\r\n"
+	}, 3*time.Second, 10*time.Millisecond)
+
+	el.engine.redisTLS = &tls.Config{}
+	_, err = el.engine.Dial(addr, false)
+	assert.NotNil(t, err)
+}
@@ -15,12 +15,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -79,6 +82,32 @@ func parseCli() {
 	}
 }
 
+// notifyShutdown relays the signals asking the proxy to stop
+func notifyShutdown() chan os.Signal {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	return sigs
+}
+
+// shutdownOnSignal stops the engine gracefully on the first signal received,
+// waiting for the event loop to close the connections until the timeout.
+// A second signal is no longer relayed, it kills the proxy stuck in shutdown as by default.
+func shutdownOnSignal(sigs chan os.Signal, protoAddr string, timeout time.Duration, stop func(context.Context, string) error) {
+	sig, ok := <-sigs
+	if !ok {
+		return
+	}
+	signal.Stop(sigs)
+	logging.Infof("rcproxy received signal %s, shutting down within %v", sig, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := stop(ctx, protoAddr); err != nil {
+		logging.Errorf("rcproxy graceful shutdown failed, err: %s", err)
+		return
+	}
+	logging.Infof("rcproxy shut down gracefully")
+}
+
 func main() {
 	parseCli()
 
@@ -115,6 +144,9 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 		ginSrv := gin.New()
 		web.Init(ginSrv)
+		if cfg.DebugEndpoints {
+			web.InitDebug(ginSrv)
+		}
 		httpSrv := &http.Server{Handler: ginSrv, Addr: addr}
 		go func() {
 			if err = httpSrv.ListenAndServe(); err != nil {
@@ -126,20 +158,71 @@ func main() {
 
 	tcpServer := server.NewListenServer(
 		server.WithRedisPassword(cfg.Redis.Password),
+		server.WithVersion(Tag),
+		server.WithServerName(cfg.ServerName),
 		server.WithServerRetryTimeout(cfg.Redis.ServerRetryTimeout),
+		server.WithSlowStartWindow(cfg.Redis.SlowStartWindow),
 		server.WithDisableRedisSlave(cfg.Redis.DisableSlave),
+		server.WithReadOnly(cfg.Redis.ReadOnlyProxy),
+		server.WithSlavePolicy(cfg.Redis.SlavePolicy),
+		server.WithReadWeights(cfg.Redis.ReadWeights),
+		server.WithNodeTags(cfg.Redis.NodeTags),
+		server.WithReadYourWrites(cfg.Redis.ReadYourWrites),
+		server.WithDebugSubcommands(cfg.Redis.DebugSubcommands),
+		server.WithAckOnSend(cfg.Redis.AckOnSend),
+		server.WithMaxConnsPerIP(cfg.Redis.MaxConnsPerIP),
+		server.WithPassthroughRedirects(cfg.Redis.PassthroughRedirects),
+		server.WithMovedCacheWindow(cfg.Redis.MovedCacheWindow),
+		server.WithCompressThreshold(cfg.Redis.CompressThreshold),
+		server.WithAuditConns(cfg.AuditConns),
+		server.WithCommandCase(cfg.Redis.CommandCase),
 	)
+	protoAddr := fmt.Sprintf("tcp://:%d", cfg.Port)
+	stopTimeout := 10 * time.Second
+	if cfg.ShutdownTimeout > 0 {
+		stopTimeout = time.Duration(cfg.ShutdownTimeout) * time.Second
+	}
+	go shutdownOnSignal(notifyShutdown(), protoAddr, stopTimeout, core.Stop)
+
 	if err = core.Run(
 		tcpServer,
-		fmt.Sprintf("tcp://:%d", cfg.Port),
+		protoAddr,
 		core.WithRedisPasswd(cfg.Redis.Password),
 		core.WithRedisServers(cfg.Redis.Servers),
 		core.WithRedisPreconnect(cfg.Redis.Preconnect),
+		core.WithRedisPreconnectQuorum(cfg.Redis.PreconnectQuorum),
+		core.WithRedisPreconnectRetries(cfg.Redis.PreconnectRetries),
+		core.WithRedisPreconnectBackoff(cfg.Redis.PreconnectBackoff),
 		core.WithRedisConnectTimeout(cfg.Redis.ConnTimeout),
 		core.WithRedisRequestTimeout(cfg.Redis.Timeout),
 		core.WithRedisServerConnections(cfg.Redis.ServerConnections),
+		core.WithRedisServerConnectionsMax(cfg.Redis.ServerConnsMax),
+		core.WithRedisScaleUpInflight(cfg.Redis.ScaleUpInflight),
+		core.WithRedisServerDrainGrace(cfg.Redis.ServerDrainGrace),
+		core.WithRedisServerMaxPending(cfg.Redis.ServerMaxPending),
 		core.WithRedisMsgMaxLength(cfg.Redis.MsgMaxLengthLimit),
+		core.WithRedisMaxKeysPerCommand(cfg.Redis.MaxKeysPerCommand),
+		core.WithRedisMaxValueSize(cfg.Redis.MaxValueSize),
+		core.WithRedisMaxReplyElements(cfg.Redis.MaxReplyElements),
+		core.WithRedisCrossSlotBehavior(cfg.Redis.CrossSlotBehavior),
+		core.WithRedisCommandCase(cfg.Redis.CommandCase),
+		core.WithCommandMetrics(cfg.Redis.CommandMetrics),
 		core.WithSlowlogSlowerThan(cfg.Redis.SlowlogSlowerThan),
+		core.WithSlowlogFamilies(cfg.Redis.SlowlogFamilies),
+		core.WithRedisLogRedactKeys(cfg.Redis.LogRedactKeys),
+		core.WithRedisMonitorInterval(cfg.Redis.MonitorInterval),
+		core.WithRedisMaxTopologyProbeConns(cfg.Redis.MaxTopologyProbes),
+		core.WithSlotCoverageHook(cfg.Redis.SlotCoverageHook),
+		core.WithSlotCoverageGrace(cfg.Redis.SlotCoverageGrace),
+		core.WithClientReadBufferCap(cfg.Redis.ClientReadBuffer),
+		core.WithServerReadBufferCap(cfg.Redis.ServerReadBuffer),
+		core.WithClientSlowOutbound(cfg.Redis.SlowClientOutbound),
+		core.WithClientSlowTicks(cfg.Redis.SlowClientSeconds),
+		core.WithClientSlowDisconnect(cfg.Redis.SlowClientClose),
+		core.WithClientHandshakeTimeout(cfg.Redis.HandshakeTimeout),
+		core.WithClientTLS(cfg.Redis.TLSCert, cfg.Redis.TLSKey),
+		core.WithRedisTLS(cfg.Redis.RedisTLS, cfg.Redis.RedisTLSCA, cfg.Redis.RedisTLSInsecure),
+		core.WithMaxTotalBufferBytes(cfg.Redis.MaxTotalBuffer),
 	); err != nil {
 		logging.Errorf("rcproxy run failed: %s", err)
 	}
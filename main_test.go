@@ -0,0 +1,75 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core/pkg/logging"
+)
+
+func TestShutdownOnSignal(t *testing.T) {
+	sink := new(logging.MemorySink)
+	assert.Nil(t, logging.InitializeLogger(logging.WithWriter(sink)))
+	t.Cleanup(logging.Reset)
+
+	sigs := notifyShutdown()
+	t.Cleanup(func() { signal.Stop(sigs) })
+
+	type call struct {
+		addr     string
+		deadline time.Time
+	}
+	calls := make(chan call, 1)
+	stop := func(ctx context.Context, protoAddr string) error {
+		deadline, _ := ctx.Deadline()
+		calls <- call{protoAddr, deadline}
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		shutdownOnSignal(sigs, "tcp://:9736", 5*time.Second, stop)
+		close(done)
+	}()
+
+	start := time.Now()
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case c := <-calls:
+		assert.Equal(t, "tcp://:9736", c.addr)
+		assert.WithinDuration(t, start.Add(5*time.Second), c.deadline, time.Second)
+	case <-time.After(time.Second):
+		t.Fatal("SIGTERM didn't stop the engine")
+	}
+	<-done
+	assert.True(t, sink.Contains(logging.LevelInfo, "rcproxy received signal terminated, shutting down within 5s"))
+	assert.True(t, sink.Contains(logging.LevelInfo, "rcproxy shut down gracefully"))
+
+	// a failed stop is reported
+	fake := make(chan os.Signal, 1)
+	fake <- os.Interrupt
+	shutdownOnSignal(fake, "tcp://:9736", time.Second, func(context.Context, string) error {
+		return errors.New("engine is in shutdown")
+	})
+	assert.True(t, sink.Contains(logging.LevelError, "rcproxy graceful shutdown failed, err: engine is in shutdown"))
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"rcproxy/core"
+)
+
+// HandleNodeBans returns the ban state of every redis node, revealing why a node takes no traffic
+func HandleNodeBans(c *gin.Context) {
+	if core.EngineGlobal == nil {
+		c.JSON(http.StatusServiceUnavailable, "rcproxy is starting")
+		return
+	}
+	bans, err := core.EngineGlobal.NodeBans()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, bans)
+}
+
+type ClearBansRes struct {
+	Cleared int
+}
+
+// HandleClearBans lifts the bans of all the redis nodes at once and resets their gradients
+func HandleClearBans(c *gin.Context) {
+	if core.EngineGlobal == nil {
+		c.JSON(http.StatusServiceUnavailable, "rcproxy is starting")
+		return
+	}
+	cleared, err := core.EngineGlobal.ClearBans()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &ClearBansRes{Cleared: cleared})
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core"
+)
+
+func TestNodeBans(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ginSrv := gin.New()
+	Init(ginSrv)
+
+	// the engine is not running, the pools are read at once
+	core.EngineGlobal = &core.Engine{ProxyPool: map[string]*core.Pool{
+		"127.0.0.1:8300": {Addr: "127.0.0.1:8300"},
+		"127.0.0.1:8301": {Addr: "127.0.0.1:8301"},
+	}}
+	core.EngineGlobal.ProxyPool["127.0.0.1:8301"].ReportFailure(time.Minute)
+
+	type banRes struct {
+		Addr         string
+		State        string
+		LiftBanOrder int32
+		LiftBanTime  time.Time
+	}
+	bans := func() []banRes {
+		w := httptest.NewRecorder()
+		ginSrv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/nodes/bans", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var res []banRes
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res
+	}
+
+	res := bans()
+	if assert.Equal(t, 2, len(res)) {
+		assert.Equal(t, "127.0.0.1:8300", res[0].Addr)
+		assert.Equal(t, "healthy", res[0].State)
+		assert.Equal(t, "127.0.0.1:8301", res[1].Addr)
+		assert.Equal(t, "banned", res[1].State)
+		assert.Equal(t, int32(1), res[1].LiftBanOrder)
+		assert.True(t, res[1].LiftBanTime.After(time.Now()))
+	}
+
+	w := httptest.NewRecorder()
+	ginSrv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/nodes/clear-bans", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"Cleared":1}`, w.Body.String())
+
+	for _, v := range bans() {
+		assert.Equal(t, "healthy", v.State, "addr: %s", v.Addr)
+		assert.Equal(t, int32(0), v.LiftBanOrder, "addr: %s", v.Addr)
+	}
+	assert.True(t, core.EngineGlobal.ProxyPool["127.0.0.1:8301"].Available())
+}
@@ -16,6 +16,7 @@ package web
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -47,3 +48,29 @@ func HandleClusters(c *gin.Context) {
 
 	c.JSON(http.StatusOK, res)
 }
+
+// refreshTimeout how long a refresh waits for the cluster nodes reply
+const refreshTimeout = 3 * time.Second
+
+// refreshClusterNodes forces a topology refresh, replaced in tests
+var refreshClusterNodes = func(addr string) (int, error) {
+	return core.EngineGlobal.RefreshClusterNodes(addr, refreshTimeout)
+}
+
+type ClusterRefreshRes struct {
+	Nodes int
+}
+
+// HandleClusterRefresh re-reads the topology at once, from the redis node `?addr=` or a random one
+func HandleClusterRefresh(c *gin.Context) {
+	if core.EngineGlobal == nil {
+		c.JSON(http.StatusServiceUnavailable, "rcproxy is starting")
+		return
+	}
+	nodes, err := refreshClusterNodes(c.Query("addr"))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &ClusterRefreshRes{Nodes: nodes})
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core"
+)
+
+func TestClusterRefresh(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ginSrv := gin.New()
+	Init(ginSrv)
+
+	core.EngineGlobal = &core.Engine{}
+	refresh := refreshClusterNodes
+	t.Cleanup(func() { refreshClusterNodes = refresh })
+
+	var addrs []string
+	refreshClusterNodes = func(addr string) (int, error) {
+		addrs = append(addrs, addr)
+		if addr == "127.0.0.1:9999" {
+			return 0, errors.New("proxy pool[127.0.0.1:9999] not found")
+		}
+		return 9, nil
+	}
+
+	w := httptest.NewRecorder()
+	ginSrv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/cluster/refresh", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"Nodes":9}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	ginSrv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/cluster/refresh?addr=127.0.0.1:9999", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "not found")
+
+	assert.Equal(t, []string{"", "127.0.0.1:9999"}, addrs)
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core"
+)
+
+func TestConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ginSrv := gin.New()
+	Init(ginSrv)
+
+	core.EngineGlobal = &core.Engine{Opts: &core.Options{
+		RedisPasswd:            "secret",
+		RedisMsgMaxLength:      6 * 1024 * 1024,
+		RedisConnectionTimeout: 200,
+	}}
+
+	w := httptest.NewRecorder()
+	ginSrv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "secret")
+
+	var opts core.Options
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &opts))
+	assert.Equal(t, redacted, opts.RedisPasswd)
+	assert.Equal(t, 6*1024*1024, opts.RedisMsgMaxLength)
+	assert.Equal(t, 200, opts.RedisConnectionTimeout)
+	assert.Equal(t, "secret", core.EngineGlobal.Opts.RedisPasswd, "the running options are untouched")
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rcproxy/core"
+)
+
+const (
+	defaultConnectionsLimit = 100
+	maxConnectionsLimit     = 1000
+)
+
+// clientConnections snapshots the client connections, replaced in tests
+var clientConnections = func() ([]core.ConnInfo, error) {
+	if core.EngineGlobal == nil {
+		return nil, nil
+	}
+	return core.EngineGlobal.ClientConnections()
+}
+
+type ConnectionRes struct {
+	core.ConnInfo
+	Age  string
+	Idle string
+}
+
+// HandleConnections returns a bounded sample of the client connections,
+// `?limit=` caps the sample, `?sort=age` returns the oldest connections first
+func HandleConnections(c *gin.Context) {
+	limit := defaultConnectionsLimit
+	if v := c.Query("limit"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, "invalid limit "+v)
+			return
+		}
+		limit = n
+	}
+	if limit > maxConnectionsLimit {
+		limit = maxConnectionsLimit
+	}
+
+	conns, err := clientConnections()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	switch c.Query("sort") {
+	case "":
+		sort.Slice(conns, func(i, j int) bool { return conns[i].Fd < conns[j].Fd })
+	case "age":
+		sort.Slice(conns, func(i, j int) bool { return conns[i].CreatedAt.Before(conns[j].CreatedAt) })
+	default:
+		c.JSON(http.StatusBadRequest, "unknown sort "+c.Query("sort"))
+		return
+	}
+	if len(conns) > limit {
+		conns = conns[:limit]
+	}
+
+	now := time.Now()
+	res := make([]*ConnectionRes, 0, len(conns))
+	for _, conn := range conns {
+		res = append(res, &ConnectionRes{
+			ConnInfo: conn,
+			Age:      now.Sub(conn.CreatedAt).String(),
+			Idle:     now.Sub(conn.LastActive).String(),
+		})
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core"
+)
+
+func TestConnections(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ginSrv := gin.New()
+	Init(ginSrv)
+
+	now := time.Now()
+	snapshot := clientConnections
+	t.Cleanup(func() { clientConnections = snapshot })
+	clientConnections = func() ([]core.ConnInfo, error) {
+		return []core.ConnInfo{
+			{Fd: 9, RemoteAddr: "127.0.0.1:50001", CreatedAt: now.Add(-time.Hour), LastActive: now.Add(-time.Minute), InFlight: 2},
+			{Fd: 7, RemoteAddr: "127.0.0.1:50002", CreatedAt: now.Add(-time.Minute), LastActive: now},
+			{Fd: 8, RemoteAddr: "127.0.0.1:50003", CreatedAt: now.Add(-24 * time.Hour), LastActive: now.Add(-time.Hour)},
+		}, nil
+	}
+
+	get := func(url string) (int, []ConnectionRes) {
+		w := httptest.NewRecorder()
+		ginSrv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		var res []ConnectionRes
+		if w.Code == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		}
+		return w.Code, res
+	}
+
+	code, res := get("/connections")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, []int{7, 8, 9}, []int{res[0].Fd, res[1].Fd, res[2].Fd})
+	assert.Equal(t, "127.0.0.1:50001", res[2].RemoteAddr)
+	assert.Equal(t, 2, res[2].InFlight)
+	age, err := time.ParseDuration(res[2].Age)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, age, time.Hour)
+	idle, err := time.ParseDuration(res[2].Idle)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, idle, time.Minute)
+	assert.Less(t, idle, time.Hour)
+
+	code, res = get("/connections?sort=age&limit=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, []int{8, 9}, []int{res[0].Fd, res[1].Fd})
+
+	code, _ = get("/connections?limit=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/connections?sort=idle")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
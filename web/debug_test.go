@@ -0,0 +1,43 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core"
+)
+
+func TestResetStats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ginSrv := gin.New()
+	InitDebug(ginSrv)
+
+	core.GlobalStats.TotalRequests.WithLabelValues().Add(10)
+	core.GlobalStats.CurrConnections.WithLabelValues("client").Set(2)
+
+	w := httptest.NewRecorder()
+	ginSrv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug/reset-stats", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(core.GlobalStats.TotalRequests.WithLabelValues()))
+	assert.Equal(t, float64(2), testutil.ToFloat64(core.GlobalStats.CurrConnections.WithLabelValues("client")), "gauges are kept")
+}
@@ -23,7 +23,15 @@ import (
 func Init(ginSrv *gin.Engine) {
 	pprof.Register(ginSrv)
 	ginSrv.GET("/cluster/nodes", HandleClusters)
+	ginSrv.POST("/cluster/refresh", HandleClusterRefresh)
+	ginSrv.GET("/nodes/bans", HandleNodeBans)
+	ginSrv.POST("/nodes/clear-bans", HandleClearBans)
 	ginSrv.GET("/authip", HandleAuthIp)
 	ginSrv.GET("/version", HandleVersion)
+	ginSrv.GET("/config", HandleConfig)
+	ginSrv.GET("/connections", HandleConnections)
+	ginSrv.GET("/keycount", HandleKeyCount)
+	ginSrv.POST("/slot/:n/readonly", HandleSlotReadOnly)
+	ginSrv.DELETE("/slot/:n/readonly", HandleSlotWritable)
 	ginSrv.GET("/metrics", gin.WrapH(promhttp.Handler()))
 }
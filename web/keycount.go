@@ -0,0 +1,46 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"rcproxy/core"
+)
+
+// countKeys issues DBSIZE to every master, replaced in tests
+var countKeys = func() []core.NodeKeys {
+	return core.EngineGlobal.ClusterNodes.CountKeys()
+}
+
+type KeyCountRes struct {
+	Nodes []core.NodeKeys
+	Total int64
+}
+
+// HandleKeyCount returns the number of keys of every master and the total, revealing an unbalanced cluster
+func HandleKeyCount(c *gin.Context) {
+	if core.EngineGlobal == nil {
+		c.JSON(http.StatusServiceUnavailable, "rcproxy is starting")
+		return
+	}
+	res := &KeyCountRes{Nodes: countKeys()}
+	for _, node := range res.Nodes {
+		res.Total += node.Keys
+	}
+	c.JSON(http.StatusOK, res)
+}
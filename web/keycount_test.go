@@ -0,0 +1,52 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core"
+)
+
+func TestKeyCount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ginSrv := gin.New()
+	Init(ginSrv)
+
+	core.EngineGlobal = &core.Engine{}
+	count := countKeys
+	t.Cleanup(func() { countKeys = count })
+	countKeys = func() []core.NodeKeys {
+		return []core.NodeKeys{
+			{Addr: "127.0.0.1:8300", Keys: 120},
+			{Addr: "127.0.0.1:8302", Keys: 30},
+			{Addr: "127.0.0.1:8304", Err: "connection refused"},
+		}
+	}
+
+	w := httptest.NewRecorder()
+	ginSrv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/keycount", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"Nodes":[
+		{"Addr":"127.0.0.1:8300","Keys":120,"Err":""},
+		{"Addr":"127.0.0.1:8302","Keys":30,"Err":""},
+		{"Addr":"127.0.0.1:8304","Keys":0,"Err":"connection refused"}
+	],"Total":150}`, w.Body.String())
+}
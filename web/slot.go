@@ -0,0 +1,56 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"rcproxy/core"
+)
+
+type SlotReadOnlyRes struct {
+	ReadOnlySlots []int32
+}
+
+// HandleSlotReadOnly rejects the writes to the slot `:n` during a migration, the reads proceed
+func HandleSlotReadOnly(c *gin.Context) {
+	handleSlotReadOnly(c, true)
+}
+
+// HandleSlotWritable accepts the writes to the slot `:n` again
+func HandleSlotWritable(c *gin.Context) {
+	handleSlotReadOnly(c, false)
+}
+
+func handleSlotReadOnly(c *gin.Context, readOnly bool) {
+	if core.EngineGlobal == nil {
+		c.JSON(http.StatusServiceUnavailable, "rcproxy is starting")
+		return
+	}
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "invalid slot "+c.Param("n"))
+		return
+	}
+	slots, err := core.EngineGlobal.SetSlotReadOnly(int32(n), readOnly)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &SlotReadOnlyRes{ReadOnlySlots: slots})
+}
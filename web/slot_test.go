@@ -0,0 +1,56 @@
+// Copyright (c) 2022 The rcproxy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"rcproxy/core"
+)
+
+func TestSlotReadOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ginSrv := gin.New()
+	Init(ginSrv)
+
+	// the engine is not running, the slots are set at once
+	core.EngineGlobal = &core.Engine{}
+
+	var cases = []struct {
+		method string
+		url    string
+		code   int
+		expect string
+	}{
+		{http.MethodPost, "/slot/100/readonly", http.StatusOK, `{"ReadOnlySlots":[100]}`},
+		{http.MethodPost, "/slot/7/readonly", http.StatusOK, `{"ReadOnlySlots":[7,100]}`},
+		{http.MethodDelete, "/slot/100/readonly", http.StatusOK, `{"ReadOnlySlots":[7]}`},
+		{http.MethodPost, "/slot/16384/readonly", http.StatusBadRequest, `"invalid slot"`},
+		{http.MethodPost, "/slot/x/readonly", http.StatusBadRequest, `"invalid slot x"`},
+	}
+	for _, v := range cases {
+		w := httptest.NewRecorder()
+		ginSrv.ServeHTTP(w, httptest.NewRequest(v.method, v.url, nil))
+		assert.Equal(t, v.code, w.Code, "%s %s", v.method, v.url)
+		assert.JSONEq(t, v.expect, w.Body.String(), "%s %s", v.method, v.url)
+	}
+	assert.True(t, core.EngineGlobal.SlotReadOnly(7))
+	assert.False(t, core.EngineGlobal.SlotReadOnly(100))
+}